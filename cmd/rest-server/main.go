@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -11,11 +12,17 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	restserver "github.com/restic/rest-server"
+	"github.com/restic/rest-server/fs"
 	"github.com/spf13/cobra"
 )
 
+// shutdownTimeout is how long open requests may take to finish after the
+// server has been told to shut down.
+const shutdownTimeout = 30 * time.Second
+
 // cmdRoot is the base command when no other command has been specified.
 var cmdRoot = &cobra.Command{
 	Use:           "rest-server",
@@ -44,10 +51,16 @@ var (
 func init() {
 	flags := cmdRoot.Flags()
 	flags.StringVar(&cpuProfile, "cpu-profile", cpuProfile, "write CPU profile to file")
-	flags.BoolVar(&server.Debug, "debug", server.Debug, "output debug messages")
+	flags.BoolVar(&server.Debug, "debug", server.Debug, "output debug messages, including the time spent in each phase of saving a blob")
 	flags.StringVar(&server.Listen, "listen", server.Listen, "listen address")
 	flags.StringVar(&server.Log, "log", server.Log, "write HTTP requests in the combined log format to the specified `filename` (use \"-\" for logging to stdout)")
 	flags.Int64Var(&server.MaxRepoSize, "max-size", server.MaxRepoSize, "the maximum size of the repository in bytes")
+	flags.Int64Var(&server.MaxBlobSize, "max-blob-size", server.MaxBlobSize, "the maximum size of a single blob in bytes (0 means no limit)")
+	flags.Uint64Var(&server.MinFreeSpace, "min-free-space", server.MinFreeSpace, "reject uploads once less than this many bytes are free on the disk (0 means no limit)")
+	flags.IntVar(&server.CopyBufferSize, "copy-buffer-size", server.CopyBufferSize, "the size of the buffer uploads are copied through in bytes (0 means the default of 32 KiB)")
+	flags.IntVar(&server.MaxTransfers, "max-transfers", server.MaxTransfers, "the maximum number of concurrent blob uploads and downloads, further transfers are rejected (0 means no limit)")
+	flags.Int64Var(&server.MaxTransferBytes, "max-transfer-bytes", server.MaxTransferBytes, "the maximum total size of concurrent blob uploads in bytes as announced by the clients (0 means no limit)")
+	flags.IntVar(&server.StatsWorkers, "stats-workers", server.StatsWorkers, "the number of data subdirs read in parallel to compute repository statistics (0 means 8, at most 64)")
 	flags.StringVar(&server.Path, "path", server.Path, "data directory")
 	flags.BoolVar(&server.TLS, "tls", server.TLS, "turn on TLS support")
 	flags.StringVar(&server.TLSCert, "tls-cert", server.TLSCert, "TLS certificate path")
@@ -56,10 +69,24 @@ func init() {
 	flags.StringVar(&server.HtpasswdPath, "htpasswd-file", server.HtpasswdPath, "location of .htpasswd file (default: \"<data directory>/.htpasswd)\"")
 	flags.BoolVar(&server.NoVerifyUpload, "no-verify-upload", server.NoVerifyUpload,
 		"do not verify the integrity of uploaded data. DO NOT enable unless the rest-server runs on a very low-power device")
+	flags.BoolVar(&server.SkipExisting, "skip-existing-blobs", server.SkipExisting, "do not rewrite blobs which are uploaded again with the same size")
+	flags.BoolVar(&server.CompressConfig, "compress-config", server.CompressConfig, "send the repository config gzip compressed to clients which accept it")
+	flags.BoolVar(&server.VerifyOnRead, "verify-on-read", server.VerifyOnRead, "verify the integrity of blobs when they are downloaded to detect corruption of the storage")
+	flags.DurationVar(&server.OperationTimeout, "operation-timeout", server.OperationTimeout, "fail storage operations which do not complete within this time, e.g. on a hanging network filesystem (0 means no timeout)")
+	flags.DurationVar(&server.ReadIdleTimeout, "read-idle-timeout", server.ReadIdleTimeout, "close downloads which the client has not read from for this long (0 means no timeout)")
+	flags.BoolVar(&server.BestEffortList, "best-effort-listing", server.BestEffortList, "skip unreadable entries when listing blobs instead of failing the whole listing")
+	flags.BoolVar(&server.FollowSymlinks, "follow-symlinks", server.FollowSymlinks, "allow symlinks in repositories which point outside of the repository")
+	flags.BoolVar(&server.UseFileLocks, "use-file-locks", server.UseFileLocks, "hold an advisory lock on files while they are uploaded, for external tools which honor it")
 	flags.BoolVar(&server.AppendOnly, "append-only", server.AppendOnly, "enable append only mode")
+	flags.BoolVar(&server.LockRepos, "lock-repos", server.LockRepos, "make deletions wait for other requests to the same repository, using a lock file in the repository")
+	flags.StringSliceVar(&server.ObjectTypes, "object-types", server.ObjectTypes, "the object types stored in repositories (default data,index,keys,locks,snapshots)")
+	flags.IntVar(&server.MaxListDepth, "max-list-depth", server.MaxListDepth, "the maximum number of directory levels read by a listing, deeper trees fail the listing (0 means no limit)")
+	flags.IntVar(&server.MaxListEntries, "max-list-entries", server.MaxListEntries, "the maximum number of directory entries read by a listing, more fail the listing (0 means no limit)")
 	flags.BoolVar(&server.PrivateRepos, "private-repos", server.PrivateRepos, "users can only access their private repo")
+	flags.StringVar(&server.RootTemplate, "root-template", server.RootTemplate, "the directory of each user below the data directory, {user} is replaced by the user name, e.g. \"tenants/{user}\"")
 	flags.BoolVar(&server.Prometheus, "prometheus", server.Prometheus, "enable Prometheus metrics")
 	flags.BoolVar(&server.PrometheusNoAuth, "prometheus-no-auth", server.PrometheusNoAuth, "disable auth for Prometheus /metrics endpoint")
+	flags.BoolVar(&server.HealthCheck, "health-check", server.HealthCheck, "enable the /healthz endpoint which checks that the data directory is writable")
 }
 
 var version = "0.12.1-dev"
@@ -99,20 +126,15 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		}
 		log.Println("CPU profiling enabled")
 
-		// clean profiling shutdown on sigint
-		sigintCh := make(chan os.Signal, 1)
-		go func() {
-			for range sigintCh {
-				pprof.StopCPUProfile()
-				log.Println("Stopped CPU profiling")
-				err := f.Close()
-				if err != nil {
-					log.Printf("error closing CPU profile file: %v", err)
-				}
-				os.Exit(130)
+		// profiling is stopped after the graceful shutdown
+		defer func() {
+			pprof.StopCPUProfile()
+			log.Println("Stopped CPU profiling")
+			err := f.Close()
+			if err != nil {
+				log.Printf("error closing CPU profile file: %v", err)
 			}
 		}()
-		signal.Notify(sigintCh, syscall.SIGINT)
 	}
 
 	if server.NoAuth {
@@ -125,6 +147,11 @@ func runRoot(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
+	// the handler uses the Filesystem of the server for each request, so it
+	// can still be wrapped
+	maintenance := fs.NewMaintenanceFilesystem(server.Filesystem)
+	server.Filesystem = maintenance
+	handleMaintenanceSignals(maintenance)
 
 	if server.PrivateRepos {
 		log.Println("Private repositories enabled")
@@ -142,13 +169,37 @@ func runRoot(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("unable to listen: %w", err)
 	}
 
+	srv := &http.Server{Handler: handler}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error waiting for open requests: %v", err)
+		}
+	}()
+
 	if !enabledTLS {
-		err = http.Serve(listener, handler)
+		err = srv.Serve(listener)
 	} else {
 		log.Printf("TLS enabled, private key %s, pubkey %v", privateKey, publicKey)
-		err = http.ServeTLS(listener, handler, publicKey, privateKey)
+		err = srv.ServeTLS(listener, publicKey, privateKey)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		// Serve returns immediately, wait until the open requests are done
+		<-shutdown
+		err = nil
 	}
 
+	// flush and release the storage also if serving failed
+	if cerr := server.Filesystem.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("unable to close the storage: %w", cerr)
+	}
 	return err
 }
 
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// handleMaintenanceSignals enables the maintenance mode of m on SIGUSR1 and
+// disables it on SIGUSR2.
+func handleMaintenanceSignals(m *fs.MaintenanceFilesystem) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range ch {
+			enabled := sig == syscall.SIGUSR1
+			m.SetMaintenance(enabled)
+			if enabled {
+				log.Println("Maintenance mode enabled, modifications are rejected")
+			} else {
+				log.Println("Maintenance mode disabled")
+			}
+		}
+	}()
+}
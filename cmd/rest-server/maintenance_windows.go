@@ -0,0 +1,7 @@
+package main
+
+import "github.com/restic/rest-server/fs"
+
+// handleMaintenanceSignals does nothing, there are no signals to toggle the
+// maintenance mode with.
+func handleMaintenanceSignals(m *fs.MaintenanceFilesystem) {}
@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrAppendOnly is returned by AppendOnlyFilesystem for operations which
+// would delete or modify existing data.
+var ErrAppendOnly = newError("append_only", "repository is append-only")
+
+// AppendOnlyFilesystem wraps a Filesystem and refuses to delete or overwrite
+// existing data. Lock files are exempt, restic needs to be able to remove
+// its own locks.
+type AppendOnlyFilesystem struct {
+	Filesystem
+}
+
+// NewAppendOnlyFilesystem returns an AppendOnlyFilesystem for base.
+func NewAppendOnlyFilesystem(base Filesystem) *AppendOnlyFilesystem {
+	return &AppendOnlyFilesystem{Filesystem: base}
+}
+
+func isLock(path string) bool {
+	_, objectType, _ := SplitBlobPath(path)
+	return objectType == "locks"
+}
+
+// DeleteConfig always returns ErrAppendOnly.
+func (a *AppendOnlyFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return ErrAppendOnly
+}
+
+// SaveBlob returns ErrAppendOnly if the blob already exists.
+func (a *AppendOnlyFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	_, err := a.Filesystem.CheckBlob(ctx, path)
+	if err == nil {
+		return 0, ErrAppendOnly
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return a.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob returns ErrAppendOnly for all blobs except locks.
+func (a *AppendOnlyFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	if !isLock(path) {
+		return 0, ErrAppendOnly
+	}
+	return a.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs returns ErrAppendOnly for all blobs except locks.
+func (a *AppendOnlyFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	return deleteEach(ctx, a, paths, needSize)
+}
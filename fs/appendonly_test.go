@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendOnlyFilesystem(t *testing.T) {
+	ctx := context.Background()
+	f := NewAppendOnlyFilesystem(NewMemoryFilesystem())
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := filepath.Join(repo, "config")
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteConfig(ctx, cfg); !errors.Is(err, ErrAppendOnly) {
+		t.Fatalf("DeleteConfig: want ErrAppendOnly, got %v", err)
+	}
+
+	for _, tpe := range []string{"data", "locks"} {
+		blob := filepath.Join(repo, tpe, testID)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("bar"), 3); !errors.Is(err, ErrAppendOnly) {
+			t.Fatalf("SaveBlob %v: want ErrAppendOnly for overwrite, got %v", tpe, err)
+		}
+
+		_, err := f.DeleteBlob(ctx, blob, false)
+		if tpe == "locks" && err != nil {
+			t.Fatalf("DeleteBlob: deleting locks must be allowed, got %v", err)
+		}
+		if tpe != "locks" && !errors.Is(err, ErrAppendOnly) {
+			t.Fatalf("DeleteBlob %v: want ErrAppendOnly, got %v", tpe, err)
+		}
+	}
+
+	lock := filepath.Join(repo, "locks", "lock")
+	if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+	_, err := f.DeleteBlobs(ctx, []string{lock, filepath.Join(repo, "data", testID)}, false)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Errors[0] != nil || !errors.Is(batchErr.Errors[1], ErrAppendOnly) {
+		t.Fatalf("DeleteBlobs: want ErrAppendOnly for data only, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// AuditEvent describes a modification done through an AuditFilesystem.
+type AuditEvent struct {
+	Op       string // create_repo, save_config, delete_config, save_blob or delete_blob, seal and unseal for SealFilesystem
+	Path     string
+	Size     int64 // number of bytes written or removed
+	Duration time.Duration
+	Err      error // nil if the operation succeeded
+}
+
+// AuditLogger records the events of an AuditFilesystem. Log is called with
+// the context passed to the Filesystem, from which e.g. the authenticated user
+// can be extracted. It is called synchronously and may be called concurrently.
+type AuditLogger interface {
+	Log(ctx context.Context, event AuditEvent)
+}
+
+// AuditLoggerFunc is an AuditLogger which calls the function.
+type AuditLoggerFunc func(ctx context.Context, event AuditEvent)
+
+// Log calls f.
+func (f AuditLoggerFunc) Log(ctx context.Context, event AuditEvent) {
+	f(ctx, event)
+}
+
+// AuditFilesystem wraps a Filesystem and reports all modifications to an
+// AuditLogger after they have been done, whether they succeeded or not.
+type AuditFilesystem struct {
+	Filesystem
+	logger AuditLogger
+}
+
+// NewAuditFilesystem returns an AuditFilesystem for base which reports to
+// logger.
+func NewAuditFilesystem(base Filesystem, logger AuditLogger) *AuditFilesystem {
+	return &AuditFilesystem{Filesystem: base, logger: logger}
+}
+
+func (a *AuditFilesystem) log(ctx context.Context, op, path string, size int64, start time.Time, err error) {
+	a.logger.Log(ctx, AuditEvent{
+		Op:       op,
+		Path:     path,
+		Size:     size,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
+
+// CreateRepo creates the repository.
+func (a *AuditFilesystem) CreateRepo(ctx context.Context, path string) error {
+	start := time.Now()
+	err := a.Filesystem.CreateRepo(ctx, path)
+	a.log(ctx, "create_repo", path, 0, start, err)
+	return err
+}
+
+// SaveConfig saves the config.
+func (a *AuditFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	start := time.Now()
+	cr := &countingReader{rd: rd}
+	err := a.Filesystem.SaveConfig(ctx, path, cr)
+	a.log(ctx, "save_config", path, cr.n, start, err)
+	return err
+}
+
+// DeleteConfig removes the config.
+func (a *AuditFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	start := time.Now()
+	err := a.Filesystem.DeleteConfig(ctx, path)
+	a.log(ctx, "delete_config", path, 0, start, err)
+	return err
+}
+
+// SaveBlob saves the blob.
+func (a *AuditFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	start := time.Now()
+	n, err := a.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	a.log(ctx, "save_blob", path, n, start, err)
+	return n, err
+}
+
+// DeleteBlob removes the blob. The size is always determined so that it can
+// be logged.
+func (a *AuditFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	start := time.Now()
+	size, err := a.Filesystem.DeleteBlob(ctx, path, true)
+	a.log(ctx, "delete_blob", path, size, start, err)
+	return size, err
+}
+
+// DeleteBlobs removes the blobs, one event is logged for each blob.
+func (a *AuditFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	start := time.Now()
+	sizes, err := a.Filesystem.DeleteBlobs(ctx, paths, true)
+
+	var batchErr *BatchError
+	errors.As(err, &batchErr)
+	for i, path := range paths {
+		var size int64
+		if i < len(sizes) {
+			size = sizes[i]
+		}
+		pathErr := err
+		if batchErr != nil {
+			pathErr = batchErr.Errors[i]
+		}
+		a.log(ctx, "delete_blob", path, size, start, pathErr)
+	}
+	return sizes, err
+}
+
+// countingReader counts the bytes read from rd.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
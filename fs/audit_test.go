@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditFilesystem(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "alice")
+
+	var events []AuditEvent
+	f := NewAuditFilesystem(NewMemoryFilesystem(), AuditLoggerFunc(func(ctx context.Context, event AuditEvent) {
+		if ctx.Value(key{}) != "alice" {
+			t.Errorf("context not passed to the logger")
+		}
+		events = append(events, event)
+	}))
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	cfg := filepath.Join(repo, "config")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetBlob(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err == nil {
+		t.Fatal("deleting a missing blob must fail")
+	}
+	if err := f.DeleteConfig(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditEvent{
+		{Op: "create_repo", Path: repo},
+		{Op: "save_config", Path: cfg, Size: 6},
+		{Op: "save_blob", Path: blob, Size: 6},
+		{Op: "delete_blob", Path: blob, Size: 6},
+		{Op: "delete_blob", Path: blob},
+		{Op: "delete_config", Path: cfg},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("want %d events, got %v", len(want), events)
+	}
+	for i, ev := range events {
+		if ev.Op != want[i].Op || ev.Path != want[i].Path || ev.Size != want[i].Size {
+			t.Errorf("event %d: want %v %v %v, got %v %v %v", i, want[i].Op, want[i].Path, want[i].Size, ev.Op, ev.Path, ev.Size)
+		}
+		if (ev.Err != nil) != (i == 4) {
+			t.Errorf("event %d: unexpected error %v", i, ev.Err)
+		}
+	}
+	if !errors.Is(events[4].Err, os.ErrNotExist) {
+		t.Errorf("want not exist error, got %v", events[4].Err)
+	}
+}
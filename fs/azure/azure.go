@@ -0,0 +1,914 @@
+// Package azure implements a fs.Filesystem which stores the repositories in
+// an Azure Blob Storage container.
+//
+// The package talks to the Blob service REST API directly instead of using
+// the Azure SDK, which requires a newer Go version than rest-server supports.
+// Only the few operations needed for repositories are implemented.
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// apiVersion is the version of the Blob service REST API used.
+const apiVersion = "2020-10-02"
+
+// DefaultBlockSize is the default size of the blocks of large uploads.
+const DefaultBlockSize = 4 << 20
+
+// imdsEndpoint is the token endpoint of the Azure Instance Metadata Service,
+// which issues the tokens of managed identities.
+const imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// Options configure the Filesystem.
+type Options struct {
+	// Account is the name of the storage account, it defaults to
+	// $AZURE_STORAGE_ACCOUNT. It is taken from the connection string if
+	// one is used.
+	Account string
+	// Container is the name of the container the blobs are stored in.
+	Container string
+	// Prefix is prepended to all blob names, it may be empty.
+	Prefix string
+	// Root is the local path the repositories are served from, usually the
+	// path of the server. The paths passed to the Filesystem must be below
+	// Root, they are mapped to blob names relative to Root.
+	Root string
+
+	// Endpoint is the URL of the Blob service, by default
+	// https://<account>.blob.core.windows.net. It must be set for the
+	// Azurite emulator, e.g. to http://127.0.0.1:10000/devstoreaccount1.
+	Endpoint string
+
+	// ConnectionString is a connection string of the storage account as
+	// shown in the Azure portal, containing the AccountName and either an
+	// AccountKey or a SharedAccessSignature. It defaults to
+	// $AZURE_STORAGE_CONNECTION_STRING and takes precedence over the other
+	// credentials.
+	ConnectionString string
+	// AccountKey is the shared key of the account, it defaults to
+	// $AZURE_STORAGE_KEY.
+	AccountKey string
+	// UseManagedIdentity authenticates with the managed identity of the
+	// virtual machine or container rest-server runs on, if neither a
+	// connection string nor an account key is configured. ClientID selects
+	// a user-assigned identity, the system-assigned one is used if it is
+	// empty.
+	UseManagedIdentity bool
+	ClientID           string
+	// IdentityEndpoint is the endpoint the tokens of the managed identity
+	// are requested from, the Azure Instance Metadata Service if unset.
+	IdentityEndpoint string
+
+	// BlockSize is the size of the blocks which large blobs are staged in
+	// before the block list is committed, blobs smaller than BlockSize are
+	// uploaded in a single request. Defaults to DefaultBlockSize.
+	BlockSize int64
+}
+
+// Filesystem stores repositories in an Azure Blob Storage container as block
+// blobs. Containers have no directories, so creating a repository is a no-op
+// and listing an empty or missing directory returns no blobs instead of an
+// error.
+//
+// Each request to the Blob service, and to the token endpoint of a managed
+// identity, is bound to the context of the operation, including the reads of
+// the reader returned by GetBlob, so it ends at the deadline of the context.
+// Without a deadline there is no timeout, the requests are sent with
+// http.DefaultClient and run until the context is canceled.
+type Filesystem struct {
+	client    *http.Client
+	endpoint  *url.URL
+	container string
+	prefix    string
+	root      string
+	blockSize int64
+
+	account string
+	key     []byte      // shared key, if set
+	sas     url.Values  // shared access signature, if set
+	tokens  *tokenCache // managed identity, if set
+}
+
+var (
+	_ fs.Filesystem = &Filesystem{}
+	_ fs.Presigner  = &Filesystem{}
+)
+
+// New returns a Filesystem for the container configured in opt.
+func New(opt Options) (*Filesystem, error) {
+	if opt.Container == "" {
+		return nil, errors.New("no container specified")
+	}
+	if opt.Root == "" {
+		return nil, errors.New("no root path specified")
+	}
+
+	f := &Filesystem{
+		client:    http.DefaultClient,
+		container: opt.Container,
+		root:      filepath.Clean(opt.Root),
+		blockSize: opt.BlockSize,
+		account:   opt.Account,
+	}
+	if f.blockSize <= 0 {
+		f.blockSize = DefaultBlockSize
+	}
+	if f.account == "" {
+		f.account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+
+	endpoint := opt.Endpoint
+	connStr := opt.ConnectionString
+	if connStr == "" {
+		connStr = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+	}
+	accountKey := opt.AccountKey
+	if accountKey == "" && connStr == "" {
+		accountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+
+	switch {
+	case connStr != "":
+		cs, err := parseConnectionString(connStr)
+		if err != nil {
+			return nil, err
+		}
+		if cs.account != "" {
+			f.account = cs.account
+		}
+		if endpoint == "" {
+			endpoint = cs.endpoint
+		}
+		if cs.sas != "" {
+			f.sas, err = url.ParseQuery(strings.TrimPrefix(cs.sas, "?"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid shared access signature: %w", err)
+			}
+		} else {
+			accountKey = cs.key
+		}
+	case accountKey != "":
+	case opt.UseManagedIdentity:
+		ep := opt.IdentityEndpoint
+		if ep == "" {
+			ep = imdsEndpoint
+		}
+		f.tokens = &tokenCache{client: f.client, endpoint: ep, clientID: opt.ClientID}
+	default:
+		return nil, errors.New("no credentials specified")
+	}
+	if accountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account key: %w", err)
+		}
+		f.key = key
+	}
+
+	if f.account == "" && (f.key != nil || endpoint == "") {
+		return nil, errors.New("no account specified")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + f.account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	f.endpoint = u
+
+	f.prefix = strings.Trim(opt.Prefix, "/")
+	if f.prefix != "" {
+		f.prefix += "/"
+	}
+	return f, nil
+}
+
+// connectionString are the settings of a connection string used here.
+type connectionString struct {
+	account, key, sas, endpoint string
+}
+
+// parseConnectionString parses a connection string of the form
+// "AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net".
+func parseConnectionString(s string) (connectionString, error) {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i < 0 {
+			return connectionString{}, fmt.Errorf("invalid connection string setting %q", part)
+		}
+		settings[strings.ToLower(part[:i])] = part[i+1:]
+	}
+
+	cs := connectionString{
+		account:  settings["accountname"],
+		key:      settings["accountkey"],
+		sas:      settings["sharedaccesssignature"],
+		endpoint: settings["blobendpoint"],
+	}
+	if cs.key == "" && cs.sas == "" {
+		return connectionString{}, errors.New("connection string contains neither AccountKey nor SharedAccessSignature")
+	}
+	if cs.endpoint == "" {
+		if cs.account == "" {
+			return connectionString{}, errors.New("connection string contains neither AccountName nor BlobEndpoint")
+		}
+		proto := settings["defaultendpointsprotocol"]
+		if proto == "" {
+			proto = "https"
+		}
+		suffix := settings["endpointsuffix"]
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		cs.endpoint = proto + "://" + cs.account + ".blob." + suffix
+	}
+	return cs, nil
+}
+
+// blobName returns the name of the blob for path.
+func (f *Filesystem) blobName(path string) (string, error) {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is not below %v", path, f.root)
+	}
+	if rel == "." {
+		return strings.TrimSuffix(f.prefix, "/"), nil
+	}
+	return f.prefix + filepath.ToSlash(rel), nil
+}
+
+// ResponseError is returned for requests which the Blob service rejected.
+type ResponseError struct {
+	StatusCode int
+	// Code is the error code of the service, e.g. BlobNotFound.
+	Code string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azure: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("azure: %d %s", e.StatusCode, e.Code)
+}
+
+// pathError wraps err, errors for missing blobs are translated to
+// os.ErrNotExist.
+func pathError(op, path string, err error) error {
+	var respErr *ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// do sends a request for the blob name, or for the container if name is
+// empty. Responses with an error status are returned as a *ResponseError.
+func (f *Filesystem) do(ctx context.Context, method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *f.endpoint
+	u.Path += "/" + f.container
+	if name != "" {
+		u.Path += "/" + name
+	}
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range f.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), rd)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+
+	switch {
+	case f.key != nil:
+		req.Header.Set("Authorization", "SharedKey "+f.account+":"+f.sign(req))
+	case f.tokens != nil:
+		token, err := f.tokens.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return nil, &ResponseError{StatusCode: resp.StatusCode, Code: resp.Header.Get("x-ms-error-code")}
+	}
+	return resp, nil
+}
+
+// sign returns the shared key signature of req.
+func (f *Filesystem) sign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	parts := []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // the x-ms-date header is used instead of Date
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}
+
+	var msHeaders []string
+	for k := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k)
+		}
+	}
+	sort.Strings(msHeaders)
+	var b strings.Builder
+	b.WriteString(strings.Join(parts, "\n"))
+	b.WriteString("\n")
+	for _, k := range msHeaders {
+		b.WriteString(k + ":" + strings.TrimSpace(h.Get(k)) + "\n")
+	}
+
+	b.WriteString("/" + f.account + req.URL.EscapedPath())
+	query := req.URL.Query()
+	var names []string
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		values := query[k]
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+
+	return f.signString(b.String())
+}
+
+// signString returns the signature of s with the shared key.
+func (f *Filesystem) signString(s string) string {
+	mac := hmac.New(sha256.New, f.key)
+	_, _ = mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// serviceSAS returns a service shared access signature which allows reading
+// the blob name until expiry.
+func (f *Filesystem) serviceSAS(name string, expiry time.Time) url.Values {
+	q := url.Values{
+		"sv": {apiVersion},
+		"sr": {"b"},
+		"sp": {"r"},
+		"se": {expiry.UTC().Format("2006-01-02T15:04:05Z")},
+	}
+	if f.endpoint != nil && f.endpoint.Scheme == "https" {
+		q.Set("spr", "https")
+	}
+	parts := []string{
+		q.Get("sp"),
+		"", // start
+		q.Get("se"),
+		"/blob/" + f.account + "/" + f.container + "/" + name,
+		"", // identifier
+		"", // IP range
+		q.Get("spr"),
+		q.Get("sv"),
+		q.Get("sr"),
+		"", // snapshot time
+		"", // Cache-Control of the response
+		"", // Content-Disposition
+		"", // Content-Encoding
+		"", // Content-Language
+		"", // Content-Type
+	}
+	q.Set("sig", f.signString(strings.Join(parts, "\n")))
+	return q
+}
+
+// tokenCache requests the access tokens of a managed identity and caches
+// them until shortly before they expire.
+type tokenCache struct {
+	client   *http.Client
+	endpoint string
+	clientID string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get returns a valid access token for the storage service.
+func (t *tokenCache) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Until(t.expires) > 5*time.Minute {
+		return t.token, nil
+	}
+
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://storage.azure.com/"}}
+	if t.clientID != "" {
+		q.Set("client_id", t.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting managed identity token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting managed identity token: %v", resp.Status)
+	}
+
+	var res struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresOn   json.Number `json:"expires_on"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("decoding managed identity token: %w", err)
+	}
+	expires, err := res.ExpiresOn.Int64()
+	if err != nil {
+		return "", fmt.Errorf("invalid expiry of managed identity token: %w", err)
+	}
+	t.token, t.expires = res.AccessToken, time.Unix(expires, 0)
+	return t.token, nil
+}
+
+// CreateRepo only checks that the repository has no config yet, containers
+// have no directories.
+func (f *Filesystem) CreateRepo(ctx context.Context, path string) error {
+	exists, _, err := f.CheckConfig(ctx, filepath.Join(path, "config"))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &os.PathError{Op: "create", Path: path, Err: fs.ErrRepoExists}
+	}
+	return nil
+}
+
+func (f *Filesystem) head(ctx context.Context, op, path string) (int64, error) {
+	blob, err := f.stat(ctx, op, path)
+	return blob.Size, err
+}
+
+// stat returns the name, size and modification time of the blob for path.
+func (f *Filesystem) stat(ctx context.Context, op, path string) (fs.Blob, error) {
+	name, err := f.blobName(path)
+	if err != nil {
+		return fs.Blob{}, err
+	}
+	resp, err := f.do(ctx, http.MethodHead, name, nil, nil, nil)
+	if err != nil {
+		return fs.Blob{}, pathError(op, path, err)
+	}
+	_ = resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return fs.Blob{Name: filepath.Base(path), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (f *Filesystem) remove(ctx context.Context, path string) error {
+	name, err := f.blobName(path)
+	if err != nil {
+		return err
+	}
+	resp, err := f.do(ctx, http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return pathError("remove", path, err)
+	}
+	return resp.Body.Close()
+}
+
+// put uploads data as the blob for path in a single request.
+func (f *Filesystem) put(ctx context.Context, path string, data []byte, header http.Header) error {
+	name, err := f.blobName(path)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	resp, err := f.do(ctx, http.MethodPut, name, nil, header, data)
+	if err != nil {
+		return pathError("write", path, err)
+	}
+	return resp.Body.Close()
+}
+
+// CheckConfig returns whether the config blob exists and its size.
+func (f *Filesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	size, err := f.head(ctx, "stat", path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, size, nil
+}
+
+// GetConfig returns the contents of the config blob.
+func (f *Filesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	rd, _, err := f.GetConfigReader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// GetConfigReader returns the body of the config blob and its size.
+func (f *Filesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	name, err := f.blobName(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := f.do(ctx, http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, 0, pathError("open", path, err)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// SaveConfig stores the config blob. It is only created if it does not
+// exist yet, which the service checks atomically.
+func (f *Filesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	err = f.put(ctx, path, buf, http.Header{"If-None-Match": {"*"}})
+	var respErr *ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusConflict {
+		return &os.PathError{Op: "create", Path: path, Err: fs.ErrConfigExists}
+	}
+	return err
+}
+
+// DeleteConfig removes the config blob.
+func (f *Filesystem) DeleteConfig(ctx context.Context, path string) error {
+	return f.remove(ctx, path)
+}
+
+// listResult is the response of a List Blobs request.
+type listResult struct {
+	Blobs []struct {
+		Name       string
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		}
+	} `xml:"Blobs>Blob"`
+	NextMarker string
+}
+
+// ListBlobs lists all blobs below path.
+func (f *Filesystem) ListBlobs(ctx context.Context, path string) ([]fs.Blob, error) {
+	var blobs []fs.Blob
+	err := f.ListBlobsFunc(ctx, path, func(blob fs.Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for all blobs below path, using a prefix query. For
+// hashed object types all intermediate subdirs are listed at once, blobs
+// which are not in one of these are ignored.
+func (f *Filesystem) ListBlobsFunc(ctx context.Context, path string, fn func(fs.Blob) error) error {
+	name, err := f.blobName(path)
+	if err != nil {
+		return err
+	}
+	prefix := name + "/"
+	hashed := fs.IsHashed(filepath.Base(path))
+
+	query := url.Values{
+		"restype": {"container"},
+		"comp":    {"list"},
+		"prefix":  {prefix},
+	}
+	if !hashed {
+		query.Set("delimiter", "/")
+	}
+	for {
+		resp, err := f.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return pathError("readdir", path, err)
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		_ = resp.Body.Close()
+		if err != nil {
+			return pathError("readdir", path, err)
+		}
+
+		for _, b := range res.Blobs {
+			name := strings.TrimPrefix(b.Name, prefix)
+			if hashed {
+				i := strings.IndexByte(name, '/')
+				if i < 0 {
+					continue
+				}
+				name = name[i+1:]
+			}
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			modTime, _ := http.ParseTime(b.Properties.LastModified)
+			if err := fn(fs.Blob{Name: name, Size: b.Properties.ContentLength, ModTime: modTime}); err != nil {
+				return err
+			}
+		}
+		if res.NextMarker == "" {
+			return nil
+		}
+		query.Set("marker", res.NextMarker)
+	}
+}
+
+// CheckBlob returns the size and modification time of the blob.
+func (f *Filesystem) CheckBlob(ctx context.Context, path string) (fs.Blob, error) {
+	return f.stat(ctx, "stat", path)
+}
+
+// GetBlob returns a reader for the blob. Seeking the reader is cheap, the
+// data is only requested on the next call to Read.
+func (f *Filesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	size, err := f.head(ctx, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	name, err := f.blobName(path)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{ctx: ctx, f: f, path: path, name: name, size: size}, nil
+}
+
+// PresignGet returns a URL with a service shared access signature for the
+// blob, which is valid for ttl. The signature requires the shared key, no URL
+// is returned for other credentials.
+func (f *Filesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	if f.key == nil {
+		return "", false, nil
+	}
+	name, err := f.blobName(path)
+	if err != nil {
+		return "", false, err
+	}
+	u := *f.endpoint
+	u.Path += "/" + f.container + "/" + name
+	u.RawQuery = f.serviceSAS(name, time.Now().Add(ttl)).Encode()
+	return u.String(), true, nil
+}
+
+// SaveBlob uploads the blob. Blobs smaller than the BlockSize are uploaded
+// with a single request, larger ones are staged in blocks which are then
+// committed with a block list. A failed read aborts the upload before the
+// block list is committed, so that a truncated blob is not stored. The
+// service removes the uncommitted blocks after a week.
+func (f *Filesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	name, err := f.blobName(path)
+	if err != nil {
+		return 0, err
+	}
+	rd = fs.NewSizeCheckReader(path, rd, expectedSize)
+
+	buf := make([]byte, f.blockSize)
+	var written int64
+	var blocks []string
+	for {
+		n, err := io.ReadFull(rd, buf)
+		written += int64(n)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return written, err
+		}
+		if last && len(blocks) == 0 {
+			return written, f.put(ctx, path, buf[:n], nil)
+		}
+		if n > 0 {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(blocks))))
+			query := url.Values{"comp": {"block"}, "blockid": {id}}
+			resp, err := f.do(ctx, http.MethodPut, name, query, nil, buf[:n])
+			if err != nil {
+				return written, pathError("write", path, err)
+			}
+			_ = resp.Body.Close()
+			blocks = append(blocks, id)
+		}
+		if last {
+			break
+		}
+	}
+
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blocks {
+		list.WriteString("<Latest>" + id + "</Latest>")
+	}
+	list.WriteString("</BlockList>")
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := f.do(ctx, http.MethodPut, name, url.Values{"comp": {"blocklist"}}, header, list.Bytes())
+	if err != nil {
+		return written, pathError("write", path, err)
+	}
+	return written, resp.Body.Close()
+}
+
+// DeleteBlob removes the blob.
+func (f *Filesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	if needSize {
+		var err error
+		size, err = f.head(ctx, "remove", path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, f.remove(ctx, path)
+}
+
+// DeleteBlobs removes the blobs one after the other.
+func (f *Filesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for i, p := range paths {
+		size, err := f.DeleteBlob(ctx, p, needSize)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs[i] = err
+			continue
+		}
+		sizes[i] = size
+	}
+	return sizes, fs.NewBatchError(errs)
+}
+
+// RepoStats returns the statistics of the repository by listing the blobs of
+// all object types.
+func (f *Filesystem) RepoStats(ctx context.Context, path string) (fs.RepoStats, error) {
+	var stats fs.RepoStats
+	stats.Types = make(map[string]fs.ObjectStats, len(fs.ObjectTypes))
+	for _, t := range fs.ObjectTypes {
+		var o fs.ObjectStats
+		err := f.ListBlobsFunc(ctx, filepath.Join(path, t), func(blob fs.Blob) error {
+			o.Size += blob.Size
+			o.Count++
+			return nil
+		})
+		if err != nil {
+			return fs.RepoStats{}, err
+		}
+		stats.Types[t] = o
+		stats.Size += o.Size
+		stats.Count += o.Count
+	}
+	return stats, nil
+}
+
+// Walk calls fn for the blobs of all object types by listing them.
+func (f *Filesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob fs.Blob) error) error {
+	return fs.WalkTypes(ctx, f, path, fn)
+}
+
+// HealthCheck writes and removes a small blob below path.
+func (f *Filesystem) HealthCheck(ctx context.Context, path string) error {
+	path = filepath.Join(path, fs.HealthDir, "check")
+	if err := f.put(ctx, path, []byte("ok\n"), nil); err != nil {
+		return err
+	}
+	return f.remove(ctx, path)
+}
+
+// Sync does nothing, a blob is stored durably once its upload has returned.
+func (f *Filesystem) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close closes the idle connections of the client.
+func (f *Filesystem) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+// blobReader reads a blob, starting a new ranged request after each seek.
+type blobReader struct {
+	ctx  context.Context
+	f    *Filesystem
+	path string
+	name string
+
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		var header http.Header
+		if r.offset > 0 {
+			header = http.Header{"x-ms-range": {fmt.Sprintf("bytes=%d-", r.offset)}}
+		}
+		resp, err := r.f.do(r.ctx, http.MethodGet, r.name, nil, header, nil)
+		if err != nil {
+			return 0, pathError("read", r.path, err)
+		}
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset {
+		if err := r.Close(); err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,390 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// fakeAzure implements the small subset of the Blob service API used by
+// Filesystem for the container "container", checking only the presence of
+// the authentication.
+type fakeAzure struct {
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	blocks map[string][]byte // staged blocks by blob name and block ID
+	auth   func(r *http.Request) bool
+}
+
+func (s *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("x-ms-version") == "" || !s.auth(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/container")
+	name = strings.TrimPrefix(name, "/")
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && q.Get("comp") == "list":
+		prefix := q.Get("prefix")
+		delim := q.Get("delimiter")
+		var names []string
+		for k := range s.blobs {
+			if strings.HasPrefix(k, prefix) && (delim == "" || !strings.Contains(k[len(prefix):], delim)) {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		// return one blob per page to exercise the markers
+		if m := q.Get("marker"); m != "" {
+			for len(names) > 0 && names[0] < m {
+				names = names[1:]
+			}
+		}
+		_, _ = fmt.Fprint(w, "<EnumerationResults><Blobs>")
+		if len(names) > 0 {
+			_, _ = fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>Mon, 02 Jan 2006 15:04:05 GMT</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>", names[0], len(s.blobs[names[0]]))
+		}
+		_, _ = fmt.Fprint(w, "</Blobs>")
+		if len(names) > 1 {
+			_, _ = fmt.Fprintf(w, "<NextMarker>%s</NextMarker>", names[1])
+		}
+		_, _ = fmt.Fprint(w, "</EnumerationResults>")
+
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		buf, _ := ioutil.ReadAll(r.Body)
+		s.blocks[name+"/"+q.Get("blockid")] = buf
+
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, id := range list.Latest {
+			block, ok := s.blocks[name+"/"+id]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data = append(data, block...)
+		}
+		s.blobs[name] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.blobs[name]; ok && r.Header.Get("If-None-Match") == "*" {
+			w.Header().Set("x-ms-error-code", "BlobAlreadyExists")
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		buf, _ := ioutil.ReadAll(r.Body)
+		s.blobs[name] = buf
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		buf, ok := s.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("x-ms-range"); rng != "" {
+			var start int
+			_, _ = fmt.Sscanf(rng, "bytes=%d-", &start)
+			buf = buf[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(buf)))
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(buf)
+		}
+
+	case r.Method == http.MethodDelete:
+		if _, ok := s.blobs[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func newFake() (*fakeAzure, *httptest.Server) {
+	fake := &fakeAzure{blobs: make(map[string][]byte), blocks: make(map[string][]byte)}
+	return fake, httptest.NewServer(fake)
+}
+
+var testKey = base64.StdEncoding.EncodeToString([]byte("secret"))
+
+func TestFilesystem(t *testing.T) {
+	fake, srv := newFake()
+	defer srv.Close()
+	fake.auth = func(r *http.Request) bool {
+		return strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey account:")
+	}
+
+	root := filepath.FromSlash("/srv/restic")
+	f, err := New(Options{
+		Account:    "account",
+		Container:  "container",
+		Prefix:     "/backups/",
+		Root:       root,
+		Endpoint:   srv.URL,
+		AccountKey: testKey,
+		BlockSize:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := f.HealthCheck(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.blobs) != 0 {
+		t.Fatalf("HealthCheck must remove its blob, got %v", fake.blobs)
+	}
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateRepo(ctx, filepath.FromSlash("/elsewhere")); err == nil {
+		t.Fatal("paths outside of the root must be rejected")
+	}
+
+	cfg := filepath.Join(repo, "config")
+	if exists, _, err := f.CheckConfig(ctx, cfg); err != nil || exists {
+		t.Fatalf("CheckConfig: want missing config, got %v, %v", exists, err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); !errors.Is(err, fs.ErrConfigExists) {
+		t.Fatalf("SaveConfig: want ErrConfigExists, got %v", err)
+	}
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, fs.ErrRepoExists) {
+		t.Fatalf("CreateRepo: want ErrRepoExists, got %v", err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if _, ok := fake.blobs["backups/repo/config"]; !ok {
+		t.Fatalf("config stored under the wrong name, blobs: %v", fake.blobs)
+	}
+
+	// larger than the block size, staged in blocks
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("blob data"), -1); err != nil || n != 9 {
+		t.Fatalf("SaveBlob: got %v, %v", n, err)
+	}
+	if len(fake.blocks) != 3 {
+		t.Fatalf("want 3 staged blocks, got %d", len(fake.blocks))
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", "key"), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated upload must not be committed
+	short := filepath.Join(repo, "snapshots", id)
+	if _, err := f.SaveBlob(ctx, short, strings.NewReader("short"), 10); !errors.Is(err, fs.ErrShortWrite) {
+		t.Fatalf("SaveBlob: want ErrShortWrite, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, short); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want ErrNotExist for a truncated upload, got %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 9 || b.ModTime.IsZero() {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+
+	for _, tpe := range []string{"data", "keys"} {
+		blobs, err := f.ListBlobs(ctx, filepath.Join(repo, tpe))
+		if err != nil || len(blobs) != 1 || blobs[0].ModTime.IsZero() {
+			t.Fatalf("ListBlobs %v: got %v, %v", tpe, blobs, err)
+		}
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "data" {
+		t.Fatalf("reading after seek: got %q, %v", buf, err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 9 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("DeleteBlob: want ErrNotExist after delete, got %v", err)
+	}
+
+	var paths []string
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(repo, "locks", name)
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader(name), 1); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	// listed over several pages
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "locks")); err != nil || len(blobs) != 3 {
+		t.Fatalf("ListBlobs: want 3 locks, got %v, %v", blobs, err)
+	}
+	paths = append(paths, filepath.Join(repo, "locks", "missing"))
+	sizes, err := f.DeleteBlobs(ctx, paths, true)
+	if err != nil || len(sizes) != 4 || sizes[0] != 1 || sizes[3] != 0 {
+		t.Fatalf("DeleteBlobs: got %v, %v", sizes, err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	f := &Filesystem{account: "account", key: []byte("secret")}
+	req, err := http.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/container?restype=container&comp=list&prefix=repo%2Fdata%2F", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-ms-date", "Mon, 02 Jan 2006 15:04:05 GMT")
+	req.Header.Set("x-ms-version", apiVersion)
+
+	// computed independently from the documented string to sign
+	want := "Ztfpbn9p7bpGNXrf6EgFbJ7QYUl+lWiDOhhlznoZrho="
+	if sig := f.sign(req); sig != want {
+		t.Fatalf("want signature %v, got %v", want, sig)
+	}
+}
+
+func TestPresignGet(t *testing.T) {
+	endpoint, err := url.Parse("https://account.blob.core.windows.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Filesystem{account: "account", key: []byte("secret"), endpoint: endpoint, container: "container"}
+	expiry := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	q := f.serviceSAS("repo/data/ab/abcd", expiry)
+
+	// computed independently from the documented string to sign
+	want := "KOIafPPPrwIKTwA2Edq0svqXddgDZYJAA6eVhKMd1/A="
+	if sig := q.Get("sig"); sig != want {
+		t.Fatalf("want signature %v, got %v", want, sig)
+	}
+	if q.Get("se") != "2006-01-02T15:04:05Z" || q.Get("sp") != "r" || q.Get("spr") != "https" {
+		t.Fatalf("unexpected signature parameters %v", q)
+	}
+
+	f.root = filepath.FromSlash("/srv")
+	u, ok, err := f.PresignGet(context.Background(), filepath.FromSlash("/srv/repo/keys/key"), time.Minute)
+	if err != nil || !ok || !strings.HasPrefix(u, "https://account.blob.core.windows.net/container/repo/keys/key?") {
+		t.Fatalf("PresignGet: got %v, %v, %v", u, ok, err)
+	}
+	// URLs cannot be signed without the shared key
+	f.key = nil
+	if _, ok, err := f.PresignGet(context.Background(), filepath.FromSlash("/srv/repo/keys/key"), time.Minute); ok || err != nil {
+		t.Fatalf("PresignGet: want no URL without the shared key, got %v, %v", ok, err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	fake, srv := newFake()
+	defer srv.Close()
+	fake.auth = func(r *http.Request) bool {
+		return r.URL.Query().Get("sig") == "signature" || r.Header.Get("Authorization") == "Bearer token"
+	}
+	ctx := context.Background()
+	root := filepath.FromSlash("/srv/restic")
+
+	// shared access signature from a connection string
+	f, err := New(Options{
+		Container:        "container",
+		Root:             root,
+		ConnectionString: "BlobEndpoint=" + srv.URL + ";SharedAccessSignature=sv=2020-10-02&sig=signature",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.HealthCheck(ctx, root); err != nil {
+		t.Fatalf("SAS: %v", err)
+	}
+
+	// managed identity, the token is requested once
+	var requests int
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "id" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"access_token": "token", "expires_on": "99999999999"}`)
+	}))
+	defer imds.Close()
+	f, err = New(Options{
+		Account:            "account",
+		Container:          "container",
+		Root:               root,
+		Endpoint:           srv.URL,
+		UseManagedIdentity: true,
+		ClientID:           "id",
+		IdentityEndpoint:   imds.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.HealthCheck(ctx, root); err != nil {
+			t.Fatalf("managed identity: %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("want the token requested once, got %d requests", requests)
+	}
+
+	for _, opt := range []Options{
+		{Container: "container", Root: root, Account: "account"},
+		{Container: "container", Root: root, ConnectionString: "AccountName=account"},
+		{Container: "container", Root: root, AccountKey: "not base64!"},
+		{Root: root, AccountKey: testKey, Account: "account"},
+	} {
+		if _, err := New(opt); err == nil {
+			t.Errorf("%+v: want an error", opt)
+		}
+	}
+}
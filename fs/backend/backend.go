@@ -0,0 +1,205 @@
+// Package backend constructs a fs.Filesystem from a URL, so that the storage
+// backend can be selected with a single configuration string. It is kept
+// separate from package fs because it depends on all backends.
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/restic/rest-server/fs"
+	"github.com/restic/rest-server/fs/azure"
+	"github.com/restic/rest-server/fs/s3"
+	"github.com/restic/rest-server/fs/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options configure the Filesystem returned by NewFilesystem.
+type Options struct {
+	// Root is the local path the repositories are served from, usually the
+	// path of the server. The paths passed to the Filesystem must be below
+	// Root.
+	Root string
+
+	// AppendOnly wraps the backend in a fs.AppendOnlyFilesystem.
+	AppendOnly bool
+	// MaxRepoSize wraps the backend in a fs.QuotaFilesystem limiting the size
+	// of each repository to MaxRepoSize bytes, 0 means no limit.
+	MaxRepoSize int64
+	// SoftRepoSize is the soft limit of the size of each repository, see
+	// fs.QuotaFilesystem.SoftLimit, 0 means no soft limit. It can be set
+	// with or without MaxRepoSize.
+	SoftRepoSize int64
+
+	// Disk is used for file URLs, which allows to set its options. A new
+	// fs.DiskFilesystem is used if Disk is nil.
+	Disk *fs.DiskFilesystem
+	// SSH is the configuration of the SSH client used for sftp URLs. The user
+	// in the URL, if any, replaces the user of the configuration.
+	SSH *ssh.ClientConfig
+}
+
+// NewFilesystem returns the Filesystem for uri. The supported schemes are:
+//
+//	file:///srv/restic                   repositories in the directory /srv/restic
+//	mem://                               repositories in memory
+//	s3://bucket/prefix?endpoint=https://minio:9000&region=us-east-1&path-style=true
+//	sftp://user@host:22/remote/root?conns=4
+//	azure://container/prefix?account=name&managed-identity=true
+//
+// The path of a file URL must be Root, Root defaults to it if it is unset.
+// Credentials for S3 are taken from the environment, see s3.Options. The path
+// of an sftp URL is the directory on the server, the home directory of the
+// user if it is empty. Azure URLs accept the parameters account, endpoint,
+// managed-identity, client-id and block-size, the remaining credentials are
+// taken from the environment, see azure.Options.
+//
+// The wrappers selected in opts are applied in a fixed order, from the
+// outside in: quota, append-only, backend. The quota is thus checked before
+// anything else, and the append-only check is applied to all backends alike.
+func NewFilesystem(uri string, opts Options) (fs.Filesystem, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL: %w", err)
+	}
+
+	var f fs.Filesystem
+	switch u.Scheme {
+	case "file":
+		f, err = newDisk(u, &opts)
+	case "mem":
+		f = fs.NewMemoryFilesystem()
+	case "s3":
+		f, err = newS3(u, opts)
+	case "sftp":
+		f, err = newSFTP(u, opts)
+	case "azure":
+		f, err = newAzure(u, opts)
+	case "":
+		return nil, fmt.Errorf("backend URL %q has no scheme", uri)
+	default:
+		return nil, fmt.Errorf("unknown backend scheme %q in %q", u.Scheme, uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s backend: %w", u.Scheme, err)
+	}
+
+	if opts.AppendOnly {
+		f = fs.NewAppendOnlyFilesystem(f)
+	}
+	if opts.MaxRepoSize > 0 || opts.SoftRepoSize > 0 {
+		q := fs.NewQuotaFilesystem(f, opts.MaxRepoSize)
+		q.SoftLimit = opts.SoftRepoSize
+		f = q
+	}
+	return f, nil
+}
+
+func newDisk(u *url.URL, opts *Options) (fs.Filesystem, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("remote host %q not supported", u.Host)
+	}
+	if u.Path == "" {
+		return nil, errors.New("no path specified")
+	}
+	dir := filepath.Clean(filepath.FromSlash(u.Path))
+	if opts.Root == "" {
+		opts.Root = dir
+	} else if filepath.Clean(opts.Root) != dir {
+		return nil, fmt.Errorf("path %v does not match the root %v", dir, opts.Root)
+	}
+	if opts.Disk != nil {
+		return opts.Disk, nil
+	}
+	return &fs.DiskFilesystem{}, nil
+}
+
+func newS3(u *url.URL, opts Options) (fs.Filesystem, error) {
+	q := u.Query()
+	s3opt := s3.Options{
+		Bucket:   u.Host,
+		Prefix:   u.Path,
+		Root:     opts.Root,
+		Endpoint: q.Get("endpoint"),
+		Region:   q.Get("region"),
+	}
+	var err error
+	if v := q.Get("path-style"); v != "" {
+		s3opt.UsePathStyle, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path-style: %w", err)
+		}
+	}
+	if v := q.Get("part-size"); v != "" {
+		s3opt.PartSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part-size: %w", err)
+		}
+	}
+	return s3.New(s3opt)
+}
+
+func newSFTP(u *url.URL, opts Options) (fs.Filesystem, error) {
+	if u.Hostname() == "" {
+		return nil, errors.New("no host specified")
+	}
+	if opts.SSH == nil {
+		return nil, errors.New("no SSH configuration specified")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	cfg := *opts.SSH
+	if u.User != nil {
+		cfg.User = u.User.Username()
+	}
+
+	sftpopt := sftp.Options{
+		Addr:       net.JoinHostPort(u.Hostname(), port),
+		Config:     &cfg,
+		Root:       opts.Root,
+		RemoteRoot: u.Path,
+	}
+	if sftpopt.RemoteRoot == "" {
+		sftpopt.RemoteRoot = "."
+	}
+	if v := u.Query().Get("conns"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conns: %w", err)
+		}
+		sftpopt.Conns = n
+	}
+	return sftp.New(sftpopt)
+}
+
+func newAzure(u *url.URL, opts Options) (fs.Filesystem, error) {
+	q := u.Query()
+	azopt := azure.Options{
+		Account:   q.Get("account"),
+		Container: u.Host,
+		Prefix:    u.Path,
+		Root:      opts.Root,
+		Endpoint:  q.Get("endpoint"),
+		ClientID:  q.Get("client-id"),
+	}
+	var err error
+	if v := q.Get("managed-identity"); v != "" {
+		azopt.UseManagedIdentity, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid managed-identity: %w", err)
+		}
+	}
+	if v := q.Get("block-size"); v != "" {
+		azopt.BlockSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block-size: %w", err)
+		}
+	}
+	return azure.New(azopt)
+}
@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/restic/rest-server/fs"
+	"github.com/restic/rest-server/fs/azure"
+	"github.com/restic/rest-server/fs/s3"
+	"github.com/restic/rest-server/fs/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewFilesystem(t *testing.T) {
+	root := t.TempDir()
+	disk := &fs.DiskFilesystem{}
+	opts := Options{Root: root, Disk: disk, SSH: &ssh.ClientConfig{}}
+
+	f, err := NewFilesystem("file://"+filepath.ToSlash(root), opts)
+	if err != nil || f != disk {
+		t.Fatalf("file: want the configured DiskFilesystem, got %T, %v", f, err)
+	}
+	if f, err := NewFilesystem("mem://", opts); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(*fs.MemoryFilesystem); !ok {
+		t.Fatalf("mem: got %T", f)
+	}
+	if f, err := NewFilesystem("s3://bucket/prefix?endpoint=http://localhost:9000&path-style=true", opts); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(*s3.Filesystem); !ok {
+		t.Fatalf("s3: got %T", f)
+	}
+	if f, err := NewFilesystem("sftp://user@localhost:2222/srv/restic?conns=2", opts); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(*sftp.Filesystem); !ok {
+		t.Fatalf("sftp: got %T", f)
+	}
+	if f, err := NewFilesystem("azure://container/prefix?account=name&managed-identity=true", opts); err != nil {
+		t.Fatal(err)
+	} else if _, ok := f.(*azure.Filesystem); !ok {
+		t.Fatalf("azure: got %T", f)
+	}
+	if opts.SSH.User != "" {
+		t.Fatal("the SSH configuration of the caller has been modified")
+	}
+
+	// quota outside append-only outside the backend
+	opts.AppendOnly = true
+	opts.MaxRepoSize = 100
+	f, err = NewFilesystem("mem://", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, ok := f.(*fs.QuotaFilesystem)
+	if !ok {
+		t.Fatalf("want QuotaFilesystem outside, got %T", f)
+	}
+	a, ok := q.Filesystem.(*fs.AppendOnlyFilesystem)
+	if !ok {
+		t.Fatalf("want AppendOnlyFilesystem inside the quota, got %T", q.Filesystem)
+	}
+	if _, ok := a.Filesystem.(*fs.MemoryFilesystem); !ok {
+		t.Fatalf("want the backend innermost, got %T", a.Filesystem)
+	}
+
+	// a soft limit alone also wraps the backend
+	f, err = NewFilesystem("mem://", Options{Root: opts.Root, SoftRepoSize: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, ok := f.(*fs.QuotaFilesystem); !ok || q.SoftLimit != 80 {
+		t.Fatalf("want QuotaFilesystem with soft limit, got %T", f)
+	}
+}
+
+func TestNewFilesystemErrors(t *testing.T) {
+	opts := Options{Root: filepath.FromSlash("/srv/restic")}
+	for _, test := range []struct {
+		uri string
+		err string
+	}{
+		{"ftp://host/path", `unknown backend scheme "ftp"`},
+		{"/srv/restic", "no scheme"},
+		{"file:///other", "does not match the root"},
+		{"file://host/srv/restic", "remote host"},
+		{"s3:///prefix", "no bucket"},
+		{"s3://bucket?part-size=big", "invalid part-size"},
+		{"sftp://host/path", "no SSH configuration"},
+		{"azure:///prefix?managed-identity=true&account=name", "no container"},
+		{"azure://container?block-size=big", "invalid block-size"},
+	} {
+		_, err := NewFilesystem(test.uri, opts)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: want error %q, got %v", test.uri, test.err, err)
+		}
+	}
+
+	// the root defaults to the path of a file URL
+	if _, err := NewFilesystem("file:///srv/restic", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFilesystem("sftp://host/path", Options{SSH: &ssh.ClientConfig{}}); err == nil {
+		t.Fatal("sftp without root must fail")
+	}
+}
@@ -0,0 +1,226 @@
+package fs
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"math"
+	"path/filepath"
+	"sync"
+)
+
+// bloomMinCapacity is the smallest number of blobs a filter is sized for, so
+// that new and small repositories can grow for a while before the false
+// positive rate increases.
+const bloomMinCapacity = 1024
+
+// BloomFilesystem wraps a Filesystem and keeps a bloom filter of the blobs of
+// each repository in memory. CheckBlob, GetBlob, Stat and BlobExists consult
+// it first, so that lookups of blobs which clearly do not exist return
+// ErrNotFound without accessing the underlying Filesystem. This speeds up
+// large repositories where clients frequently probe for missing blobs.
+//
+// The filter of a repository is built by Rebuild, which walks all its blobs,
+// usually on startup. Until then, lookups in the repository are passed on
+// unchanged. Blobs saved by SaveBlob are added to the filter. Bloom filters
+// cannot forget entries, so deleted blobs remain in the filter and their
+// lookups fall through to the underlying Filesystem, as do the occasional
+// false positives. After many blobs have been removed, e.g. by a prune,
+// Rebuild shrinks the filter again.
+//
+// Blobs created without going through SaveBlob of the BloomFilesystem, for
+// example by restoring them from the trash, are unknown to the filter until
+// the next Rebuild.
+type BloomFilesystem struct {
+	Filesystem
+
+	// FalsePositiveRate is the share of lookups of missing blobs which still
+	// reach the underlying Filesystem, 1% if unset.
+	FalsePositiveRate float64
+
+	mu       sync.RWMutex
+	filters  map[string]*bloomFilter // repository path -> filter
+	rebuilds map[string]*[]uint64    // repository path -> keys saved during Rebuild
+
+	rebuildMu sync.Mutex
+}
+
+var (
+	_ BlobExister = &BloomFilesystem{}
+	_ BlobStater  = &BloomFilesystem{}
+)
+
+// NewBloomFilesystem returns a BloomFilesystem for base without any filters,
+// which are built by Rebuild.
+func NewBloomFilesystem(base Filesystem) *BloomFilesystem {
+	return &BloomFilesystem{
+		Filesystem: base,
+		filters:    make(map[string]*bloomFilter),
+		rebuilds:   make(map[string]*[]uint64),
+	}
+}
+
+// bloomKey returns the hash of the blob at path and the path of its
+// repository.
+func bloomKey(path string) (repo string, key uint64) {
+	repo, objectType, name := SplitBlobPath(path)
+	return repo, blobKey(objectType, name)
+}
+
+func blobKey(objectType, name string) uint64 {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, objectType)
+	_, _ = io.WriteString(h, "/")
+	_, _ = io.WriteString(h, name)
+	return h.Sum64()
+}
+
+// missing reports whether the filter rules out that the blob at path exists.
+func (b *BloomFilesystem) missing(path string) bool {
+	repo, key := bloomKey(path)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	f := b.filters[repo]
+	return f != nil && !f.mayContain(key)
+}
+
+// Rebuild replaces the filter of the repository at path by one built from a
+// walk of all its blobs. Blobs saved while the walk is running are added as
+// well. If the walk fails, also for individual entries, the previous filter is
+// kept, as a filter missing some blobs would hide them from clients.
+func (b *BloomFilesystem) Rebuild(ctx context.Context, path string) error {
+	path = filepath.Clean(path)
+	b.rebuildMu.Lock()
+	defer b.rebuildMu.Unlock()
+
+	saved := &[]uint64{}
+	b.mu.Lock()
+	b.rebuilds[path] = saved
+	b.mu.Unlock()
+
+	var keys []uint64
+	err := b.Filesystem.Walk(ctx, path, func(objectType string, blob Blob) error {
+		keys = append(keys, blobKey(objectType, blob.Name))
+		return nil
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.rebuilds, path)
+	if err != nil {
+		return err
+	}
+	f := newBloomFilter(2*(len(keys)+len(*saved)), b.FalsePositiveRate)
+	for _, key := range keys {
+		f.add(key)
+	}
+	for _, key := range *saved {
+		f.add(key)
+	}
+	b.filters[path] = f
+	return nil
+}
+
+// CheckBlob returns ErrNotFound if the filter rules out the blob, otherwise
+// the blob is checked by the underlying Filesystem.
+func (b *BloomFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	if b.missing(path) {
+		return Blob{}, notExist("stat", path)
+	}
+	return b.Filesystem.CheckBlob(ctx, path)
+}
+
+// GetBlob returns ErrNotFound if the filter rules out the blob, otherwise the
+// blob is opened by the underlying Filesystem.
+func (b *BloomFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	if b.missing(path) {
+		return nil, notExist("open", path)
+	}
+	return b.Filesystem.GetBlob(ctx, path)
+}
+
+// Stat returns ErrNotFound if the filter rules out the blob, otherwise the
+// metadata from the underlying Filesystem.
+func (b *BloomFilesystem) Stat(ctx context.Context, path string) (BlobInfo, error) {
+	if b.missing(path) {
+		return BlobInfo{}, notExist("stat", path)
+	}
+	return Stat(ctx, b.Filesystem, path)
+}
+
+// BlobExists returns false if the filter rules out the blob, otherwise it asks
+// the underlying Filesystem.
+func (b *BloomFilesystem) BlobExists(ctx context.Context, path string) (bool, error) {
+	if b.missing(path) {
+		return false, nil
+	}
+	return BlobExists(ctx, b.Filesystem, path)
+}
+
+// SaveBlob adds the blob to the filter and saves it. It is added first, so
+// that the blob is never hidden once it has been saved; if saving fails, the
+// entry merely is a false positive.
+func (b *BloomFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	repo, key := bloomKey(path)
+	b.mu.Lock()
+	if f := b.filters[repo]; f != nil {
+		f.add(key)
+	}
+	if saved := b.rebuilds[repo]; saved != nil {
+		*saved = append(*saved, key)
+	}
+	b.mu.Unlock()
+	return b.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// bloomFilter is a bloom filter for 64 bit keys. The bit positions are derived
+// from the two halves of the key by double hashing.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// newBloomFilter returns a filter for capacity keys with the false positive
+// rate p, 1% if p is not between 0 and 1.
+func newBloomFilter(capacity int, p float64) *bloomFilter {
+	if capacity < bloomMinCapacity {
+		capacity = bloomMinCapacity
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(capacity) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+func (f *bloomFilter) positions(key uint64, fn func(word int, bit uint64) bool) bool {
+	m := uint64(len(f.bits)) * 64
+	h1, h2 := key&0xffffffff, key>>32|1
+	for i := uint64(0); i < f.hashes; i++ {
+		pos := (h1 + i*h2) % m
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(key uint64) {
+	f.positions(key, func(word int, bit uint64) bool {
+		f.bits[word] |= bit
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(key uint64) bool {
+	return f.positions(key, func(word int, bit uint64) bool {
+		return f.bits[word]&bit != 0
+	})
+}
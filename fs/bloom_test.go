@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// statCounter counts the CheckBlob calls which reach the Filesystem.
+type statCounter struct {
+	Filesystem
+	calls int
+}
+
+func (s *statCounter) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	s.calls++
+	return s.Filesystem.CheckBlob(ctx, path)
+}
+
+func TestBloomFilesystem(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.FromSlash("/repo")
+	blobPath := func(id string) string {
+		return filepath.Join(repo, "data", id[:2], id)
+	}
+	mem := NewMemoryFilesystem()
+	if _, err := mem.SaveBlob(ctx, blobPath(testID), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	base := &statCounter{Filesystem: mem}
+	b := NewBloomFilesystem(base)
+
+	// without a filter all lookups are passed on
+	missing := fmt.Sprintf("%064x", 1)
+	if _, err := b.CheckBlob(ctx, blobPath(missing)); !errors.Is(err, ErrNotFound) || base.calls != 1 {
+		t.Fatalf("want ErrNotFound from the base, got %v after %d calls", err, base.calls)
+	}
+
+	if err := b.Rebuild(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	base.calls = 0
+	const lookups = 1000
+	for i := 0; i < lookups; i++ {
+		path := blobPath(fmt.Sprintf("%064x", i))
+		if _, err := b.CheckBlob(ctx, path); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("CheckBlob(%v): want ErrNotFound, got %v", path, err)
+		}
+		if ok, err := b.BlobExists(ctx, path); ok || err != nil {
+			t.Fatalf("BlobExists(%v): want false, got %v, %v", path, ok, err)
+		}
+	}
+	// only false positives reach the base
+	if base.calls > lookups/20 {
+		t.Fatalf("want most lookups answered by the filter, %d of %d reached the base", base.calls, lookups)
+	}
+
+	if blob, err := b.CheckBlob(ctx, blobPath(testID)); err != nil || blob.Size != 6 {
+		t.Fatalf("want the existing blob, got %v, %v", blob, err)
+	}
+	saved := strings.Repeat("ab", 32)
+	if _, err := b.SaveBlob(ctx, blobPath(saved), strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := b.GetBlob(ctx, blobPath(saved))
+	if err != nil {
+		t.Fatalf("want the saved blob, got %v", err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foo" {
+		t.Fatalf("want %q, got %q", "foo", buf)
+	}
+
+	// deleted blobs remain in the filter, the lookup falls through
+	if _, err := b.DeleteBlob(ctx, blobPath(testID), false); err != nil {
+		t.Fatal(err)
+	}
+	base.calls = 0
+	if _, err := b.Stat(ctx, blobPath(testID)); !errors.Is(err, ErrNotFound) || base.calls != 1 {
+		t.Fatalf("want ErrNotFound from the base, got %v after %d calls", err, base.calls)
+	}
+
+	// a failed walk keeps the previous filter
+	ctxCanceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Rebuild(ctxCanceled, repo); err == nil {
+		t.Fatal("want an error for the canceled walk")
+	}
+	if _, err := b.CheckBlob(ctx, blobPath(saved)); err != nil {
+		t.Fatalf("want the saved blob after the failed rebuild, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// Capabilities describes the features of a filesystem storing repositories,
+// see DiskFilesystem.Capabilities. The features which depend on them fall
+// back to slower or less durable behavior where a capability is missing,
+// the capabilities show which behavior a setup gets.
+type Capabilities struct {
+	// Reflink is set if files can be cloned using reflinks, see CloneRepo.
+	Reflink bool `json:"reflink"`
+	// Fsync is set if files can be synced. Otherwise syncing is skipped,
+	// whatever the SyncMode, and saved blobs may be lost on a crash.
+	Fsync bool `json:"fsync"`
+	// DirSync is set if directories can be synced, which persists the names
+	// of renamed files. It is never set on Windows.
+	DirSync bool `json:"dir_sync"`
+	// AtomicRename is set if a file can be renamed over an existing file,
+	// which SaveBlob relies on to replace blobs.
+	AtomicRename bool `json:"atomic_rename"`
+	// Hardlink is set if files can be hard linked, see DedupFilesystem.
+	Hardlink bool `json:"hardlink"`
+	// Xattr is set if extended attributes can be stored. Otherwise
+	// MetadataFilesystem stores the metadata in sidecar files.
+	Xattr bool `json:"xattr"`
+}
+
+// Names returns the names of the capabilities, as used in their JSON
+// encoding, with whether each is supported. The names are sorted.
+func (c Capabilities) Names() ([]string, []bool) {
+	caps := map[string]bool{
+		"reflink":       c.Reflink,
+		"fsync":         c.Fsync,
+		"dir_sync":      c.DirSync,
+		"atomic_rename": c.AtomicRename,
+		"hardlink":      c.Hardlink,
+		"xattr":         c.Xattr,
+	}
+	names := make([]string, 0, len(caps))
+	for name := range caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	supported := make([]bool, len(names))
+	for i, name := range names {
+		supported[i] = caps[name]
+	}
+	return names, supported
+}
+
+// Capabilities returns the features of the filesystem storing the directory
+// at path, e.g. the base directory of all repositories. They are probed by
+// creating a few small temporary files in the directory, the result is
+// cached so that each directory is only probed once. CloneRepo and
+// SnapshotTree use the capabilities of the parent directory of their
+// destination.
+func (d *DiskFilesystem) Capabilities(path string) (Capabilities, error) {
+	path = filepath.Clean(path)
+	if v, ok := d.capabilities.Load(path); ok {
+		return v.(Capabilities), nil
+	}
+	caps, err := probeCapabilities(path, d.fileMode())
+	if err != nil {
+		return Capabilities{}, err
+	}
+	d.capabilities.Store(path, caps)
+	return caps, nil
+}
+
+// probeCapabilities probes the features of the filesystem storing dir using
+// temporary files. An error is only returned if the files cannot be
+// created, the probes only report whether a feature works.
+func probeCapabilities(dir string, perm os.FileMode) (Capabilities, error) {
+	var caps Capabilities
+	f, err := tempFile(dir, "probe", perm)
+	if err != nil {
+		return caps, err
+	}
+	src := f.Name()
+	defer removeTemp(src)
+	_, err = f.Write([]byte{0})
+	if err == nil {
+		var notSup bool
+		notSup, err = syncFile(f)
+		caps.Fsync = err == nil && !notSup
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return caps, err
+	}
+
+	caps.DirSync = probeDirSync(dir)
+	caps.Reflink = probeReflink(src, perm)
+	caps.Xattr = setMetaXattr(src, []byte("{}")) == nil
+	caps.Hardlink = probeLink(src)
+	caps.AtomicRename, err = probeRename(dir, src, perm)
+	return caps, err
+}
+
+// probeDirSync reports whether dir can be synced.
+func probeDirSync(dir string) bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	err = fsync(f)
+	_ = f.Close()
+	return err == nil
+}
+
+// probeReflink reports whether the file src can be reflinked.
+func probeReflink(src string, perm os.FileMode) bool {
+	dst := src + "-clone"
+	if err := reflink(src, dst, perm); err != nil {
+		return false
+	}
+	removeTemp(dst)
+	return true
+}
+
+// probeLink reports whether the file src can be hard linked.
+func probeLink(src string) bool {
+	dst := src + "-link"
+	if err := os.Link(src, dst); err != nil {
+		return false
+	}
+	removeTemp(dst)
+	return true
+}
+
+// probeRename reports whether a new file in dir can be renamed over the
+// existing file dst.
+func probeRename(dir, dst string, perm os.FileMode) (bool, error) {
+	f, err := tempFile(dir, "probe", perm)
+	if err != nil {
+		return false, err
+	}
+	src := f.Name()
+	defer removeTemp(src)
+	_, err = f.Write([]byte{1})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.Rename(src, dst) == nil, nil
+}
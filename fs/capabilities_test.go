@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDiskFilesystemCapabilities(t *testing.T) {
+	f := &DiskFilesystem{}
+	dir := t.TempDir()
+	caps, err := f.Capabilities(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("capabilities: %+v", caps)
+	if runtime.GOOS == "linux" && (!caps.Fsync || !caps.DirSync || !caps.AtomicRename || !caps.Hardlink) {
+		t.Fatalf("want fsync, dir sync, atomic renames and hard links on Linux, got %+v", caps)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("probe left files behind: %v, %v", entries, err)
+	}
+
+	// the result is cached, the directory is not probed again
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := f.Capabilities(dir); err != nil || again != caps {
+		t.Fatalf("want cached %+v, got %+v, %v", caps, again, err)
+	}
+	if _, err := f.Capabilities(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error for a missing directory, got %v", err)
+	}
+}
+
+func TestCapabilitiesNames(t *testing.T) {
+	names, supported := Capabilities{Fsync: true, Xattr: true}.Names()
+	want := []string{"atomic_rename", "dir_sync", "fsync", "hardlink", "reflink", "xattr"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("want names %v, got %v", want, names)
+	}
+	for i, name := range names {
+		if supported[i] != (name == "fsync" || name == "xattr") {
+			t.Errorf("%v: got supported %v", name, supported[i])
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package fs
+
+// Decorator wraps a Filesystem, e.g. in one of the wrappers of this package:
+//
+//	func(f Filesystem) Filesystem { return NewAppendOnlyFilesystem(f) }
+type Decorator func(Filesystem) Filesystem
+
+// Chain wraps base in the decorators in order, the first decorator wraps base
+// directly and the last one is the outermost, which receives the calls of
+// the handler. Nil decorators are skipped, so that optional features can be
+// left out of the chain by leaving their decorator unset.
+//
+// The order matters, a wrapper only sees the operations passed on by the
+// wrappers outside of it. From the innermost to the outermost:
+//
+//   - AppendOnlyFilesystem, ReadOnlyFilesystem and SealFilesystem directly
+//     around base, so that no other wrapper can remove data behind their
+//     back, e.g. a TrashFilesystem moving blobs to the trash.
+//   - Wrappers which transform the stored data, like EncryptedFilesystem and
+//     CompressedFilesystem, and RetryFilesystem, ThrottledFilesystem and
+//     TimeoutFilesystem, which should only act on the operations of the
+//     storage.
+//   - Wrappers which enforce limits on the data as uploaded by clients, like
+//     QuotaFilesystem and VerifyHashFilesystem.
+//   - Wrappers which observe requests, like AuditFilesystem and those of the
+//     metrics and tracing packages, outermost so that they also record the
+//     requests rejected by the other wrappers.
+func Chain(base Filesystem, decorators ...Decorator) Filesystem {
+	f := base
+	for _, d := range decorators {
+		if d != nil {
+			f = d(f)
+		}
+	}
+	return f
+}
@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordingFilesystem appends its name to calls for each CheckBlob.
+type recordingFilesystem struct {
+	Filesystem
+	name  string
+	calls *[]string
+}
+
+func (r *recordingFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	*r.calls = append(*r.calls, r.name)
+	return r.Filesystem.CheckBlob(ctx, path)
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryFilesystem()
+	blob := filepath.Join(filepath.FromSlash("/repo"), "data", testID[:2], testID)
+	if _, err := mem.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []string
+	record := func(name string) Decorator {
+		return func(f Filesystem) Filesystem {
+			return &recordingFilesystem{Filesystem: f, name: name, calls: &calls}
+		}
+	}
+	f := Chain(mem,
+		func(f Filesystem) Filesystem { return NewAppendOnlyFilesystem(f) },
+		record("inner"),
+		nil,
+		record("outer"),
+	)
+
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+	if strings.Join(calls, ",") != "outer,inner" {
+		t.Fatalf("want the calls in the order outer,inner, got %v", calls)
+	}
+	// the innermost decorator still applies
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, ErrAppendOnly) {
+		t.Fatalf("DeleteBlob: want ErrAppendOnly, got %v", err)
+	}
+
+	if Chain(mem) != Filesystem(mem) {
+		t.Fatal("want base without decorators")
+	}
+}
+
+// closeCounter counts the calls of Close.
+type closeCounter struct {
+	Filesystem
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return c.Filesystem.Close()
+}
+
+func TestClosePropagates(t *testing.T) {
+	members := []*closeCounter{
+		{Filesystem: NewMemoryFilesystem()},
+		{Filesystem: NewMemoryFilesystem()},
+		{Filesystem: NewMemoryFilesystem()},
+	}
+	var events int
+	f := Chain(NewMirrorFilesystem(members[0], members[1]),
+		func(f Filesystem) Filesystem { return NewAppendOnlyFilesystem(f) },
+		func(f Filesystem) Filesystem { return NewSplitReadWriteFilesystem(members[2], f) },
+		func(f Filesystem) Filesystem { return NewNotifyFilesystem(f, func(Event) { events++ }, 10) },
+		func(f Filesystem) Filesystem {
+			return NewAuditFilesystem(f, AuditLoggerFunc(func(context.Context, AuditEvent) {}))
+		},
+	)
+
+	blob := filepath.Join(filepath.FromSlash("/repo"), "keys", testID)
+	if _, err := f.SaveBlob(context.Background(), blob, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the queued event is delivered before the base is closed
+	if events != 1 {
+		t.Fatalf("want 1 event, got %d", events)
+	}
+	for i, m := range members {
+		if m.closed != 1 {
+			t.Fatalf("member %d: want 1 Close, got %d", i, m.closed)
+		}
+	}
+}
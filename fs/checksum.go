@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"strconv"
+)
+
+// The metadata keys ChecksumFilesystem stores the checksum and the size of a
+// blob in.
+const (
+	checksumKey     = "crc32c"
+	checksumSizeKey = "crc32c-size"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumFilesystem wraps a MetadataFilesystem and stores the CRC-32C
+// checksum and the size of each saved blob in its metadata. With
+// VerifyOnRead, blobs are checked against them when they are read, which
+// detects truncated and corrupted blobs at a fraction of the cost of
+// verifying their SHA-256 hash with VerifyHashFilesystem. Blobs saved before
+// the checksums were enabled have no checksum and are not verified.
+//
+// Storing the checksum costs an extended attribute per blob, or a sidecar
+// file where extended attributes are not supported, see MetadataFilesystem.
+type ChecksumFilesystem struct {
+	Filesystem
+	meta *MetadataFilesystem
+
+	// VerifyOnRead makes GetBlob check the size of a blob against its
+	// metadata and verify the checksum while the blob is read.
+	VerifyOnRead bool
+}
+
+// NewChecksumFilesystem returns a ChecksumFilesystem which stores the
+// checksums in the metadata of base.
+func NewChecksumFilesystem(base *MetadataFilesystem) *ChecksumFilesystem {
+	return &ChecksumFilesystem{Filesystem: base, meta: base}
+}
+
+// SaveBlob saves the blob and then its checksum. The checksum is only stored
+// if the base read exactly the data of the blob, e.g. not if it skipped an
+// existing blob without reading the upload.
+func (c *ChecksumFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	cr := &crcReader{rd: rd, crc: crc32.New(castagnoli)}
+	n, err := c.Filesystem.SaveBlob(ctx, path, cr, expectedSize)
+	if err != nil || cr.n != n {
+		return n, err
+	}
+	return n, c.meta.SetBlobMeta(ctx, path, map[string]string{
+		checksumKey:     fmt.Sprintf("%08x", cr.crc.Sum32()),
+		checksumSizeKey: strconv.FormatInt(n, 10),
+	})
+}
+
+// GetBlob returns a reader for the blob. If VerifyOnRead is set and the blob
+// has a checksum, ErrCorrupt is returned right away if the blob does not have
+// the size it was saved with, and the reader fails with ErrCorrupt instead of
+// returning the last part of the blob if the checksum of the data does not
+// match, the same way as the reader of VerifyHashFilesystem.
+func (c *ChecksumFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := c.Filesystem.GetBlob(ctx, path)
+	if err != nil || !c.VerifyOnRead {
+		return rd, err
+	}
+	meta, err := c.meta.GetBlobMeta(ctx, path)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	want, err := strconv.ParseUint(meta[checksumKey], 16, 32)
+	if err != nil {
+		// no checksum stored
+		return rd, nil
+	}
+	wantSize, err := strconv.ParseInt(meta[checksumSizeKey], 10, 64)
+	if err != nil {
+		return rd, nil
+	}
+
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	if size != wantSize {
+		_ = rd.Close()
+		log.Printf("ERROR: blob %v is corrupt, it has %d bytes instead of %d", path, size, wantSize)
+		return nil, fmt.Errorf("%v: %d bytes instead of %d: %w", path, size, wantSize, ErrCorrupt)
+	}
+	return &crcVerifyingReader{ReadSeekCloser: rd, path: path, crc: crc32.New(castagnoli), want: uint32(want), size: size, verify: true}, nil
+}
+
+// crcReader computes the checksum of the data read from rd.
+type crcReader struct {
+	rd  io.Reader
+	crc hash.Hash32
+	n   int64
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	_, _ = r.crc.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// crcVerifyingReader computes the checksum of the data read from the start
+// of the blob, and fails with ErrCorrupt instead of returning the last chunk
+// of data if it does not match want.
+type crcVerifyingReader struct {
+	io.ReadSeekCloser
+	path   string
+	crc    hash.Hash32
+	want   uint32
+	size   int64
+	pos    int64
+	verify bool // whether all data up to pos has been checksummed
+}
+
+func (r *crcVerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	r.pos += int64(n)
+	if !r.verify {
+		return n, err
+	}
+	_, _ = r.crc.Write(p[:n])
+	if r.pos < r.size {
+		return n, err
+	}
+
+	r.verify = false
+	if sum := r.crc.Sum32(); r.pos > r.size || sum != r.want {
+		log.Printf("ERROR: blob %v is corrupt, its CRC-32C is %08x instead of %08x", r.path, sum, r.want)
+		return 0, fmt.Errorf("%v: %w", r.path, ErrCorrupt)
+	}
+	return n, err
+}
+
+func (r *crcVerifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos == 0 {
+		// reading from the start again
+		r.crc.Reset()
+		r.verify = true
+	} else if pos != r.pos {
+		r.verify = false
+	}
+	r.pos = pos
+	return pos, nil
+}
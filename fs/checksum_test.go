@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumFilesystem(t *testing.T) {
+	ctx := context.Background()
+	disk := &DiskFilesystem{}
+	c := NewChecksumFilesystem(NewMetadataFilesystem(disk))
+	c.VerifyOnRead = true
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := c.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := c.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := c.meta.GetBlobMeta(ctx, blob); err != nil || meta[checksumKey] != "0d5f5c7f" || meta[checksumSizeKey] != "6" {
+		t.Fatalf("want the checksum of foobar, got %v, %v", meta, err)
+	}
+
+	read := func() (string, error) {
+		rd, err := c.GetBlob(ctx, blob)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			_ = rd.Close()
+		}()
+		buf, err := ioutil.ReadAll(rd)
+		return string(buf), err
+	}
+	if data, err := read(); err != nil || data != "foobar" {
+		t.Fatalf("want foobar, got %q, %v", data, err)
+	}
+
+	// a corrupted blob fails at the end, a truncated one right away
+	file := filepath.Join(repo, "data", testID[:2], testID)
+	if err := ioutil.WriteFile(file, []byte("foobaz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt for a corrupted blob, got %v", err)
+	}
+	if err := os.Truncate(file, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBlob(ctx, blob); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt for a truncated blob, got %v", err)
+	}
+
+	// range reads are not verified
+	if _, err := c.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("foobaz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := c.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "baz" {
+		t.Fatalf("want baz, got %q, %v", buf, err)
+	}
+	_ = rd.Close()
+
+	// blobs without a checksum are read as they are
+	other := filepath.Join(repo, "keys", testID)
+	if _, err := disk.SaveBlob(ctx, other, strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if rd, err := c.GetBlob(ctx, other); err != nil {
+		t.Fatal(err)
+	} else if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "key" {
+		t.Fatalf("want key, got %q, %v", buf, err)
+	} else {
+		_ = rd.Close()
+	}
+}
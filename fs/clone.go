@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CloneRepo copies the repository at src to dst, which must not exist yet.
+// Files are cloned using reflinks if the filesystem supports them, see
+// Capabilities, which is almost instant and uses no additional space until
+// the files diverge. If reflinking a file fails nonetheless, e.g. because src
+// is on another filesystem, the remaining files are copied. On failure the
+// partial copy is removed.
+func (d *DiskFilesystem) CloneRepo(ctx context.Context, src, dst string) error {
+	return d.cloneTree(ctx, src, dst, false)
+}
+
+// SnapshotTree copies the directory of objectType in the repository at path
+// to dst, which must not exist yet, e.g. to keep the index and snapshots so
+// that a failed prune can be undone. Files are cloned using reflinks like by
+// CloneRepo. Where reflinks are not supported they are hard linked instead of
+// copied, which is safe since blobs are never modified, only replaced or
+// removed. Only files on another filesystem than dst are copied. On failure
+// the partial copy is removed.
+func (d *DiskFilesystem) SnapshotTree(ctx context.Context, path, objectType, dst string) error {
+	if err := d.checkObjectType(objectType); err != nil {
+		return err
+	}
+	return d.cloneTree(ctx, filepath.Join(path, objectType), dst, true)
+}
+
+// cloneTree copies the directory src to dst, which must not exist yet. The
+// files are reflinked if possible, otherwise hard linked if link is set and
+// copied as the last resort. On failure the partial copy is removed.
+func (d *DiskFilesystem) cloneTree(ctx context.Context, src, dst string, link bool) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if err := d.mkdir(dst); err != nil {
+		return err
+	}
+
+	// a failed probe only means that reflinks are not tried
+	caps, _ := d.Capabilities(filepath.Dir(dst))
+	c := &cloner{d: d, tryReflink: caps.Reflink, tryLink: link}
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, e os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case e.IsDir():
+			dirs = append(dirs, target)
+			if rel == "." {
+				return nil
+			}
+			return d.mkdir(target)
+		case e.Type().IsRegular():
+			return c.cloneFile(path, target)
+		default:
+			// repositories only contain directories and regular files
+			return nil
+		}
+	})
+	if err == nil {
+		for _, dir := range dirs {
+			if err = d.syncDir(dir); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+// CopyBlob copies the blob at src to dst, e.g. to another repository, and
+// returns its size. The copy is saved like an uploaded blob by SaveBlob, it
+// is written to a temporary file which is synced and renamed. On Linux the
+// data is copied by the kernel using copy_file_range, which creates a reflink
+// on filesystems supporting it. ErrNotFound is returned if src does not
+// exist.
+func (d *DiskFilesystem) CopyBlob(ctx context.Context, src, dst string) (int64, error) {
+	var size int64
+	err := d.withBlob(src, func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size, err = d.SaveBlob(ctx, dst, f, fi.Size())
+		return err
+	})
+	return size, err
+}
+
+// cloner clones the files of a tree. Once reflinking or linking a file
+// has failed, it is not tried again for the following files.
+type cloner struct {
+	d          *DiskFilesystem
+	tryReflink bool
+	tryLink    bool
+}
+
+// cloneFile reflinks, links or copies the file src to dst.
+func (c *cloner) cloneFile(src, dst string) error {
+	d := c.d
+	if c.tryReflink {
+		if err := reflink(src, dst, d.fileMode()); err == nil {
+			if d.IgnoreUmask {
+				if err := os.Chmod(dst, d.fileMode()); err != nil {
+					return err
+				}
+			}
+			return d.syncPath(dst)
+		}
+		c.tryReflink = false
+	}
+	if c.tryLink {
+		// the link shares the data and the mode of src, only the directory
+		// needs to be synced
+		if err := d.fsys().Link(src, dst); err == nil {
+			return nil
+		}
+		c.tryLink = false
+	}
+	return d.copyFile(src, dst)
+}
+
+// copyFile copies the file src to dst.
+func (d *DiskFilesystem) copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.fileMode())
+	if err != nil {
+		return err
+	}
+	err = d.chmodFile(out)
+	if err == nil {
+		// io.Copy uses copy_file_range on Linux, which also creates
+		// reflinks on some filesystems
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		_, err = d.syncFile(out)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncPath syncs the file at path unless the SyncMode is SyncNone.
+func (d *DiskFilesystem) syncPath(path string) error {
+	if d.SyncMode == SyncNone {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	_, err = d.syncFile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,20 @@
+package fs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflink creates dst as a clone of src using clonefile, which is supported
+// by APFS.
+func reflink(src, dst string, perm os.FileMode) error {
+	if err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, perm); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return nil
+}
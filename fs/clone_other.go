@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package fs
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is not supported on this platform.
+func reflink(src, dst string, perm os.FileMode) error {
+	return errors.New("reflinks are not supported")
+}
@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskFilesystemCloneRepo(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	base := t.TempDir()
+	src, dst := filepath.Join(base, "repo"), filepath.Join(base, "clone")
+	if err := f.CreateRepo(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(src, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(src, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.CloneRepo(ctx, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := f.GetConfig(ctx, filepath.Join(dst, "config")); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: want %q, got %q, %v", "config", buf, err)
+	}
+	cloned := filepath.Join(dst, "data", testID[:2], testID)
+	rd, err := f.GetBlob(ctx, cloned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "data", "ff")); err != nil {
+		t.Fatalf("empty subdirs not cloned: %v", err)
+	}
+
+	// the clone is independent of the original
+	if _, err := f.DeleteBlob(ctx, cloned, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); err != nil {
+		t.Fatalf("blob removed from the original: %v", err)
+	}
+
+	if err := f.CloneRepo(ctx, src, dst); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want exist error for an existing destination, got %v", err)
+	}
+	if err := f.CloneRepo(ctx, filepath.Join(base, "missing"), filepath.Join(base, "other")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error for a missing source, got %v", err)
+	}
+}
+
+func TestDiskFilesystemCopyBlob(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	base := t.TempDir()
+	src, dst := filepath.Join(base, "repo"), filepath.Join(base, "copy")
+	for _, repo := range []string{src, dst} {
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob := filepath.Join(src, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	copied := filepath.Join(dst, "data", testID[:2], testID)
+	if n, err := f.CopyBlob(ctx, blob, copied); err != nil || n != 6 {
+		t.Fatalf("CopyBlob: want 6 bytes, got %v, %v", n, err)
+	}
+	rd, err := f.GetBlob(ctx, copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+	}
+	entries, err := os.ReadDir(filepath.Dir(copied))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("want only the copied blob, got %v, %v", entries, err)
+	}
+
+	missing := filepath.Join(src, "data", "00", strings.Repeat("0", 64))
+	if _, err := f.CopyBlob(ctx, missing, copied); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for a missing source, got %v", err)
+	}
+}
+
+func TestDiskFilesystemSnapshotTree(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	base := t.TempDir()
+	repo := filepath.Join(base, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(repo, "index", testID)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	for _, path := range []string{index, blob} {
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		objectType, blob string
+	}{
+		{"index", index},
+		{"data", blob},
+	} {
+		dst := filepath.Join(base, "snapshot-"+test.objectType)
+		if err := f.SnapshotTree(ctx, repo, test.objectType, dst); err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(filepath.Join(repo, test.objectType), test.blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// neither replacing nor removing the original affects the snapshot
+		if _, err := f.SaveBlob(ctx, test.blob, strings.NewReader("bazbaz"), 6); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.DeleteBlob(ctx, test.blob, false); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := os.ReadFile(filepath.Join(dst, rel)); err != nil || string(buf) != "foobar" {
+			t.Fatalf("%v: want %q in the snapshot, got %q, %v", test.objectType, "foobar", buf, err)
+		}
+	}
+
+	if err := f.SnapshotTree(ctx, repo, "index", filepath.Join(base, "snapshot-index")); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("want exist error for an existing destination, got %v", err)
+	}
+	if err := f.SnapshotTree(ctx, repo, "config", filepath.Join(base, "other")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("want ErrInvalidName for an invalid object type, got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressedMagic      = "rszstd\x00\x01"
+	compressedHeaderSize = len(compressedMagic) + 8 // magic, decompressed size
+)
+
+// CompressedFilesystem wraps a Filesystem and compresses blobs with zstd.
+// Compressed blobs start with a header containing a magic value and the
+// decompressed size, blobs without the header are returned unchanged, so that
+// existing repositories can be migrated gradually. Blobs uploaded without a
+// known size are stored uncompressed. The config is never compressed.
+//
+// The sizes reported by CheckBlob and the listings are the decompressed sizes
+// restic expects, which requires reading the header of each blob. StoredSize
+// and RepoStats report the space used on the storage.
+//
+// Seeking within a compressed blob is supported, but requires decompressing
+// the data up to the new offset. As data saved by restic is encrypted, it
+// usually compresses badly; the wrapper is mainly useful for repositories
+// containing other, compressible data.
+type CompressedFilesystem struct {
+	Filesystem
+}
+
+// NewCompressedFilesystem returns a CompressedFilesystem for base.
+func NewCompressedFilesystem(base Filesystem) *CompressedFilesystem {
+	return &CompressedFilesystem{Filesystem: base}
+}
+
+// readCompressedHeader reads the header of a blob from rd. ok is false if
+// the blob is not compressed.
+func readCompressedHeader(rd io.Reader) (size int64, ok bool, err error) {
+	var hdr [compressedHeaderSize]byte
+	_, err = io.ReadFull(rd, hdr[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// too short for a header
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if string(hdr[:len(compressedMagic)]) != compressedMagic {
+		return 0, false, nil
+	}
+	return int64(binary.BigEndian.Uint64(hdr[len(compressedMagic):])), true, nil
+}
+
+// size returns the decompressed size of the blob at path, which uses stored
+// bytes on the storage.
+func (c *CompressedFilesystem) size(ctx context.Context, path string, stored int64) (int64, error) {
+	if stored < int64(compressedHeaderSize) {
+		return stored, nil
+	}
+	rd, err := c.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+
+	size, ok, err := readCompressedHeader(rd)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return stored, nil
+	}
+	return size, nil
+}
+
+// ListBlobs lists the blobs with their decompressed sizes.
+func (c *CompressedFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs := []Blob{}
+	err := c.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// ListBlobsFunc calls fn for the blobs with their decompressed sizes.
+func (c *CompressedFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	return c.Filesystem.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		size, err := c.size(ctx, blobPath(path, blob.Name), blob.Size)
+		if err != nil {
+			return err
+		}
+		blob.Size = size
+		return fn(blob)
+	})
+}
+
+// Walk calls fn for the blobs with their decompressed sizes.
+func (c *CompressedFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, c, path, fn)
+}
+
+// CheckBlob returns the blob with its decompressed size.
+func (c *CompressedFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	blob, err := c.Filesystem.CheckBlob(ctx, path)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob.Size, err = c.size(ctx, path, blob.Size)
+	if err != nil {
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+// StoredSize returns the size of the blob on the storage.
+func (c *CompressedFilesystem) StoredSize(ctx context.Context, path string) (int64, error) {
+	blob, err := c.Filesystem.CheckBlob(ctx, path)
+	return blob.Size, err
+}
+
+// GetBlob returns a reader for the blob, which decompresses it if necessary.
+func (c *CompressedFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := c.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	size, ok, err := readCompressedHeader(rd)
+	if err == nil && !ok {
+		_, err = rd.Seek(0, io.SeekStart)
+		if err == nil {
+			return rd, nil
+		}
+	}
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	return &decompressingReader{rd: rd, size: size}, nil
+}
+
+// SaveBlob compresses and saves the blob. The number of bytes read from rd
+// is returned.
+func (c *CompressedFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	if expectedSize < 0 {
+		// the header needs the size
+		return c.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	}
+
+	cr := &countingReader{rd: rd}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = pw.CloseWithError(compress(pw, cr, expectedSize))
+	}()
+
+	_, err := c.Filesystem.SaveBlob(ctx, path, pr, -1)
+	// stop the compression if the blob has not been read completely
+	_ = pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return cr.n, err
+}
+
+// compress writes the header and the compressed data read from rd to w. An
+// error is returned if rd does not contain exactly size bytes, so that the
+// header is correct.
+func compress(w io.Writer, rd *countingReader, size int64) error {
+	var hdr [compressedHeaderSize]byte
+	copy(hdr[:], compressedMagic)
+	binary.BigEndian.PutUint64(hdr[len(compressedMagic):], uint64(size))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(enc, rd); err != nil {
+		_ = enc.Close()
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if rd.n != size {
+		return fmt.Errorf("blob has %d bytes, expected %d: %w", rd.n, size, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// DeleteBlob removes the blob, returning its decompressed size.
+func (c *CompressedFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	if needSize {
+		blob, _ := c.CheckBlob(ctx, path)
+		size = blob.Size
+	}
+	if _, err := c.Filesystem.DeleteBlob(ctx, path, false); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// DeleteBlobs removes the blobs, returning their decompressed sizes.
+func (c *CompressedFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	var sizes []int64
+	if needSize {
+		sizes = make([]int64, len(paths))
+		for i, path := range paths {
+			blob, _ := c.CheckBlob(ctx, path)
+			sizes[i] = blob.Size
+		}
+	}
+	stored, err := c.Filesystem.DeleteBlobs(ctx, paths, false)
+	if sizes == nil {
+		return stored, err
+	}
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		for i := range sizes {
+			if batchErr.Errors[i] != nil {
+				sizes[i] = 0
+			}
+		}
+	}
+	return sizes, err
+}
+
+// decompressingReader decompresses a blob. Seeking only changes the position,
+// which is reached by decompressing from the start or the current position on
+// the next read.
+type decompressingReader struct {
+	rd      io.ReadSeekCloser
+	dec     *zstd.Decoder
+	size    int64 // decompressed size
+	pos     int64 // position requested by Seek
+	decoded int64 // position of dec
+}
+
+// reset starts decompressing at the beginning of the blob.
+func (r *decompressingReader) reset() error {
+	if _, err := r.rd.Seek(int64(compressedHeaderSize), io.SeekStart); err != nil {
+		return err
+	}
+	r.decoded = 0
+	if r.dec == nil {
+		dec, err := zstd.NewReader(r.rd, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		r.dec = dec
+		return nil
+	}
+	return r.dec.Reset(r.rd)
+}
+
+func (r *decompressingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.dec == nil || r.pos < r.decoded {
+		if err := r.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if r.pos > r.decoded {
+		n, err := io.CopyN(io.Discard, r.dec, r.pos-r.decoded)
+		r.decoded += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > r.size-r.pos {
+		p = p[:r.size-r.pos]
+	}
+	n, err := r.dec.Read(p)
+	r.pos += int64(n)
+	r.decoded += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decompressingReader) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.rd.Close()
+}
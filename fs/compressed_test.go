@@ -0,0 +1,93 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	f := NewCompressedFilesystem(base)
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("compressible data "), 10000)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if n, err := f.SaveBlob(ctx, blob, bytes.NewReader(data), int64(len(data))); err != nil || n != int64(len(data)) {
+		t.Fatalf("SaveBlob: got %v, %v", n, err)
+	}
+
+	stored, err := f.StoredSize(ctx, blob)
+	if err != nil || stored >= int64(len(data))/10 {
+		t.Fatalf("blob must be stored compressed, got size %v, %v", stored, err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != int64(len(data)) {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 1 || blobs[0].Size != int64(len(data)) {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := rd.Seek(0, io.SeekEnd); err != nil || size != int64(len(data)) {
+		t.Fatalf("Seek: got %v, %v", size, err)
+	}
+	for _, offset := range []int64{1000, 50000, 10} {
+		if _, err := rd.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 100)
+		if _, err := io.ReadFull(rd, buf); err != nil || !bytes.Equal(buf, data[offset:offset+100]) {
+			t.Fatalf("reading at offset %d failed: %v", offset, err)
+		}
+	}
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("reading blob failed: %v", err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// uncompressed blobs are returned unchanged
+	plain := filepath.Join(repo, "keys", "key")
+	if _, err := base.SaveBlob(ctx, plain, strings.NewReader("uncompressed key data"), -1); err != nil {
+		t.Fatal(err)
+	}
+	rd, err = f.GetBlob(ctx, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "uncompressed key data" {
+		t.Fatalf("reading uncompressed blob: got %q, %v", buf, err)
+	}
+	_ = rd.Close()
+
+	// a wrong size must not be saved
+	other := filepath.Join(repo, "snapshots", "snapshot")
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("short"), 10); err == nil {
+		t.Fatal("SaveBlob with wrong size must fail")
+	}
+	if _, err := base.CheckBlob(ctx, other); err == nil {
+		t.Fatal("blob with wrong size must not be saved")
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != int64(len(data)) {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+}
@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// ErrConfigCorrupt is returned by ValidateConfig if the config of a
+// repository cannot be a valid restic config, e.g. because it has been
+// truncated.
+var ErrConfigCorrupt = newError("config_corrupt", "config is corrupt")
+
+// ErrConfigEncrypted is returned by ReadRepoConfig for a config encrypted by
+// restic, which cannot be read without the key of the repository.
+var ErrConfigEncrypted = newError("config_encrypted", "config is encrypted")
+
+// LatestRepoVersion is the latest version of the restic repository format
+// known to the server. Version 2 added compression, the layout of the
+// repository is the same for both versions.
+const LatestRepoVersion = 2
+
+// RepoConfig is the content of a restic config.
+type RepoConfig struct {
+	Version           uint   `json:"version"`
+	ID                string `json:"id"`
+	ChunkerPolynomial string `json:"chunker_polynomial"`
+
+	// Unknown lists the top-level fields of the config which are not
+	// fields of RepoConfig, in sorted order, e.g. those added by a
+	// repository version later than LatestRepoVersion.
+	Unknown []string `json:"-"`
+}
+
+// KnownVersion reports whether the server knows the repository version of
+// the config. The fields of later versions are read as far as possible, but
+// features depending on the format, e.g. compression, should not assume
+// anything about such repositories.
+func (c RepoConfig) KnownVersion() bool {
+	return c.Version >= 1 && c.Version <= LatestRepoVersion
+}
+
+// minEncryptedConfig is the size of the shortest encrypted config: the IV and
+// the MAC of restic's encryption around the shortest config with a version
+// and an id.
+const minEncryptedConfig = 16 + len(`{"version":1,"id":"0"}`) + 16
+
+// ValidateConfig reads the config at path from f and checks that it looks
+// like a valid restic config, so that a corrupt config is reported by the
+// server instead of by a confusing error of restic. It returns
+// ErrConfigCorrupt otherwise, and ErrNotFound if there is no config.
+//
+// Restic encrypts the config, so without the key of the repository only its
+// size can be checked, it must be at least minEncryptedConfig bytes. A config
+// which is plain JSON text instead, as written by some tools and tests, must
+// be a single JSON object with a positive integer version and a non-empty
+// string id. Other fields are ignored, so that configs of later repository
+// versions are accepted.
+func ValidateConfig(ctx context.Context, f Filesystem, path string) error {
+	buf, err := f.GetConfig(ctx, path)
+	if err != nil {
+		return err
+	}
+	if !isJSONText(buf) {
+		if len(buf) < minEncryptedConfig {
+			return fmt.Errorf("%v: %d bytes are too short for an encrypted config: %w", path, len(buf), ErrConfigCorrupt)
+		}
+		return nil
+	}
+
+	_, err = parseConfig(path, buf)
+	return err
+}
+
+// ReadRepoConfig reads the config at path from f and returns its content. The
+// config must pass ValidateConfig, and ErrConfigEncrypted is returned for a
+// config encrypted by restic, which is how restic always stores it. Only
+// configs stored as plain JSON text, e.g. by tools which create repositories
+// on the server, can be read. A later repository version is not an error,
+// see RepoConfig.KnownVersion.
+func ReadRepoConfig(ctx context.Context, f Filesystem, path string) (RepoConfig, error) {
+	buf, err := f.GetConfig(ctx, path)
+	if err != nil {
+		return RepoConfig{}, err
+	}
+	if !isJSONText(buf) {
+		if len(buf) < minEncryptedConfig {
+			return RepoConfig{}, fmt.Errorf("%v: %d bytes are too short for an encrypted config: %w", path, len(buf), ErrConfigCorrupt)
+		}
+		return RepoConfig{}, fmt.Errorf("%v: %w", path, ErrConfigEncrypted)
+	}
+	return parseConfig(path, buf)
+}
+
+// parseConfig parses a config stored as plain JSON text. The version and the
+// id are required. Another field which cannot be parsed makes the config
+// corrupt for a known version, for a later version it is listed as unknown.
+func parseConfig(path string, buf []byte) (RepoConfig, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return RepoConfig{}, fmt.Errorf("%v: %v: %w", path, err, ErrConfigCorrupt)
+	}
+	var cfg RepoConfig
+	if err := json.Unmarshal(fields["version"], &cfg.Version); err != nil || cfg.Version == 0 {
+		return RepoConfig{}, fmt.Errorf("%v: no version: %w", path, ErrConfigCorrupt)
+	}
+	if err := json.Unmarshal(fields["id"], &cfg.ID); err != nil || cfg.ID == "" {
+		return RepoConfig{}, fmt.Errorf("%v: no id: %w", path, ErrConfigCorrupt)
+	}
+	for name, value := range fields {
+		var err error
+		switch name {
+		case "version", "id":
+		case "chunker_polynomial":
+			err = json.Unmarshal(value, &cfg.ChunkerPolynomial)
+		default:
+			cfg.Unknown = append(cfg.Unknown, name)
+		}
+		if err != nil && cfg.KnownVersion() {
+			return RepoConfig{}, fmt.Errorf("%v: %v: %v: %w", path, name, err, ErrConfigCorrupt)
+		} else if err != nil {
+			cfg.Unknown = append(cfg.Unknown, name)
+		}
+	}
+	sort.Strings(cfg.Unknown)
+	return cfg, nil
+}
+
+// isJSONText reports whether buf is text starting like a JSON object. An
+// encrypted config is indistinguishable from random data, which is never
+// valid UTF-8 without control characters.
+func isJSONText(buf []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimLeft(buf, " \t\r\n"), []byte("{")) || !utf8.Valid(buf) {
+		return false
+	}
+	for _, c := range buf {
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	ctx := context.Background()
+	f := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(repo, "config")
+	if err := ValidateConfig(ctx, f, path); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for a missing config, got %v", err)
+	}
+
+	encrypted := make([]byte, 200)
+	for i := range encrypted {
+		encrypted[i] = byte(i*7 + 1)
+	}
+	encrypted[0] = '{'
+
+	for _, test := range []struct {
+		name   string
+		config []byte
+		valid  bool
+	}{
+		{"encrypted", encrypted, true},
+		{"truncated encrypted", encrypted[:20], false},
+		{"empty", nil, false},
+		{"json", []byte(`{"version":2,"id":"5956a3f67a","chunker_polynomial":"25b468838dcb75"}`), true},
+		{"future fields", []byte("{\n  \"version\": 3,\n  \"id\": \"5956a3f67a\",\n  \"new\": {\"a\": [1, 2]}\n}\n"), true},
+		{"truncated json", []byte(`{"version":2,"id":"5956a3f67a","chunker_pol`), false},
+		{"trailing data", []byte(`{"version":2,"id":"5956a3f67a"} {}`), false},
+		{"no version", []byte(`{"id":"5956a3f67a"}`), false},
+		{"zero version", []byte(`{"version":0,"id":"5956a3f67a"}`), false},
+		{"string version", []byte(`{"version":"2","id":"5956a3f67a"}`), false},
+		{"no id", []byte(`{"version":2}`), false},
+		{"empty id", []byte(`{"version":2,"id":""}`), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := f.DeleteConfig(ctx, path); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Fatal(err)
+			}
+			if err := f.SaveConfig(ctx, path, bytes.NewReader(test.config)); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidateConfig(ctx, f, path)
+			if test.valid && err != nil {
+				t.Fatalf("want a valid config, got %v", err)
+			}
+			if !test.valid && !errors.Is(err, ErrConfigCorrupt) {
+				t.Fatalf("want ErrConfigCorrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadRepoConfig(t *testing.T) {
+	ctx := context.Background()
+	f := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(repo, "config")
+
+	for _, test := range []struct {
+		name   string
+		config string
+		want   RepoConfig
+		known  bool
+		err    error
+	}{
+		{
+			name:   "v2",
+			config: `{"version":2,"id":"5956a3f67a","chunker_polynomial":"25b468838dcb75"}`,
+			want:   RepoConfig{Version: 2, ID: "5956a3f67a", ChunkerPolynomial: "25b468838dcb75"},
+			known:  true,
+		},
+		{
+			name:   "future version",
+			config: `{"version":3,"id":"5956a3f67a","chunker_polynomial":{"degree":53},"hash":"blake3"}`,
+			want:   RepoConfig{Version: 3, ID: "5956a3f67a", Unknown: []string{"chunker_polynomial", "hash"}},
+		},
+		{name: "bad field of a known version", config: `{"version":1,"id":"5956a3f67a","chunker_polynomial":53}`, err: ErrConfigCorrupt},
+		{name: "no id", config: `{"version":2}`, err: ErrConfigCorrupt},
+		{name: "encrypted", config: strings.Repeat("\x00\xff", 50), err: ErrConfigEncrypted},
+		{name: "truncated encrypted", config: "\x00\xff", err: ErrConfigCorrupt},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := f.DeleteConfig(ctx, path); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Fatal(err)
+			}
+			if err := f.SaveConfig(ctx, path, strings.NewReader(test.config)); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadRepoConfig(ctx, f, path)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("want %v, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, test.want) || cfg.KnownVersion() != test.known {
+				t.Fatalf("want %+v, got %+v (known version %v)", test.want, cfg, cfg.KnownVersion())
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// linker is implemented by Filesystems which can create hard links, like
+// DiskFilesystem.
+type linker interface {
+	Link(ctx context.Context, oldpath, newpath string) error
+}
+
+// DedupFilesystem wraps a Filesystem and stores identical data blobs only
+// once, also across repositories. Blob names are the hashes of their content,
+// so when a data blob is saved for which a blob with the same name is already
+// known, a hard link to the existing blob is created instead of a new copy.
+// Removing a blob then only frees the space once the last link is removed.
+//
+// The index of known blobs is kept in memory and filled as blobs are saved.
+// If the underlying Filesystem cannot create hard links or linking fails, for
+// example because the repositories are on different filesystems, the blob is
+// saved normally.
+//
+// Linking trusts that existing blobs match their name, so uploads must be
+// verified, which is the default.
+type DedupFilesystem struct {
+	Filesystem
+
+	mu    sync.Mutex
+	index map[string]string // blob name -> path of a stored copy
+}
+
+// NewDedupFilesystem returns a DedupFilesystem for base.
+func NewDedupFilesystem(base Filesystem) *DedupFilesystem {
+	return &DedupFilesystem{
+		Filesystem: base,
+		index:      make(map[string]string),
+	}
+}
+
+func (d *DedupFilesystem) lookup(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	path, ok := d.index[name]
+	return path, ok
+}
+
+func (d *DedupFilesystem) remember(name, path string) {
+	d.mu.Lock()
+	d.index[name] = path
+	d.mu.Unlock()
+}
+
+// forget removes the index entry for name if it refers to path.
+func (d *DedupFilesystem) forget(name, path string) {
+	d.mu.Lock()
+	if d.index[name] == path {
+		delete(d.index, name)
+	}
+	d.mu.Unlock()
+}
+
+// SaveBlob links the blob to an existing copy if possible, and saves it
+// otherwise. The data is read completely in both cases, so that it is
+// verified by wrapping Filesystems.
+func (d *DedupFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	_, objectType, name := SplitBlobPath(path)
+	l, ok := d.Filesystem.(linker)
+	if !ok || objectType != "data" {
+		return d.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	}
+
+	if existing, ok := d.lookup(name); ok && existing != path {
+		err := l.Link(ctx, existing, path)
+		if err == nil {
+			return d.drain(ctx, path, rd)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// the existing copy has been removed in the meantime
+			d.forget(name, existing)
+		}
+	}
+
+	n, err := d.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	if err == nil {
+		d.remember(name, path)
+	}
+	return n, err
+}
+
+// drain reads the data of a blob which has been linked to path, the link is
+// removed if reading fails or the size does not match.
+func (d *DedupFilesystem) drain(ctx context.Context, path string, rd io.Reader) (int64, error) {
+	n, err := io.Copy(io.Discard, contextReader{ctx, rd})
+	if err == nil {
+		var blob Blob
+		blob, err = d.Filesystem.CheckBlob(ctx, path)
+		if err == nil && blob.Size != n {
+			err = fmt.Errorf("linked blob %v has size %d, but %d bytes were uploaded", path, blob.Size, n)
+		}
+	}
+	if err != nil {
+		_, _ = d.Filesystem.DeleteBlob(ctx, path, false)
+		return n, err
+	}
+	return n, nil
+}
+
+// DeleteBlob removes the blob and its index entry.
+func (d *DedupFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	_, _, name := SplitBlobPath(path)
+	d.forget(name, path)
+	return d.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs and their index entries.
+func (d *DedupFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	for _, path := range paths {
+		_, _, name := SplitBlobPath(path)
+		d.forget(name, path)
+	}
+	return d.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
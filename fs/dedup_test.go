@@ -0,0 +1,63 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	f := NewDedupFilesystem(&DiskFilesystem{})
+
+	var blobs []string
+	for _, repo := range []string{"repo1", "repo2"} {
+		repo = filepath.Join(base, repo)
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(repo, "data", testID[:2], testID)
+		if n, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil || n != 6 {
+			t.Fatalf("SaveBlob: want 6 bytes, got %v, %v", n, err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	fi1, err := os.Stat(blobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(blobs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Fatal("identical blobs have not been linked")
+	}
+
+	// a failed upload must not leave the link behind
+	blob := filepath.Join(base, "repo3", "data", testID[:2], testID)
+	errRead := errors.New("read failed")
+	if _, err := f.SaveBlob(ctx, blob, readerFunc(func(p []byte) (int, error) { return 0, errRead }), 6); !errors.Is(err, errRead) {
+		t.Fatalf("want errRead, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("link must be removed after failed upload, got %v", err)
+	}
+
+	// the remaining link must still be usable after the first copy is removed
+	if _, err := f.DeleteBlob(ctx, blobs[0], false); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := f.GetBlob(ctx, blobs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("want %q, got %q", "foobar", buf)
+	}
+}
@@ -0,0 +1,81 @@
+package fs
+
+import "sync"
+
+// dirSyncer coalesces the syncs of directories after concurrent renames into
+// the same directory. At most one sync per directory is in progress. Callers
+// arriving while it is running may have renamed their file after it started,
+// so they all wait for the next sync, which is started once the running one
+// has finished. With many concurrent uploads into the same directory each
+// sync thus covers the renames of all uploads which finished during the
+// previous one. The zero value is ready to use.
+type dirSyncer struct {
+	mu   sync.Mutex
+	dirs map[string]*dirSync
+}
+
+// dirSync are the syncs of a single directory.
+type dirSync struct {
+	running *syncRound // in progress
+	next    *syncRound // started once running has finished
+}
+
+// syncRound is a single sync of a directory, done is closed once err is set.
+type syncRound struct {
+	done    chan struct{}
+	err     error
+	callers int // waiting for the sync
+}
+
+// sync syncs dir using fn and returns once a sync which started after the
+// call has finished, returning its error.
+func (s *dirSyncer) sync(dir string, fn func(dir string) error) error {
+	s.mu.Lock()
+	if s.dirs == nil {
+		s.dirs = make(map[string]*dirSync)
+	}
+	d := s.dirs[dir]
+	if d == nil {
+		d = &dirSync{}
+		s.dirs[dir] = d
+	}
+	if d.running == nil {
+		r := &syncRound{done: make(chan struct{})}
+		d.running = r
+		s.mu.Unlock()
+		return s.run(dir, d, r, fn)
+	}
+
+	r, leader := d.next, false
+	if r == nil {
+		r, leader = &syncRound{done: make(chan struct{})}, true
+		d.next = r
+	}
+	r.callers++
+	running := d.running
+	s.mu.Unlock()
+
+	if !leader {
+		<-r.done
+		return r.err
+	}
+	// the finished round has made r the running one
+	<-running.done
+	return s.run(dir, d, r, fn)
+}
+
+// run runs the sync r of dir and starts the next one, if any.
+func (s *dirSyncer) run(dir string, d *dirSync, r *syncRound, fn func(dir string) error) error {
+	r.err = fn(dir)
+
+	s.mu.Lock()
+	if d.next != nil {
+		d.running, d.next = d.next, nil
+	} else {
+		d.running = nil
+		delete(s.dirs, dir)
+	}
+	s.mu.Unlock()
+	close(r.done)
+	return r.err
+}
@@ -0,0 +1,65 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDirSyncer(t *testing.T) {
+	var s dirSyncer
+	var syncs int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	errSync := errors.New("sync failed")
+	fn := func(dir string) error {
+		if atomic.AddInt32(&syncs, 1) == 1 {
+			close(started)
+			<-release
+			return nil
+		}
+		return errSync
+	}
+
+	// the first sync blocks, all callers arriving meanwhile share the next
+	first := make(chan error)
+	go func() { first <- s.sync("dir", fn) }()
+	<-started
+
+	const callers = 16
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.sync("dir", fn)
+		}(i)
+	}
+	// wait until all callers are waiting for the next sync
+	for waiting := 0; waiting < callers; {
+		s.mu.Lock()
+		if next := s.dirs["dir"].next; next != nil {
+			waiting = next.callers
+		}
+		s.mu.Unlock()
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&syncs); n != 2 {
+		t.Fatalf("want the %d callers coalesced into one sync, got %d", callers, n-1)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, errSync) {
+			t.Fatalf("want the error of the shared sync, got %v", err)
+		}
+	}
+	if len(s.dirs) != 0 {
+		t.Fatalf("want no state left, got %v", s.dirs)
+	}
+}
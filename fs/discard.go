@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// DiscardFilesystem stores nothing, it is meant for measuring the throughput
+// of the HTTP layer without the storage being the bottleneck. Uploaded data is
+// read and discarded, reads return zeros and listings return a synthetic set
+// of blobs. It must never be used for real backups.
+type DiscardFilesystem struct {
+	// BlobSize is the size of all blobs and configs, reads return that many
+	// zero bytes.
+	BlobSize int64
+	// BlobCount is the number of blobs listed for each object type.
+	BlobCount int
+
+	written uint64 // atomic
+}
+
+var _ Filesystem = &DiscardFilesystem{}
+
+// NewDiscardFilesystem returns a DiscardFilesystem for blobs of blobSize bytes
+// which lists blobCount blobs for each object type. It logs a warning, as all
+// uploaded data is lost.
+func NewDiscardFilesystem(blobSize int64, blobCount int) *DiscardFilesystem {
+	log.Printf("WARNING: all uploaded data is DISCARDED, the storage must only be used for benchmarks and never for real backups")
+	return &DiscardFilesystem{BlobSize: blobSize, BlobCount: blobCount}
+}
+
+// Written returns the number of bytes uploaded and discarded so far.
+func (d *DiscardFilesystem) Written() uint64 {
+	return atomic.LoadUint64(&d.written)
+}
+
+// discard reads rd until EOF and counts the bytes.
+func (d *DiscardFilesystem) discard(ctx context.Context, rd io.Reader) (int64, error) {
+	n, err := io.Copy(io.Discard, contextReader{ctx, rd})
+	atomic.AddUint64(&d.written, uint64(n))
+	return n, err
+}
+
+// zeros returns a reader over BlobSize zero bytes.
+func (d *DiscardFilesystem) zeros() nopCloser {
+	return nopCloser{io.NewSectionReader(zeroReader{}, 0, d.BlobSize)}
+}
+
+// zeroReader reads zero bytes at any offset.
+type zeroReader struct{}
+
+func (zeroReader) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// CreateRepo does nothing, repositories always exist.
+func (d *DiscardFilesystem) CreateRepo(ctx context.Context, path string) error {
+	return ctx.Err()
+}
+
+// CheckConfig reports a config of BlobSize bytes.
+func (d *DiscardFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	return true, d.BlobSize, ctx.Err()
+}
+
+// GetConfig returns BlobSize zero bytes.
+func (d *DiscardFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	return make([]byte, d.BlobSize), ctx.Err()
+}
+
+// GetConfigReader returns a reader over BlobSize zero bytes.
+func (d *DiscardFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return d.zeros(), d.BlobSize, nil
+}
+
+// SaveConfig reads and discards the config.
+func (d *DiscardFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	_, err := d.discard(ctx, rd)
+	return err
+}
+
+// DeleteConfig does nothing.
+func (d *DiscardFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return ctx.Err()
+}
+
+// ListBlobs lists BlobCount synthetic blobs.
+func (d *DiscardFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs := make([]Blob, 0, d.BlobCount)
+	err := d.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// ListBlobsFunc calls fn for BlobCount synthetic blobs of BlobSize bytes,
+// which are named after their index and sorted lexically by name.
+func (d *DiscardFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	for i := 0; i < d.BlobCount; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(Blob{Name: fmt.Sprintf("%064x", i), Size: d.BlobSize}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckBlob reports a blob of BlobSize bytes.
+func (d *DiscardFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	return Blob{Name: filepath.Base(path), Size: d.BlobSize}, ctx.Err()
+}
+
+// GetBlob returns a reader over BlobSize zero bytes.
+func (d *DiscardFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.zeros(), nil
+}
+
+// SaveBlob reads and discards the blob and returns its size.
+func (d *DiscardFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	return d.discard(ctx, rd)
+}
+
+// DeleteBlob returns BlobSize as the size of the removed blob.
+func (d *DiscardFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	return d.BlobSize, ctx.Err()
+}
+
+// DeleteBlobs returns BlobSize as the size of all removed blobs.
+func (d *DiscardFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	return deleteEach(ctx, d, paths, needSize)
+}
+
+// RepoStats returns the statistics of the synthetic blobs.
+func (d *DiscardFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	return listRepoStats(ctx, d, path)
+}
+
+// Walk calls fn for the synthetic blobs of all object types.
+func (d *DiscardFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, d, path, fn)
+}
+
+// HealthCheck only checks that ctx has not been canceled.
+func (d *DiscardFilesystem) HealthCheck(ctx context.Context, path string) error {
+	return ctx.Err()
+}
+
+// Sync does nothing, there is no data to make durable.
+func (d *DiscardFilesystem) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close does nothing.
+func (d *DiscardFilesystem) Close() error {
+	return nil
+}
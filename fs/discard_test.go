@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiscardFilesystem(t *testing.T) {
+	ctx := context.Background()
+	f := NewDiscardFilesystem(100, 3)
+	repo := filepath.Join(t.TempDir(), "repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil || n != 6 {
+		t.Fatalf("SaveBlob: want 6 bytes, got %v, %v", n, err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.Written(); n != 12 {
+		t.Fatalf("want 12 bytes written, got %d", n)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(90, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); !bytes.Equal(buf, make([]byte, 10)) {
+		t.Fatalf("want 10 zero bytes, got %v", buf)
+	}
+
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 3 {
+		t.Fatalf("ListBlobs: want 3 blobs, got %v, %v", blobs, err)
+	}
+	for _, b := range blobs {
+		if err := ValidateName(b.Name); err != nil || b.Size != 100 {
+			t.Fatalf("invalid synthetic blob %v: %v", b, err)
+		}
+	}
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil || stats.Count != int64(3*len(ObjectTypes)) || stats.Size != 300*int64(len(ObjectTypes)) {
+		t.Fatalf("RepoStats: got %v, %v", stats, err)
+	}
+}
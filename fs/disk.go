@@ -0,0 +1,3140 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrBlobTooLarge is returned by DiskFilesystem.SaveBlob if the blob exceeds
+// MaxBlobSize.
+var ErrBlobTooLarge = newError("blob_too_large", "blob too large")
+
+// SyncMode selects how DiskFilesystem ensures that saved files are durable.
+// Keys and locks are always saved with SyncFull, see durableObjectTypes.
+type SyncMode int
+
+const (
+	// SyncFull syncs each saved file and its directory, so that both the
+	// data and the new file name survive a crash.
+	SyncFull SyncMode = iota
+	// SyncDataOnly syncs each saved file but not its directory.
+	SyncDataOnly
+	// SyncNone never syncs. Recently written blobs may be lost on power loss
+	// or a kernel crash, in exchange this roughly doubles the throughput for
+	// small blobs, which dominate index-heavy backups.
+	SyncNone
+	// SyncDeferred syncs saved blobs and their directories in the background
+	// after they have been renamed into place. Index and snapshot files, the
+	// config and Flush act as a barrier: they wait until all blobs saved
+	// before have been synced, so a snapshot never references packs which
+	// may be lost on a crash while the sync cost is spread over many blobs.
+	// Failed background syncs are reported by the next barrier.
+	//
+	// This relies on restic's write ordering: a pack is uploaded completely
+	// before an index referencing it is saved, and an index before the
+	// snapshot. An index file becomes visible only once all packs saved
+	// before it are durable, so after a crash every index and snapshot on
+	// disk references durable packs; only unreferenced packs may be lost.
+	// A client uploading an index before the packs it references gets no
+	// such guarantee.
+	SyncDeferred
+)
+
+// OverwritePolicy selects what DiskFilesystem.SaveBlob does if the blob
+// already exists.
+type OverwritePolicy int
+
+const (
+	// OverwriteReplace atomically replaces the existing blob with the
+	// upload, which lets clients retry failed uploads.
+	OverwriteReplace OverwritePolicy = iota
+	// OverwriteReject rejects the upload with ErrBlobExists without reading
+	// it. Blobs are named after their content, so a legitimate upload of an
+	// existing blob never changes it. Concurrent uploads of the same blob
+	// are detected as well, only the first one is stored.
+	OverwriteReject
+	// OverwriteSkipIfSame reads and discards the upload if the existing
+	// blob has the announced size, optionally after verifying its content,
+	// see DiskFilesystem.OverwriteVerify. Otherwise the blob is replaced.
+	OverwriteSkipIfSame
+)
+
+// DiskFilesystem stores repositories in directories on the local disk, using
+// the same layout as the restic local backend.
+type DiskFilesystem struct {
+	DirMode  os.FileMode // used for directory creation, DefaultDirMode if unset
+	FileMode os.FileMode // used for file creation, DefaultFileMode if unset
+	SyncMode SyncMode    // used for saving files, SyncFull if unset
+
+	// IgnoreUmask sets the modes of created files and directories to
+	// exactly FileMode and DirMode. Otherwise the process umask is applied
+	// to them, e.g. with the common umask 022 a FileMode of 0660 results in
+	// files which the group cannot write. New directories also keep the
+	// setgid bit of their parent directory, so that all files of a repository
+	// shared by a group belong to that group.
+	IgnoreUmask bool
+
+	// SubdirWidth is the number of hex characters in the names of the data
+	// subdirs created for new repositories, DefaultSubdirWidth if unset. For
+	// existing repositories the width is detected from the subdirs on disk.
+	SubdirWidth int
+
+	// Resolver selects the data subdirs of new repositories, a
+	// ShardedResolver with SubdirWidth and a single level if unset. The
+	// layout of existing repositories is detected from the subdirs on disk
+	// unless Resolver is set to a PathResolver other than ShardedResolver.
+	Resolver PathResolver
+
+	// Preallocate allocates the space for blobs of a known size before they
+	// are written, which reduces fragmentation and lets uploads fail right
+	// away if there is not enough space. It is only supported on Linux.
+	Preallocate bool
+
+	// DropCache evicts saved files from the page cache once they have been
+	// synced, so that large backups do not push out the cached data of
+	// other applications. It is only supported on Linux, with SyncNone the
+	// pages are still dirty and most of them stay cached.
+	DropCache bool
+
+	// MaxBlobSize is the maximum size of a blob in bytes, SaveBlob aborts
+	// uploads of larger blobs with ErrBlobTooLarge. Zero means no limit.
+	MaxBlobSize int64
+
+	// MinFreeSpace is the space in bytes which must remain free on the disk,
+	// SaveBlob rejects uploads with ErrNoSpace once less space is left. This
+	// is a coarse guard which works regardless of how many repositories
+	// share the disk. Zero means no limit.
+	MinFreeSpace uint64
+
+	// SkipExistingBlobs makes SaveBlob skip writing a blob which already
+	// exists with the announced size, the uploaded data is read and
+	// discarded. As blobs are named after the hash of their content, this
+	// avoids rewriting packs which restic uploads again after a network
+	// error. It assumes that the uploaded data matches the stored blob, which
+	// is only checked if the hash of uploads is verified. It is the same as
+	// OverwriteSkipIfSame and only used if the OverwritePolicy is unset.
+	SkipExistingBlobs bool
+
+	// OverwritePolicy selects what SaveBlob does if the blob already exists,
+	// OverwriteReplace if unset.
+	OverwritePolicy OverwritePolicy
+	// OverwriteVerify makes OverwriteSkipIfSame read the existing blob and
+	// only skip the upload if the blob matches its SHA-256 name, so that a
+	// corrupt blob is replaced by the upload. Lock files, which are not
+	// named after their content, are always replaced.
+	OverwriteVerify bool
+
+	// TempDir is the directory uploads are written to before they are
+	// renamed to their final name, by default the directory of the file. It
+	// must be on the same filesystem as the repositories so that the rename
+	// is atomic, otherwise the directory of the file is used and a warning
+	// is logged. If the rename fails nonetheless, e.g. between two bind
+	// mounts of the same filesystem, the upload is copied to a temporary
+	// file next to the file and renamed from there.
+	TempDir string
+
+	// CopyBufferSize is the size in bytes of the buffer uploaded data is
+	// copied through, which may be raised for fast disks and networks. The
+	// buffers are pooled, so concurrent uploads share them. By default the
+	// runtime copies through its own 32 KiB buffer. Data read from a file,
+	// e.g. by CopyBlob, is always copied by the kernel where supported.
+	// Downloads are not affected, GetBlob returns the file itself so that
+	// wrappers like MmapFilesystem can use it.
+	CopyBufferSize int
+
+	// ReadIdleTimeout closes blobs returned by GetBlob which have not been
+	// read for longer than the timeout, e.g. because the client stalled,
+	// so that the file descriptor is released. The following reads fail
+	// with ErrReadTimeout. The files are wrapped then, so MmapFilesystem
+	// cannot map them. Zero means no timeout.
+	ReadIdleTimeout time.Duration
+
+	// BestEffortListing makes ListBlobs and ListBlobsFunc skip subdirs and
+	// entries which cannot be read, e.g. because of wrong permissions,
+	// instead of failing the whole listing. The skipped entries are logged
+	// and reported by a *ListingError, which matches ErrPartialListing,
+	// after the other blobs have been listed. This keeps damaged
+	// repositories usable for restores. Errors reading the object type
+	// directory itself still fail the listing.
+	BestEffortListing bool
+
+	// StrictListing makes ListBlobs, ListBlobsFunc and Walk fail with
+	// ErrUnexpectedEntry if an object type directory contains an entry which
+	// cannot be a blob, Walk reports it in its *WalkError. Otherwise such
+	// entries, e.g. the .nfsXXXX files of NFS or the .DS_Store files of
+	// macOS, are skipped so that clients never see them, and counted, see
+	// UnexpectedEntries. Blobs have hex names, except for locks which may
+	// have any name, and hashed object types only have subdirs with hex
+	// names. Temporary files of uploads are always skipped silently.
+	StrictListing bool
+
+	// UseFileLocks holds an exclusive advisory lock, flock, on each file
+	// from the creation of its temporary file until it has been renamed to
+	// its final name. External tools which take
+	// a shared flock before reading a blob, e.g. a script running restic
+	// check on the server, can thus wait for uploads in progress. Tools
+	// which do not lock files are unaffected. The lock is not taken on
+	// Windows and on filesystems which do not support flock.
+	UseFileLocks bool
+
+	// FollowSymlinks allows symlinks in repositories which point outside of
+	// the repository, e.g. a data directory moved to another disk. Otherwise
+	// blobs which resolve to a location outside of their repository are
+	// rejected with ErrInvalidName, which needs an lstat of each directory
+	// level of the blob. The repository directories themselves and their
+	// parents may always be symlinks.
+	FollowSymlinks bool
+
+	// ObjectTypes are the object types which can be stored in repositories,
+	// the package level ObjectTypes if unset. CreateRepo creates their
+	// directories, and blobs of other object types are rejected with
+	// ErrInvalidName. Only the "data" object type uses subdirs.
+	ObjectTypes []string
+
+	// StatsWorkers is the number of data subdirs read in parallel by
+	// RepoStats and CountBlobs, 8 if unset. It is capped at 64, as more
+	// parallel reads only thrash the disk.
+	StatsWorkers int
+
+	// Now returns the current time, time.Now if unset. It is used to
+	// determine the age of stale locks and temporary files.
+	Now func() time.Time
+
+	// MaxListDepth and MaxListEntries bound the directories read by a
+	// single call of ListRepos, ListBlobs or Walk, so that a client which
+	// has created a huge or deeply nested directory tree cannot exhaust
+	// the memory of the server. MaxListDepth is the number of directory
+	// levels below the root of ListRepos or the object type directory,
+	// MaxListEntries the total number of directory entries read. Exceeding
+	// them fails with ErrTooManyEntries, zero means no limit.
+	MaxListDepth   int
+	MaxListEntries int
+
+	// SyncObserver is called with the duration of each fsync of a file, or
+	// of a directory if dir is set, e.g. to record the latency of the disk
+	// separately from the duration of uploads, which includes receiving
+	// the data. It is called concurrently.
+	SyncObserver func(dir bool, duration time.Duration)
+
+	// SaveTiming is called with the time spent in each phase of a blob
+	// saved successfully by SaveBlob, to find out whether slow uploads wait
+	// for the network, the disk, fsync or the rename. It is called
+	// concurrently. Unless it is set, the phases are not measured.
+	SaveTiming func(path string, timing SaveBlobTiming)
+
+	sys            osFS // realFS if unset, replaced by tests
+	fsyncWarning   sync.Once
+	tempDirWarning sync.Once
+	crossDevice    sync.Once // logs the first fallback of restage
+	layouts        sync.Map  // repository path -> detected PathResolver
+	capabilities   sync.Map  // directory -> Capabilities
+	unexpected     uint64    // must be accessed using sync/atomic
+	writers        pathWriters
+	syncs          syncQueue
+	dirSyncs       dirSyncer
+	openBlobs      sharedFiles
+	renamed        sync.Map  // old path -> struct{} of repositories moved by RenameRepo
+	uploads        sync.Map  // upload ID -> *upload
+	copyBuffers    sync.Pool // of *[]byte with CopyBufferSize bytes
+}
+
+// DefaultSubdirWidth is the number of hex characters in the names of the data
+// subdirs, resulting in the 256 subdirs used by restic.
+const DefaultSubdirWidth = 2
+
+var _ Filesystem = &DiskFilesystem{}
+
+func (d *DiskFilesystem) now() time.Time {
+	if d.Now == nil {
+		return time.Now()
+	}
+	return d.Now()
+}
+
+// fsys returns the osFS used for single files.
+func (d *DiskFilesystem) fsys() osFS {
+	if d.sys == nil {
+		return realFS{}
+	}
+	return d.sys
+}
+
+func (d *DiskFilesystem) dirMode() os.FileMode {
+	if d.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return d.DirMode
+}
+
+func (d *DiskFilesystem) fileMode() os.FileMode {
+	if d.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return d.FileMode
+}
+
+func (d *DiskFilesystem) objectTypes() []string {
+	if d.ObjectTypes == nil {
+		return ObjectTypes
+	}
+	return d.ObjectTypes
+}
+
+// checkObjectType returns ErrInvalidName unless objectType is one of the
+// configured ObjectTypes.
+func (d *DiskFilesystem) checkObjectType(objectType string) error {
+	for _, t := range d.objectTypes() {
+		if objectType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("object type %q: %w", objectType, ErrInvalidName)
+}
+
+// validateBlobPath checks path using validateBlobPath and that the blob
+// belongs to one of the configured ObjectTypes. Blobs in the TrashDir are only
+// checked by name.
+func (d *DiskFilesystem) validateBlobPath(path string) error {
+	if err := validateBlobPath(path); err != nil {
+		return err
+	}
+	repo, objectType, _ := SplitBlobPath(path)
+	if filepath.Base(repo) == TrashDir {
+		return nil
+	}
+	return d.checkObjectType(objectType)
+}
+
+// validateListPath checks that the directory path passed to ListBlobsFunc is
+// the directory of one of the configured ObjectTypes. Subdirs of hashed object
+// types and directories in the TrashDir are not checked.
+func (d *DiskFilesystem) validateListPath(path string) error {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == TrashDir {
+			return nil
+		}
+	}
+	if IsHashed(filepath.Base(filepath.Dir(path))) {
+		return nil
+	}
+	return d.checkObjectType(filepath.Base(path))
+}
+
+// mkdir creates the directory path using the DirMode.
+func (d *DiskFilesystem) mkdir(path string) error {
+	if err := d.fsys().Mkdir(path, d.dirMode()); err != nil {
+		return err
+	}
+	return d.chmodDir(path)
+}
+
+// mkdirAll creates the directory path and all missing parents using the
+// DirMode.
+func (d *DiskFilesystem) mkdirAll(path string) error {
+	if !d.IgnoreUmask {
+		return os.MkdirAll(path, d.dirMode())
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := d.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	err := d.mkdir(path)
+	if os.IsExist(err) {
+		// created concurrently
+		return nil
+	}
+	return err
+}
+
+// repairDir creates the missing directory dir of a blob and its missing
+// parents, e.g. a data subdir which has been removed by accident. The parents
+// of the created directories are synced, so that the directories persist
+// together with the blob. The directories of a repository which has been
+// moved away by RenameRepo are not recreated, so that a request which was
+// running during the rename fails instead of leaving parts of the repository
+// at the old path.
+func (d *DiskFilesystem) repairDir(dir string) error {
+	if repo := d.repoOf(dir); repo != "" {
+		if _, ok := d.renamed.Load(repo); ok {
+			return &os.PathError{Op: "mkdir", Path: repo, Err: os.ErrNotExist}
+		}
+	}
+	var missing []string
+	for p := dir; filepath.Dir(p) != p; p = filepath.Dir(p) {
+		if _, err := d.fsys().Stat(p); err == nil {
+			break
+		}
+		missing = append(missing, p)
+	}
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+	for _, p := range missing {
+		if err := d.syncDir(filepath.Dir(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repoOf returns the repository containing the blob directory dir, the
+// parent of its innermost object type directory, or "" if dir is not below
+// an object type directory.
+func (d *DiskFilesystem) repoOf(dir string) string {
+	for p := dir; filepath.Dir(p) != p; p = filepath.Dir(p) {
+		if d.checkObjectType(filepath.Base(p)) == nil {
+			return filepath.Dir(p)
+		}
+	}
+	return ""
+}
+
+// chmodDir sets the mode of the new directory at path to the DirMode if
+// IgnoreUmask is set, keeping the setgid bit of the parent directory.
+func (d *DiskFilesystem) chmodDir(path string) error {
+	if !d.IgnoreUmask {
+		return nil
+	}
+	mode := d.dirMode()
+	if fi, err := os.Stat(filepath.Dir(path)); err == nil && fi.Mode()&os.ModeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	return os.Chmod(path, mode)
+}
+
+// chmodFile sets the mode of the new file f to the FileMode if IgnoreUmask
+// is set.
+func (d *DiskFilesystem) chmodFile(f *os.File) error {
+	if !d.IgnoreUmask {
+		return nil
+	}
+	return f.Chmod(d.fileMode())
+}
+
+// syncFile syncs f unless the SyncMode is SyncNone. It returns true if the
+// filesystem does not support syncing, the warning about this is printed once.
+func (d *DiskFilesystem) syncFile(f *os.File) (bool, error) {
+	return d.syncFileMode(f, d.SyncMode)
+}
+
+// syncFileMode syncs f like syncFile, but using mode instead of the SyncMode.
+func (d *DiskFilesystem) syncFileMode(f *os.File, mode SyncMode) (bool, error) {
+	if mode == SyncNone {
+		return false, nil
+	}
+	start := time.Now()
+	syncNotSup, err := syncFile(f)
+	if d.SyncObserver != nil && !syncNotSup {
+		d.SyncObserver(false, time.Since(start))
+	}
+	if syncNotSup {
+		d.fsyncWarning.Do(func() {
+			log.Print("WARNING: fsync is not supported by the data storage. This can lead to data loss, if the system crashes or the storage is unexpectedly disconnected.")
+		})
+	}
+	return syncNotSup, err
+}
+
+// Flush waits until the background syncs of all blobs saved before with
+// SyncDeferred have completed. It returns an error if any of them failed
+// since the last barrier.
+func (d *DiskFilesystem) Flush() error {
+	return d.syncs.flush()
+}
+
+// isBarrier returns true if saving a blob of objectType must wait for the
+// deferred syncs, as the blob references the blobs saved before.
+func isBarrier(objectType string) bool {
+	return objectType == "index" || objectType == "snapshots"
+}
+
+// deferredSync syncs the saved blob at path and its directory, it is called
+// by the syncQueue.
+func (d *DiskFilesystem) deferredSync(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// removed in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	syncNotSup, err := d.syncFile(f)
+	if err == nil && d.DropCache {
+		_ = dropCache(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !syncNotSup {
+		err = d.syncDir(filepath.Dir(path))
+	}
+	return err
+}
+
+// stagingDir returns the directory for the temporary file used to save a file
+// in dir, which may not exist yet. This is TempDir if it is set and on the
+// same filesystem as dir, otherwise dir.
+func (d *DiskFilesystem) stagingDir(dir string) string {
+	if d.TempDir == "" {
+		return dir
+	}
+	// the closest existing parent is on the same filesystem as dir, unless
+	// a filesystem is mounted on a missing directory later on
+	parent := dir
+	same, err := sameDevice(d.TempDir, parent)
+	for os.IsNotExist(err) && filepath.Dir(parent) != parent {
+		parent = filepath.Dir(parent)
+		same, err = sameDevice(d.TempDir, parent)
+	}
+	if err != nil || !same {
+		d.tempDirWarning.Do(func() {
+			if err == nil {
+				err = errors.New("different filesystem")
+			}
+			log.Printf("WARNING: temp dir %v cannot be used for %v, writing temporary files next to the saved files: %v", d.TempDir, dir, err)
+		})
+		return dir
+	}
+	return d.TempDir
+}
+
+// syncDir syncs the directory dirname if the SyncMode is SyncFull or
+// SyncDeferred. Concurrent syncs of the same directory are coalesced, see
+// dirSyncer.
+func (d *DiskFilesystem) syncDir(dirname string) error {
+	return d.syncDirMode(dirname, d.SyncMode)
+}
+
+// syncDirMode syncs the directory dirname like syncDir, but using mode
+// instead of the SyncMode.
+func (d *DiskFilesystem) syncDirMode(dirname string, mode SyncMode) error {
+	if mode != SyncFull && mode != SyncDeferred {
+		return nil
+	}
+	return d.dirSyncs.sync(dirname, d.observedSyncDir)
+}
+
+// observedSyncDir syncs the directory dirname and passes the duration to the
+// SyncObserver.
+func (d *DiskFilesystem) observedSyncDir(dirname string) error {
+	if d.SyncObserver == nil {
+		return syncDir(dirname)
+	}
+	start := time.Now()
+	err := syncDir(dirname)
+	d.SyncObserver(true, time.Since(start))
+	return err
+}
+
+// durableObjectTypes are the object types whose blobs are always saved with
+// SyncFull, whatever the SyncMode. restic relies on a lock it has saved to
+// exclude concurrent prunes, a lock lost on a crash lets another client
+// remove data which is still in use. Keys are synced as well, a key lost on
+// a crash can lock everyone out of the repository, see ReplaceKey. Both are
+// small and rare, so this costs little even for SyncNone.
+var durableObjectTypes = []string{"keys", "locks"}
+
+// syncModeFor returns the SyncMode used to save the file at path, which is a
+// blob if blob is set. This is the SyncMode unless the blob belongs to one
+// of the durableObjectTypes or the file is the SealMarker.
+func (d *DiskFilesystem) syncModeFor(path string, blob bool) SyncMode {
+	if !blob && filepath.Base(path) == SealMarker {
+		return SyncFull
+	}
+	if blob {
+		_, objectType, _ := SplitBlobPath(path)
+		for _, t := range durableObjectTypes {
+			if objectType == t {
+				return SyncFull
+			}
+		}
+	}
+	return d.SyncMode
+}
+
+func (d *DiskFilesystem) subdirWidth() int {
+	if d.SubdirWidth <= 0 {
+		return DefaultSubdirWidth
+	}
+	return d.SubdirWidth
+}
+
+func (d *DiskFilesystem) resolver() PathResolver {
+	if d.Resolver == nil {
+		return ShardedResolver{Width: d.subdirWidth(), Depth: 1}
+	}
+	return d.Resolver
+}
+
+// repoResolver returns the PathResolver for the data subdirs of the
+// repository at repo. The width and the number of levels of the subdirs are
+// detected by descending into the first subdir of each level and cached, if
+// there are no subdirs yet the configured resolver is used.
+func (d *DiskFilesystem) repoResolver(repo string) PathResolver {
+	if r, ok := d.layouts.Load(repo); ok {
+		return r.(PathResolver)
+	}
+	if _, ok := d.resolver().(ShardedResolver); !ok {
+		return d.resolver()
+	}
+
+	var r ShardedResolver
+	dir := filepath.Join(repo, "data")
+	for {
+		subdir := firstSubdir(dir, r.Width)
+		if subdir == "" {
+			break
+		}
+		r.Width = len(subdir)
+		r.Depth++
+		dir = filepath.Join(dir, subdir)
+	}
+	if r.Depth == 0 {
+		return d.resolver()
+	}
+	d.layouts.Store(repo, r)
+	return r
+}
+
+// firstSubdir returns the name of the first subdir of dir named with hex
+// characters, or "" if there is none. If width is not 0, only subdirs with
+// names of that length are considered.
+func firstSubdir(dir string, width int) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if e.IsDir() && isHex(e.Name()) && (width == 0 || len(e.Name()) == width) {
+			return e.Name()
+		}
+	}
+	return ""
+}
+
+// classify marks errors caused by a full disk or an exceeded disk quota as
+// ErrNoSpace, and errors caused by a read-only storage as ErrReadOnly. Other
+// errors are returned unchanged, errors of the os package already match
+// ErrNotFound and ErrExists.
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case isNoSpace(err):
+		return &kindError{kind: ErrNoSpace, err: err}
+	case isReadOnly(err):
+		return &kindError{kind: ErrReadOnly, err: err}
+	default:
+		return err
+	}
+}
+
+// blobNameLength is the length of the names restic uses for blobs, the hex
+// encoded SHA-256 hash of their content.
+const blobNameLength = 64
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the path of the blob at path on disk. The caller always
+// uses subdirs named after the first two characters of the blob name for
+// hashed object types, these are replaced with the subdirs actually used by
+// the repository. All methods accessing blobs use it to compute their path.
+func (d *DiskFilesystem) resolve(path string) string {
+	repo, objectType, name := SplitBlobPath(path)
+	if !IsHashed(objectType) {
+		return path
+	}
+	subdir := d.repoResolver(repo).Subdir(name)
+	if subdir == "" {
+		return path
+	}
+	return filepath.Join(repo, objectType, subdir, name)
+}
+
+// withBlob validates path and calls fn with the path of the blob on disk. If
+// the blob does not exist and belongs to a hashed object type, fn is called
+// again with the path used by the flat layout, so that repositories can be
+// used while MigrateLayout runs.
+func (d *DiskFilesystem) withBlob(path string, fn func(path string) error) error {
+	if err := d.validateBlobPath(path); err != nil {
+		return err
+	}
+	repo, objectType, name := SplitBlobPath(path)
+	call := func(file string) error {
+		if err := d.checkSymlinks(repo, file); err != nil {
+			return err
+		}
+		return fn(file)
+	}
+	err := call(d.resolve(path))
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if !IsHashed(objectType) {
+		return err
+	}
+	if flatErr := call(filepath.Join(repo, objectType, name)); !errors.Is(flatErr, os.ErrNotExist) {
+		return flatErr
+	}
+	return err
+}
+
+// checkSymlinks returns ErrInvalidName if file, which is in the repository at
+// repo, resolves to a location outside of the repository, unless
+// FollowSymlinks is set. Without symlinks this only needs an lstat of each
+// directory level below repo, the paths are only resolved with
+// filepath.EvalSymlinks if there is a symlink. Parts of file which do not
+// exist yet are not resolved.
+func (d *DiskFilesystem) checkSymlinks(repo, file string) error {
+	if d.FollowSymlinks {
+		return nil
+	}
+	rel, err := filepath.Rel(repo, file)
+	if err != nil {
+		return err
+	}
+	link := false
+	dir := repo
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, elem)
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			// created by the caller
+			break
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link = true
+			break
+		}
+	}
+	if !link {
+		return nil
+	}
+
+	root, err := filepath.EvalSymlinks(repo)
+	if err != nil {
+		return err
+	}
+	resolved, err := evalExisting(file)
+	if err != nil {
+		return err
+	}
+	if r, err := filepath.Rel(root, resolved); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%v resolves to %v outside of the repository: %w", file, resolved, ErrInvalidName)
+	}
+	return nil
+}
+
+// evalExisting resolves the symlinks in the longest existing prefix of path
+// and appends the rest.
+func evalExisting(path string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// MigrateLayout moves the data blobs of the repository at path which are
+// stored directly in the data directory, as done by the flat layout, to their
+// subdirs. Nothing is done if the repository does not use the flat layout.
+// The repository can be used while the blobs are moved, and MigrateLayout
+// can simply be run again if it has been interrupted.
+func (d *DiskFilesystem) MigrateLayout(ctx context.Context, path string) error {
+	dataDir := filepath.Join(path, "data")
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	r := d.repoResolver(path)
+	moved := make(map[string]bool)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !isFlatBlob(e) {
+			continue
+		}
+
+		name := e.Name()
+		if r.Subdir(name) == "" {
+			continue
+		}
+		subdir := filepath.Join(dataDir, r.Subdir(name))
+		if err := d.mkdirAll(subdir); err != nil {
+			return err
+		}
+		oldPath, newPath := filepath.Join(dataDir, name), filepath.Join(subdir, name)
+		if _, err := os.Lstat(newPath); err == nil {
+			// the blob has been uploaded again, as blobs are named after
+			// their content the copy in the data directory is redundant
+			err = os.Remove(oldPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := d.fsys().Rename(oldPath, newPath); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed in the meantime
+				continue
+			}
+			return err
+		}
+		for dir := subdir; dir != dataDir; dir = filepath.Dir(dir) {
+			moved[dir] = true
+		}
+	}
+
+	for subdir := range moved {
+		if err := d.syncDir(subdir); err != nil {
+			return err
+		}
+	}
+	if len(moved) > 0 {
+		return d.syncDir(dataDir)
+	}
+	return nil
+}
+
+// PruneStaleLocks removes the locks of the repository at path which have not
+// been modified for longer than olderThan, as left behind by crashed restic
+// clients. Locks which cannot be stat'ed are skipped. The number of removed
+// locks is returned.
+func (d *DiskFilesystem) PruneStaleLocks(ctx context.Context, path string, olderThan time.Duration) (int, error) {
+	dir := filepath.Join(path, "locks")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		lock := filepath.Join(dir, e.Name())
+		st, err := d.fsys().Stat(lock)
+		if err != nil || !st.Mode().IsRegular() || d.now().Sub(st.ModTime()) <= olderThan {
+			continue
+		}
+		if err := d.fsys().Remove(lock); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// removed by the client in the meantime
+				continue
+			}
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Compact removes the empty subdirs of the object type directories of the
+// repository at path, bottom-up, e.g. the data subdirs left empty by a prune.
+// The object type directories themselves are kept, and so is the first subdir
+// of each level in data so that the layout of the repository is still
+// detected. The number of removed directories is returned.
+//
+// Compact can run while the repository is used. A directory is only removed
+// if it is empty, and SaveBlob creates missing subdirs again.
+func (d *DiskFilesystem) Compact(ctx context.Context, path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	keep := make(map[string]bool)
+	r := d.repoResolver(path)
+	if sr, ok := r.(ShardedResolver); ok && sr.Depth > 0 {
+		dataDir := filepath.Join(path, "data")
+		subdir := filepath.Join(dataDir, sr.Subdir(strings.Repeat("0", sr.Width*sr.Depth)))
+		for dir := subdir; dir != dataDir; dir = filepath.Dir(dir) {
+			keep[dir] = true
+		}
+	}
+
+	removed := 0
+	for _, t := range d.objectTypes() {
+		if _, err := d.compactDir(ctx, filepath.Join(path, t), keep, &removed); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// compactDir removes the empty subdirs of dir except those in keep, counting
+// them in removed. It returns whether dir is empty afterwards.
+func (d *DiskFilesystem) compactDir(ctx context.Context, dir string, keep map[string]bool, removed *int) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	empty := true
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if !e.IsDir() {
+			empty = false
+			continue
+		}
+		subdir := filepath.Join(dir, e.Name())
+		subdirEmpty, err := d.compactDir(ctx, subdir, keep, removed)
+		if err != nil {
+			return false, err
+		}
+		if !subdirEmpty || keep[subdir] {
+			empty = false
+			continue
+		}
+		if err := os.Remove(subdir); err != nil {
+			// a blob has been saved in the meantime, or the directory has
+			// been removed concurrently
+			if entries, readErr := os.ReadDir(subdir); len(entries) == 0 && !errors.Is(readErr, os.ErrNotExist) {
+				return false, err
+			}
+			empty = false
+			continue
+		}
+		*removed++
+	}
+	return empty, nil
+}
+
+// ListRepos returns the paths of the repositories below root, relative to
+// root, which is "." if root is a repository itself. A repository is a
+// directory with a config file and the directories of all object types.
+// Nested repositories are found as well, but the object type directories of
+// repositories and hidden directories are not searched. Symlinks to
+// directories are followed, each directory is only searched once so that
+// symlink loops do not cause an endless recursion. Directories which cannot
+// be read are skipped.
+func (d *DiskFilesystem) ListRepos(ctx context.Context, root string) ([]string, error) {
+	var repos []string
+	visited := make(map[string]bool)
+	if err := d.listRepos(ctx, root, root, 0, visited, &repos, d.listBudget()); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+func (d *DiskFilesystem) listRepos(ctx context.Context, root, dir string, depth int, visited map[string]bool, repos *[]string, budget *listBudget) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if visited[real] {
+		return nil
+	}
+	visited[real] = true
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if err := budget.read(dir, depth, len(entries)); err != nil {
+		return err
+	}
+
+	skip := make(map[string]bool)
+	if d.isRepo(dir) {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		*repos = append(*repos, rel)
+		for _, t := range d.objectTypes() {
+			skip[t] = true
+		}
+	}
+	for _, e := range entries {
+		if skip[e.Name()] || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		sub := filepath.Join(dir, e.Name())
+		if e.Type()&os.ModeSymlink != 0 {
+			fi, err := os.Stat(sub)
+			if err != nil || !fi.IsDir() {
+				// dangling or not pointing to a directory
+				continue
+			}
+		} else if !e.IsDir() {
+			continue
+		}
+		err := d.listRepos(ctx, root, sub, depth+1, visited, repos, budget)
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+			// not accessible or removed in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNestedRepo reports whether dir, a subdir of the repository at repo, is a
+// repository itself. Repositories cannot be nested in the object type
+// directories, so their contents are not checked.
+func (d *DiskFilesystem) isNestedRepo(repo, dir string) bool {
+	rel, err := filepath.Rel(repo, dir)
+	if err != nil {
+		return false
+	}
+	top := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	return d.checkObjectType(top) != nil && d.isRepo(dir)
+}
+
+// isRepo reports whether dir contains a config file and the directories of
+// all object types.
+func (d *DiskFilesystem) isRepo(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "config")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	for _, t := range d.objectTypes() {
+		if fi, err := os.Stat(filepath.Join(dir, t)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// CreateRepo creates the repository directories, using Resolver for the data
+// subdirs. Missing directories are created unless the config exists.
+func (d *DiskFilesystem) CreateRepo(ctx context.Context, path string) error {
+	if _, err := os.Lstat(filepath.Join(path, "config")); err == nil {
+		return repoExists(path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	// the repository may be recreated after it has been moved away
+	d.renamed.Delete(filepath.Clean(path))
+
+	if err := d.mkdirAll(path); err != nil {
+		return classify(err)
+	}
+
+	for _, t := range d.objectTypes() {
+		if err := d.mkdir(filepath.Join(path, t)); err != nil && !os.IsExist(err) {
+			return classify(err)
+		}
+	}
+
+	// keep the layout of an existing repository
+	r := d.repoResolver(path)
+	subdirs := r.Subdirs()
+	err := runParallel(ctx, len(subdirs), mkdirWorkers, func(i int) error {
+		return d.mkdirAll(filepath.Join(path, "data", subdirs[i]))
+	})
+	if err != nil {
+		return classify(err)
+	}
+	d.layouts.Store(filepath.Clean(path), r)
+	return nil
+}
+
+// DeleteRepo removes the repository at path with all its blobs. To guard
+// against deleting an arbitrary directory, path must be below root, the base
+// directory of all repositories, and look like a repository: it must contain
+// the config and the directories of all object types, and nothing else but
+// the files maintained by this package, e.g. the RepoLockFile, MetaDir and
+// temporary files. Otherwise ErrNotRepo is returned. In particular, a
+// repository containing other repositories, like the repository of a user
+// with private repositories, is not removed. Sealed repositories, see
+// SealFilesystem, are not removed either, ErrSealed is returned.
+//
+// The directory is first renamed, so that clients never see a partially
+// removed repository. Asking for confirmation is up to the caller.
+func (d *DiskFilesystem) DeleteRepo(ctx context.Context, root, path string) error {
+	root, path = filepath.Clean(root), filepath.Clean(path)
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to delete %v outside of %v: %w", path, root, ErrInvalidName)
+	}
+	if err := d.checkRepo(path); err != nil {
+		return err
+	}
+	if sealed, err := d.sealed(path); err != nil || sealed {
+		if err == nil {
+			err = fmt.Errorf("%v: %w", path, ErrSealed)
+		}
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var tmp string
+	for i := 0; i < 10; i++ {
+		tmp = filepath.Join(filepath.Dir(path), tempName(filepath.Base(path), fmt.Sprintf("%08x", rand.Uint32())))
+		if _, err = os.Lstat(tmp); os.IsNotExist(err) {
+			break
+		}
+	}
+	if err := d.fsys().Rename(path, tmp); err != nil {
+		return classify(err)
+	}
+	d.layouts.Delete(path)
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("repository %v removed, but cleaning up %v failed: %w", path, tmp, err)
+	}
+	return nil
+}
+
+// RenameRepo moves the repository at src to dst, both below root, by renaming
+// its directory, e.g. when a client has been renamed. src must look like a
+// repository, see DeleteRepo, and dst must not exist yet. Missing parents of
+// dst are created. If src and dst are on different filesystems the
+// repository is not copied, as that could take hours, and an error is
+// returned instead.
+//
+// The rename waits for the requests holding a lock on the repository, see
+// LockRepo. Requests for src which are running during or started after the
+// rename fail with ErrNotFound, the directories of src are not recreated by
+// uploads until CreateRepo is called for src again.
+func (d *DiskFilesystem) RenameRepo(ctx context.Context, root, src, dst string) error {
+	root, src, dst = filepath.Clean(root), filepath.Clean(src), filepath.Clean(dst)
+	for _, path := range []string{src, dst} {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to move %v outside of %v: %w", path, root, ErrInvalidName)
+		}
+	}
+	if err := d.checkRepo(src); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return repoExists(dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := d.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	unlock, err := d.LockRepo(ctx, src, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// mark src before the rename, so that no upload can recreate it
+	// in between
+	d.renamed.Store(src, struct{}{})
+	if err := d.fsys().Rename(src, dst); err != nil {
+		d.renamed.Delete(src)
+		if isCrossDevice(err) {
+			return fmt.Errorf("%v and %v are on different filesystems, copy the repository instead: %w", src, dst, err)
+		}
+		return classify(err)
+	}
+	d.renamed.Delete(dst)
+	d.layouts.Delete(src)
+	if err := d.syncDir(filepath.Dir(src)); err != nil {
+		return err
+	}
+	if filepath.Dir(src) == filepath.Dir(dst) {
+		return nil
+	}
+	return d.syncDir(filepath.Dir(dst))
+}
+
+// SwapRepo replaces the repository at live with the one at staged, both
+// below root, e.g. to put a repository into service which has been restored
+// or rebuilt next to it. Both must look like a repository, see DeleteRepo,
+// and be on the same filesystem, as with RenameRepo the repositories are
+// never copied. The old repository is moved aside into a hidden directory
+// next to live, named after live and the time of the swap, whose path is
+// returned so that it can be inspected or deleted later. A sealed repository
+// is not replaced and ErrSealed is returned.
+//
+// The swap waits for the requests holding a lock on either repository, see
+// LockRepo. It renames two directories, requests which are run in between
+// fail with ErrNotFound, but a request never sees files of both
+// repositories. If putting staged into place fails, the old repository is
+// moved back. Afterwards requests for staged fail with ErrNotFound, as after
+// RenameRepo.
+func (d *DiskFilesystem) SwapRepo(ctx context.Context, root, live, staged string) (string, error) {
+	root, live, staged = filepath.Clean(root), filepath.Clean(live), filepath.Clean(staged)
+	for _, path := range []string{live, staged} {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("refusing to swap %v outside of %v: %w", path, root, ErrInvalidName)
+		}
+		if err := d.checkRepo(path); err != nil {
+			return "", err
+		}
+	}
+	if live == staged {
+		return "", fmt.Errorf("cannot swap %v with itself: %w", live, ErrInvalidName)
+	}
+	if sealed, err := d.sealed(live); err != nil || sealed {
+		if err == nil {
+			err = fmt.Errorf("%v: %w", live, ErrSealed)
+		}
+		return "", err
+	}
+	if same, err := sameDevice(live, staged); err != nil {
+		return "", err
+	} else if !same {
+		return "", fmt.Errorf("%v and %v are on different filesystems, copy the repository instead: %w", live, staged, syscall.EXDEV)
+	}
+	backup := filepath.Join(filepath.Dir(live), "."+filepath.Base(live)+".swapped-"+d.now().UTC().Format("20060102T150405Z"))
+	if _, err := os.Lstat(backup); err == nil {
+		return "", repoExists(backup)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	unlockLive, err := d.LockRepo(ctx, live, true)
+	if err != nil {
+		return "", err
+	}
+	defer unlockLive()
+	unlockStaged, err := d.LockRepo(ctx, staged, true)
+	if err != nil {
+		return "", err
+	}
+	defer unlockStaged()
+	// mark both paths, so that no upload can recreate live while it is
+	// missing, or staged once it has been moved
+	d.renamed.Store(live, struct{}{})
+	d.renamed.Store(staged, struct{}{})
+	if err := d.fsys().Rename(live, backup); err != nil {
+		d.renamed.Delete(live)
+		d.renamed.Delete(staged)
+		return "", classify(err)
+	}
+	if err := d.fsys().Rename(staged, live); err != nil {
+		d.renamed.Delete(staged)
+		if rerr := d.fsys().Rename(backup, live); rerr != nil {
+			return "", fmt.Errorf("swapping in %v failed: %v, and restoring %v from %v failed: %w", staged, err, live, backup, rerr)
+		}
+		d.renamed.Delete(live)
+		if isCrossDevice(err) {
+			return "", fmt.Errorf("%v and %v are on different filesystems, copy the repository instead: %w", live, staged, err)
+		}
+		return "", classify(err)
+	}
+	d.renamed.Delete(live)
+	d.layouts.Delete(live)
+	d.layouts.Delete(staged)
+	if err := d.syncDir(filepath.Dir(live)); err != nil {
+		return backup, err
+	}
+	if filepath.Dir(live) == filepath.Dir(staged) {
+		return backup, nil
+	}
+	return backup, d.syncDir(filepath.Dir(staged))
+}
+
+// checkRepo returns ErrNotRepo unless path looks like a repository, see
+// DeleteRepo.
+func (d *DiskFilesystem) checkRepo(path string) error {
+	if fi, err := os.Lstat(path); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%v is no directory: %w", path, ErrNotRepo)
+	}
+	if fi, err := os.Lstat(filepath.Join(path, "config")); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%v has no config: %w", path, ErrNotRepo)
+		}
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%v: config is no file: %w", path, ErrNotRepo)
+	}
+
+	known := map[string]bool{"config": true, RepoLockFile: true, MetaDir: true, TrashDir: true, SealMarker: true}
+	for _, t := range d.objectTypes() {
+		fi, err := os.Lstat(filepath.Join(path, t))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("%v has no %v directory: %w", path, t, ErrNotRepo)
+		}
+		known[t] = true
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !known[e.Name()] && !isTempFile(e.Name()) {
+			return fmt.Errorf("%v contains %v: %w", path, e.Name(), ErrNotRepo)
+		}
+	}
+	return nil
+}
+
+// mkdirWorkers is the number of data subdirs created in parallel by
+// CreateRepo, which hides the latency of network filesystems.
+const mkdirWorkers = 16
+
+// runParallel calls fn for the indexes 0 to n-1, using up to workers
+// goroutines. Once fn has returned an error or ctx has been canceled, no
+// further calls are started. The first error is returned.
+func runParallel(ctx context.Context, n, workers int, fn func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	// fail records err unless an error has been recorded before, it reports
+	// whether an error has been recorded
+	fail := func(err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		return firstErr != nil
+	}
+
+	indexes := make(chan int)
+	for i := 0; i < workers && i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fail(fn(i))
+			}
+		}()
+	}
+	for i := 0; i < n && !fail(ctx.Err()); i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return firstErr
+}
+
+// CheckConfig returns whether the config file exists and its size.
+func (d *DiskFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	st, err := d.fsys().Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, st.Size(), nil
+}
+
+// GetConfig returns the contents of the config file.
+func (d *DiskFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	rd, _, err := d.GetConfigReader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+	return ioutil.ReadAll(rd)
+}
+
+// GetConfigReader returns a reader for the config file and its size. The
+// errors of the os package are returned, which match ErrNotFound only for a
+// missing config and os.ErrPermission if it is not accessible.
+func (d *DiskFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// SaveConfig saves the config file, it fails with ErrConfigExists if the file
+// already exists. Like blobs, the config is written to a temporary file first
+// and then moved to its final name, so that a crash never leaves a partial
+// config behind. The temporary file is hard linked to the final name, which
+// fails if the config has been saved concurrently, even by another process.
+// With SyncDeferred, it waits for the pending syncs first.
+func (d *DiskFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	if _, err := os.Lstat(path); err == nil {
+		return &os.PathError{Op: "create", Path: path, Err: ErrConfigExists}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err := d.writeFile(ctx, path, rd, -1, 0, false, false, nil)
+	if errors.Is(err, ErrExists) {
+		// saved concurrently
+		return &os.PathError{Op: "create", Path: path, Err: ErrConfigExists}
+	}
+	return err
+}
+
+// ReplaceConfig atomically replaces the config file, or saves it if it does
+// not exist yet. Unlike SaveConfig, it is not used for initializing
+// repositories but for the rare cases in which an existing config must be
+// rewritten.
+func (d *DiskFilesystem) ReplaceConfig(ctx context.Context, path string, rd io.Reader) error {
+	_, err := d.writeFile(ctx, path, rd, -1, 0, false, true, nil)
+	return err
+}
+
+// DeleteConfig removes the config file.
+func (d *DiskFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return classify(os.Remove(path))
+}
+
+// ListBlobs lists all blobs in the object type directory at path, sorted
+// lexically by name. With BestEffortListing, the blobs which could be read
+// are returned together with a *ListingError if some entries were skipped.
+func (d *DiskFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs := []Blob{}
+	err := d.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrPartialListing) {
+		return nil, err
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for all blobs in the object type directory at path,
+// reading one directory at a time. The directories are read in lexical order
+// and their entries are sorted by name, so that the blobs of each subdir are
+// listed in lexical order. Blobs of the flat layout are listed last.
+//
+// With BestEffortListing, subdirs and entries which cannot be read are
+// logged and skipped, and a *ListingError matching ErrPartialListing is
+// returned after all other blobs have been passed to fn.
+func (d *DiskFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	if err := d.validateListPath(path); err != nil {
+		return err
+	}
+	if d.checkObjectType(filepath.Base(path)) == nil {
+		if err := d.checkSymlinks(filepath.Dir(path), path); err != nil {
+			return err
+		}
+	}
+	items, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	budget := d.listBudget()
+	if err := budget.read(path, 0, len(items)); err != nil {
+		return err
+	}
+
+	l := &listing{fn: fn, bestEffort: d.BestEffortListing, budget: budget, anyName: anyNames(path), unexpected: d.unexpectedEntry}
+	if IsHashed(filepath.Base(path)) {
+		err = d.listHashed(ctx, path, items, l)
+	} else {
+		err = l.list(ctx, path, items)
+	}
+	if err != nil {
+		return err
+	}
+	if len(l.errs) > 0 {
+		return &ListingError{Path: path, Errors: l.errs}
+	}
+	return nil
+}
+
+// listBudget counts the directory entries read by a listing and enforces
+// MaxListDepth and MaxListEntries, a nil listBudget has no limits.
+type listBudget struct {
+	maxDepth   int
+	maxEntries int
+	entries    int
+}
+
+// listBudget returns the budget for a listing, nil if there are no limits.
+func (d *DiskFilesystem) listBudget() *listBudget {
+	if d.MaxListDepth <= 0 && d.MaxListEntries <= 0 {
+		return nil
+	}
+	return &listBudget{maxDepth: d.MaxListDepth, maxEntries: d.MaxListEntries}
+}
+
+// read accounts for the n entries read from dir, which is depth levels below
+// the start of the listing.
+func (b *listBudget) read(dir string, depth, n int) error {
+	if b == nil {
+		return nil
+	}
+	if b.maxDepth > 0 && depth > b.maxDepth {
+		return fmt.Errorf("%v is nested more than %d levels deep: %w", dir, b.maxDepth, ErrTooManyEntries)
+	}
+	b.entries += n
+	if b.maxEntries > 0 && b.entries > b.maxEntries {
+		return fmt.Errorf("more than %d entries listed at %v: %w", b.maxEntries, dir, ErrTooManyEntries)
+	}
+	return nil
+}
+
+// UnexpectedEntries returns the number of entries skipped by listings
+// because they cannot be blobs, see StrictListing. A growing number means
+// that some tool drops files into the repositories.
+func (d *DiskFilesystem) UnexpectedEntries() uint64 {
+	return atomic.LoadUint64(&d.unexpected)
+}
+
+// unexpectedEntry handles the entry at path which cannot be a blob. It
+// returns ErrUnexpectedEntry with StrictListing, otherwise the entry is
+// counted and skipped.
+func (d *DiskFilesystem) unexpectedEntry(path string) error {
+	if d.StrictListing {
+		return fmt.Errorf("%v: %w", path, ErrUnexpectedEntry)
+	}
+	atomic.AddUint64(&d.unexpected, 1)
+	return nil
+}
+
+// isBlobEntry reports whether the directory entry e, which is no directory
+// and no temporary file, can be a blob. Unless anyName is set, blobs have
+// hex names.
+func isBlobEntry(e os.DirEntry, anyName bool) bool {
+	if !e.Type().IsRegular() && e.Type()&os.ModeSymlink == 0 {
+		return false
+	}
+	return anyName || isHex(e.Name())
+}
+
+// anyNames reports whether the blobs in the directory path may have any
+// name: locks, and the entries below the TrashDir, whose names carry a
+// suffix.
+func anyNames(path string) bool {
+	if filepath.Base(path) == "locks" {
+		return true
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == TrashDir {
+			return true
+		}
+	}
+	return false
+}
+
+// listing passes the blobs of a directory to fn. Errors reading subdirs and
+// entries are returned unless bestEffort is set, in which case they are
+// logged and collected in errs.
+type listing struct {
+	fn         func(Blob) error
+	bestEffort bool
+	budget     *listBudget
+	errs       []error
+
+	anyName    bool                    // see anyNames
+	unexpected func(path string) error // see DiskFilesystem.unexpectedEntry
+}
+
+// skip returns err, or nil after recording it if the listing is best-effort.
+func (l *listing) skip(err error) error {
+	if !l.bestEffort {
+		return err
+	}
+	log.Printf("WARNING: skipping unreadable entry while listing: %v", err)
+	l.errs = append(l.errs, err)
+	return nil
+}
+
+// list calls fn for the blobs among items, the entries of dir.
+func (l *listing) list(ctx context.Context, dir string, items []os.DirEntry) error {
+	for _, i := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := l.entry(dir, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry calls fn for the entry e of dir if it is a blob.
+func (l *listing) entry(dir string, e os.DirEntry) error {
+	if isTempFile(e.Name()) {
+		return nil
+	}
+	if e.IsDir() || !isBlobEntry(e, l.anyName) {
+		return l.unexpected(filepath.Join(dir, e.Name()))
+	}
+	fi, err := e.Info()
+	if errors.Is(err, os.ErrNotExist) {
+		// the blob has been removed since the directory was read
+		return nil
+	}
+	if err != nil {
+		return l.skip(err)
+	}
+	return l.fn(Blob{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+}
+
+// listHashed lists the blobs in the subdirs of the object type directory
+// path, whose entries are items. Blobs stored directly in the directory by
+// the flat layout are listed as well, see MigrateLayout. If such a blob is
+// moved to its subdir while listing, it is listed exactly once.
+func (d *DiskFilesystem) listHashed(ctx context.Context, path string, items []os.DirEntry, l *listing) error {
+	flat := make(map[string]os.DirEntry)
+	for _, i := range items {
+		if isFlatBlob(i) {
+			flat[i.Name()] = i
+		}
+	}
+
+	for _, i := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !i.IsDir() {
+			if !isFlatBlob(i) && !isTempFile(i.Name()) {
+				if err := l.unexpected(filepath.Join(path, i.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !isHex(i.Name()) {
+			if err := l.unexpected(filepath.Join(path, i.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := l.subdir(ctx, filepath.Join(path, i.Name()), 1, flat); err != nil {
+			return err
+		}
+	}
+	return d.listFlat(ctx, path, items, flat, l)
+}
+
+// listFlat lists the blobs among items, the entries of the object type
+// directory path, which are still in flat after the subdirs have been
+// listed.
+func (d *DiskFilesystem) listFlat(ctx context.Context, path string, items []os.DirEntry, flat map[string]os.DirEntry, l *listing) error {
+	for _, i := range items {
+		e, ok := flat[i.Name()]
+		if !ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// the blob has been moved to its subdir after that was read
+			// or it has been removed
+			fi, err = os.Stat(d.resolve(blobPath(path, e.Name())))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+		}
+		if err != nil {
+			if err := l.skip(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := l.fn(Blob{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subdir lists the blobs in dir, depth levels below the object type
+// directory, and its subdirs, removing them from flat.
+func (l *listing) subdir(ctx context.Context, dir string, depth int, flat map[string]os.DirEntry) error {
+	items, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		// the empty subdir has been removed by Compact
+		return nil
+	}
+	if err != nil {
+		// os.ReadDir returns the entries read before the error, which
+		// are still listed in best-effort mode
+		if err := l.skip(err); err != nil {
+			return err
+		}
+	}
+	if err := l.budget.read(dir, depth, len(items)); err != nil {
+		return err
+	}
+	for _, i := range items {
+		if i.IsDir() && isHex(i.Name()) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := l.subdir(ctx, filepath.Join(dir, i.Name()), depth+1, flat); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(flat, i.Name())
+		if err := l.entry(dir, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBlobsPrefix lists the blobs in the object type directory path whose
+// names start with prefix. For hashed object types stored in subdirs by a
+// ShardedResolver, only the subdirs which can contain such blobs are read,
+// e.g. data/ab/ for the prefix abc, instead of all of them. Blobs of the flat
+// layout are listed as well. Other object types and resolvers list all
+// blobs and filter them.
+func (d *DiskFilesystem) ListBlobsPrefix(ctx context.Context, path, prefix string) ([]Blob, error) {
+	if prefix != "" && !isHex(prefix) {
+		return nil, fmt.Errorf("prefix %q: %w", prefix, ErrInvalidName)
+	}
+	r, sharded := d.repoResolver(filepath.Dir(path)).(ShardedResolver)
+	if prefix == "" || !IsHashed(filepath.Base(path)) || !sharded || r.Width <= 0 {
+		return listBlobsPrefix(ctx, d, path, prefix)
+	}
+	if err := d.validateListPath(path); err != nil {
+		return nil, err
+	}
+	if err := d.checkSymlinks(filepath.Dir(path), path); err != nil {
+		return nil, err
+	}
+	items, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	budget := d.listBudget()
+	if err := budget.read(path, 0, len(items)); err != nil {
+		return nil, err
+	}
+
+	blobs := []Blob{}
+	l := &listing{fn: func(blob Blob) error {
+		if strings.HasPrefix(blob.Name, prefix) {
+			blobs = append(blobs, blob)
+		}
+		return nil
+	}, bestEffort: d.BestEffortListing, budget: budget, anyName: anyNames(path), unexpected: d.unexpectedEntry}
+	flat := make(map[string]os.DirEntry)
+	for _, i := range items {
+		if isFlatBlob(i) && strings.HasPrefix(i.Name(), prefix) {
+			flat[i.Name()] = i
+		}
+	}
+
+	// the subdirs named after the complete parts of the prefix
+	levels := len(prefix) / r.Width
+	if levels > r.Depth {
+		levels = r.Depth
+	}
+	dir := path
+	for i := 0; i < levels; i++ {
+		dir = filepath.Join(dir, prefix[i*r.Width:(i+1)*r.Width])
+	}
+	rest := prefix[levels*r.Width:]
+	if rest == "" || levels == r.Depth {
+		err = l.subdir(ctx, dir, levels, flat)
+	} else {
+		// only the subdirs of dir starting with the rest of the prefix
+		entries := items
+		if levels > 0 {
+			entries, err = os.ReadDir(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				entries, err = nil, nil
+			}
+			if err == nil {
+				err = budget.read(dir, levels, len(entries))
+			}
+		}
+		for _, e := range entries {
+			if err != nil {
+				break
+			}
+			if e.IsDir() && strings.HasPrefix(e.Name(), rest) {
+				err = l.subdir(ctx, filepath.Join(dir, e.Name()), levels+1, flat)
+			}
+		}
+	}
+	if err == nil {
+		err = d.listFlat(ctx, path, items, flat, l)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(l.errs) > 0 {
+		return blobs, &ListingError{Path: path, Errors: l.errs}
+	}
+	return blobs, nil
+}
+
+// Walk calls fn for the blobs of all object types, reading the directories
+// directly. For hashed object types all subdirs are read, and the object type
+// directory itself for repositories using the flat layout.
+func (d *DiskFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	var errs []error
+	budget := d.listBudget()
+	for _, t := range d.objectTypes() {
+		if err := d.walkDir(ctx, filepath.Join(path, t), t, 0, fn, &errs, budget); err != nil {
+			return err
+		}
+	}
+	return newWalkError(errs)
+}
+
+// walkDir calls fn for the blobs in dir, which is depth levels below the
+// object type directory. Errors for entries are appended to errs, only the
+// errors of fn, ctx and budget are returned.
+func (d *DiskFilesystem) walkDir(ctx context.Context, dir, objectType string, depth int, fn func(string, Blob) error, errs *[]error, budget *listBudget) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			*errs = append(*errs, err)
+		}
+		return nil
+	}
+	if err := budget.read(dir, depth, len(entries)); err != nil {
+		return err
+	}
+
+	hashed := IsHashed(objectType)
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			continue
+		}
+		if e.IsDir() && hashed && isHex(e.Name()) {
+			if err := d.walkDir(ctx, filepath.Join(dir, e.Name()), objectType, depth+1, fn, errs, budget); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.IsDir() || !isBlobEntry(e, objectType == "locks") || hashed && depth == 0 && !isFlatBlob(e) {
+			if err := d.unexpectedEntry(filepath.Join(dir, e.Name())); err != nil {
+				*errs = append(*errs, err)
+			}
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// the blob has been removed since the directory was read
+			continue
+		}
+		if err != nil {
+			*errs = append(*errs, err)
+			continue
+		}
+		if err := fn(objectType, Blob{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isFlatBlob reports whether e is a blob stored directly in the directory of
+// a hashed object type. Apart from the subdirs the directory only contains
+// blobs if the repository uses the flat layout.
+func isFlatBlob(e os.DirEntry) bool {
+	return e.Type().IsRegular() && len(e.Name()) == blobNameLength && isHex(e.Name())
+}
+
+// CheckBlob returns the size of the blob.
+func (d *DiskFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	info, err := d.Stat(ctx, path)
+	if err != nil {
+		return Blob{}, err
+	}
+	return info.Blob(), nil
+}
+
+// Stat returns the size, modification time and mode of the blob.
+func (d *DiskFilesystem) Stat(ctx context.Context, path string) (BlobInfo, error) {
+	var info BlobInfo
+	err := d.withBlob(path, func(path string) error {
+		st, err := d.fsys().Stat(path)
+		if err != nil {
+			return err
+		}
+		info = BlobInfo{Name: st.Name(), Size: st.Size(), ModTime: st.ModTime(), Mode: st.Mode()}
+		return nil
+	})
+	return info, err
+}
+
+// BlobExists returns whether the blob exists. It still needs to stat the
+// file, but does not return its size and modification time.
+func (d *DiskFilesystem) BlobExists(ctx context.Context, path string) (bool, error) {
+	err := d.withBlob(path, func(path string) error {
+		_, err := d.fsys().Stat(path)
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetBlob opens the blob for reading. With a ReadIdleTimeout, the file is
+// closed once it has been idle for too long.
+func (d *DiskFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	var f *os.File
+	err := d.withBlob(path, func(path string) error {
+		var err error
+		f, err = d.fsys().Open(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if d.ReadIdleTimeout > 0 {
+		return newIdleReader(f, d.ReadIdleTimeout), nil
+	}
+	return f, nil
+}
+
+// OpenBlob opens the blob for reads at arbitrary offsets. Concurrent readers
+// of the same file share its descriptor, ReadAt uses pread and is safe for
+// concurrent use. A blob which has been replaced or removed is opened again
+// for new readers. With a ReadIdleTimeout each reader opens the file itself,
+// so that abandoned readers are still closed.
+func (d *DiskFilesystem) OpenBlob(ctx context.Context, path string) (BlobReaderAt, error) {
+	if d.ReadIdleTimeout > 0 {
+		return getBlobReaderAt(ctx, d, path)
+	}
+	var rd BlobReaderAt
+	err := d.withBlob(path, func(path string) error {
+		var err error
+		rd, err = d.openBlobs.open(d.fsys(), path)
+		return err
+	})
+	return rd, err
+}
+
+// sharedFiles are the files opened by OpenBlob, each is closed once its last
+// reader has been closed.
+type sharedFiles struct {
+	mu    sync.Mutex
+	files map[string]*sharedFile
+}
+
+// sharedFile is a file opened by OpenBlob, refs is protected by the mutex of
+// sharedFiles.
+type sharedFile struct {
+	f    *os.File
+	info os.FileInfo
+	refs int
+}
+
+// open returns a reader for the file at path, which shares the descriptor
+// with the other readers of the file unless it has been replaced. The size
+// is taken from the opened descriptor, a file which is not open yet costs
+// no stat of its path.
+func (s *sharedFiles) open(sys osFS, path string) (BlobReaderAt, error) {
+	s.mu.Lock()
+	_, shared := s.files[path]
+	s.mu.Unlock()
+	if shared {
+		fi, err := sys.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		if sf, ok := s.files[path]; ok && os.SameFile(sf.info, fi) {
+			sf.refs++
+			s.mu.Unlock()
+			return &sharedReader{files: s, path: path, sf: sf}, nil
+		}
+		s.mu.Unlock()
+	}
+
+	f, err := sys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	sf := &sharedFile{f: f, info: fi, refs: 1}
+	s.mu.Lock()
+	if s.files == nil {
+		s.files = make(map[string]*sharedFile)
+	}
+	// replaces a stale file, which is closed by its last reader
+	s.files[path] = sf
+	s.mu.Unlock()
+	return &sharedReader{files: s, path: path, sf: sf}, nil
+}
+
+// release drops a reference to sf and closes the file with the last one.
+func (s *sharedFiles) release(path string, sf *sharedFile) error {
+	s.mu.Lock()
+	sf.refs--
+	last := sf.refs == 0
+	if last && s.files[path] == sf {
+		delete(s.files, path)
+	}
+	s.mu.Unlock()
+	if last {
+		return sf.f.Close()
+	}
+	return nil
+}
+
+// sharedReader is a reader of a sharedFile.
+type sharedReader struct {
+	files  *sharedFiles
+	path   string
+	sf     *sharedFile
+	closed uint32 // must be accessed using sync/atomic
+}
+
+func (r *sharedReader) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadUint32(&r.closed) != 0 {
+		return 0, os.ErrClosed
+	}
+	return r.sf.f.ReadAt(p, off)
+}
+
+func (r *sharedReader) Size() int64 { return r.sf.info.Size() }
+
+func (r *sharedReader) Close() error {
+	if !atomic.CompareAndSwapUint32(&r.closed, 0, 1) {
+		return os.ErrClosed
+	}
+	return r.files.release(r.path, r.sf)
+}
+
+// SaveBlob writes the blob to a temporary file in the same directory, syncs
+// it and then renames it to its final name. Afterwards the directory is
+// synced so that the new name is persisted. Syncing is controlled by the
+// SyncMode, locks are always synced, see durableObjectTypes.
+//
+// For concurrent uploads of the same blob only one rename happens at a time,
+// and an upload which finishes after a later one has been saved is
+// discarded, so the newest upload wins.
+//
+// A new blob announced and uploaded with zero bytes is created directly, as
+// there is no data which could be visible partially, see saveEmpty.
+//
+// If MinFreeSpace is set, the upload is rejected with ErrNoSpace if there is
+// not enough free space left. If MaxBlobSize is set, blobs exceeding it are
+// rejected with ErrBlobTooLarge, either up front if expectedSize is too large
+// or as soon as the data read from rd exceeds the limit. If SkipExistingBlobs
+// is set, an existing blob of expectedSize bytes is kept and the data read
+// from rd is discarded.
+func (d *DiskFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	if err := d.validateBlobPath(path); err != nil {
+		return 0, err
+	}
+	if d.MinFreeSpace > 0 {
+		if err := d.checkFreeSpace(path, expectedSize); err != nil {
+			return 0, err
+		}
+	}
+	if d.MaxBlobSize > 0 {
+		if expectedSize > d.MaxBlobSize {
+			return 0, fmt.Errorf("blob of %d bytes: %w", expectedSize, ErrBlobTooLarge)
+		}
+	}
+	policy := d.overwritePolicy()
+	switch policy {
+	case OverwriteReject:
+		if exists, err := d.BlobExists(ctx, path); err != nil || exists {
+			return 0, existsError(path, err)
+		}
+	case OverwriteSkipIfSame:
+		if d.sameBlob(ctx, path, expectedSize) {
+			return skipBlob(ctx, path, rd, expectedSize)
+		}
+	}
+	repo, _, _ := SplitBlobPath(path)
+	blobPath := path
+	path = d.resolve(path)
+	if err := d.checkSymlinks(repo, path); err != nil {
+		return 0, err
+	}
+	w := d.writers.start(path)
+	defer w.finish()
+	if d.SaveTiming != nil {
+		w.timer = newSaveTimer()
+	}
+	var n int64
+	var err error
+	done := false
+	if expectedSize == 0 {
+		rd, done, err = d.saveEmpty(ctx, path, rd, policy != OverwriteReject, w)
+	}
+	if !done {
+		n, err = d.writeFile(ctx, path, rd, expectedSize, d.MaxBlobSize, true, policy != OverwriteReject, w)
+	}
+	if policy == OverwriteReject && errors.Is(err, ErrExists) {
+		// saved concurrently
+		return n, existsError(blobPath, nil)
+	}
+	if err == nil && w.timer != nil {
+		d.SaveTiming(blobPath, w.timer.timing)
+	}
+	return n, err
+}
+
+// saveEmpty creates the blob at path on disk, which has been announced to be
+// empty, without a temporary file if rd is empty. A new file has no data to
+// sync, so only its directory is synced according to the SyncMode. It
+// reports whether the blob has been saved or has failed. Otherwise, if rd
+// is not empty or an existing file has to be replaced atomically, the blob
+// must be saved by writeFile reading the returned reader, which replaces
+// rd.
+func (d *DiskFilesystem) saveEmpty(ctx context.Context, path string, rd io.Reader, replace bool, w *pathWriter) (io.Reader, bool, error) {
+	var probe [1]byte
+	n, err := io.ReadFull(contextReader{ctx, rd}, probe[:])
+	if n > 0 {
+		// fails with ErrLongWrite
+		return io.MultiReader(bytes.NewReader(probe[:n]), rd), false, nil
+	}
+	if err != io.EOF {
+		return rd, true, err
+	}
+
+	mode := d.syncModeFor(path, true)
+	if _, objectType, _ := SplitBlobPath(path); mode == SyncDeferred && isBarrier(objectType) {
+		if err := d.Flush(); err != nil {
+			return rd, true, err
+		}
+	}
+	timer := w.saveTimer()
+	created, err := w.commit(func() error {
+		err := d.createEmpty(path)
+		if os.IsNotExist(err) {
+			if err := d.repairDir(filepath.Dir(path)); err != nil {
+				return err
+			}
+			err = d.createEmpty(path)
+		}
+		return err
+	})
+	if os.IsExist(err) && replace {
+		return bytes.NewReader(nil), false, nil
+	}
+	if err != nil {
+		return rd, true, classify(err)
+	}
+	timer.lap(phaseOpen)
+	if !created {
+		// a newer upload has already replaced the file
+		return rd, true, nil
+	}
+	if err := d.syncDirMode(filepath.Dir(path), mode); err != nil {
+		return rd, true, err
+	}
+	timer.lap(phaseSyncDir)
+	return rd, true, nil
+}
+
+// createEmpty creates the empty file path, which must not exist.
+func (d *DiskFilesystem) createEmpty(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.fileMode())
+	if err != nil {
+		return err
+	}
+	err = d.chmodFile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+func (d *DiskFilesystem) overwritePolicy() OverwritePolicy {
+	if d.OverwritePolicy == OverwriteReplace && d.SkipExistingBlobs {
+		return OverwriteSkipIfSame
+	}
+	return d.OverwritePolicy
+}
+
+// existsError returns err if it is not nil, and ErrBlobExists for the blob
+// at path otherwise.
+func existsError(path string, err error) error {
+	if err != nil {
+		return err
+	}
+	return &os.PathError{Op: "save", Path: path, Err: ErrBlobExists}
+}
+
+// sameBlob reports whether the blob at path exists with expectedSize bytes
+// and, if OverwriteVerify is set, matches its name.
+func (d *DiskFilesystem) sameBlob(ctx context.Context, path string, expectedSize int64) bool {
+	if expectedSize < 0 {
+		return false
+	}
+	if b, err := d.CheckBlob(ctx, path); err != nil || b.Size != expectedSize {
+		return false
+	}
+	return !d.OverwriteVerify || VerifyBlob(ctx, d, path) == nil
+}
+
+// skipBlob reads and discards the data uploaded for the blob at path, which
+// already exists with size bytes. It fails if the amount of data differs.
+func skipBlob(ctx context.Context, path string, rd io.Reader, size int64) (int64, error) {
+	n, err := io.Copy(io.Discard, contextReader{ctx, rd})
+	if err == nil {
+		err = checkSize(path, n, size)
+	}
+	return n, err
+}
+
+// FreeSpace returns the free space available to the server and the total size
+// of the disk storing path, in bytes.
+func (d *DiskFilesystem) FreeSpace(path string) (free, total uint64, err error) {
+	return freeSpace(path)
+}
+
+// checkFreeSpace returns ErrNoSpace if saving a blob of expectedSize bytes,
+// which may be negative if unknown, at path would leave less than
+// MinFreeSpace bytes free.
+func (d *DiskFilesystem) checkFreeSpace(path string, expectedSize int64) error {
+	// the repository may not exist yet, check the closest existing parent
+	dir := filepath.Dir(path)
+	free, _, err := freeSpace(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		free, _, err = freeSpace(dir)
+	}
+	if err != nil {
+		return err
+	}
+	need := d.MinFreeSpace
+	if expectedSize > 0 {
+		need += uint64(expectedSize)
+	}
+	if free < need {
+		return fmt.Errorf("%d bytes free, %d bytes reserved: %w", free, d.MinFreeSpace, ErrNoSpace)
+	}
+	return nil
+}
+
+// copyChunk is the amount of data copied between two checks of the context.
+const copyChunk = 1 << 20
+
+// getCopyBuffer returns a buffer of CopyBufferSize bytes from the pool, which
+// must be put back once it is no longer used.
+func (d *DiskFilesystem) getCopyBuffer() *[]byte {
+	if bp, ok := d.copyBuffers.Get().(*[]byte); ok && len(*bp) == d.CopyBufferSize {
+		return bp
+	}
+	buf := make([]byte, d.CopyBufferSize)
+	return &buf
+}
+
+// copyData copies the data from rd to f in chunks of copyChunk bytes and
+// checks the context before each chunk. Each chunk is copied by f.ReadFrom
+// with an io.LimitedReader reading directly from rd, so that the runtime can
+// use copy_file_range or splice if rd is a file or a socket and the data
+// never passes through userspace. If CopyBufferSize is set, data which is
+// not read from a file is copied through a pooled buffer of that size
+// instead.
+//
+// If maxSize is positive, the copy fails with ErrBlobTooLarge once more than
+// maxSize bytes have been read.
+func (d *DiskFilesystem) copyData(ctx context.Context, f *os.File, rd io.Reader, maxSize int64) (int64, error) {
+	var buf []byte
+	if _, isFile := rd.(*os.File); d.CopyBufferSize > 0 && !isFile {
+		bp := d.getCopyBuffer()
+		defer d.copyBuffers.Put(bp)
+		buf = *bp
+	}
+
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := int64(copyChunk)
+		if len(buf) > copyChunk {
+			chunk = int64(len(buf))
+		}
+		if maxSize > 0 && maxSize+1-written < chunk {
+			// reading one byte more than allowed detects an oversized blob
+			chunk = maxSize + 1 - written
+		}
+		var n int64
+		var err error
+		if buf != nil {
+			// hide f.ReadFrom, which would copy through its own buffer
+			n, err = io.CopyBuffer(fullWriter{f}, &io.LimitedReader{R: rd, N: chunk}, buf)
+		} else {
+			n, err = f.ReadFrom(&io.LimitedReader{R: rd, N: chunk})
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if maxSize > 0 && written > maxSize {
+			return written, ErrBlobTooLarge
+		}
+		if n < chunk {
+			// the copy stops early only at the end of the data
+			return written, nil
+		}
+	}
+}
+
+// fullWriter writes all data to w, also if w returns a short write together
+// with EINTR, which writers other than *os.File may pass on from an
+// interrupted system call. *os.File already retries itself.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := f.w.Write(p[written:])
+		written += n
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// checkWritten returns an error unless the file f has the size written, the
+// number of bytes read from the upload.
+func checkWritten(f *os.File, written int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != written {
+		return fmt.Errorf("%v: %d bytes on disk, but %d bytes were uploaded", f.Name(), fi.Size(), written)
+	}
+	return nil
+}
+
+// DeleteBlob removes the blob. If needSize is set, the size is that of the
+// removed file, see removeWithSize.
+func (d *DiskFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	err := d.withBlob(path, func(path string) error {
+		if !needSize {
+			return d.fsys().Remove(path)
+		}
+		var err error
+		size, err = d.removeWithSize(path)
+		return err
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return size, nil
+}
+
+// removeWithSize removes the file at path and returns its size. A stat
+// before the removal may see a different file than the one removed if the
+// blob is saved again concurrently, so the file is first renamed to a
+// temporary name which no one else uses and removed from there. The size is
+// always that of the removed file, which keeps the accounting of quotas
+// exact.
+//
+// If removing the file fails, it is renamed back. This replaces a blob
+// saved in the meantime, which has the same contents as blobs are named after
+// their hash, and the failed deletion does not change the usage. Only if the
+// server crashes in between, the blob is left behind as a temporary file
+// and removed by SweepTemps.
+func (d *DiskFilesystem) removeWithSize(path string) (int64, error) {
+	tmp := filepath.Join(filepath.Dir(path), tempName(filepath.Base(path), fmt.Sprintf("%08x", rand.Uint32())))
+	if err := d.fsys().Rename(path, tmp); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, notExist("remove", path)
+		}
+		return 0, err
+	}
+	var size int64
+	if stat, err := d.fsys().Stat(tmp); err == nil {
+		size = stat.Size()
+	}
+	if err := d.fsys().Remove(tmp); err != nil {
+		if rerr := d.fsys().Rename(tmp, path); rerr != nil {
+			log.Printf("error restoring %v after a failed removal, it is left behind as %v: %v", path, tmp, rerr)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// deleteWorkers is the number of blobs removed in parallel by DeleteBlobs.
+const deleteWorkers = 8
+
+// DeleteBlobs removes the blobs in parallel.
+func (d *DiskFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < deleteWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				size, err := d.DeleteBlob(ctx, paths[i], needSize)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					errs[i] = err
+					continue
+				}
+				sizes[i] = size
+			}
+		}()
+	}
+	for i := range paths {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return sizes, NewBatchError(errs)
+}
+
+// writeFile atomically replaces the file at path with the data read from rd,
+// using a temporary file which is committed by commitFile. If blob is set, a
+// missing parent directory is created. Unless replace is set, it fails with
+// an error matching ErrExists if the file exists. The rename is done via w,
+// which may be nil. If Preallocate is set, the space for expectedSize bytes
+// is allocated up front unless expectedSize is negative. If maxSize is
+// positive, more data fails with ErrBlobTooLarge.
+//
+// Errors are marked using classify. The temporary file is removed on all
+// errors, so that a failed upload does not use up space.
+func (d *DiskFilesystem) writeFile(ctx context.Context, path string, rd io.Reader, expectedSize, maxSize int64, blob, replace bool, w *pathWriter) (written int64, err error) {
+	defer func() {
+		err = classify(err)
+	}()
+
+	tmpDir, name := d.stagingDir(filepath.Dir(path)), filepath.Base(path)
+	tf, err := tempFile(tmpDir, name, d.fileMode())
+	if os.IsNotExist(err) && blob {
+		// the error is caused by a missing directory, create it and retry
+		mkdirErr := d.repairDir(filepath.Dir(path))
+		if mkdirErr != nil {
+			log.Print(mkdirErr)
+		} else {
+			// try again
+			tf, err = tempFile(tmpDir, name, d.fileMode())
+		}
+	}
+	if err == nil {
+		err = d.chmodFile(tf)
+		if err != nil {
+			_ = tf.Close()
+			removeTemp(tf.Name())
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d.UseFileLocks {
+		unlock := lockWrite(tf.Name())
+		defer unlock()
+	}
+
+	preallocated := false
+	if d.Preallocate && expectedSize > 0 {
+		err := preallocate(tf, expectedSize)
+		if isNoSpace(err) {
+			_ = tf.Close()
+			removeTemp(tf.Name())
+			return 0, err
+		}
+		// other errors mean that the filesystem does not support it
+		preallocated = err == nil
+	}
+	timer := w.saveTimer()
+	timer.lap(phaseOpen)
+
+	written, err = d.copyData(ctx, tf, rd, maxSize)
+	if err == nil {
+		// the data is only checked afterwards to keep the fast paths of
+		// copyData for files
+		err = checkSize(path, written, expectedSize)
+	}
+	if err == nil && preallocated && written < expectedSize {
+		// remove the part of the preallocated space which was not used
+		err = tf.Truncate(written)
+	}
+	if err == nil {
+		// guards against data lost by a short write going unnoticed
+		err = checkWritten(tf, written)
+	}
+	if err != nil {
+		_ = tf.Close()
+		removeTemp(tf.Name())
+		return written, err
+	}
+	timer.lap(phaseCopy)
+
+	return written, d.commitFile(tf, path, blob, replace, w)
+}
+
+// commitFile syncs and closes the temporary file tf and renames it to path
+// via w, which may be nil. Unless replace is set, it is moved with
+// linkNoReplace instead. If blob is set, a missing parent directory is
+// created and with SyncDeferred the file is synced in the background unless
+// it is a barrier. If DropCache is set, the file is evicted from the page
+// cache after syncing. The temporary file is removed on all errors.
+func (d *DiskFilesystem) commitFile(tf *os.File, path string, blob, replace bool, w *pathWriter) error {
+	mode := d.syncModeFor(path, blob)
+	deferSync := false
+	if mode == SyncDeferred {
+		_, objectType, _ := SplitBlobPath(path)
+		if !blob || isBarrier(objectType) {
+			if err := d.Flush(); err != nil {
+				_ = tf.Close()
+				removeTemp(tf.Name())
+				return err
+			}
+		} else {
+			deferSync = true
+		}
+	}
+
+	var syncNotSup bool
+	var err error
+	if !deferSync {
+		syncNotSup, err = d.syncFileMode(tf, mode)
+	}
+	if err != nil {
+		_ = tf.Close()
+		removeTemp(tf.Name())
+		return err
+	}
+	if d.DropCache && !deferSync {
+		// the cache is only a performance concern, errors are ignored
+		_ = dropCache(tf)
+	}
+
+	if err := tf.Close(); err != nil {
+		removeTemp(tf.Name())
+		return err
+	}
+	timer := w.saveTimer()
+	timer.lap(phaseSync)
+
+	rename := d.fsys().Rename
+	if !replace {
+		rename = d.linkNoReplace
+	}
+	renamed, err := w.commit(func() error {
+		err := rename(tf.Name(), path)
+		if os.IsNotExist(err) && blob {
+			// staged in TempDir, the directory has not been created yet
+			if err := d.repairDir(filepath.Dir(path)); err != nil {
+				return err
+			}
+			err = rename(tf.Name(), path)
+		}
+		if isCrossDevice(err) && filepath.Dir(tf.Name()) != filepath.Dir(path) {
+			err = d.restage(tf.Name(), path, mode, !deferSync, rename)
+		}
+		return err
+	})
+	if err != nil {
+		removeTemp(tf.Name())
+		return err
+	}
+	timer.lap(phaseRename)
+	if !renamed {
+		// a newer upload has already replaced the file
+		removeTemp(tf.Name())
+		return nil
+	}
+
+	if deferSync {
+		d.syncs.add(path, d.deferredSync)
+		return nil
+	}
+	if !syncNotSup {
+		if err := d.syncDirMode(filepath.Dir(path), mode); err != nil {
+			// Don't call os.Remove(path) as this is prone to race conditions with parallel upload retries
+			return err
+		}
+		timer.lap(phaseSyncDir)
+	}
+	return nil
+}
+
+// restage moves the temporary file name, which could not be renamed to path
+// because it is stored on another filesystem, by copying it to a new
+// temporary file in the directory of path and renaming that one, so that path
+// is still replaced atomically. The copy is synced according to mode if sync
+// is set. name is removed once path has been replaced.
+func (d *DiskFilesystem) restage(name, path string, mode SyncMode, sync bool, rename func(oldpath, newpath string) error) error {
+	d.crossDevice.Do(func() {
+		log.Printf("WARNING: cannot rename temporary files from %v to %v, copying them instead", filepath.Dir(name), filepath.Dir(path))
+	})
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tf, err := tempFile(filepath.Dir(path), filepath.Base(path), d.fileMode())
+	if err != nil {
+		return err
+	}
+	err = d.chmodFile(tf)
+	if err == nil {
+		_, err = io.Copy(tf, src)
+	}
+	if err == nil && sync {
+		_, err = d.syncFileMode(tf, mode)
+	}
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = rename(tf.Name(), path)
+	}
+	if err != nil {
+		removeTemp(tf.Name())
+		return err
+	}
+	removeTemp(name)
+	return nil
+}
+
+// linkNoReplace moves the file at oldpath to newpath, it fails with an error
+// matching ErrExists if newpath exists. The file is hard linked to newpath and
+// then removed, so that of two concurrent calls only one succeeds. On
+// filesystems without hard links newpath is checked before renaming the file.
+func (d *DiskFilesystem) linkNoReplace(oldpath, newpath string) error {
+	err := d.fsys().Link(oldpath, newpath)
+	if err == nil {
+		removeTemp(oldpath)
+		return nil
+	}
+	if !os.IsExist(err) {
+		if _, err = os.Lstat(newpath); os.IsNotExist(err) {
+			return d.fsys().Rename(oldpath, newpath)
+		}
+	}
+	if err == nil || os.IsExist(err) {
+		return &os.PathError{Op: "create", Path: newpath, Err: ErrExists}
+	}
+	return err
+}
+
+// Rename moves the file at oldpath to newpath, creating the parent directory
+// of newpath if necessary.
+func (d *DiskFilesystem) Rename(ctx context.Context, oldpath, newpath string) error {
+	oldpath, newpath = d.resolve(oldpath), d.resolve(newpath)
+	if err := d.mkdirAll(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	if err := d.fsys().Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	return d.syncDir(filepath.Dir(newpath))
+}
+
+// Link creates newpath as a hard link to the file at oldpath, creating the
+// parent directory of newpath if necessary.
+func (d *DiskFilesystem) Link(ctx context.Context, oldpath, newpath string) error {
+	oldpath, newpath = d.resolve(oldpath), d.resolve(newpath)
+	if err := d.mkdirAll(filepath.Dir(newpath)); err != nil {
+		return err
+	}
+	if err := d.fsys().Link(oldpath, newpath); err != nil {
+		return err
+	}
+	return d.syncDir(filepath.Dir(newpath))
+}
+
+// RepoStats returns the statistics of the repository. The intermediate
+// subdirs of hashed object types are read in parallel.
+func (d *DiskFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	if _, err := os.Stat(path); err != nil {
+		return RepoStats{}, err
+	}
+
+	var stats RepoStats
+	for _, t := range d.objectTypes() {
+		var o ObjectStats
+		var err error
+		if IsHashed(t) {
+			o, err = hashedDirStats(ctx, filepath.Join(path, t), d.statsWorkers())
+		} else {
+			o, err = dirStats(ctx, filepath.Join(path, t))
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return RepoStats{}, err
+		}
+		stats.add(t, o)
+	}
+	return stats, nil
+}
+
+// defaultStatsWorkers is the default number of intermediate subdirs read in
+// parallel by RepoStats and CountBlobs, maxStatsWorkers the highest number
+// used regardless of StatsWorkers.
+const (
+	defaultStatsWorkers = 8
+	maxStatsWorkers     = 64
+)
+
+func (d *DiskFilesystem) statsWorkers() int {
+	switch {
+	case d.StatsWorkers <= 0:
+		return defaultStatsWorkers
+	case d.StatsWorkers > maxStatsWorkers:
+		return maxStatsWorkers
+	}
+	return d.StatsWorkers
+}
+
+// hashedDirStats sums up the files in the subdirs of dir, the directory of a
+// hashed object type, and the blobs stored in dir by the flat layout. The
+// subdirs are read by up to workers goroutines in parallel.
+func hashedDirStats(ctx context.Context, dir string, workers int) (ObjectStats, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ObjectStats{}, err
+	}
+
+	var size, count int64
+	var subdirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			subdirs = append(subdirs, filepath.Join(dir, e.Name()))
+			continue
+		}
+		if !isFlatBlob(e) {
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return ObjectStats{}, err
+		}
+		size += fi.Size()
+		count++
+	}
+	err = runParallel(ctx, len(subdirs), workers, func(i int) error {
+		o, err := dirStats(ctx, subdirs[i])
+		if errors.Is(err, os.ErrNotExist) {
+			// the empty subdir has been removed by Compact
+			err = nil
+		}
+		atomic.AddInt64(&size, o.Size)
+		atomic.AddInt64(&count, o.Count)
+		return err
+	})
+	if err != nil {
+		return ObjectStats{}, err
+	}
+	return ObjectStats{Size: size, Count: count}, nil
+}
+
+// dirStats sums up the files in dir and its subdirs.
+func dirStats(ctx context.Context, dir string) (ObjectStats, error) {
+	if err := ctx.Err(); err != nil {
+		return ObjectStats{}, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ObjectStats{}, err
+	}
+
+	var o ObjectStats
+	for _, e := range entries {
+		if e.IsDir() {
+			sub, err := dirStats(ctx, filepath.Join(dir, e.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return ObjectStats{}, err
+			}
+			o.Size += sub.Size
+			o.Count += sub.Count
+			continue
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// the blob has been removed since the directory was read
+			continue
+		}
+		if err != nil {
+			return ObjectStats{}, err
+		}
+		o.Size += fi.Size()
+		o.Count++
+	}
+	return o, nil
+}
+
+// CountBlobs returns the number of blobs of each object type in the
+// repository at path. Unlike RepoStats it only reads the directories and
+// does not stat the blobs, so it is cheap enough to be polled for monitoring.
+// The subdirs of hashed object types are read in parallel. Temporary files
+// of uploads are not counted, missing object type directories count as
+// empty.
+func (d *DiskFilesystem) CountBlobs(ctx context.Context, path string) (map[string]int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, t := range d.objectTypes() {
+		var n int
+		var err error
+		if IsHashed(t) {
+			n, err = countHashed(ctx, filepath.Join(path, t), d.statsWorkers())
+		} else {
+			n, err = countDir(ctx, filepath.Join(path, t))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		counts[t] = n
+	}
+	return counts, nil
+}
+
+// countHashed counts the blobs in the subdirs of dir, the directory of a
+// hashed object type, and those stored in dir by the flat layout, using up
+// to workers goroutines.
+func countHashed(ctx context.Context, dir string, workers int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	var subdirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			subdirs = append(subdirs, filepath.Join(dir, e.Name()))
+		} else if isFlatBlob(e) {
+			total++
+		}
+	}
+	err = runParallel(ctx, len(subdirs), workers, func(i int) error {
+		n, err := countDir(ctx, subdirs[i])
+		if errors.Is(err, os.ErrNotExist) {
+			// the empty subdir has been removed by Compact
+			err = nil
+		}
+		atomic.AddInt64(&total, int64(n))
+		return err
+	})
+	return int(total), err
+}
+
+// countDir counts the files in dir and its subdirs, except for temporary
+// files.
+func countDir(ctx context.Context, dir string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		if e.IsDir() {
+			sub, err := countDir(ctx, filepath.Join(dir, e.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return 0, err
+			}
+			n += sub
+			continue
+		}
+		if e.Type().IsRegular() && !isTempFile(e.Name()) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// TempPrefix is prepended to the name of a saved file, followed by a short
+// random token, to name the temporary file it is written to before it is
+// renamed. Temporary files are only left behind if the server crashes or
+// removing them fails, SweepTemps and CleanTemp remove them.
+const TempPrefix = ".tmp-"
+
+// TempSuffix was appended to the name of a saved file, followed by a random
+// number, to name the temporary files of earlier versions. They are still
+// recognized, so that those left behind are removed as well.
+const TempSuffix = ".rest-server-temp"
+
+// TempSweepAge is the time since the last modification after which
+// SweepTemps considers a temporary file orphaned.
+const TempSweepAge = time.Hour
+
+// tempName returns the name of a temporary file for the file name.
+func tempName(name, token string) string {
+	return TempPrefix + name + "-" + token
+}
+
+// isTempFile reports whether name is the name of a temporary file.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, TempPrefix) || strings.Contains(name, TempSuffix)
+}
+
+// removeTemp removes the temporary file name after saving a file has failed.
+// A failure is logged instead of being returned, so that it does not mask the
+// error which aborted saving the file.
+func removeTemp(name string) {
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("error removing temporary file, it is left behind: %v", err)
+	}
+}
+
+// SweepTemps removes the temporary files below path, the base directory of
+// all repositories, which have not been modified for TempSweepAge. It is
+// meant to be run on startup to remove the files of uploads which were never
+// committed, e.g. because the server crashed. The temporary files of uploads
+// still in progress, e.g. by another server for the same directory, are
+// written to continuously and thus kept. Unlike CleanTemp, nested
+// repositories are included. The number of removed files is returned.
+func (d *DiskFilesystem) SweepTemps(ctx context.Context, path string) (int, error) {
+	return d.cleanTemp(ctx, path, TempSweepAge, false)
+}
+
+// CleanTemp removes the temporary files left behind in the repository at path
+// which have not been modified for longer than olderThan, so that files of
+// uploads still in progress are kept. Repositories nested in the repository
+// are skipped. The temporary files in TempDir are removed as well, they may
+// belong to any repository. The number of removed files is returned.
+func (d *DiskFilesystem) CleanTemp(ctx context.Context, path string, olderThan time.Duration) (int, error) {
+	return d.cleanTemp(ctx, path, olderThan, true)
+}
+
+// cleanTemp implements CleanTemp and SweepTemps, nested repositories are only
+// skipped if skipNested is set.
+func (d *DiskFilesystem) cleanTemp(ctx context.Context, path string, olderThan time.Duration, skipNested bool) (int, error) {
+	removed := 0
+	clean := func(file string, e os.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !e.Type().IsRegular() || !isTempFile(e.Name()) {
+			return nil
+		}
+		fi, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// renamed or removed in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.now().Sub(fi.ModTime()) <= olderThan {
+			return nil
+		}
+		if err := d.fsys().Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	}
+
+	err := filepath.WalkDir(path, func(file string, e os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && file != path {
+			// removed in the meantime, e.g. by Compact
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if skipNested && e.IsDir() && file != path && d.isNestedRepo(path, file) {
+			return filepath.SkipDir
+		}
+		return clean(file, e)
+	})
+	if err != nil || d.TempDir == "" {
+		return removed, err
+	}
+
+	entries, err := os.ReadDir(d.TempDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+	for _, e := range entries {
+		if err := clean(filepath.Join(d.TempDir, e.Name()), e); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// tempFile creates a new temporary file in dir for the file name.
+func tempFile(dir, name string, perm os.FileMode) (f *os.File, err error) {
+	for i := 0; i < 10; i++ {
+		fn := filepath.Join(dir, tempName(name, fmt.Sprintf("%08x", rand.Uint32())))
+		f, err = os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) {
+			continue
+		}
+		break
+	}
+	return
+}
+
+func syncFile(f *os.File) (bool, error) {
+	err := fsync(f)
+	// Ignore error if filesystem does not support fsync.
+	syncNotSup := err != nil && (errors.Is(err, syscall.ENOTSUP) || isMacENOTTY(err))
+	if syncNotSup {
+		err = nil
+	}
+	return syncNotSup, err
+}
+
+func syncDir(dirname string) error {
+	if runtime.GOOS == "windows" {
+		// syncing a directory is not possible on windows
+		return nil
+	}
+
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	err = fsync(dir)
+	// Ignore error if filesystem does not support fsync.
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINVAL) {
+		err = nil
+	}
+	if err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// HealthCheck writes, syncs and removes a temporary file in the HealthDir
+// subdir of path. The base directory itself is not created, so that a missing
+// mount is detected.
+func (d *DiskFilesystem) HealthCheck(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	dir := filepath.Join(path, HealthDir)
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, "check-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok\n"))
+	if err == nil {
+		// a full disk may only be detected when the data is synced
+		_, err = syncFile(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Sync waits for the deferred syncs like Flush, unless ctx is canceled
+// first. Without SyncDeferred there are none, as each blob is synced before
+// SaveBlob returns, so Sync returns right away.
+func (d *DiskFilesystem) Sync(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Flush()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close waits for the deferred syncs like Flush, there are no other
+// resources to release.
+func (d *DiskFilesystem) Close() error {
+	return d.Flush()
+}
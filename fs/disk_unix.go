@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// The ExFAT driver on some versions of macOS can return ENOTTY,
+// "inappropriate ioctl for device", for fsync.
+//
+// https://github.com/restic/restic/issues/4016
+// https://github.com/realm/realm-core/issues/5789
+func isMacENOTTY(err error) bool {
+	return runtime.GOOS == "darwin" && errors.Is(err, syscall.ENOTTY)
+}
+
+// isNoSpace returns true if err is caused by a full disk or an exceeded disk
+// quota.
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// isReadOnly returns true if err is caused by a read-only filesystem.
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS)
+}
+
+// isCrossDevice returns true if err is caused by renaming a file to another
+// filesystem.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// sameDevice returns true if the existing files a and b are stored on the
+// same filesystem, so that a file can be renamed from one to the other.
+func sameDevice(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, &os.PathError{Op: "stat", Path: a, Err: err}
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, &os.PathError{Op: "stat", Path: b, Err: err}
+	}
+	return sa.Dev == sb.Dev, nil
+}
+
+// lockWrite acquires an exclusive flock on the file name through a file
+// descriptor of its own, so that the lock is kept when the file is closed
+// after writing it and moves with the file when it is renamed. Failures, e.g.
+// on filesystems without flock, are ignored. The returned function releases
+// the lock.
+func lockWrite(name string) func() {
+	f, err := os.Open(name)
+	if err != nil {
+		return func() {}
+	}
+	if ok, _ := tryLock(f, true); !ok {
+		_ = f.Close()
+		return func() {}
+	}
+	return func() { _ = f.Close() }
+}
@@ -0,0 +1,492 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNoSpaceError(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EDQUOT} {
+		err := error(&os.PathError{Op: "write", Path: "blob", Err: errno})
+		if !isNoSpace(err) {
+			t.Fatalf("%v must be detected", errno)
+		}
+		err = classify(err)
+		if !errors.Is(err, ErrNoSpace) || !errors.Is(err, errno) {
+			t.Fatalf("%v must match ErrNoSpace and the original error", err)
+		}
+	}
+	if isNoSpace(os.ErrPermission) {
+		t.Fatal("other errors must not be detected")
+	}
+}
+
+func TestReadOnlyError(t *testing.T) {
+	err := classify(&os.PathError{Op: "open", Path: "blob", Err: syscall.EROFS})
+	if !errors.Is(err, ErrReadOnly) || !errors.Is(err, syscall.EROFS) || errors.Is(err, ErrNoSpace) {
+		t.Fatalf("%v must match ErrReadOnly and the original error", err)
+	}
+	if err := classify(&os.PathError{Op: "open", Path: "blob", Err: syscall.ENOENT}); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrReadOnly) {
+		t.Fatalf("%v must only match ErrNotFound", err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.WriteString("foobar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// errors other than missing support are returned with the file name
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := syncFile(f); err == nil || !strings.Contains(err.Error(), f.Name()) {
+		t.Fatalf("want an error for a closed file, got %v", err)
+	}
+}
+
+func TestDiskFilesystemSyncObserver(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	syncs := make(map[bool]int)
+	f := &DiskFilesystem{SyncObserver: func(dir bool, duration time.Duration) {
+		mu.Lock()
+		syncs[dir]++
+		mu.Unlock()
+	}}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	syncs = make(map[bool]int)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if syncs[false] != 1 || syncs[true] != 1 {
+		t.Fatalf("want 1 sync of the file and of the directory, got %v", syncs)
+	}
+
+	// nothing is synced with SyncNone
+	f.SyncMode = SyncNone
+	syncs = make(map[bool]int)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncs) != 0 {
+		t.Fatalf("want no syncs, got %v", syncs)
+	}
+}
+
+func TestDiskFilesystemIgnoreUmask(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(022))
+
+	ctx := context.Background()
+	base := t.TempDir()
+	if err := os.Chmod(base, 0770|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ignoreUmask := range []bool{false, true} {
+		f := &DiskFilesystem{DirMode: 0770, FileMode: 0660, IgnoreUmask: ignoreUmask}
+		repo := filepath.Join(base, "repo")
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(repo, "data", testID[:2], testID)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+
+		wantDir, wantFile := os.FileMode(0750), os.FileMode(0640)
+		if ignoreUmask {
+			wantDir, wantFile = 0770, 0660
+		}
+		for _, dir := range []string{repo, filepath.Dir(blob)} {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// without IgnoreUmask, inheriting the setgid bit is up to the OS
+			if fi.Mode().Perm() != wantDir || ignoreUmask && fi.Mode()&os.ModeSetgid == 0 {
+				t.Errorf("IgnoreUmask %v: %v has mode %v", ignoreUmask, dir, fi.Mode())
+			}
+		}
+		if fi, err := os.Stat(blob); err != nil || fi.Mode().Perm() != wantFile {
+			t.Errorf("IgnoreUmask %v: want file mode %v, got %v, %v", ignoreUmask, wantFile, fi.Mode(), err)
+		}
+
+		if err := os.RemoveAll(repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiskFilesystemIgnoreUmaskSubdirs(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(077))
+
+	ctx := context.Background()
+	f := &DiskFilesystem{DirMode: 0750, FileMode: 0640, IgnoreUmask: true}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	dirs := 0
+	err := filepath.WalkDir(repo, func(path string, e os.DirEntry, err error) error {
+		if err != nil || !e.IsDir() {
+			return err
+		}
+		dirs++
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm() != 0750 {
+			t.Errorf("%v has mode %v", path, fi.Mode())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + len(ObjectTypes) + 256; dirs != want {
+		t.Fatalf("want %d directories, got %d", want, dirs)
+	}
+}
+
+// stagingReader records the temporary files in dir when it is first read.
+type stagingReader struct {
+	*strings.Reader
+	dir   string
+	files []string
+}
+
+func (r *stagingReader) Read(p []byte) (int, error) {
+	if r.files == nil {
+		entries, _ := os.ReadDir(r.dir)
+		r.files = []string{}
+		for _, e := range entries {
+			r.files = append(r.files, e.Name())
+		}
+	}
+	return r.Reader.Read(p)
+}
+
+func TestDiskFilesystemTempDir(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	f := &DiskFilesystem{TempDir: tempDir}
+	// the repository does not exist yet
+	blob := filepath.Join(t.TempDir(), "repo", "data", testID[:2], testID)
+
+	rd := &stagingReader{Reader: strings.NewReader("foobar"), dir: tempDir}
+	if _, err := f.SaveBlob(ctx, blob, rd, 6); err != nil {
+		t.Fatal(err)
+	}
+	if len(rd.files) != 1 || !strings.HasPrefix(rd.files[0], TempPrefix+testID+"-") {
+		t.Fatalf("want the blob staged in the temp dir, got %v", rd.files)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+		t.Fatalf("temp dir must be empty, got %v, %v", entries, err)
+	}
+
+	// a temp dir on another filesystem is not used
+	other, err := os.MkdirTemp("/dev/shm", "rest-server-test")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(other)
+	}()
+	if same, err := sameDevice(other, tempDir); err != nil || same {
+		t.Skipf("no other filesystem for the temp dir: %v", err)
+	}
+	f = &DiskFilesystem{TempDir: other}
+	rd = &stagingReader{Reader: strings.NewReader("foobar"), dir: other}
+	if _, err := f.SaveBlob(ctx, blob, rd, 6); err != nil {
+		t.Fatal(err)
+	}
+	if len(rd.files) != 0 {
+		t.Fatalf("temp dir on another filesystem must not be used, got %v", rd.files)
+	}
+}
+
+func TestDiskFilesystemCrossDeviceRename(t *testing.T) {
+	ctx := context.Background()
+	tempDir := t.TempDir()
+	f := &DiskFilesystem{TempDir: tempDir, sys: &faultyFS{renameErr: syscall.EXDEV}}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	for _, data := range []string{"foobar", "bazqux"} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader(data), 6); err != nil {
+			t.Fatal(err)
+		}
+		if buf, err := os.ReadFile(blob); err != nil || string(buf) != data {
+			t.Fatalf("want %q, got %q, %v", data, buf, err)
+		}
+	}
+	for _, dir := range []string{tempDir, filepath.Dir(blob)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if isTempFile(e.Name()) {
+				t.Fatalf("temporary file %v left behind in %v", e.Name(), dir)
+			}
+		}
+	}
+}
+
+func TestDiskFilesystemListRepos(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	for _, repo := range []string{"a", "b/c", "b/c/d", "b/c/data/e"} {
+		dir := filepath.Join(root, filepath.FromSlash(repo))
+		if err := f.CreateRepo(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SaveConfig(ctx, filepath.Join(dir, "config"), strings.NewReader("config")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// neither a directory without a config, a config without the object
+	// type directories nor hidden directories are repositories
+	if err := f.CreateRepo(ctx, filepath.Join(root, "uninitialized")); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"other", ".hidden"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, dir, "config"), []byte("config"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// symlinks are followed, but loops and repositories linked twice are
+	// only searched once
+	if err := os.Symlink("..", filepath.Join(root, "b", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(root, "z")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := f.ListRepos(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", filepath.Join("b", "c"), filepath.Join("b", "c", "d")}
+	if fmt.Sprint(repos) != fmt.Sprint(want) {
+		t.Fatalf("want repositories %v, got %v", want, repos)
+	}
+
+	repos, err = f.ListRepos(ctx, filepath.Join(root, "a"))
+	if err != nil || fmt.Sprint(repos) != "[.]" {
+		t.Fatalf("want the root itself, got %v, %v", repos, err)
+	}
+	if _, err := f.ListRepos(ctx, filepath.Join(root, "missing")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for a missing root, got %v", err)
+	}
+}
+
+func TestDiskFilesystemSymlinks(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	other := t.TempDir() // another volume
+
+	// the repository itself is a symlink
+	repo := filepath.Join(base, "repo")
+	if err := (&DiskFilesystem{}).CreateRepo(ctx, filepath.Join(other, "repo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(other, "repo"), repo); err != nil {
+		t.Fatal(err)
+	}
+	f := &DiskFilesystem{}
+	lock := filepath.Join(repo, "locks", testID)
+	if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+		t.Fatalf("symlinked repository: %v", err)
+	}
+
+	// the data directory is moved to another volume
+	data := filepath.Join(other, "data")
+	if err := os.Rename(filepath.Join(repo, "data"), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(data, filepath.Join(repo, "data")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("SaveBlob: want ErrInvalidName, got %v", err)
+	}
+	if _, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("ListBlobs: want ErrInvalidName, got %v", err)
+	}
+
+	follow := &DiskFilesystem{FollowSymlinks: true}
+	if _, err := follow.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, err := follow.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs: want 1 blob, got %v, %v", blobs, err)
+	}
+	if _, err := follow.CheckBlob(ctx, blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("CheckBlob: want ErrInvalidName, got %v", err)
+	}
+
+	// a blob linking to a file outside of the repository
+	secret := filepath.Join(base, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(repo, "snapshots", testID)
+	if err := os.Symlink(secret, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetBlob(ctx, snapshot); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("GetBlob: want ErrInvalidName, got %v", err)
+	}
+	if _, err := f.DeleteBlob(ctx, snapshot, false); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("DeleteBlob: want ErrInvalidName, got %v", err)
+	}
+
+	// links within the repository are fine
+	index := filepath.Join(repo, "index", testID)
+	if err := os.Symlink(lock, index); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := f.GetBlob(ctx, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "lock" {
+		t.Fatalf("wrong data read: %q", buf)
+	}
+}
+
+// lockCheckReader checks whether the temporary files in dir are locked
+// before returning the data.
+type lockCheckReader struct {
+	io.Reader
+	dir    string
+	locked bool
+	err    error
+}
+
+func (r *lockCheckReader) Read(p []byte) (int, error) {
+	if r.err == nil {
+		r.locked, r.err = isLocked(r.dir)
+	}
+	return r.Reader.Read(p)
+}
+
+// isLocked reports whether the temporary file in dir is locked.
+func isLocked(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if !isTempFile(e.Name()) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		ok, err := tryLock(f, false)
+		return !ok, err
+	}
+	return false, errors.New("no temporary file")
+}
+
+func TestDiskFilesystemUseFileLocks(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	for _, useLocks := range []bool{false, true} {
+		f := &DiskFilesystem{UseFileLocks: useLocks}
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(repo, "keys")
+		rd := &lockCheckReader{Reader: strings.NewReader("foobar"), dir: dir}
+		blob := filepath.Join(dir, testID)
+		if _, err := f.SaveBlob(ctx, blob, rd, 6); err != nil {
+			t.Fatal(err)
+		}
+		if rd.err != nil {
+			t.Fatal(rd.err)
+		}
+		if rd.locked != useLocks {
+			t.Fatalf("UseFileLocks %v: want locked %v during the upload", useLocks, useLocks)
+		}
+
+		// the lock is released afterwards
+		bf, err := os.Open(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := tryLock(bf, false)
+		_ = bf.Close()
+		if err != nil || !ok {
+			t.Fatalf("want the blob unlocked after the upload, got %v, %v", ok, err)
+		}
+		if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiskFilesystemNoSpace(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{sys: &faultyFS{mkdirErr: syscall.ENOSPC}}
+	if err := f.CreateRepo(ctx, filepath.Join(t.TempDir(), "repo")); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("want ErrNoSpace, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows is not macOS.
+func isMacENOTTY(err error) bool { return false }
+
+const (
+	errorHandleDiskFull syscall.Errno = 39   // ERROR_HANDLE_DISK_FULL
+	errorDiskFull       syscall.Errno = 112  // ERROR_DISK_FULL
+	errorDiskQuota      syscall.Errno = 1295 // ERROR_DISK_QUOTA_EXCEEDED
+	errorWriteProtect   syscall.Errno = 19   // ERROR_WRITE_PROTECT
+	errorNotSameDevice  syscall.Errno = 17   // ERROR_NOT_SAME_DEVICE
+)
+
+// isNoSpace returns true if err is caused by a full disk or an exceeded disk
+// quota.
+func isNoSpace(err error) bool {
+	return errors.Is(err, errorHandleDiskFull) || errors.Is(err, errorDiskFull) || errors.Is(err, errorDiskQuota)
+}
+
+// isReadOnly returns true if err is caused by a write-protected storage.
+func isReadOnly(err error) bool {
+	return errors.Is(err, errorWriteProtect)
+}
+
+// isCrossDevice returns true if err is caused by moving a file to another
+// volume.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
+
+// freeSpace returns the space available to the user and the total size of
+// the volume containing path.
+func freeSpace(path string) (free, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		return 0, 0, &os.PathError{Op: "GetDiskFreeSpaceEx", Path: path, Err: err}
+	}
+	return free, total, nil
+}
+
+// sameDevice returns true if the existing files a and b are stored on the
+// same volume, so that a file can be renamed from one to the other. Volumes
+// mounted into directories are not detected.
+func sameDevice(a, b string) (bool, error) {
+	for _, p := range []string{a, b} {
+		if _, err := os.Stat(p); err != nil {
+			return false, err
+		}
+	}
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB)), nil
+}
+
+// lockWrite does nothing on Windows, where locks are mandatory and would keep
+// the file from being read and renamed.
+func lockWrite(name string) func() {
+	return func() {}
+}
+
+// tryLock tries to acquire a lock on the first byte of f without waiting, it
+// returns false if f is locked by someone else.
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,439 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/minio/sha256-simd"
+)
+
+// ErrDecryption is returned by EncryptedFilesystem if stored data cannot be
+// decrypted, because it has been modified or the key is wrong.
+var ErrDecryption = newError("decryption_failed", "decryption failed")
+
+const (
+	encNonceSize   = 24
+	encSegmentSize = 64 * 1024
+	encOverhead    = 16 // size of the GCM tag
+)
+
+// EncryptedFilesystem wraps a Filesystem and encrypts the config and all
+// blobs with a key held by the server, in addition to the encryption done by
+// restic.
+//
+// Each file starts with a random nonce, which is used to derive the key for
+// the file from the server key. The data is split into segments of 64 KiB,
+// each of which is encrypted with AES-256-GCM, so that the data can be
+// decrypted starting at any offset. The name of the file is authenticated,
+// so that files cannot be swapped.
+//
+// The sizes reported for the config and blobs are the sizes of the plaintext,
+// except for RepoStats which reports the space used by the encrypted data.
+type EncryptedFilesystem struct {
+	Filesystem
+	key []byte
+}
+
+// NewEncryptedFilesystem returns an EncryptedFilesystem for base using the
+// 32 byte key.
+func NewEncryptedFilesystem(base Filesystem, key []byte) (*EncryptedFilesystem, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length %d, want 32 bytes", len(key))
+	}
+	return &EncryptedFilesystem{Filesystem: base, key: append([]byte(nil), key...)}, nil
+}
+
+// aead returns the cipher for the file with the given nonce.
+func (e *EncryptedFilesystem) aead(nonce []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, e.key)
+	_, _ = mac.Write(nonce)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// segmentNonce returns the GCM nonce for segment i, the last segment is
+// marked so that truncation is detected.
+func segmentNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// segments returns the number of segments for size bytes of plaintext.
+func segments(size int64) int64 {
+	n := (size + encSegmentSize - 1) / encSegmentSize
+	if n == 0 {
+		// empty files still consist of one (empty) segment
+		n = 1
+	}
+	return n
+}
+
+// ciphertextSize returns the size of the encrypted data for size bytes of
+// plaintext.
+func ciphertextSize(size int64) int64 {
+	return encNonceSize + size + segments(size)*encOverhead
+}
+
+// plaintextSize returns the size of the plaintext for size bytes of
+// encrypted data. ok is false if size is not a valid size.
+func plaintextSize(size int64) (n int64, ok bool) {
+	c := size - encNonceSize
+	if c < encOverhead {
+		return 0, false
+	}
+	full, rem := c/(encSegmentSize+encOverhead), c%(encSegmentSize+encOverhead)
+	if rem == 0 {
+		return full * encSegmentSize, true
+	}
+	if rem < encOverhead {
+		return 0, false
+	}
+	return full*encSegmentSize + rem - encOverhead, true
+}
+
+// plainSize converts the size of a stored file, invalid sizes are reported
+// as ErrDecryption.
+func plainSize(path string, size int64, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, ok := plaintextSize(size)
+	if !ok {
+		return 0, fmt.Errorf("%v: invalid size %d: %w", path, size, ErrDecryption)
+	}
+	return n, nil
+}
+
+// encrypt returns a reader which yields the encrypted data read from rd.
+func (e *EncryptedFilesystem) encrypt(path string, rd io.Reader) (*encryptingReader, error) {
+	nonce := make([]byte, encNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		rd:   rd,
+		aead: e.aead(nonce),
+		ad:   []byte(filepath.Base(path)),
+		buf:  nonce,
+		in:   make([]byte, encSegmentSize+1),
+		out:  make([]byte, 0, encSegmentSize+encOverhead),
+	}, nil
+}
+
+// decrypt returns a reader for the plaintext of the encrypted data in rd.
+// The first segment is decrypted right away, so that errors are detected
+// early.
+func (e *EncryptedFilesystem) decrypt(path string, rd io.ReadSeekCloser) (*decryptingReader, error) {
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := plainSize(path, size, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, encNonceSize)
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rd, nonce); err != nil {
+		return nil, err
+	}
+
+	r := &decryptingReader{
+		rd:    rd,
+		path:  path,
+		aead:  e.aead(nonce),
+		ad:    []byte(filepath.Base(path)),
+		size:  plain,
+		seg:   -1,
+		ct:    make([]byte, encSegmentSize+encOverhead),
+		plain: make([]byte, 0, encSegmentSize),
+	}
+	if err := r.load(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CheckConfig returns whether the config exists and its decrypted size.
+func (e *EncryptedFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	exists, size, err := e.Filesystem.CheckConfig(ctx, path)
+	if !exists || err != nil {
+		return exists, 0, err
+	}
+	size, err = plainSize(path, size, nil)
+	return err == nil, size, err
+}
+
+// GetConfig returns the decrypted config.
+func (e *EncryptedFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	buf, err := e.Filesystem.GetConfig(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := e.decrypt(path, nopCloser{bytes.NewReader(buf)})
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(rd)
+}
+
+// GetConfigReader returns a reader for the decrypted config. The config is
+// small, so it is decrypted as a whole to determine its size.
+func (e *EncryptedFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	buf, err := e.GetConfig(ctx, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nopCloser{bytes.NewReader(buf)}, int64(len(buf)), nil
+}
+
+// SaveConfig encrypts and saves the config.
+func (e *EncryptedFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	er, err := e.encrypt(path, rd)
+	if err != nil {
+		return err
+	}
+	return e.Filesystem.SaveConfig(ctx, path, er)
+}
+
+// ListBlobs lists the blobs with their decrypted sizes.
+func (e *EncryptedFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs, err := e.Filesystem.ListBlobs(ctx, path)
+	for i := range blobs {
+		blobs[i].Size, _ = plaintextSize(blobs[i].Size)
+	}
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for the blobs with their decrypted sizes.
+func (e *EncryptedFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	return e.Filesystem.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blob.Size, _ = plaintextSize(blob.Size)
+		return fn(blob)
+	})
+}
+
+// Walk calls fn for the blobs with their decrypted sizes.
+func (e *EncryptedFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, e, path, fn)
+}
+
+// CheckBlob returns the blob with the size of the decrypted data.
+func (e *EncryptedFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	blob, err := e.Filesystem.CheckBlob(ctx, path)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob.Size, err = plainSize(path, blob.Size, nil)
+	if err != nil {
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+// GetBlob returns a reader which decrypts the blob.
+func (e *EncryptedFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := e.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := e.decrypt(path, rd)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// SaveBlob encrypts and saves the blob. The number of plaintext bytes is
+// returned.
+func (e *EncryptedFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	er, err := e.encrypt(path, rd)
+	if err != nil {
+		return 0, err
+	}
+	if expectedSize >= 0 {
+		expectedSize = ciphertextSize(expectedSize)
+	}
+	_, err = e.Filesystem.SaveBlob(ctx, path, er, expectedSize)
+	return er.n, err
+}
+
+// DeleteBlob removes the blob, returning its decrypted size.
+func (e *EncryptedFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	size, err := e.Filesystem.DeleteBlob(ctx, path, needSize)
+	size, _ = plaintextSize(size)
+	return size, err
+}
+
+// DeleteBlobs removes the blobs, returning their decrypted sizes.
+func (e *EncryptedFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes, err := e.Filesystem.DeleteBlobs(ctx, paths, needSize)
+	for i := range sizes {
+		sizes[i], _ = plaintextSize(sizes[i])
+	}
+	return sizes, err
+}
+
+// encryptingReader encrypts the data read from rd segment by segment.
+type encryptingReader struct {
+	rd   io.Reader
+	aead cipher.AEAD
+	ad   []byte
+
+	buf     []byte // encrypted data not yet returned
+	in      []byte // plaintext of the next segment, plus one byte to detect the end
+	carry   bool   // whether in[0] has been read already
+	out     []byte
+	segment int64
+	done    bool
+
+	n int64 // plaintext bytes read
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next encrypts the next segment.
+func (r *encryptingReader) next() error {
+	start := 0
+	if r.carry {
+		start = 1
+	}
+	n, err := io.ReadFull(r.rd, r.in[start:])
+	n += start
+
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+
+	data := r.in[:n]
+	if !last {
+		data = r.in[:encSegmentSize]
+	}
+	r.n += int64(len(data))
+	r.buf = r.aead.Seal(r.out[:0], segmentNonce(r.segment, last), data, r.ad)
+	r.segment++
+
+	if last {
+		r.done = true
+	} else {
+		r.in[0] = r.in[encSegmentSize]
+		r.carry = true
+	}
+	return nil
+}
+
+// decryptingReader decrypts the data read from rd, one segment at a time.
+type decryptingReader struct {
+	rd   io.ReadSeekCloser
+	path string
+	aead cipher.AEAD
+	ad   []byte
+
+	size  int64 // plaintext size
+	pos   int64
+	seg   int64 // index of the segment in plain, -1 if none
+	ct    []byte
+	plain []byte
+}
+
+// load decrypts segment i.
+func (r *decryptingReader) load(i int64) error {
+	r.seg = -1
+	if _, err := r.rd.Seek(encNonceSize+i*(encSegmentSize+encOverhead), io.SeekStart); err != nil {
+		return err
+	}
+
+	last := i == segments(r.size)-1
+	ct := r.ct
+	if last {
+		ct = ct[:r.size-i*encSegmentSize+encOverhead]
+	}
+	if _, err := io.ReadFull(r.rd, ct); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return fmt.Errorf("%v: truncated: %w", r.path, ErrDecryption)
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(i, last), ct, r.ad)
+	if err != nil {
+		return fmt.Errorf("%v: %w", r.path, ErrDecryption)
+	}
+	r.plain = plain
+	r.seg = i
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := r.pos / encSegmentSize
+	if i != r.seg {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-i*encSegmentSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.rd.Close()
+}
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedSizes(t *testing.T) {
+	for _, size := range []int64{0, 1, encSegmentSize - 1, encSegmentSize, encSegmentSize + 1, 3*encSegmentSize + 5} {
+		n, ok := plaintextSize(ciphertextSize(size))
+		if !ok || n != size {
+			t.Errorf("size %d: got %d, %v", size, n, ok)
+		}
+	}
+	for _, size := range []int64{0, encNonceSize, encNonceSize + encOverhead - 1} {
+		if _, ok := plaintextSize(size); ok {
+			t.Errorf("ciphertext size %d must be invalid", size)
+		}
+	}
+}
+
+func TestEncryptedFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	key := bytes.Repeat([]byte{1}, 32)
+	f, err := NewEncryptedFilesystem(base, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncryptedFilesystem(base, key[:16]); err == nil {
+		t.Fatal("short keys must be rejected")
+	}
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := filepath.Join(repo, "config")
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if exists, size, err := f.CheckConfig(ctx, cfg); err != nil || !exists || size != 6 {
+		t.Fatalf("CheckConfig: got %v, %v, %v", exists, size, err)
+	}
+	if rd, size, err := f.GetConfigReader(ctx, cfg); err != nil || size != 6 {
+		t.Fatalf("GetConfigReader: got size %v, %v", size, err)
+	} else if buf := readAll(t, rd); string(buf) != "config" {
+		t.Fatalf("GetConfigReader: got %q", buf)
+	}
+	if buf, err := base.GetConfig(ctx, cfg); err != nil || bytes.Contains(buf, []byte("config")) {
+		t.Fatalf("config must be stored encrypted, got %q, %v", buf, err)
+	}
+
+	data := make([]byte, 3*encSegmentSize+5)
+	rand.New(rand.NewSource(23)).Read(data)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if n, err := f.SaveBlob(ctx, blob, bytes.NewReader(data), int64(len(data))); err != nil || n != int64(len(data)) {
+		t.Fatalf("SaveBlob: got %v, %v", n, err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != int64(len(data)) {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 1 || blobs[0].Size != int64(len(data)) {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("reading blob failed: %v", err)
+	}
+	offset := int64(encSegmentSize - 3)
+	if _, err := rd.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(rd, buf); err != nil || !bytes.Equal(buf, data[offset:offset+10]) {
+		t.Fatalf("reading across segments after seek failed: %v", err)
+	}
+	if size, err := rd.Seek(0, io.SeekEnd); err != nil || size != int64(len(data)) {
+		t.Fatalf("Seek: got %v, %v", size, err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// modified data must be detected
+	ct, err := base.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ioutil.ReadAll(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)-1] ^= 1
+	if _, err := base.SaveBlob(ctx, blob, bytes.NewReader(stored), -1); err != nil {
+		t.Fatal(err)
+	}
+	rd, err = f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rd); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("want ErrDecryption for modified blob, got %v", err)
+	}
+
+	// blobs cannot be moved to another name
+	other := filepath.Join(repo, "keys", "key")
+	if _, err := base.SaveBlob(ctx, other, bytes.NewReader(stored[:encNonceSize+encOverhead]), -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetBlob(ctx, other); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("want ErrDecryption for renamed blob, got %v", err)
+	}
+
+	// a different key cannot decrypt the data
+	empty := filepath.Join(repo, "locks", "lock")
+	if _, err := f.SaveBlob(ctx, empty, strings.NewReader(""), 0); err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := NewEncryptedFilesystem(base, bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.GetBlob(ctx, empty); !errors.Is(err, ErrDecryption) {
+		t.Fatalf("want ErrDecryption for wrong key, got %v", err)
+	}
+	if size, err := f.DeleteBlob(ctx, empty, true); err != nil || size != 0 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+}
@@ -0,0 +1,19 @@
+package fs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropCache asks the kernel to evict the cached pages of f. Only clean pages
+// are evicted, so f should have been synced before.
+func dropCache(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// prefetch asks the kernel to read f into the page cache, it does not wait
+// until f has been read.
+func prefetch(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+import (
+	"io"
+	"os"
+)
+
+// dropCache does nothing, evicting files from the page cache is only
+// supported on Linux.
+func dropCache(f *os.File) error {
+	return nil
+}
+
+// prefetch reads f, so that it is stored in the page cache.
+func prefetch(f *os.File) error {
+	_, err := io.Copy(io.Discard, f)
+	return err
+}
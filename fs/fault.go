@@ -0,0 +1,332 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Fault describes an error injected by a FaultFilesystem.
+type Fault struct {
+	// Op is the name of the Filesystem method the fault applies to, e.g.
+	// "SaveBlob", or all methods if empty.
+	Op string
+	// Every injects the fault into every Every-th matching call. If it is
+	// zero, each matching call is hit with the given Probability instead.
+	Every       int
+	Probability float64
+
+	// Err is returned by the call instead of calling the base, e.g.
+	// ErrNoSpace or syscall.EIO.
+	Err error
+	// Partial makes the fault hit the data instead of the call, for
+	// SaveBlob, SaveConfig, GetBlob and GetConfigReader. The data read by
+	// the base for uploads, or by the client for downloads, ends with Err,
+	// or with io.ErrUnexpectedEOF if it is unset, after After bytes. For
+	// uploads the base then has to discard the partial data.
+	Partial bool
+	After   int64
+	// Delay delays the return of the call. After SaveBlob, which returns
+	// once the blob has been synced, this simulates a slow fsync.
+	Delay time.Duration
+
+	calls int
+}
+
+// FaultFilesystem wraps a Filesystem and injects errors into its operations
+// according to faults, to test how the rest of the server and the clients
+// deal with a failing storage. Calls which are not hit by a fault are passed
+// to the base unchanged.
+//
+// Which calls are hit is determined by a pseudo-random generator seeded with
+// the seed, and by the number of matching calls, so that the same sequence
+// of calls is hit by the same faults again. Concurrent calls are hit in the
+// order in which they arrive.
+type FaultFilesystem struct {
+	Filesystem
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	faults   []*Fault
+	injected int
+}
+
+// NewFaultFilesystem returns a FaultFilesystem for base which injects the
+// faults, the first fault which hits a call applies.
+func NewFaultFilesystem(base Filesystem, seed int64, faults ...Fault) *FaultFilesystem {
+	f := &FaultFilesystem{Filesystem: base, rnd: rand.New(rand.NewSource(seed))}
+	for i := range faults {
+		fault := faults[i]
+		f.faults = append(f.faults, &fault)
+	}
+	return f
+}
+
+// Injected returns the number of calls which have been hit by a fault.
+func (f *FaultFilesystem) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+// fault returns the fault which hits the call of op, or nil.
+func (f *FaultFilesystem) fault(op string) *Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fault := range f.faults {
+		if fault.Op != "" && fault.Op != op {
+			continue
+		}
+		fault.calls++
+		hit := false
+		if fault.Every > 0 {
+			hit = fault.calls%fault.Every == 0
+		} else {
+			hit = f.rnd.Float64() < fault.Probability
+		}
+		if hit {
+			f.injected++
+			return fault
+		}
+	}
+	return nil
+}
+
+// before returns the error of the fault if the call must not be passed to
+// the base, after the Delay.
+func (fault *Fault) before() error {
+	if fault == nil || fault.Partial || fault.Err == nil {
+		return nil
+	}
+	time.Sleep(fault.Delay)
+	return fault.Err
+}
+
+// after delays the return of a call which has been passed to the base.
+func (fault *Fault) after() {
+	if fault != nil {
+		time.Sleep(fault.Delay)
+	}
+}
+
+// reader returns rd, or a reader failing after After bytes for a partial
+// fault.
+func (fault *Fault) reader(rd io.Reader) io.Reader {
+	if fault == nil || !fault.Partial {
+		return rd
+	}
+	return fault.limit(rd)
+}
+
+// limit returns a reader failing after After bytes of rd.
+func (fault *Fault) limit(rd io.Reader) *faultReader {
+	err := fault.Err
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return &faultReader{rd: rd, left: fault.After, err: err}
+}
+
+// faultReader reads from rd until left bytes have been read, then it fails
+// with err.
+type faultReader struct {
+	rd   io.Reader
+	left int64
+	err  error
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.rd.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+// faultReadCloser is a faultReader for a reader returned by the base.
+type faultReadCloser struct {
+	*faultReader
+	io.Closer
+}
+
+// faultReadSeekCloser is a faultReader for a blob returned by the base.
+// Seeking does not reset the number of bytes left.
+type faultReadSeekCloser struct {
+	*faultReader
+	io.Seeker
+	io.Closer
+}
+
+// CreateRepo creates the repository.
+func (f *FaultFilesystem) CreateRepo(ctx context.Context, path string) error {
+	fault := f.fault("CreateRepo")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.CreateRepo(ctx, path)
+}
+
+// CheckConfig checks the config.
+func (f *FaultFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	fault := f.fault("CheckConfig")
+	if err := fault.before(); err != nil {
+		return false, 0, err
+	}
+	defer fault.after()
+	return f.Filesystem.CheckConfig(ctx, path)
+}
+
+// GetConfig returns the config.
+func (f *FaultFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	fault := f.fault("GetConfig")
+	if err := fault.before(); err != nil {
+		return nil, err
+	}
+	defer fault.after()
+	return f.Filesystem.GetConfig(ctx, path)
+}
+
+// GetConfigReader returns a reader for the config.
+func (f *FaultFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	fault := f.fault("GetConfigReader")
+	if err := fault.before(); err != nil {
+		return nil, 0, err
+	}
+	defer fault.after()
+	rd, size, err := f.Filesystem.GetConfigReader(ctx, path)
+	if err != nil || fault == nil || !fault.Partial {
+		return rd, size, err
+	}
+	return &faultReadCloser{faultReader: fault.limit(rd), Closer: rd}, size, nil
+}
+
+// SaveConfig saves the config.
+func (f *FaultFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	fault := f.fault("SaveConfig")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.SaveConfig(ctx, path, fault.reader(rd))
+}
+
+// DeleteConfig removes the config.
+func (f *FaultFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	fault := f.fault("DeleteConfig")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.DeleteConfig(ctx, path)
+}
+
+// ListBlobs lists the blobs.
+func (f *FaultFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	fault := f.fault("ListBlobs")
+	if err := fault.before(); err != nil {
+		return nil, err
+	}
+	defer fault.after()
+	return f.Filesystem.ListBlobs(ctx, path)
+}
+
+// ListBlobsFunc lists the blobs.
+func (f *FaultFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	fault := f.fault("ListBlobsFunc")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.ListBlobsFunc(ctx, path, fn)
+}
+
+// CheckBlob returns the blob.
+func (f *FaultFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	fault := f.fault("CheckBlob")
+	if err := fault.before(); err != nil {
+		return Blob{}, err
+	}
+	defer fault.after()
+	return f.Filesystem.CheckBlob(ctx, path)
+}
+
+// GetBlob returns a reader for the blob.
+func (f *FaultFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	fault := f.fault("GetBlob")
+	if err := fault.before(); err != nil {
+		return nil, err
+	}
+	defer fault.after()
+	rd, err := f.Filesystem.GetBlob(ctx, path)
+	if err != nil || fault == nil || !fault.Partial {
+		return rd, err
+	}
+	return &faultReadSeekCloser{faultReader: fault.limit(rd), Seeker: rd, Closer: rd}, nil
+}
+
+// SaveBlob saves the blob.
+func (f *FaultFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	fault := f.fault("SaveBlob")
+	if err := fault.before(); err != nil {
+		return 0, err
+	}
+	defer fault.after()
+	return f.Filesystem.SaveBlob(ctx, path, fault.reader(rd), expectedSize)
+}
+
+// DeleteBlob removes the blob.
+func (f *FaultFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	fault := f.fault("DeleteBlob")
+	if err := fault.before(); err != nil {
+		return 0, err
+	}
+	defer fault.after()
+	return f.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs.
+func (f *FaultFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	fault := f.fault("DeleteBlobs")
+	if err := fault.before(); err != nil {
+		return nil, err
+	}
+	defer fault.after()
+	return f.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
+
+// RepoStats returns the statistics of the repository.
+func (f *FaultFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	fault := f.fault("RepoStats")
+	if err := fault.before(); err != nil {
+		return RepoStats{}, err
+	}
+	defer fault.after()
+	return f.Filesystem.RepoStats(ctx, path)
+}
+
+// Walk lists the blobs of each object type.
+func (f *FaultFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	fault := f.fault("Walk")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.Walk(ctx, path, fn)
+}
+
+// HealthCheck checks the storage.
+func (f *FaultFilesystem) HealthCheck(ctx context.Context, path string) error {
+	fault := f.fault("HealthCheck")
+	if err := fault.before(); err != nil {
+		return err
+	}
+	defer fault.after()
+	return f.Filesystem.HealthCheck(ctx, path)
+}
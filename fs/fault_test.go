@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFaultFilesystem(t *testing.T) {
+	ctx := context.Background()
+	disk := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := disk.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+
+	f := NewFaultFilesystem(disk, 1,
+		Fault{Op: "SaveBlob", Every: 2, Err: ErrNoSpace},
+		Fault{Op: "SaveBlob", Every: 2, Partial: true, After: 3},
+		Fault{Op: "GetBlob", Every: 1, Partial: true, After: 3},
+	)
+	// the second call is hit by ErrNoSpace, the third by the partial
+	// fault, which counts only the calls not hit by the first fault
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(repo, "data", "00", strings.Repeat("0", 64))
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("foobar"), 6); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("want ErrNoSpace, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("foobar"), 6); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := disk.CheckBlob(ctx, other); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("partial blob saved: %v", err)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := io.ReadAll(rd)
+	if string(buf) != "foo" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want a truncated read, got %q, %v", buf, err)
+	}
+	_ = rd.Close()
+	if n := f.Injected(); n != 3 {
+		t.Fatalf("want 3 injected faults, got %d", n)
+	}
+
+	// the same seed hits the same calls
+	hits := func(seed int64) string {
+		f := NewFaultFilesystem(disk, seed, Fault{Op: "CheckBlob", Probability: 0.5, Err: ErrNotFound})
+		var s strings.Builder
+		for i := 0; i < 64; i++ {
+			if _, err := f.CheckBlob(ctx, blob); err != nil {
+				s.WriteByte('x')
+			} else {
+				s.WriteByte('.')
+			}
+		}
+		return s.String()
+	}
+	if a, b := hits(42), hits(42); a != b || !strings.Contains(a, "x") || !strings.Contains(a, ".") {
+		t.Fatalf("want the same mix of faults, got %v and %v", a, b)
+	}
+}
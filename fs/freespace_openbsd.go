@@ -0,0 +1,20 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the space available to unprivileged users and the total
+// size of the filesystem containing path.
+func freeSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	// F_bavail is negative if the reserved blocks are in use
+	if st.F_bavail > 0 {
+		free = uint64(st.F_bavail) * uint64(st.F_bsize)
+	}
+	return free, st.F_blocks * uint64(st.F_bsize), nil
+}
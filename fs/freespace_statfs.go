@@ -0,0 +1,20 @@
+//go:build !windows && !openbsd && !netbsd && !solaris
+// +build !windows,!openbsd,!netbsd,!solaris
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the space available to unprivileged users and the total
+// size of the filesystem containing path.
+func freeSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	// the types of the fields differ between the platforms
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,22 @@
+//go:build netbsd || solaris
+// +build netbsd solaris
+
+package fs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// freeSpace returns the space available to unprivileged users and the total
+// size of the filesystem containing path. The block counts of statvfs are in
+// units of the fragment size.
+func freeSpace(path string) (free, total uint64, err error) {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(path, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "statvfs", Path: path, Err: err}
+	}
+	// the types of the fields differ between the platforms
+	return uint64(st.Bavail) * uint64(st.Frsize), uint64(st.Blocks) * uint64(st.Frsize), nil
+}
@@ -0,0 +1,816 @@
+// Package fs implements the storage layer used by the repo handler. A
+// Filesystem stores the config and the blobs of restic repositories, the
+// HTTP specific parts (status codes, quota, metrics) are left to the caller.
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectTypes are subdirs that are used for object storage
+var ObjectTypes = []string{"data", "index", "keys", "locks", "snapshots"}
+
+// IsHashed returns true if blobs of the given object type are stored in
+// intermediate subdirs named after the first two characters of their name.
+func IsHashed(objectType string) bool {
+	return objectType == "data"
+}
+
+// SplitBlobPath splits the path of a blob into the repository path, the
+// object type and the name of the blob.
+func SplitBlobPath(path string) (repo, objectType, name string) {
+	dir, name := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if parent := filepath.Dir(dir); !isObjectType(filepath.Base(dir)) && IsHashed(filepath.Base(parent)) {
+		// skip the intermediate subdir
+		dir = parent
+	}
+	return filepath.Dir(dir), filepath.Base(dir), name
+}
+
+// ValidateName returns ErrInvalidName unless name is a valid blob name. Blobs
+// of all object types are named after their restic ID, so only lowercase hex
+// characters are allowed, which rules out path separators and "..".
+func ValidateName(name string) error {
+	if !isHex(name) {
+		return fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	return nil
+}
+
+// validateBlobPath checks that path does not contain "..", so that it cannot
+// escape from the repository, and the name of the blob using ValidateName.
+// The names of the entries in the TrashDir carry a suffix and are not
+// checked, they are never supplied by clients.
+func validateBlobPath(path string) error {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return fmt.Errorf("%v: %w", path, ErrInvalidName)
+		}
+	}
+	repo, _, name := SplitBlobPath(path)
+	if filepath.Base(repo) == TrashDir {
+		return nil
+	}
+	return ValidateName(name)
+}
+
+// blobPath returns the path of the blob name listed in the object type
+// directory dir.
+func blobPath(dir, name string) string {
+	if IsHashed(filepath.Base(dir)) && len(name) >= 2 {
+		return filepath.Join(dir, name[:2], name)
+	}
+	return filepath.Join(dir, name)
+}
+
+func isObjectType(name string) bool {
+	for _, t := range ObjectTypes {
+		if name == t {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultDirMode is the file mode used for directory creation if not
+// overridden
+const DefaultDirMode os.FileMode = 0700
+
+// DefaultFileMode is the file mode used for file creation if not
+// overridden
+const DefaultFileMode os.FileMode = 0600
+
+// Blob represents a single blob, its name, its size and the time it has been
+// modified. ModTime is zero if the backend does not record it.
+type Blob struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Filesystem is the interface a storage backend needs to implement. All
+// paths are full paths as computed by the repo handler, blob paths already
+// include the intermediate subdir for hashed object types.
+//
+// The context passed to each method is the context of the HTTP request, an
+// implementation should abort long running operations (like copying the data
+// in SaveBlob) once it is canceled.
+//
+// Errors must match the sentinel errors of this package with errors.Is where
+// applicable, e.g. ErrNotFound for missing files and ErrExists for already
+// existing files, so that the handler can return the appropriate HTTP status
+// code regardless of the backend.
+type Filesystem interface {
+	// CreateRepo creates the directory structure for a repository at path.
+	// It returns ErrRepoExists if the repository already has a config,
+	// otherwise directories left missing by an interrupted init are created.
+	CreateRepo(ctx context.Context, path string) error
+
+	// CheckConfig returns whether the config file at path exists and its
+	// size. A missing config is not an error, it means that the repository
+	// has not been initialized yet.
+	CheckConfig(ctx context.Context, path string) (exists bool, size int64, err error)
+	// GetConfig returns the contents of the config file at path. It returns
+	// ErrNotFound only if the config does not exist, which tells restic that
+	// the repository has to be initialized. Other errors, e.g. missing
+	// permissions, must not match ErrNotFound.
+	GetConfig(ctx context.Context, path string) ([]byte, error)
+	// GetConfigReader returns a reader for the config file at path, which
+	// must be closed by the caller, and the size of the config. Errors are
+	// returned like for GetConfig.
+	GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error)
+	// SaveConfig saves the config file at path, it must not exist yet.
+	// Otherwise it returns ErrConfigExists and the config is kept, so that
+	// initializing a repository twice does not destroy it.
+	SaveConfig(ctx context.Context, path string, rd io.Reader) error
+	// DeleteConfig removes the config file at path, but not the rest of the
+	// repository. Like DeleteBlob, it returns ErrNotFound if the config does
+	// not exist; the handler ignores that, so a retried request succeeds.
+	DeleteConfig(ctx context.Context, path string) error
+
+	// ListBlobs lists all blobs in the object type directory at path, in an
+	// arbitrary order.
+	ListBlobs(ctx context.Context, path string) ([]Blob, error)
+	// ListBlobsFunc calls fn for each blob in the object type directory at
+	// path, in an arbitrary order. If fn returns an error, the listing stops
+	// and the error is returned.
+	ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error
+	// CheckBlob returns the name, size and modification time of the blob at
+	// path.
+	CheckBlob(ctx context.Context, path string) (Blob, error)
+	// GetBlob returns a reader for the blob at path, which must be closed by
+	// the caller. The reader must support seeking so that range requests can
+	// be served.
+	GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error)
+	// SaveBlob saves the data read from rd to the blob at path, replacing it
+	// if it exists. expectedSize is the size announced by the client, or -1
+	// if it is unknown. If it is known, an upload of a different size is
+	// rejected with ErrShortWrite or ErrLongWrite and the blob is not saved.
+	// The number of bytes written is returned, also in case of an error.
+	SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (size int64, err error)
+	// DeleteBlob removes the blob at path. If needSize is set, the size of the
+	// removed blob is returned, otherwise the returned size may be zero.
+	DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error)
+	// DeleteBlobs removes the blobs at paths and returns their sizes in the
+	// same order, like DeleteBlob. Blobs which do not exist are skipped with
+	// a size of zero. If some blobs cannot be removed, a *BatchError is
+	// returned.
+	DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error)
+
+	// RepoStats returns the number and size of the blobs in the repository at
+	// path, in total and for each object type.
+	RepoStats(ctx context.Context, path string) (RepoStats, error)
+	// Walk calls fn for each blob of all ObjectTypes in the repository at
+	// path, in an arbitrary order. Missing object type directories are
+	// skipped. Errors for individual entries do not stop the walk, they are
+	// returned as a *WalkError afterwards. If fn returns an error, the walk
+	// stops and the error is returned.
+	Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error
+
+	// HealthCheck checks that files can be written below path, the base
+	// directory of all repositories, by writing and removing a small file in
+	// the HealthDir subdir. It returns an error if the storage is missing,
+	// read-only or full.
+	HealthCheck(ctx context.Context, path string) error
+
+	// Sync makes all writes which have completed before durable, e.g. by
+	// waiting for deferred syncs, without releasing any resources, so that a
+	// client can be told that a backup is safe. It returns the errors of
+	// deferred writes which failed since the last Sync or barrier, which
+	// would otherwise only be logged. Backends which complete each write
+	// before returning have nothing to do. Wrappers sync their base.
+	Sync(ctx context.Context) error
+
+	// Close flushes pending writes, e.g. deferred syncs or queued events,
+	// and releases the resources of the Filesystem, like the connections of
+	// a remote backend. It is called once when the server shuts down, no
+	// other methods may be called afterwards. Wrappers close their base.
+	Close() error
+}
+
+// BlobExister is implemented by Filesystems which can check whether a blob
+// exists more cheaply than by CheckBlob, e.g. without determining its size.
+type BlobExister interface {
+	// BlobExists returns whether the blob at path exists. A missing blob is
+	// not an error, an error is only returned if the check itself fails.
+	BlobExists(ctx context.Context, path string) (bool, error)
+}
+
+var (
+	_ BlobExister = &DiskFilesystem{}
+	_ BlobExister = &MemoryFilesystem{}
+)
+
+// BlobExists returns whether the blob at path exists in f. It uses
+// f.BlobExists if f implements BlobExister, otherwise CheckBlob.
+func BlobExists(ctx context.Context, f Filesystem, path string) (bool, error) {
+	if e, ok := f.(BlobExister); ok {
+		return e.BlobExists(ctx, path)
+	}
+	_, err := f.CheckBlob(ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// BlobInfo is the metadata of a blob returned by Stat. Backends which do not
+// record some of it leave the fields zero, e.g. MemoryFilesystem has no
+// modification times and object stores have no file mode.
+type BlobInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+}
+
+// Blob returns the name, size and modification time of the blob.
+func (i BlobInfo) Blob() Blob {
+	return Blob{Name: i.Name, Size: i.Size, ModTime: i.ModTime}
+}
+
+// BlobStater is implemented by Filesystems which return all metadata of a
+// blob at once, so that callers which need more than CheckBlob returns do
+// not have to stat the blob twice.
+type BlobStater interface {
+	// Stat returns the metadata of the blob at path, ErrNotFound if it does
+	// not exist.
+	Stat(ctx context.Context, path string) (BlobInfo, error)
+}
+
+var (
+	_ BlobStater = &DiskFilesystem{}
+	_ BlobStater = &MemoryFilesystem{}
+)
+
+// Stat returns the metadata of the blob at path in f. It uses f.Stat if f
+// implements BlobStater, otherwise CheckBlob, leaving the mode zero.
+func Stat(ctx context.Context, f Filesystem, path string) (BlobInfo, error) {
+	if s, ok := f.(BlobStater); ok {
+		return s.Stat(ctx, path)
+	}
+	blob, err := f.CheckBlob(ctx, path)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Name: blob.Name, Size: blob.Size, ModTime: blob.ModTime}, nil
+}
+
+// Presigner is implemented by Filesystems which can hand out URLs to download
+// a blob directly from the storage, e.g. presigned URLs of object stores, so
+// that the data does not have to pass through rest-server.
+//
+// Anyone who obtains such a URL can download the blob until it expires,
+// without authenticating to rest-server and without any of the checks of the
+// server, e.g. the repository is not locked and the data is not verified.
+// The URLs are usually logged by proxies and clients, so the lifetime should
+// be kept short.
+type Presigner interface {
+	// PresignGet returns a URL to download the blob at path, which is valid
+	// for ttl. If ok is false, no URL can be created for the blob, e.g.
+	// because the credentials in use cannot sign URLs, and the blob must be
+	// read using GetBlob. It does not check whether the blob exists.
+	PresignGet(ctx context.Context, path string, ttl time.Duration) (url string, ok bool, err error)
+}
+
+// PresignGet returns a URL to download the blob at path in f, which is valid
+// for ttl. It uses f.PresignGet if f implements Presigner, otherwise ok is
+// false.
+func PresignGet(ctx context.Context, f Filesystem, path string, ttl time.Duration) (url string, ok bool, err error) {
+	if p, ok := f.(Presigner); ok {
+		return p.PresignGet(ctx, path, ttl)
+	}
+	return "", false, nil
+}
+
+// BlobReaderAt reads a blob at arbitrary offsets. Unlike the reader returned
+// by GetBlob it has no position, so it can serve concurrent range requests
+// for the same blob. ReadAt may be called concurrently, Close must be called
+// once all reads have returned.
+type BlobReaderAt interface {
+	io.ReaderAt
+	io.Closer
+	// Size returns the size of the blob when it has been opened.
+	Size() int64
+}
+
+// BlobOpener is implemented by Filesystems which can share the resources of
+// a blob between concurrent readers, e.g. DiskFilesystem serves all readers
+// of a blob from a single file descriptor.
+type BlobOpener interface {
+	// OpenBlob opens the blob at path for reads at arbitrary offsets. It
+	// returns ErrNotFound if the blob does not exist.
+	OpenBlob(ctx context.Context, path string) (BlobReaderAt, error)
+}
+
+var _ BlobOpener = &DiskFilesystem{}
+
+// OpenBlob opens the blob at path in f for reads at arbitrary offsets. It
+// uses f.OpenBlob if f implements BlobOpener, otherwise the reader returned
+// by GetBlob, whose reads are then serialized.
+func OpenBlob(ctx context.Context, f Filesystem, path string) (BlobReaderAt, error) {
+	if o, ok := f.(BlobOpener); ok {
+		return o.OpenBlob(ctx, path)
+	}
+	return getBlobReaderAt(ctx, f, path)
+}
+
+// BlobPrefixLister is implemented by Filesystems which can list the blobs
+// whose names start with a prefix without listing all blobs, e.g.
+// DiskFilesystem only reads the subdir of a hashed object type which stores
+// them.
+type BlobPrefixLister interface {
+	// ListBlobsPrefix lists the blobs in the object type directory path
+	// whose names start with prefix, which must be hex encoded.
+	ListBlobsPrefix(ctx context.Context, path, prefix string) ([]Blob, error)
+}
+
+var _ BlobPrefixLister = &DiskFilesystem{}
+
+// ListBlobsPrefix lists the blobs in the object type directory path of f
+// whose names start with prefix, e.g. to resolve a short ID. It uses
+// f.ListBlobsPrefix if f implements BlobPrefixLister, otherwise it filters
+// the blobs returned by ListBlobsFunc.
+func ListBlobsPrefix(ctx context.Context, f Filesystem, path, prefix string) ([]Blob, error) {
+	if l, ok := f.(BlobPrefixLister); ok {
+		return l.ListBlobsPrefix(ctx, path, prefix)
+	}
+	return listBlobsPrefix(ctx, f, path, prefix)
+}
+
+// listBlobsPrefix filters the blobs listed by f.ListBlobsFunc by prefix.
+func listBlobsPrefix(ctx context.Context, f Filesystem, path, prefix string) ([]Blob, error) {
+	if prefix != "" && !isHex(prefix) {
+		return nil, fmt.Errorf("prefix %q: %w", prefix, ErrInvalidName)
+	}
+	blobs := []Blob{}
+	err := f.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		if strings.HasPrefix(blob.Name, prefix) {
+			blobs = append(blobs, blob)
+		}
+		return nil
+	})
+	return blobs, err
+}
+
+// getBlobReaderAt returns a BlobReaderAt which reads from the reader returned
+// by f.GetBlob.
+func getBlobReaderAt(ctx context.Context, f Filesystem, path string) (BlobReaderAt, error) {
+	rd, err := f.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	return &seekReaderAt{rd: rd, size: size}, nil
+}
+
+// seekReaderAt implements BlobReaderAt by seeking rd before each read.
+type seekReaderAt struct {
+	mu   sync.Mutex
+	rd   io.ReadSeekCloser
+	size int64
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.rd.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rd, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *seekReaderAt) Close() error { return r.rd.Close() }
+func (r *seekReaderAt) Size() int64  { return r.size }
+
+// HealthDir is the subdir of the base directory used by HealthCheck.
+const HealthDir = ".health"
+
+var (
+	// ErrNotFound is returned if a file does not exist. It is the same as
+	// os.ErrNotExist, so errors returned by the os package match it.
+	ErrNotFound = os.ErrNotExist
+	// ErrExists is returned if a file already exists. It is the same as
+	// os.ErrExist, so errors returned by the os package match it.
+	ErrExists = os.ErrExist
+	// ErrNoSpace is returned if data cannot be saved because the storage is
+	// full or a quota enforced by the storage is exceeded.
+	ErrNoSpace = newError("no_space", "no space left on storage")
+	// ErrInvalidName is returned for blob names which are not restic IDs
+	// and for blob paths which try to leave the repository.
+	ErrInvalidName = newError("invalid_name", "invalid blob name")
+	// ErrPartialListing is matched by the errors of listings which skipped
+	// unreadable entries but returned all other blobs, see ListingError.
+	ErrPartialListing = newError("partial_listing", "listing is incomplete")
+	// ErrTooManyEntries is returned by listings which read more directory
+	// entries or levels than allowed, see DiskFilesystem.MaxListEntries.
+	ErrTooManyEntries = newError("too_many_entries", "too many directory entries")
+	// ErrUnexpectedEntry is returned by listings which find an entry that is
+	// not a blob, see DiskFilesystem.StrictListing.
+	ErrUnexpectedEntry = newError("unexpected_entry", "unexpected entry in object type directory")
+	// ErrNotRepo is returned by DeleteRepo for directories which do not
+	// look like a repository.
+	ErrNotRepo = newError("not_repository", "not a repository")
+	// ErrRepoExists is returned by CreateRepo if the repository has already
+	// been initialized.
+	ErrRepoExists = newError("repository_exists", "repository already exists")
+	// ErrConfigExists is returned by SaveConfig if the config already
+	// exists, e.g. if a repository is initialized twice. It matches
+	// ErrExists as well.
+	ErrConfigExists error = &kindError{kind: ErrExists, err: newError("config_exists", "config already exists")}
+	// ErrBlobExists is returned by SaveBlob if the blob already exists and
+	// must not be overwritten, see OverwriteReject. It matches ErrExists as
+	// well.
+	ErrBlobExists error = &kindError{kind: ErrExists, err: newError("blob_exists", "blob already exists")}
+	// ErrShortWrite is returned by SaveBlob if the upload ends before the
+	// announced size has been reached, e.g. because the client died. It
+	// matches io.ErrUnexpectedEOF as well.
+	ErrShortWrite error = &kindError{kind: io.ErrUnexpectedEOF, err: newError("short_write", "upload shorter than announced")}
+	// ErrLongWrite is returned by SaveBlob if the upload contains more data
+	// than announced.
+	ErrLongWrite = newError("long_write", "upload longer than announced")
+)
+
+// repoExists returns ErrRepoExists for the repository at path.
+func repoExists(path string) error {
+	return &os.PathError{Op: "create", Path: path, Err: ErrRepoExists}
+}
+
+// kindError marks err as one of the errors of this package, e.g. ErrNoSpace,
+// while keeping the original error.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// As lets errors.As find the codedError of the kind before that of err.
+func (e *kindError) As(target interface{}) bool { return errors.As(e.kind, target) }
+
+// codedError is the type of the errors of this package, it carries a stable
+// code which identifies the error for clients, see ErrorCode.
+type codedError struct {
+	code string
+	text string
+}
+
+func newError(code, text string) error {
+	return &codedError{code: code, text: text}
+}
+
+func (e *codedError) Error() string { return e.text }
+
+// Code returns the code of the error, e.g. "quota_exceeded".
+func (e *codedError) Code() string { return e.code }
+
+// CodeInternal is the code ErrorCode returns for errors which are not
+// one of the errors of this package.
+const CodeInternal = "internal"
+
+// ErrorCode returns a stable code identifying the error of this package
+// which err matches, e.g. "quota_exceeded" for ErrQuotaExceeded, and the
+// description of that error. Unlike the text of err, the description never
+// contains paths, so both can be reported to clients. For errors not
+// originating from this package, CodeInternal is returned.
+func ErrorCode(err error) (code, text string) {
+	var c *codedError
+	switch {
+	case errors.As(err, &c):
+		return c.code, c.text
+	case errors.Is(err, ErrNotFound):
+		return "not_found", "file does not exist"
+	case errors.Is(err, ErrExists):
+		return "exists", "file already exists"
+	}
+	return CodeInternal, "internal error"
+}
+
+// BatchError is returned by DeleteBlobs if some of the blobs could not be
+// removed. Errors contains one entry for each path, nil for the blobs which
+// have been removed.
+type BatchError struct {
+	Errors []error
+}
+
+// NewBatchError returns a *BatchError for errs, or nil if all errors are nil.
+func NewBatchError(errs []error) error {
+	var first error
+	for _, err := range errs {
+		if err != nil {
+			first = err
+			break
+		}
+	}
+	if first == nil {
+		return nil
+	}
+	return &BatchError{Errors: errs}
+}
+
+func (e *BatchError) Error() string {
+	var failed int
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("removing %d of %d blobs failed, first error: %v", failed, len(e.Errors), first)
+}
+
+// Unwrap returns the errors for the individual blobs.
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Is reports whether the error of one of the blobs matches target.
+func (e *BatchError) Is(target error) bool { return anyIs(e.Errors, target) }
+
+// As finds the first error of the blobs which matches target.
+func (e *BatchError) As(target interface{}) bool { return anyAs(e.Errors, target) }
+
+// anyIs reports whether one of errs matches target. Since Go 1.20, errors.Is
+// follows Unwrap() []error by itself, but earlier versions only follow
+// Unwrap() error, so the errors of this package which combine several errors
+// implement Is and As with anyIs and anyAs.
+func anyIs(errs []error, target error) bool {
+	for _, err := range errs {
+		if err != nil && errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyAs finds the first of errs which matches target, see anyIs.
+func anyAs(errs []error, target interface{}) bool {
+	for _, err := range errs {
+		if err != nil && errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkError is returned by Walk if some entries could not be read.
+type WalkError struct {
+	Errors []error
+}
+
+func (e *WalkError) Error() string {
+	return fmt.Sprintf("reading %d entries failed, first error: %v", len(e.Errors), e.Errors[0])
+}
+
+// Unwrap returns the errors for the individual entries.
+func (e *WalkError) Unwrap() []error {
+	return e.Errors
+}
+
+// Is reports whether the error of one of the entries matches target.
+func (e *WalkError) Is(target error) bool { return anyIs(e.Errors, target) }
+
+// As finds the first error of the entries which matches target.
+func (e *WalkError) As(target interface{}) bool { return anyAs(e.Errors, target) }
+
+// newWalkError returns a *WalkError for errs, or nil if errs is empty.
+func newWalkError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &WalkError{Errors: errs}
+}
+
+// ListingError is returned by ListBlobs and ListBlobsFunc of a
+// DiskFilesystem with BestEffortListing if some entries were skipped. The
+// other blobs have been listed, so it matches ErrPartialListing.
+type ListingError struct {
+	Path   string
+	Errors []error
+}
+
+func (e *ListingError) Error() string {
+	return fmt.Sprintf("listing %v: skipped %d unreadable entries, first error: %v", e.Path, len(e.Errors), e.Errors[0])
+}
+
+// Is reports whether target is ErrPartialListing or matches the error of one
+// of the skipped entries.
+func (e *ListingError) Is(target error) bool {
+	return target == ErrPartialListing || anyIs(e.Errors, target)
+}
+
+// Unwrap returns the errors for the skipped entries.
+func (e *ListingError) Unwrap() []error {
+	return e.Errors
+}
+
+// As finds the first error of the skipped entries which matches target.
+func (e *ListingError) As(target interface{}) bool { return anyAs(e.Errors, target) }
+
+// errStopIteration stops the listing of BlobsIter once the caller stops
+// iterating.
+var errStopIteration = errors.New("iteration stopped")
+
+// BlobsIter returns an iterator over the blobs of objectType in the
+// repository at path in f, built on ListBlobsFunc so that a large listing is
+// never held in memory. The iterator has the type of iter.Seq2[Blob, error],
+// callers built with Go 1.23 or later can range over it:
+//
+//	for blob, err := range fs.BlobsIter(ctx, f, repo, "data") {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// An error of the listing is yielded last with a zero Blob. Breaking out of
+// the loop stops the listing.
+func BlobsIter(ctx context.Context, f Filesystem, path, objectType string) func(yield func(Blob, error) bool) {
+	return func(yield func(Blob, error) bool) {
+		err := f.ListBlobsFunc(ctx, filepath.Join(path, objectType), func(blob Blob) error {
+			if !yield(blob, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			yield(Blob{}, err)
+		}
+	}
+}
+
+// WalkTypes implements Walk using f.ListBlobsFunc for each of the
+// ObjectTypes. If listing an object type fails, the error is collected and the
+// walk continues with the next one.
+func WalkTypes(ctx context.Context, f Filesystem, path string, fn func(objectType string, blob Blob) error) error {
+	var errs []error
+	for _, t := range ObjectTypes {
+		var fnErr error
+		err := f.ListBlobsFunc(ctx, filepath.Join(path, t), func(blob Blob) error {
+			fnErr = fn(t, blob)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return newWalkError(errs)
+}
+
+// ListLocks returns the locks of the repository at path, the oldest first,
+// so that stale locks left behind by crashed clients can be recognized by
+// their modification time, see DiskFilesystem.PruneStaleLocks. A repository
+// without a locks directory has no locks.
+func ListLocks(ctx context.Context, f Filesystem, path string) ([]Blob, error) {
+	locks, err := f.ListBlobs(ctx, filepath.Join(path, "locks"))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(locks, func(i, j int) bool {
+		return locks[i].ModTime.Before(locks[j].ModTime)
+	})
+	return locks, nil
+}
+
+// ListBlobsSince returns the blobs in path which have been modified at or
+// after since, e.g. for a tool which copies new blobs to a mirror and only
+// wants those saved since its last run. It lists all blobs using
+// f.ListBlobsFunc and filters them by their ModTime, blobs without one are
+// always returned.
+//
+// The modification time is that of the last write to a blob, before it is
+// renamed into place. A blob which only appeared after the previous listing
+// thus may carry an older time, and clocks can go backwards. Callers should
+// therefore pass the start of the previous listing minus an overlap of a few
+// minutes, not its end, and expect to see some blobs twice.
+func ListBlobsSince(ctx context.Context, f Filesystem, path string, since time.Time) ([]Blob, error) {
+	var blobs []Blob
+	err := f.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		if blob.ModTime.IsZero() || !blob.ModTime.Before(since) {
+			blobs = append(blobs, blob)
+		}
+		return nil
+	})
+	return blobs, err
+}
+
+// deleteEach removes the blobs one by one using f.DeleteBlob, ignoring blobs
+// which do not exist.
+func deleteEach(ctx context.Context, f Filesystem, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		size, err := f.DeleteBlob(ctx, path, needSize)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs[i] = err
+			continue
+		}
+		sizes[i] = size
+	}
+	return sizes, NewBatchError(errs)
+}
+
+// contextReader returns the error of ctx instead of reading from rd once ctx
+// is canceled.
+type contextReader struct {
+	ctx context.Context
+	rd  io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rd.Read(p)
+}
+
+// checkSize returns ErrShortWrite or ErrLongWrite if written, the size of the
+// data uploaded for path, differs from expectedSize. Negative expected sizes
+// are unknown and not checked.
+func checkSize(path string, written, expectedSize int64) error {
+	switch {
+	case expectedSize < 0 || written == expectedSize:
+		return nil
+	case written < expectedSize:
+		return fmt.Errorf("%v: %d bytes uploaded instead of %d: %w", path, written, expectedSize, ErrShortWrite)
+	default:
+		return fmt.Errorf("%v: more than %d bytes uploaded: %w", path, expectedSize, ErrLongWrite)
+	}
+}
+
+// NewSizeCheckReader returns a reader for the data uploaded for path which
+// fails with ErrShortWrite if rd ends before expectedSize bytes have been
+// read, and with ErrLongWrite as soon as it returns more. Backends which
+// cannot check the size before the blob is stored can pass this reader on,
+// so that the failed read aborts the upload. If expectedSize is negative, rd
+// is returned.
+func NewSizeCheckReader(path string, rd io.Reader, expectedSize int64) io.Reader {
+	if expectedSize < 0 {
+		return rd
+	}
+	return &sizeCheckReader{path: path, rd: rd, expected: expectedSize}
+}
+
+type sizeCheckReader struct {
+	path     string
+	rd       io.Reader
+	expected int64
+	n        int64
+}
+
+func (r *sizeCheckReader) Read(p []byte) (int, error) {
+	if r.n >= r.expected && len(p) > 1 {
+		// read a single byte to detect a longer upload without returning
+		// more than the expected size
+		p = p[:1]
+	}
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	if r.n > r.expected {
+		return 0, checkSize(r.path, r.n, r.expected)
+	}
+	if err == io.EOF {
+		if sizeErr := checkSize(r.path, r.n, r.expected); sizeErr != nil {
+			return n, sizeErr
+		}
+	}
+	return n, err
+}
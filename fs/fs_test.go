@@ -0,0 +1,2718 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+const testID = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+
+func readAll(t testing.TB, rd io.Reader) []byte {
+	t.Helper()
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := rd.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf
+}
+
+// testFilesystem runs a basic test sequence against f, using base as the
+// repository path.
+func testFilesystem(t *testing.T, f Filesystem, base string) {
+	ctx := context.Background()
+	repo := filepath.Join(base, "repo")
+	cfg := filepath.Join(repo, "config")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+
+	if err := f.HealthCheck(ctx, base); err != nil {
+		t.Fatalf("HealthCheck: %v", err)
+	}
+	if _, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ListBlobs before CreateRepo: want not exist error, got %v", err)
+	}
+
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	// creating the repo a second time must not fail
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _, err := f.CheckConfig(ctx, cfg); err != nil || exists {
+		t.Fatalf("CheckConfig: want missing config, got %v, %v", exists, err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("other")); !errors.Is(err, os.ErrExist) || !errors.Is(err, ErrConfigExists) {
+		t.Fatalf("SaveConfig: want ErrConfigExists, got %v", err)
+	}
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("CreateRepo: want ErrRepoExists, got %v", err)
+	}
+	if exists, size, err := f.CheckConfig(ctx, cfg); err != nil || !exists || size != 6 {
+		t.Fatalf("CheckConfig: want size 6, got %v, %v, %v", exists, size, err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: want %q, got %q, %v", "config", buf, err)
+	}
+	if rd, size, err := f.GetConfigReader(ctx, cfg); err != nil || size != 6 {
+		t.Fatalf("GetConfigReader: want size 6, got %v, %v", size, err)
+	} else if buf := readAll(t, rd); string(buf) != "config" {
+		t.Fatalf("GetConfigReader: want %q, got %q", "config", buf)
+	}
+
+	if _, err := f.GetBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetBlob: want not exist error, got %v", err)
+	}
+	if exists, err := BlobExists(ctx, f, blob); err != nil || exists {
+		t.Fatalf("BlobExists: want missing blob, got %v, %v", exists, err)
+	}
+	data := []byte("foobar")
+	if n, err := f.SaveBlob(ctx, blob, bytes.NewReader(data), int64(len(data))); err != nil || n != int64(len(data)) {
+		t.Fatalf("SaveBlob: want %d bytes written, got %v, %v", len(data), n, err)
+	}
+	if exists, err := BlobExists(ctx, f, blob); err != nil || !exists {
+		t.Fatalf("BlobExists: want existing blob, got %v, %v", exists, err)
+	}
+
+	// uploads of a different size than announced are not saved
+	other := filepath.Join(repo, "keys", testID)
+	if _, err := f.SaveBlob(ctx, other, bytes.NewReader(data), 10); !errors.Is(err, ErrShortWrite) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("SaveBlob: want ErrShortWrite, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, other, bytes.NewReader(data), 3); !errors.Is(err, ErrLongWrite) {
+		t.Fatalf("SaveBlob: want ErrLongWrite, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, other); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want not exist error after failed uploads, got %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Name != testID || b.Size != int64(len(data)) {
+		t.Fatalf("CheckBlob: want size %d, got %v, %v", len(data), b, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); !bytes.Equal(buf, data) {
+		t.Fatalf("GetBlob: want %q, got %q", data, buf)
+	}
+
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 || blobs[0].Name != testID || blobs[0].Size != int64(len(data)) {
+		t.Fatalf("ListBlobs: unexpected result %v", blobs)
+	}
+	blobs, err = f.ListBlobs(ctx, filepath.Join(repo, "keys"))
+	if err != nil || len(blobs) != 0 {
+		t.Fatalf("ListBlobs: want empty list, got %v, %v", blobs, err)
+	}
+
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", testID), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Size != 9 || stats.Count != 2 ||
+		stats.Types["data"] != (ObjectStats{Size: 6, Count: 1}) ||
+		stats.Types["keys"] != (ObjectStats{Size: 3, Count: 1}) ||
+		stats.Types["locks"] != (ObjectStats{}) {
+		t.Fatalf("RepoStats: unexpected result %+v", stats)
+	}
+	if _, err := f.RepoStats(ctx, filepath.Join(base, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("RepoStats: want not exist error, got %v", err)
+	}
+
+	walked := make(map[string]Blob)
+	if err := f.Walk(ctx, repo, func(objectType string, blob Blob) error {
+		walked[objectType] = blob
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 2 ||
+		walked["data"].Name != testID || walked["data"].Size != int64(len(data)) ||
+		walked["keys"].Name != testID || walked["keys"].Size != 3 {
+		t.Fatalf("Walk: unexpected result %v", walked)
+	}
+	stop := errors.New("stop")
+	if err := f.Walk(ctx, repo, func(string, Blob) error { return stop }); err != stop {
+		t.Fatalf("Walk: want error of fn, got %v", err)
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != int64(len(data)) {
+		t.Fatalf("DeleteBlob: want size %d, got %v, %v", len(data), size, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, true); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("DeleteBlob: want not exist error, got %v", err)
+	}
+	if err := f.DeleteConfig(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.DeleteConfig(ctx, cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("DeleteConfig: want not exist error, got %v", err)
+	}
+	if _, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil {
+		t.Fatalf("ListBlobs: want the repository kept after deleting the config, got %v", err)
+	}
+	if _, err := f.GetConfig(ctx, cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetConfig: want not exist error, got %v", err)
+	}
+	if _, _, err := f.GetConfigReader(ctx, cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetConfigReader: want not exist error, got %v", err)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for _, test := range []struct {
+		err        error
+		code, text string
+	}{
+		{fmt.Errorf("/srv/repo: %w", ErrQuotaExceeded), "quota_exceeded", "repository quota exceeded"},
+		{&os.PathError{Op: "create", Path: "/srv/repo/config", Err: ErrRetentionActive}, "retention_active", "blob is under retention"},
+		{fmt.Errorf("saving config: %w", ErrConfigExists), "config_exists", "config already exists"},
+		{fmt.Errorf("saving blob: %w", ErrBlobExists), "blob_exists", "blob already exists"},
+		{ErrShortWrite, "short_write", "upload shorter than announced"},
+		{classify(&os.PathError{Op: "write", Path: "/srv/repo/data", Err: syscall.ENOSPC}), "no_space", "no space left on storage"},
+		{&os.PathError{Op: "open", Path: "/srv/repo/keys/1", Err: os.ErrNotExist}, "not_found", "file does not exist"},
+		{&os.PathError{Op: "open", Path: "/srv/repo/keys/1", Err: os.ErrPermission}, CodeInternal, "internal error"},
+	} {
+		code, text := ErrorCode(test.err)
+		if code != test.code || text != test.text {
+			t.Errorf("%v: want %q, %q, got %q, %q", test.err, test.code, test.text, code, text)
+		}
+	}
+}
+
+func TestMultiErrors(t *testing.T) {
+	failed := &os.PathError{Op: "remove", Path: "/repo/data/00/00", Err: ErrRetentionActive}
+	errs := []error{nil, failed}
+	for _, err := range []error{
+		&BatchError{Errors: errs},
+		&WalkError{Errors: errs},
+		&ListingError{Path: "/repo/data", Errors: errs[1:]},
+		&MirrorError{Op: "DeleteBlob", Path: "/repo/data/00/00", Errors: errs},
+	} {
+		// errors.Is and errors.As only follow Unwrap() []error since Go
+		// 1.20, the methods must work without it
+		m := err.(interface {
+			Is(error) bool
+			As(interface{}) bool
+		})
+		if !m.Is(ErrRetentionActive) || m.Is(ErrNotFound) {
+			t.Fatalf("%T: Is matches the wrong errors", err)
+		}
+		var pathErr *os.PathError
+		if !m.As(&pathErr) || pathErr != failed {
+			t.Fatalf("%T: As: want the error of the member, got %v", err, pathErr)
+		}
+		if !errors.Is(err, ErrRetentionActive) {
+			t.Fatalf("%T: errors.Is: want ErrRetentionActive", err)
+		}
+	}
+}
+
+func TestDiskFilesystem(t *testing.T) {
+	for _, mode := range []SyncMode{SyncFull, SyncDataOnly, SyncNone, SyncDeferred} {
+		testFilesystem(t, &DiskFilesystem{SyncMode: mode}, t.TempDir())
+		testFilesystem(t, &DiskFilesystem{SyncMode: mode, DropCache: true}, t.TempDir())
+	}
+	testFilesystem(t, &DiskFilesystem{CopyBufferSize: 4096}, t.TempDir())
+}
+
+func TestDiskFilesystemModTime(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "locks", testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(blob, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := f.CheckBlob(ctx, blob); err != nil || !b.ModTime.Equal(mtime) {
+		t.Fatalf("CheckBlob: want mtime %v, got %v, %v", mtime, b.ModTime, err)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "locks"))
+	if err != nil || len(blobs) != 1 || !blobs[0].ModTime.Equal(mtime) {
+		t.Fatalf("ListBlobs: want mtime %v, got %v, %v", mtime, blobs, err)
+	}
+}
+
+func TestDiskFilesystemHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	d := &DiskFilesystem{}
+	base := t.TempDir()
+
+	if err := d.HealthCheck(ctx, base); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(base, HealthDir)); err != nil || len(entries) != 0 {
+		t.Fatalf("the sentinel file must be removed, got %v, %v", entries, err)
+	}
+
+	missing := filepath.Join(base, "missing")
+	if err := d.HealthCheck(ctx, missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error for a missing base directory, got %v", err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("the base directory must not be created")
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	readOnly := filepath.Join(base, "ro")
+	if err := os.Mkdir(readOnly, 0500); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.HealthCheck(ctx, readOnly); err == nil {
+		t.Fatal("want error for a read-only base directory")
+	}
+}
+
+func TestMemoryFilesystem(t *testing.T) {
+	testFilesystem(t, NewMemoryFilesystem(), filepath.FromSlash("/srv/restic"))
+}
+
+func TestSaveBlobCanceled(t *testing.T) {
+	for _, f := range []Filesystem{&DiskFilesystem{}, NewMemoryFilesystem()} {
+		base := t.TempDir()
+		if err := f.CreateRepo(context.Background(), base); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		// cancel the context after the first chunk has been read
+		rd := io.MultiReader(strings.NewReader("foo"), readerFunc(func(p []byte) (int, error) {
+			cancel()
+			return copy(p, "bar"), nil
+		}), strings.NewReader("baz"))
+
+		blob := filepath.Join(base, "keys", testID)
+		if _, err := f.SaveBlob(ctx, blob, rd, -1); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%T: want context.Canceled, got %v", f, err)
+		}
+		if _, err := f.CheckBlob(context.Background(), blob); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%T: blob must not exist after canceled upload, got %v", f, err)
+		}
+	}
+}
+
+func TestSaveConfigFailed(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	f := &DiskFilesystem{}
+	if err := f.CreateRepo(ctx, base); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail after part of the config has been written
+	errWrite := errors.New("write failed")
+	rd := io.MultiReader(strings.NewReader("partial"), readerFunc(func(p []byte) (int, error) {
+		return 0, errWrite
+	}))
+
+	cfg := filepath.Join(base, "config")
+	if err := f.SaveConfig(ctx, cfg, rd); !errors.Is(err, errWrite) {
+		t.Fatalf("want errWrite, got %v", err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("partial config must not be visible, got %q, %v", buf, err)
+	}
+
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			t.Errorf("temporary file %v has not been removed", e.Name())
+		}
+	}
+
+	// a later attempt must succeed
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskFilesystemEmptyBlob(t *testing.T) {
+	for name, f := range map[string]*DiskFilesystem{
+		"full":     {},
+		"deferred": {SyncMode: SyncDeferred},
+		"reject":   {OverwritePolicy: OverwriteReject},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := filepath.Join(t.TempDir(), "repo")
+			if err := f.CreateRepo(ctx, repo); err != nil {
+				t.Fatal(err)
+			}
+			// the missing subdir is created
+			if err := os.Remove(filepath.Join(repo, "data", testID[:2])); err != nil {
+				t.Fatal(err)
+			}
+			for _, blob := range []string{
+				filepath.Join(repo, "data", testID[:2], testID),
+				filepath.Join(repo, "index", testID),
+			} {
+				if n, err := f.SaveBlob(ctx, blob, strings.NewReader(""), 0); err != nil || n != 0 {
+					t.Fatalf("SaveBlob: got %d, %v", n, err)
+				}
+				if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 0 {
+					t.Fatalf("CheckBlob: got %+v, %v", b, err)
+				}
+				rd, err := f.GetBlob(ctx, blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if buf := readAll(t, rd); len(buf) != 0 {
+					t.Fatalf("GetBlob: want no data, got %q", buf)
+				}
+
+				// saving the blob again replaces it, unless it is rejected
+				_, err = f.SaveBlob(ctx, blob, strings.NewReader(""), 0)
+				if f.OverwritePolicy == OverwriteReject {
+					if !errors.Is(err, ErrBlobExists) {
+						t.Fatalf("SaveBlob again: want ErrBlobExists, got %v", err)
+					}
+				} else if err != nil {
+					t.Fatalf("SaveBlob again: %v", err)
+				}
+				// data for a blob announced as empty is rejected
+				other := filepath.Join(filepath.Dir(blob), strings.Repeat("f", 64))
+				if _, err := f.SaveBlob(ctx, other, strings.NewReader("foo"), 0); !errors.Is(err, ErrLongWrite) {
+					t.Fatalf("SaveBlob with data: want ErrLongWrite, got %v", err)
+				}
+				if _, err := f.CheckBlob(ctx, other); !errors.Is(err, ErrNotFound) {
+					t.Fatalf("blob with data saved: %v", err)
+				}
+				if entries, err := os.ReadDir(filepath.Dir(blob)); err != nil || len(entries) != 1 {
+					t.Fatalf("want only the blob in its directory, got %v, %v", entries, err)
+				}
+			}
+			if err := f.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDiskFilesystemSaveConfigExists(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	f := &DiskFilesystem{}
+	if err := f.CreateRepo(ctx, base); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(base, "config")
+
+	// of concurrent inits only one succeeds, the others must not replace
+	// the config
+	const n = 8
+	errs := make(chan error)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- f.SaveConfig(ctx, cfg, strings.NewReader(fmt.Sprintf("config %d", i)))
+		}(i)
+	}
+	saved := 0
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if err == nil {
+			saved++
+		} else if !errors.Is(err, ErrConfigExists) {
+			t.Fatalf("want ErrConfigExists, got %v", err)
+		}
+	}
+	if saved != 1 {
+		t.Fatalf("config saved %d times", saved)
+	}
+	buf, err := f.GetConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("other")); !errors.Is(err, ErrConfigExists) {
+		t.Fatalf("want ErrConfigExists, got %v", err)
+	}
+	if got, err := f.GetConfig(ctx, cfg); err != nil || !bytes.Equal(got, buf) {
+		t.Fatalf("config replaced: %q, %v", got, err)
+	}
+
+	// rewriting the config must be explicit
+	if err := f.ReplaceConfig(ctx, cfg, strings.NewReader("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := f.GetConfig(ctx, cfg); err != nil || string(got) != "rewritten" {
+		t.Fatalf("config not replaced: %q, %v", got, err)
+	}
+	if n, err := f.CleanTemp(ctx, base, -1); err != nil || n != 0 {
+		t.Fatalf("temporary files left behind: %v, %v", n, err)
+	}
+}
+
+func TestBlobExists(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	d := &DiskFilesystem{}
+	repo := filepath.Join(base, "repo")
+	if err := d.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := d.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrappers do not implement BlobExister, CheckBlob is used for them
+	r := NewReadOnlyFilesystem(d)
+	if _, ok := Filesystem(r).(BlobExister); ok {
+		t.Fatal("ReadOnlyFilesystem must not implement BlobExister")
+	}
+	for _, f := range []Filesystem{d, r} {
+		if exists, err := BlobExists(ctx, f, blob); err != nil || !exists {
+			t.Fatalf("%T: want existing blob, got %v, %v", f, exists, err)
+		}
+		missing := filepath.Join(repo, "keys", testID)
+		if exists, err := BlobExists(ctx, f, missing); err != nil || exists {
+			t.Fatalf("%T: want missing blob, got %v, %v", f, exists, err)
+		}
+		// only failing checks are errors
+		invalid := filepath.Join(repo, "data", "xx", "invalid")
+		if _, err := BlobExists(ctx, f, invalid); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("%T: want ErrInvalidName, got %v", f, err)
+		}
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx := context.Background()
+	d := &DiskFilesystem{FileMode: 0640}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := d.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := d.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := Stat(ctx, d, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BlobInfo{Name: testID, Size: 6, ModTime: st.ModTime(), Mode: st.Mode()}
+	if info != want {
+		t.Fatalf("want %+v, got %+v", want, info)
+	}
+	if b, err := d.CheckBlob(ctx, blob); err != nil || b != info.Blob() {
+		t.Fatalf("CheckBlob: want %+v, got %+v, %v", info.Blob(), b, err)
+	}
+
+	// wrappers fall back to CheckBlob, without the mode
+	info, err = Stat(ctx, NewReadOnlyFilesystem(d), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Mode = 0; info != want {
+		t.Fatalf("want %+v, got %+v", want, info)
+	}
+	if _, err := Stat(ctx, d, filepath.Join(repo, "keys", testID)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestSizeCheckReader(t *testing.T) {
+	for _, test := range []struct {
+		expectedSize int64
+		err          error
+	}{
+		{-1, nil},
+		{6, nil},
+		{7, ErrShortWrite},
+		{5, ErrLongWrite},
+		{0, ErrLongWrite},
+	} {
+		rd := NewSizeCheckReader("blob", iotest.OneByteReader(strings.NewReader("foobar")), test.expectedSize)
+		buf, err := ioutil.ReadAll(rd)
+		if test.err == nil && err != nil || !errors.Is(err, test.err) {
+			t.Errorf("expected size %d: want error %v, got %v", test.expectedSize, test.err, err)
+		}
+		if test.expectedSize >= 0 && int64(len(buf)) > test.expectedSize {
+			t.Errorf("expected size %d: %d bytes returned", test.expectedSize, len(buf))
+		}
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestListBlobsSince(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ids := []string{strings.Repeat("0", 64), strings.Repeat("1", 64), strings.Repeat("2", 64)}
+	for i, id := range ids {
+		blob := filepath.Join(repo, "index", id)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+			t.Fatal(err)
+		}
+		// before, at and after since
+		mtime := since.Add(time.Duration(i-1) * time.Minute)
+		if err := os.Chtimes(blob, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs, err := ListBlobsSince(ctx, f, filepath.Join(repo, "index"), since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	if len(blobs) != 2 || blobs[0].Name != ids[1] || blobs[1].Name != ids[2] {
+		t.Fatalf("want the blobs saved at or after since, got %v", blobs)
+	}
+
+	// blobs without a modification time are always returned
+	mem := NewMemoryFilesystem()
+	if _, err := mem.SaveBlob(ctx, filepath.Join(repo, "index", ids[0]), strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err = ListBlobsSince(ctx, mem, filepath.Join(repo, "index"), time.Now())
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("want the blob without modification time, got %v, %v", blobs, err)
+	}
+}
+
+func TestListLocks(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if locks, err := ListLocks(ctx, f, repo); err != nil || len(locks) != 0 {
+		t.Fatalf("want no locks without a repository, got %v, %v", locks, err)
+	}
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ids := []string{strings.Repeat("0", 64), strings.Repeat("1", 64), strings.Repeat("2", 64)}
+	for i, id := range ids {
+		lock := filepath.Join(repo, "locks", id)
+		if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+			t.Fatal(err)
+		}
+		// the first lock is the newest
+		mtime := now.Add(time.Duration(i) * -time.Minute)
+		if err := os.Chtimes(lock, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	locks, err := ListLocks(ctx, f, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 3 || locks[0].Name != ids[2] || locks[1].Name != ids[1] || locks[2].Name != ids[0] {
+		t.Fatalf("want the locks oldest first, got %v", locks)
+	}
+}
+
+func TestDiskFilesystemDurableLocks(t *testing.T) {
+	repo := filepath.FromSlash("/repo")
+	for _, mode := range []SyncMode{SyncFull, SyncDataOnly, SyncNone, SyncDeferred} {
+		d := &DiskFilesystem{SyncMode: mode}
+		if m := d.syncModeFor(filepath.Join(repo, "locks", testID), true); m != SyncFull {
+			t.Errorf("mode %v: want locks saved with SyncFull, got %v", mode, m)
+		}
+		if m := d.syncModeFor(filepath.Join(repo, "keys", testID), true); m != SyncFull {
+			t.Errorf("mode %v: want keys saved with SyncFull, got %v", mode, m)
+		}
+		if m := d.syncModeFor(filepath.Join(repo, "data", testID[:2], testID), true); m != mode {
+			t.Errorf("mode %v: want data saved with the SyncMode, got %v", mode, m)
+		}
+		if m := d.syncModeFor(filepath.Join(repo, "config"), false); m != mode {
+			t.Errorf("mode %v: want the config saved with the SyncMode, got %v", mode, m)
+		}
+	}
+}
+
+func TestListBlobsFuncStop(t *testing.T) {
+	ctx := context.Background()
+	for _, f := range []Filesystem{&DiskFilesystem{}, NewMemoryFilesystem()} {
+		base := t.TempDir()
+		if err := f.CreateRepo(ctx, base); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			if _, err := f.SaveBlob(ctx, filepath.Join(base, "keys", name), strings.NewReader(name), 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+		err := f.ListBlobsFunc(ctx, filepath.Join(base, "keys"), func(blob Blob) error {
+			calls++
+			return errStop
+		})
+		if !errors.Is(err, errStop) || calls != 1 {
+			t.Fatalf("%T: want listing to stop after the first blob, got %d calls, %v", f, calls, err)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{testID, "00"} {
+		if err := ValidateName(name); err != nil {
+			t.Errorf("%q: want valid name, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../" + testID, "ab/" + testID, "ab\\cd", "config", strings.ToUpper(testID)} {
+		if err := ValidateName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: want ErrInvalidName, got %v", name, err)
+		}
+	}
+}
+
+func TestDiskFilesystemGetConfigErrors(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+
+	// neither the repository nor the config exist
+	if _, err := f.GetConfig(ctx, filepath.Join(repo, "config")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for a missing repository, got %v", err)
+	}
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetConfig(ctx, filepath.Join(repo, "config")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for an uninitialized repository, got %v", err)
+	}
+
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(repo, "config"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := f.GetConfig(ctx, filepath.Join(repo, "config"))
+	if !errors.Is(err, os.ErrPermission) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("want only a permission error for an inaccessible config, got %v", err)
+	}
+}
+
+func TestDiskFilesystemInvalidNames(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	base := t.TempDir()
+	repo := filepath.Join(base, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(repo, "keys", "key"),
+		filepath.Join(repo, "keys") + string(filepath.Separator) + filepath.Join("..", "..", testID),
+		filepath.Join(repo, "data") + string(filepath.Separator) + filepath.Join("..", "..", "..", testID),
+	} {
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader("foobar"), 6); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("SaveBlob %v: want ErrInvalidName, got %v", path, err)
+		}
+		if _, err := f.CheckBlob(ctx, path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("CheckBlob %v: want ErrInvalidName, got %v", path, err)
+		}
+		if _, err := f.GetBlob(ctx, path); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("GetBlob %v: want ErrInvalidName, got %v", path, err)
+		}
+		if _, err := f.DeleteBlob(ctx, path, false); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("DeleteBlob %v: want ErrInvalidName, got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, testID)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file saved outside of the repository: %v", err)
+	}
+}
+
+func TestDiskFilesystemCreateRepoRepairs(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate an init which was interrupted before all dirs were created
+	removed := []string{
+		filepath.Join(repo, "data", "00"),
+		filepath.Join(repo, "data", "7f"),
+		filepath.Join(repo, "data", "ff"),
+		filepath.Join(repo, "snapshots"),
+	}
+	for _, dir := range removed {
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := (&DiskFilesystem{}).CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range removed {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Fatalf("%v not recreated: %v", dir, err)
+		}
+	}
+}
+
+func TestDiskFilesystemCreateRepoConcurrent(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+
+	// racing inits create the same subdirs, which must not fail either of them
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(ignoreUmask bool) {
+			errs <- (&DiskFilesystem{IgnoreUmask: ignoreUmask}).CreateRepo(ctx, repo)
+		}(i%2 == 0)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 256; i++ {
+		dir := filepath.Join(repo, "data", fmt.Sprintf("%02x", i))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Fatalf("%v not created: %v", dir, err)
+		}
+	}
+
+	// a canceled init fails
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	other := filepath.Join(t.TempDir(), "repo")
+	if err := (&DiskFilesystem{}).CreateRepo(canceled, other); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+	var calls int64
+	err := runParallel(ctx, 1000, 4, func(i int) error {
+		atomic.AddInt64(&calls, 1)
+		if i == 10 {
+			return errFailed
+		}
+		return nil
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("want errFailed, got %v", err)
+	}
+	if n := atomic.LoadInt64(&calls); n >= 1000 {
+		t.Fatalf("no calls skipped after the error, %d calls", n)
+	}
+}
+
+// BenchmarkRunParallelMkdir creates the data subdirs of a repository on a
+// simulated network filesystem, where each mkdir takes a round trip.
+func BenchmarkRunParallelMkdir(b *testing.B) {
+	ctx := context.Background()
+	const latency = 200 * time.Microsecond
+	for _, workers := range []int{1, mkdirWorkers} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dir := filepath.Join(b.TempDir(), "data")
+				err := runParallel(ctx, 256, workers, func(j int) error {
+					time.Sleep(latency)
+					return os.MkdirAll(filepath.Join(dir, fmt.Sprintf("%02x", j)), 0700)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskFilesystemSubdirWidth(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := (&DiskFilesystem{SubdirWidth: 1}).CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(repo, "data"))
+	if err != nil || len(entries) != 16 {
+		t.Fatalf("want 16 data subdirs, got %d, %v", len(entries), err)
+	}
+
+	// the layout is detected independently of the configured width, and
+	// paths using the default layout are mapped to it
+	f := &DiskFilesystem{}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "data", testID[:1], testID)); err != nil {
+		t.Fatalf("blob not stored in the existing subdir: %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: want size 6, got %v, %v", b.Size, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs: want one blob, got %v, %v", blobs, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskFilesystemNestedSubdirs(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := (&DiskFilesystem{Resolver: ShardedResolver{Width: 1, Depth: 2}}).CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "data", "f", "f")); err != nil {
+		t.Fatalf("nested subdirs not created: %v", err)
+	}
+
+	// the layout is detected, single-level and nested repositories can be
+	// used with the same filesystem
+	f := &DiskFilesystem{}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "data", testID[:1], testID[1:2], testID)); err != nil {
+		t.Fatalf("blob not stored in the nested subdir: %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: want size 6, got %v, %v", b.Size, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 1 || blobs[0].Name != testID {
+		t.Fatalf("ListBlobs: want one blob, got %v, %v", blobs, err)
+	}
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil || stats.Types["data"].Count != 1 {
+		t.Fatalf("RepoStats: want one data blob, got %v, %v", stats, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(t.TempDir(), "other")
+	if err := f.CreateRepo(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(other, "data", testID[:2], testID), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(other, "data", testID[:2], testID)); err != nil {
+		t.Fatalf("blob not stored in the single-level subdir: %v", err)
+	}
+}
+
+func TestDiskFilesystemWalkErrors(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range []string{filepath.Join(repo, "data", "00", "00"+testID[2:]), filepath.Join(repo, "data", "ff", "ff"+testID[2:])} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unreadable := filepath.Join(repo, "data", "00")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chmod(unreadable, 0700)
+	}()
+
+	// the unreadable subdir is reported, the walk continues with the others
+	var walked int
+	err := f.Walk(ctx, repo, func(string, Blob) error {
+		walked++
+		return nil
+	})
+	var walkErr *WalkError
+	if !errors.As(err, &walkErr) || len(walkErr.Errors) != 1 {
+		t.Fatalf("want WalkError for one entry, got %v", err)
+	}
+	if walked != 1 {
+		t.Fatalf("want one blob, got %d", walked)
+	}
+	if err := f.Walk(ctx, filepath.Join(repo, "missing"), func(string, Blob) error { return nil }); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error for a missing repository, got %v", err)
+	}
+}
+
+func TestDiskFilesystemDeleteRepo(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	repo := filepath.Join(root, "user")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	// without a config it is not a repository yet
+	if err := f.DeleteRepo(ctx, root, repo); !errors.Is(err, ErrNotRepo) {
+		t.Fatalf("want ErrNotRepo without config, got %v", err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", testID[:2], testID), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// nested repositories protect their parent
+	nested := filepath.Join(repo, "nested")
+	if err := f.CreateRepo(ctx, nested); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path string
+		err  error
+	}{
+		{root, ErrInvalidName},
+		{filepath.Dir(root), ErrInvalidName},
+		{filepath.Join(root, "..", "other"), ErrInvalidName},
+		{repo, ErrNotRepo},
+		{filepath.Join(root, "missing"), ErrNotFound},
+	} {
+		if err := f.DeleteRepo(ctx, root, test.path); !errors.Is(err, test.err) {
+			t.Errorf("%v: want %v, got %v", test.path, test.err, err)
+		}
+	}
+	if err := os.RemoveAll(nested); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.DeleteRepo(ctx, root, repo); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("want the repository removed, got %v", entries)
+	}
+}
+
+func TestDiskFilesystemRenameRepo(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	src := filepath.Join(root, "clients", "old")
+	dst := filepath.Join(root, "clients", "new")
+	if err := f.CreateRepo(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(src, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join("data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, filepath.Join(src, blob), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(root, "other")
+	if err := os.Mkdir(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		src, dst string
+		err      error
+	}{
+		{src, filepath.Join(root, "..", "outside"), ErrInvalidName},
+		{root, dst, ErrInvalidName},
+		{other, dst, ErrNotRepo},
+		{src, other, ErrRepoExists},
+		{filepath.Join(root, "missing"), dst, ErrNotFound},
+	} {
+		if err := f.RenameRepo(ctx, root, test.src, test.dst); !errors.Is(err, test.err) {
+			t.Errorf("%v to %v: want %v, got %v", test.src, test.dst, test.err, err)
+		}
+	}
+
+	if err := f.RenameRepo(ctx, root, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := f.CheckBlob(ctx, filepath.Join(dst, blob)); err != nil || b.Size != 6 {
+		t.Fatalf("want the blob in the new repository, got %v, %v", b, err)
+	}
+
+	// requests for the old path fail instead of recreating it
+	if _, err := f.CheckBlob(ctx, filepath.Join(src, blob)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CheckBlob: want ErrNotFound, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(src, blob), strings.NewReader("foobar"), 6); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SaveBlob: want ErrNotFound, got %v", err)
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Fatalf("want no directory at the old path, got %v", err)
+	}
+
+	// until the old repository is created again
+	if err := f.CreateRepo(ctx, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(src, blob), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskFilesystemSwapRepo(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	f := &DiskFilesystem{Now: func() time.Time { return now }}
+	root := t.TempDir()
+	live := filepath.Join(root, "clients", "live")
+	staged := filepath.Join(root, "staging", "live")
+	for i, repo := range []string{live, staged} {
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader(fmt.Sprintf("config %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob := filepath.Join("data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, filepath.Join(staged, blob), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(root, "other")
+	if err := os.Mkdir(other, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		live, staged string
+		err          error
+	}{
+		{live, filepath.Join(root, "..", "outside"), ErrInvalidName},
+		{root, staged, ErrInvalidName},
+		{live, live, ErrInvalidName},
+		{live, other, ErrNotRepo},
+		{filepath.Join(root, "missing"), staged, ErrNotFound},
+	} {
+		if _, err := f.SwapRepo(ctx, root, test.live, test.staged); !errors.Is(err, test.err) {
+			t.Errorf("%v with %v: want %v, got %v", test.live, test.staged, test.err, err)
+		}
+	}
+
+	backup, err := f.SwapRepo(ctx, root, live, staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "clients", ".live.swapped-20240501T120000Z"); backup != want {
+		t.Fatalf("want backup %v, got %v", want, backup)
+	}
+	if buf, err := f.GetConfig(ctx, filepath.Join(live, "config")); err != nil || string(buf) != "config 1" {
+		t.Fatalf("want the staged config, got %q, %v", buf, err)
+	}
+	if b, err := f.CheckBlob(ctx, filepath.Join(live, blob)); err != nil || b.Size != 6 {
+		t.Fatalf("want the staged blob, got %v, %v", b, err)
+	}
+	if buf, err := f.GetConfig(ctx, filepath.Join(backup, "config")); err != nil || string(buf) != "config 0" {
+		t.Fatalf("want the old config in the backup, got %q, %v", buf, err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(staged, blob), strings.NewReader("foobar"), 6); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SaveBlob: want ErrNotFound for the staged path, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(live, "data", "ff", "ff"+testID[2:]), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// the backup is hidden
+	repos, err := f.ListRepos(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0] != filepath.Join("clients", "live") {
+		t.Fatalf("want only the live repository, got %v", repos)
+	}
+
+	// a second swap within the same second does not overwrite the backup
+	if err := f.CreateRepo(ctx, staged); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(staged, "config"), strings.NewReader("config 2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SwapRepo(ctx, root, live, staged); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("want ErrRepoExists, got %v", err)
+	}
+	now = now.Add(time.Second)
+	if _, err := f.SwapRepo(ctx, root, live, staged); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskFilesystemBestEffortListing(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range []string{filepath.Join(repo, "data", "00", "00"+testID[2:]), filepath.Join(repo, "data", "ff", "ff"+testID[2:])} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unreadable := filepath.Join(repo, "data", "00")
+	if err := os.Chmod(unreadable, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chmod(unreadable, 0700)
+	}()
+
+	// strict by default
+	dataDir := filepath.Join(repo, "data")
+	if _, err := f.ListBlobs(ctx, dataDir); err == nil || errors.Is(err, ErrPartialListing) {
+		t.Fatalf("want the listing to fail, got %v", err)
+	}
+
+	f.BestEffortListing = true
+	blobs, err := f.ListBlobs(ctx, dataDir)
+	var listErr *ListingError
+	if !errors.As(err, &listErr) || !errors.Is(err, ErrPartialListing) || len(listErr.Errors) != 1 {
+		t.Fatalf("want ListingError for one entry, got %v", err)
+	}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("want the permission error to be wrapped, got %v", err)
+	}
+	if len(blobs) != 1 || blobs[0].Name != "ff"+testID[2:] {
+		t.Fatalf("want the readable blob, got %v", blobs)
+	}
+}
+
+func TestDiskFilesystemMigrateLayout(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	dataDir := filepath.Join(repo, "data")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	otherID := strings.Repeat("1", 64)
+	for _, id := range []string{testID, otherID} {
+		if err := ioutil.WriteFile(filepath.Join(dataDir, id), []byte("foobar"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a blob which has been uploaded again since
+	if err := os.MkdirAll(filepath.Join(dataDir, otherID[:2]), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, otherID[:2], otherID), []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// blobs in the flat layout can be used
+	f := &DiskFilesystem{}
+	blob := filepath.Join(dataDir, testID[:2], testID)
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: want size 6, got %v, %v", b.Size, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+	}
+	blobs, err := f.ListBlobs(ctx, dataDir)
+	if err != nil || len(blobs) != 2 {
+		t.Fatalf("ListBlobs: want two blobs, got %v, %v", blobs, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := f.MigrateLayout(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{testID, otherID} {
+			if _, err := os.Stat(filepath.Join(dataDir, id)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("blob %v not removed from the data directory: %v", id, err)
+			}
+			if _, err := os.Stat(filepath.Join(dataDir, id[:2], id)); err != nil {
+				t.Fatalf("blob %v not moved: %v", id, err)
+			}
+		}
+	}
+
+	blobs, err = f.ListBlobs(ctx, dataDir)
+	if err != nil || len(blobs) != 2 {
+		t.Fatalf("ListBlobs: want two blobs, got %v, %v", blobs, err)
+	}
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 6 {
+		t.Fatalf("DeleteBlob: want size 6, got %v, %v", size, err)
+	}
+}
+
+func TestDiskFilesystemPruneStaleLocks(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := filepath.Join(repo, "locks", strings.Repeat("0", 64))
+	fresh := filepath.Join(repo, "locks", strings.Repeat("f", 64))
+	for _, lock := range []string{stale, fresh} {
+		if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := f.PruneStaleLocks(ctx, repo, time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("want one removed lock, got %v, %v", n, err)
+	}
+	if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale lock not removed: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("fresh lock removed: %v", err)
+	}
+}
+
+func TestDiskFilesystemCompact(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{Resolver: ShardedResolver{Width: 1, Depth: 2}}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// 16 subdirs of the first level and 256 of the second, the first ones
+	// and those storing the blob are kept
+	n, err := f.Compact(ctx, repo)
+	if err != nil || n != 16+256-4 {
+		t.Fatalf("want %d removed directories, got %v, %v", 16+256-4, n, err)
+	}
+	for _, objectType := range ObjectTypes {
+		if fi, err := os.Stat(filepath.Join(repo, objectType)); err != nil || !fi.IsDir() {
+			t.Fatalf("object type directory %v removed: %v", objectType, err)
+		}
+	}
+	for _, dir := range []string{"0", filepath.Join("0", "0")} {
+		if _, err := os.Stat(filepath.Join(repo, "data", dir)); err != nil {
+			t.Fatalf("first subdir removed: %v", err)
+		}
+	}
+	if n, err := f.Compact(ctx, repo); err != nil || n != 0 {
+		t.Fatalf("second Compact: want nothing removed, got %v, %v", n, err)
+	}
+
+	// the layout is still detected, and removed subdirs are created again
+	f = &DiskFilesystem{}
+	id := strings.Repeat("a", 64)
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "data", "a", "a", id)); err != nil {
+		t.Fatalf("blob not saved with the layout of the repository: %v", err)
+	}
+
+	// blobs are saved and listed while compacting
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("%064x", i*0x1000)
+			path := filepath.Join(repo, "data", id[:2], id)
+			if _, err := f.SaveBlob(ctx, path, strings.NewReader("foo"), 3); err != nil {
+				done <- err
+				return
+			}
+			if _, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil {
+				done <- err
+				return
+			}
+			if _, err := f.DeleteBlob(ctx, path, false); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for {
+		if _, err := f.Compact(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestDiskFilesystemCleanTemp(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{TempDir: t.TempDir()}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	var stale, fresh []string
+	for _, dir := range []string{filepath.Dir(blob), filepath.Join(repo, "index"), f.TempDir} {
+		for i, files := range []*[]string{&stale, &fresh} {
+			tmp := filepath.Join(dir, fmt.Sprintf("%s%s%d", testID, TempSuffix, i))
+			if err := ioutil.WriteFile(tmp, []byte("foo"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if files == &stale {
+				if err := os.Chtimes(tmp, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+			*files = append(*files, tmp)
+		}
+	}
+
+	n, err := f.CleanTemp(ctx, repo, time.Hour)
+	if err != nil || n != len(stale) {
+		t.Fatalf("want %d removed files, got %v, %v", len(stale), n, err)
+	}
+	for _, tmp := range stale {
+		if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("stale temporary file %v not removed: %v", tmp, err)
+		}
+	}
+	for _, tmp := range append(fresh, blob) {
+		if _, err := os.Stat(tmp); err != nil {
+			t.Fatalf("%v removed: %v", tmp, err)
+		}
+	}
+}
+
+func TestDiskFilesystemSweepTemps(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	base := t.TempDir()
+	var blobs []string
+	for _, repo := range []string{"repo", filepath.Join("repo", "nested")} {
+		repo = filepath.Join(base, repo)
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(repo, "data", testID[:2], testID)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	// a crashed upload, one of an earlier version and one still in progress
+	dir := filepath.Join(base, "repo", "nested", "data", testID[:2])
+	orphan := filepath.Join(dir, tempName(testID, "0123abcd"))
+	legacy := filepath.Join(dir, testID+TempSuffix+"42")
+	active := filepath.Join(dir, tempName(testID, "4567cdef"))
+	old := time.Now().Add(-2 * TempSweepAge)
+	for _, tmp := range []string{orphan, legacy, active} {
+		if err := ioutil.WriteFile(tmp, []byte("foo"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if tmp != active {
+			if err := os.Chtimes(tmp, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if n, err := f.SweepTemps(ctx, base); err != nil || n != 2 {
+		t.Fatalf("want 2 removed files, got %v, %v", n, err)
+	}
+	for _, tmp := range []string{orphan, legacy} {
+		if _, err := os.Stat(tmp); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("orphaned temporary file %v not removed: %v", tmp, err)
+		}
+	}
+	for _, file := range append(blobs, active) {
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("%v removed: %v", file, err)
+		}
+	}
+}
+
+func TestDiskFilesystemCountBlobs(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{testID, strings.Repeat("0", 64), strings.Repeat("f", 64)}
+	for _, id := range ids {
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", testID), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a blob of the flat layout is counted, an upload in progress is not
+	flat := strings.Repeat("1", 64)
+	for _, file := range []string{filepath.Join(repo, "data", flat), filepath.Join(repo, "data", "00", tempName(flat, "0123abcd"))} {
+		if err := ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(filepath.Join(repo, "snapshots")); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := f.CountBlobs(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"data": 4, "index": 0, "keys": 1, "locks": 0, "snapshots": 0}
+	if len(counts) != len(want) {
+		t.Fatalf("want counts %v, got %v", want, counts)
+	}
+	for objectType, n := range want {
+		if counts[objectType] != n {
+			t.Fatalf("want counts %v, got %v", want, counts)
+		}
+	}
+
+	if _, err := f.CountBlobs(ctx, filepath.Join(repo, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want not exist error for a missing repository, got %v", err)
+	}
+}
+
+func TestDiskFilesystemRepairSubdir(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	for i, f := range []*DiskFilesystem{{}, {TempDir: filepath.Join(base, "tmp")}} {
+		repo := filepath.Join(base, fmt.Sprintf("repo%d", i))
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		if f.TempDir != "" {
+			if err := os.MkdirAll(f.TempDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// a removed subdir and a removed object type directory are created
+		// again
+		blobs := []string{
+			filepath.Join(repo, "data", testID[:2], testID),
+			filepath.Join(repo, "keys", testID),
+		}
+		for _, dir := range []string{filepath.Dir(blobs[0]), filepath.Dir(blobs[1])} {
+			if err := os.Remove(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, blob := range blobs {
+			if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+				t.Fatalf("TempDir %q: SaveBlob: %v", f.TempDir, err)
+			}
+			if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+				t.Fatalf("TempDir %q: CheckBlob: got %v, %v", f.TempDir, b, err)
+			}
+		}
+	}
+}
+
+func TestDiskFilesystemStatsWorkers(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := (&DiskFilesystem{}).CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%02x%062x", i*7%256, i)
+		if err := ioutil.WriteFile(filepath.Join(repo, "data", id[:2], id), []byte("foobar"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a blob of the flat layout is included
+	if err := ioutil.WriteFile(filepath.Join(repo, "data", strings.Repeat("1", 64)), []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{0, 1, 1000} {
+		f := &DiskFilesystem{StatsWorkers: workers}
+		stats, err := f.RepoStats(ctx, repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o := stats.Types["data"]; o.Count != 101 || o.Size != 603 {
+			t.Fatalf("workers=%d: want 101 data blobs with 603 bytes, got %+v", workers, o)
+		}
+	}
+}
+
+// BenchmarkDiskFilesystemRepoStats computes the statistics of a repository
+// with many small blobs using different numbers of workers.
+func BenchmarkDiskFilesystemRepoStats(b *testing.B) {
+	ctx := context.Background()
+	repo := filepath.Join(b.TempDir(), "repo")
+	if err := (&DiskFilesystem{}).CreateRepo(ctx, repo); err != nil {
+		b.Fatal(err)
+	}
+	const blobs = 256 * 64
+	for i := 0; i < blobs; i++ {
+		id := fmt.Sprintf("%02x%062x", i%256, i)
+		if err := ioutil.WriteFile(filepath.Join(repo, "data", id[:2], id), []byte("foobar"), 0600); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, workers := range []int{1, 2, 4, 8, 16, 32, 64} {
+		f := &DiskFilesystem{StatsWorkers: workers}
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				stats, err := f.RepoStats(ctx, repo)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if stats.Types["data"].Count != blobs {
+					b.Fatalf("want %d blobs, got %+v", blobs, stats.Types["data"])
+				}
+			}
+		})
+	}
+}
+
+func TestDiskFilesystemNestedRepos(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+
+	// the intermediate directories are created, they are no repositories
+	var repos []string
+	for _, repo := range []string{"clients/acme/db", "clients/acme/files"} {
+		dir := filepath.Join(root, filepath.FromSlash(repo))
+		if err := f.CreateRepo(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SaveConfig(ctx, filepath.Join(dir, "config"), strings.NewReader("config")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.SaveBlob(ctx, filepath.Join(dir, "data", testID[:2], testID), strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, filepath.FromSlash(repo))
+	}
+	for _, dir := range []string{"clients/acme/notes", "clients/other/data"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := f.ListRepos(ctx, root)
+	if err != nil || fmt.Sprint(list) != fmt.Sprint(repos) {
+		t.Fatalf("want repositories %v, got %v, %v", repos, list, err)
+	}
+
+	// a parent which is a repository itself does not include the nested ones
+	parent := filepath.Join(root, "clients")
+	if err := f.CreateRepo(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(parent, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := f.RepoStats(ctx, parent)
+	if err != nil || stats.Count != 0 {
+		t.Fatalf("RepoStats: want no blobs in the parent, got %v, %v", stats, err)
+	}
+	nested := filepath.Join(root, "clients", "acme", "db", "index", testID+TempSuffix+"1")
+	if err := ioutil.WriteFile(nested, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.CleanTemp(ctx, parent, -1); err != nil || n != 0 {
+		t.Fatalf("CleanTemp: want no files removed from nested repositories, got %v, %v", n, err)
+	}
+	list, err = f.ListRepos(ctx, root)
+	if err != nil || fmt.Sprint(list) != fmt.Sprint(append([]string{"clients"}, repos...)) {
+		t.Fatalf("want the parent and the nested repositories, got %v, %v", list, err)
+	}
+}
+
+func TestListBlobsSorted(t *testing.T) {
+	for name, f := range map[string]Filesystem{"disk": &DiskFilesystem{}, "memory": NewMemoryFilesystem()} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := filepath.Join(t.TempDir(), "repo")
+			if err := f.CreateRepo(ctx, repo); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{strings.Repeat("f", 64), strings.Repeat("0", 64), strings.Repeat("a", 64), "00" + strings.Repeat("b", 62)}
+			for _, id := range names {
+				if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader("foobar"), 6); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+			if err != nil || len(blobs) != len(names) {
+				t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+			}
+			for i := 1; i < len(blobs); i++ {
+				if blobs[i-1].Name >= blobs[i].Name {
+					t.Fatalf("blobs are not sorted: %v", blobs)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskFilesystemListBlobsSizes(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for i, id := range []string{strings.Repeat("0", 64), strings.Repeat("a", 64), strings.Repeat("f", 64)} {
+		path := filepath.Join(repo, "data", id[:2], id)
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader(strings.Repeat("x", 100*i)), int64(100*i)); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	// a blob of the flat layout
+	flat := filepath.Join(repo, "data", strings.Repeat("b", 64))
+	if err := os.WriteFile(flat, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, flat)
+
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != len(paths) {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+	sizes := make(map[string]int64)
+	for _, b := range blobs {
+		sizes[b.Name] = b.Size
+	}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, ok := sizes[filepath.Base(path)]; !ok || size != fi.Size() {
+			t.Fatalf("%v: want size %d, got %d", filepath.Base(path), fi.Size(), size)
+		}
+	}
+}
+
+func TestDiskFilesystemPreallocate(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{Preallocate: true}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads which do not match the preallocated size are rejected and the
+	// saved blob is kept
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	for _, test := range []struct {
+		expectedSize int64
+		err          error
+	}{
+		{6, nil},
+		{1000, ErrShortWrite},
+		{3, ErrLongWrite},
+	} {
+		_, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), test.expectedSize)
+		if test.err == nil && err != nil || !errors.Is(err, test.err) {
+			t.Fatalf("expected size %d: want error %v, got %v", test.expectedSize, test.err, err)
+		}
+		if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+			t.Fatalf("expected size %d: want size 6, got %v, %v", test.expectedSize, b.Size, err)
+		}
+		rd, err := f.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf := readAll(t, rd); string(buf) != "foobar" {
+			t.Fatalf("GetBlob: want %q, got %q", "foobar", buf)
+		}
+		if n, err := f.CleanTemp(ctx, repo, -1); err != nil || n != 0 {
+			t.Fatalf("temporary files left behind: %v, %v", n, err)
+		}
+	}
+}
+
+func TestDiskFilesystemMaxBlobSize(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{MaxBlobSize: 6}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil || n != 6 {
+		t.Fatalf("SaveBlob: want 6 bytes written, got %v, %v", n, err)
+	}
+	// the limit applies to the data even if no or a wrong size is announced
+	for _, expectedSize := range []int64{7, -1, 6} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobarbaz"), expectedSize); !errors.Is(err, ErrBlobTooLarge) {
+			t.Fatalf("expected size %d: want ErrBlobTooLarge, got %v", expectedSize, err)
+		}
+	}
+	// the temp file is removed and the saved blob is kept
+	entries, err := os.ReadDir(filepath.Dir(blob))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("want only the saved blob, got %v, %v", entries, err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: want size 6, got %v, %v", b.Size, err)
+	}
+}
+
+func TestDiskFilesystemSyncDeferred(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{SyncMode: SyncDeferred}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader(id), 64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// saving a snapshot waits for the pending syncs
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "snapshots", testID), strings.NewReader("snapshot"), 8); err != nil {
+		t.Fatal(err)
+	}
+	f.syncs.mu.Lock()
+	added, synced := f.syncs.added, f.syncs.synced
+	f.syncs.mu.Unlock()
+	if added != 10 || synced != 10 {
+		t.Fatalf("want 10 blobs synced before the snapshot, got %d of %d", synced, added)
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkNoReplace(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, testID)
+	for _, name := range []string{src, dst} {
+		if err := ioutil.WriteFile(name, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the caller decides whether a config or a blob exists
+	err := (&DiskFilesystem{}).linkNoReplace(src, dst)
+	if !errors.Is(err, ErrExists) || errors.Is(err, ErrConfigExists) {
+		t.Fatalf("want ErrExists, got %v", err)
+	}
+	if buf, err := ioutil.ReadFile(dst); err != nil || string(buf) != dst {
+		t.Fatalf("want the existing file kept, got %q, %v", buf, err)
+	}
+}
+
+func TestDiskFilesystemSync(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{SyncMode: SyncDeferred}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader(id), 64); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	f.syncs.mu.Lock()
+	added, synced := f.syncs.added, f.syncs.synced
+	f.syncs.mu.Unlock()
+	if added != 10 || synced != 10 {
+		t.Fatalf("want all blobs synced, got %d of %d", synced, added)
+	}
+
+	// nothing is pending, but the caller gave up
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := f.Sync(canceled); err != nil && !errors.Is(err, context.Canceled) {
+		t.Fatalf("want nil or context.Canceled, got %v", err)
+	}
+}
+
+func TestDiskFilesystemLockRepo(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+
+	// nothing is locked for a missing repository
+	unlock, err := f.LockRepo(ctx, repo, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	tryLock := func(exclusive bool) (func(), error) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		return f.LockRepo(ctx, repo, exclusive)
+	}
+	shared1, err := tryLock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared2, err := tryLock(false)
+	if err != nil {
+		t.Fatalf("shared locks must not exclude each other: %v", err)
+	}
+	if _, err := tryLock(true); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("exclusive lock must wait for shared locks, got %v", err)
+	}
+	shared1()
+	shared2()
+
+	exclusive, err := tryLock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tryLock(false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shared lock must wait for the exclusive lock, got %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		unlock, err := f.LockRepo(ctx, repo, false)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	exclusive()
+	if err := <-done; err != nil {
+		t.Fatalf("waiting lock must be acquired once the lock is released: %v", err)
+	}
+}
+
+func TestDiskFilesystemSkipExistingBlobs(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{SkipExistingBlobs: true}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(blob, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upload is read but the blob is not rewritten
+	rd := strings.NewReader("bazbar")
+	if n, err := f.SaveBlob(ctx, blob, rd, 6); err != nil || n != 6 || rd.Len() != 0 {
+		t.Fatalf("SaveBlob: want 6 bytes read, got %v, %v, %d left", n, err, rd.Len())
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || !b.ModTime.Equal(mtime) {
+		t.Fatalf("blob must not be rewritten, got %v, %v", b, err)
+	}
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 6); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("SaveBlob: want error for a short upload, got %v", err)
+	}
+
+	// blobs of a different or unknown size are written
+	for _, expectedSize := range []int64{7, -1} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar2"), expectedSize); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 7 {
+			t.Fatalf("expected size %d: blob must be rewritten, got %v, %v", expectedSize, b, err)
+		}
+	}
+}
+
+func TestDiskFilesystemOverwritePolicy(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	// the SHA-256 of foobar
+	id := "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2"
+	content := func(f *DiskFilesystem, blob string) string {
+		rd, err := f.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(readAll(t, rd))
+	}
+	errRead := errors.New("upload read")
+	unread := readerFunc(func(p []byte) (int, error) { return 0, errRead })
+
+	for _, test := range []struct {
+		policy OverwritePolicy
+		verify bool
+		stored string // after an upload of bazbaz over the corrupt foobaz
+	}{
+		{OverwriteReplace, false, "bazbaz"},
+		{OverwriteReject, false, "foobaz"},
+		{OverwriteSkipIfSame, false, "foobaz"},
+		{OverwriteSkipIfSame, true, "bazbaz"},
+	} {
+		f := &DiskFilesystem{OverwritePolicy: test.policy, OverwriteVerify: test.verify}
+		blob := filepath.Join(base, fmt.Sprintf("repo%d-%v", test.policy, test.verify), "data", id[:2], id)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+
+		switch test.policy {
+		case OverwriteReject:
+			// the upload is rejected before it is read
+			if _, err := f.SaveBlob(ctx, blob, unread, 6); !errors.Is(err, ErrBlobExists) || errors.Is(err, ErrConfigExists) {
+				t.Fatalf("policy %d: want ErrBlobExists, got %v", test.policy, err)
+			}
+		case OverwriteSkipIfSame:
+			// an intact blob of the same size is never rewritten
+			if n, err := f.SaveBlob(ctx, blob, strings.NewReader("bazbaz"), 6); err != nil || n != 6 {
+				t.Fatalf("policy %d: SaveBlob: got %v, %v", test.policy, n, err)
+			}
+			if got := content(f, blob); got != "foobar" {
+				t.Fatalf("policy %d: want the blob kept, got %q", test.policy, got)
+			}
+		}
+
+		// corrupt the blob, then upload it again
+		if err := ioutil.WriteFile(blob, []byte("foobaz"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := f.SaveBlob(ctx, blob, strings.NewReader("bazbaz"), 6)
+		if test.policy == OverwriteReject {
+			if !errors.Is(err, ErrExists) {
+				t.Fatalf("policy %d: want ErrExists, got %v", test.policy, err)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if got := content(f, blob); got != test.stored {
+			t.Fatalf("policy %d, verify %v: want %q stored, got %q", test.policy, test.verify, test.stored, got)
+		}
+	}
+}
+
+func TestDiskFilesystemObjectTypes(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{ObjectTypes: []string{"data", "index", "keys", "locks", "snapshots", "unpacked"}}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(repo, "unpacked")); err != nil || !fi.IsDir() {
+		t.Fatalf("object type directory not created: %v", err)
+	}
+
+	blob := filepath.Join(repo, "unpacked", testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "unpacked")); err != nil || len(blobs) != 1 || blobs[0].Name != testID {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil || stats.Types["unpacked"].Count != 1 {
+		t.Fatalf("RepoStats: got %v, %v", stats, err)
+	}
+
+	// object types which are not configured are rejected
+	f = &DiskFilesystem{}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("CheckBlob: want ErrInvalidName, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("SaveBlob: want ErrInvalidName, got %v", err)
+	}
+	if _, err := f.ListBlobs(ctx, filepath.Join(repo, "unpacked")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("ListBlobs: want ErrInvalidName, got %v", err)
+	}
+}
+
+func TestDiskFilesystemSaveBlobFromFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*copyChunk+100)/16)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(dir, "repo", "data", testID[:2], testID)
+
+	for _, maxSize := range []int64{0, int64(len(data)), copyChunk + 1} {
+		f := &DiskFilesystem{MaxBlobSize: maxSize}
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := f.SaveBlob(ctx, blob, in, -1)
+		_ = in.Close()
+		if maxSize > 0 && maxSize < int64(len(data)) {
+			if !errors.Is(err, ErrBlobTooLarge) {
+				t.Fatalf("max size %d: want ErrBlobTooLarge, got %v", maxSize, err)
+			}
+			continue
+		}
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("max size %d: want %d bytes written, got %v, %v", maxSize, len(data), n, err)
+		}
+		rd, err := f.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readAll(t, rd), data) {
+			t.Fatalf("max size %d: wrong data saved", maxSize)
+		}
+	}
+}
+
+func BenchmarkDiskFilesystemSaveBlob(b *testing.B) {
+	ctx := context.Background()
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte{0xaa}, 64<<20)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, data, 0600); err != nil {
+		b.Fatal(err)
+	}
+	f := &DiskFilesystem{SyncMode: SyncNone}
+	blob := filepath.Join(dir, "repo", "data", testID[:2], testID)
+
+	for _, bc := range []struct {
+		name string
+		wrap func(*os.File) io.Reader
+	}{
+		// the file is passed on as is, which allows copy_file_range
+		{"file", func(f *os.File) io.Reader { return f }},
+		// hiding the file forces copying the data through a buffer
+		{"buffer", func(f *os.File) io.Reader { return struct{ io.Reader }{f} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				in, err := os.Open(src)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = f.SaveBlob(ctx, blob, bc.wrap(in), int64(len(data)))
+				_ = in.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// interruptedWriter writes at most half of the data and returns EINTR on
+// every other call.
+type interruptedWriter struct {
+	bytes.Buffer
+	calls int
+}
+
+func (w *interruptedWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if w.calls%2 == 1 {
+		n, _ := w.Buffer.Write(p[:len(p)/2])
+		return n, syscall.EINTR
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestFullWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	w := &interruptedWriter{}
+	n, err := io.CopyBuffer(fullWriter{w}, iotest.HalfReader(bytes.NewReader(data)), make([]byte, 4096))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("want %d bytes written, got %d, %v", len(data), n, err)
+	}
+	if !bytes.Equal(w.Bytes(), data) {
+		t.Fatal("data written after EINTR does not match")
+	}
+
+	// other errors are returned with the number of bytes written
+	errFailed := errors.New("write failed")
+	n2, err := fullWriter{writerFunc(func(p []byte) (int, error) { return 1, errFailed })}.Write([]byte("foo"))
+	if n2 != 1 || !errors.Is(err, errFailed) {
+		t.Fatalf("want one byte and errFailed, got %d, %v", n2, err)
+	}
+
+	// the size of the file is checked before it is committed
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritten(f, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWritten(f, 4); err == nil {
+		t.Fatal("want an error for a file shorter than the data written")
+	}
+}
+
+// BenchmarkDiskFilesystemCopyBufferSize saves a blob read from a source
+// which is not a file, like the body of an upload, with different buffer
+// sizes. Zero is the default buffer of the runtime.
+func BenchmarkDiskFilesystemCopyBufferSize(b *testing.B) {
+	ctx := context.Background()
+	dir := b.TempDir()
+	data := bytes.Repeat([]byte{0xaa}, 64<<20)
+	blob := filepath.Join(dir, "repo", "data", testID[:2], testID)
+
+	for _, size := range []int{0, 32 << 10, 128 << 10, 512 << 10, 1 << 20, 4 << 20} {
+		f := &DiskFilesystem{SyncMode: SyncNone, CopyBufferSize: size}
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				// hide bytes.Reader.WriteTo like the body of a request
+				rd := struct{ io.Reader }{bytes.NewReader(data)}
+				if _, err := f.SaveBlob(ctx, blob, rd, int64(len(data))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskFilesystemFreeSpace(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := &DiskFilesystem{}
+	free, total, err := f.FreeSpace(dir)
+	if err != nil || total == 0 || free > total {
+		t.Fatalf("FreeSpace: got %v, %v, %v", free, total, err)
+	}
+
+	// the repository does not exist yet
+	blob := filepath.Join(dir, "repo", "data", testID[:2], testID)
+	f.MinFreeSpace = total
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("SaveBlob: want ErrNoSpace, got %v", err)
+	}
+	f.MinFreeSpace = 1
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteBlobs(t *testing.T) {
+	ctx := context.Background()
+	for _, f := range []Filesystem{&DiskFilesystem{}, NewMemoryFilesystem()} {
+		base := t.TempDir()
+		if err := f.CreateRepo(ctx, base); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for i := 0; i < 20; i++ {
+			path := filepath.Join(base, "keys", fmt.Sprintf("%064x", i))
+			if _, err := f.SaveBlob(ctx, path, strings.NewReader(path), -1); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+		// missing blobs are skipped, so that retries succeed
+		paths = append(paths, filepath.Join(base, "keys", strings.Repeat("f", 64)))
+
+		sizes, err := f.DeleteBlobs(ctx, paths, true)
+		if err != nil {
+			t.Fatalf("%T: %v", f, err)
+		}
+		for i, size := range sizes {
+			if want := int64(len(paths[i])); i < 20 && size != want {
+				t.Fatalf("%T: size %d: want %d, got %d", f, i, want, size)
+			}
+		}
+		if sizes[20] != 0 {
+			t.Fatalf("%T: want size 0 for missing blob, got %d", f, sizes[20])
+		}
+		if blobs, err := f.ListBlobs(ctx, filepath.Join(base, "keys")); err != nil || len(blobs) != 0 {
+			t.Fatalf("%T: want all blobs removed, got %v, %v", f, blobs, err)
+		}
+	}
+}
+
+func TestOpenBlob(t *testing.T) {
+	ctx := context.Background()
+	disk := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := disk.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemoryFilesystem()
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+
+	for _, f := range []Filesystem{disk, mem} {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+		rd, err := OpenBlob(ctx, f, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rd.Size() != 6 {
+			t.Fatalf("want size 6, got %d", rd.Size())
+		}
+		buf := make([]byte, 4)
+		if n, err := rd.ReadAt(buf, 1); n != 4 || err != nil || string(buf) != "ooba" {
+			t.Fatalf("ReadAt(1): got %q, %v", buf[:n], err)
+		}
+		if n, err := rd.ReadAt(buf, 4); n != 2 || err != io.EOF || string(buf[:n]) != "ar" {
+			t.Fatalf("ReadAt(4): got %q, %v", buf[:n], err)
+		}
+		if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+		missing := filepath.Join(repo, "data", "00", strings.Repeat("0", 64))
+		if _, err := OpenBlob(ctx, f, missing); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("want ErrNotFound, got %v", err)
+		}
+	}
+
+	// concurrent readers share the file until it is replaced
+	r1, err := disk.OpenBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := disk.OpenBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.(*sharedReader).sf != r2.(*sharedReader).sf {
+		t.Fatal("want the readers to share the file")
+	}
+	// also through wrappers like TimeoutFilesystem
+	rt, err := OpenBlob(ctx, NewTimeoutFilesystem(disk, time.Minute), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sr, ok := rt.(*sharedReader); !ok || sr.sf != r1.(*sharedReader).sf {
+		t.Fatalf("want the reader of the wrapper to share the file, got %T", rt)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.SaveBlob(ctx, blob, strings.NewReader("bazqux"), 6); err != nil {
+		t.Fatal(err)
+	}
+	r3, err := disk.OpenBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := r3.ReadAt(buf, 0); err != nil || string(buf) != "bazqux" {
+		t.Fatalf("want the new blob, got %q, %v", buf, err)
+	}
+	if _, err := r1.ReadAt(buf, 0); err != nil || string(buf) != "foobar" {
+		t.Fatalf("want the old blob for the open reader, got %q, %v", buf, err)
+	}
+
+	for _, rd := range []BlobReaderAt{r1, r2, r3} {
+		if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r2.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("want os.ErrClosed after Close, got %v", err)
+	}
+	if n := len(disk.openBlobs.files); n != 0 {
+		t.Fatalf("want all files closed, %d are open", n)
+	}
+}
+
+func TestDiskFilesystemListLimits(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(repo, "data")
+	if _, err := f.SaveBlob(ctx, blobPath(data, testID), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default layout is within the limits
+	f.MaxListDepth = 1
+	f.MaxListEntries = 1000
+	if blobs, err := f.ListBlobs(ctx, data); err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs: want 1 blob, got %v, %v", blobs, err)
+	}
+	if err := f.Walk(ctx, repo, func(string, Blob) error { return nil }); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if repos, err := f.ListRepos(ctx, root); err != nil || len(repos) != 1 {
+		t.Fatalf("ListRepos: want 1 repository, got %v, %v", repos, err)
+	}
+
+	// a deeply nested tree created by a client
+	if err := os.MkdirAll(filepath.Join(data, "00", "a", "b", "c"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "a", "b", "c"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.ListBlobs(ctx, data); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("ListBlobs: want ErrTooManyEntries, got %v", err)
+	}
+	if err := f.Walk(ctx, repo, func(string, Blob) error { return nil }); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("Walk: want ErrTooManyEntries, got %v", err)
+	}
+	if _, err := f.ListRepos(ctx, root); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("ListRepos: want ErrTooManyEntries, got %v", err)
+	}
+
+	// the 256 data subdirs exceed a small number of entries
+	f.MaxListDepth = 0
+	f.MaxListEntries = 100
+	if _, err := f.ListBlobs(ctx, data); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("ListBlobs: want ErrTooManyEntries, got %v", err)
+	}
+	f.MaxListEntries = 0
+	if blobs, err := f.ListBlobs(ctx, data); err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs without limits: want 1 blob, got %v, %v", blobs, err)
+	}
+}
+
+func TestListBlobsPrefix(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(repo, "data")
+	ids := []string{
+		"ab" + strings.Repeat("0", 62),
+		"ab" + strings.Repeat("1", 62),
+		"a0" + strings.Repeat("0", 62),
+		"cd" + strings.Repeat("0", 62),
+	}
+	for _, id := range ids {
+		if _, err := f.SaveBlob(ctx, blobPath(data, id), strings.NewReader("foo"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a blob of the flat layout
+	flat := "ab" + strings.Repeat("2", 62)
+	if err := os.WriteFile(filepath.Join(data, flat), []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(blobs []Blob) string {
+		var n []string
+		for _, b := range blobs {
+			n = append(n, b.Name)
+		}
+		sort.Strings(n)
+		return strings.Join(n, ",")
+	}
+	for _, test := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"", []string{ids[2], ids[0], ids[1], flat, ids[3]}},
+		{"a", []string{ids[2], ids[0], ids[1], flat}},
+		{"ab", []string{ids[0], ids[1], flat}},
+		{"ab1", []string{ids[1]}},
+		{ids[3], []string{ids[3]}},
+		{"ef", nil},
+	} {
+		blobs, err := ListBlobsPrefix(ctx, f, data, test.prefix)
+		if err != nil {
+			t.Fatalf("prefix %q: %v", test.prefix, err)
+		}
+		if got, want := names(blobs), strings.Join(test.want, ","); got != want {
+			t.Errorf("prefix %q: want %v, got %v", test.prefix, want, got)
+		}
+		// the fallback lists the same blobs
+		blobs, err = listBlobsPrefix(ctx, f, data, test.prefix)
+		if err != nil || names(blobs) != strings.Join(test.want, ",") {
+			t.Errorf("prefix %q: fallback returned %v, %v", test.prefix, names(blobs), err)
+		}
+	}
+
+	// only the subdirs matching the prefix are read
+	if err := os.MkdirAll(filepath.Join(data, "cd", "a", "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f.MaxListDepth = 1
+	if blobs, err := f.ListBlobsPrefix(ctx, data, "ab"); err != nil || len(blobs) != 3 {
+		t.Fatalf("want 3 blobs, got %v, %v", blobs, err)
+	}
+	if _, err := f.ListBlobsPrefix(ctx, data, "c"); !errors.Is(err, ErrTooManyEntries) {
+		t.Fatalf("want ErrTooManyEntries for the nested subdir, got %v", err)
+	}
+
+	if _, err := f.ListBlobsPrefix(ctx, data, "xyz"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("want ErrInvalidName, got %v", err)
+	}
+}
+
+// failingLister fails all listings after listing its base.
+type failingLister struct {
+	Filesystem
+}
+
+func (f failingLister) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	if err := f.Filesystem.ListBlobsFunc(ctx, path, fn); err != nil {
+		return err
+	}
+	return errors.New("listing failed")
+}
+
+func TestBlobsIter(t *testing.T) {
+	ctx := context.Background()
+	f := NewMemoryFilesystem()
+	repo := "/repo"
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", id), strings.NewReader("key"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	BlobsIter(ctx, f, repo, "keys")(func(blob Blob, err error) bool {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, blob.Name)
+		return true
+	})
+	if len(names) != 3 {
+		t.Fatalf("want 3 blobs, got %v", names)
+	}
+
+	// stopping the iteration stops the listing without an error
+	calls := 0
+	BlobsIter(ctx, f, repo, "keys")(func(blob Blob, err error) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Fatalf("want the iteration stopped after one blob, got %d calls", calls)
+	}
+
+	// errors of the listing are yielded last
+	var errs []error
+	blobs := 0
+	BlobsIter(ctx, failingLister{f}, repo, "keys")(func(blob Blob, err error) bool {
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			blobs++
+		}
+		return true
+	})
+	if blobs != 3 || len(errs) != 1 {
+		t.Fatalf("want 3 blobs and an error, got %d blobs and %v", blobs, errs)
+	}
+}
+
+func TestDiskFilesystemUnexpectedEntries(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", testID), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(repo, "data", "notes"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(repo, "keys", "backup"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	junk := []string{
+		filepath.Join(repo, "data", ".DS_Store"),
+		filepath.Join(repo, "data", testID[:2], ".nfs000000000001"),
+		filepath.Join(repo, "data", "notes", testID),
+		filepath.Join(repo, "keys", ".DS_Store"),
+	}
+	temps := []string{
+		filepath.Join(repo, "data", testID[:2], tempName(testID, "0123abcd")),
+		filepath.Join(repo, "keys", tempName(testID, "0123abcd")),
+	}
+	// locks may have any name
+	lock := filepath.Join(repo, "locks", "lock-1")
+	for _, file := range append(append(junk, temps...), lock) {
+		if err := ioutil.WriteFile(file, []byte("junk"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for dir, want := range map[string]string{"data": testID, "keys": testID, "locks": "lock-1"} {
+		blobs, err := f.ListBlobs(ctx, filepath.Join(repo, dir))
+		if err != nil || len(blobs) != 1 || blobs[0].Name != want {
+			t.Errorf("%v: want only %v listed, got %v, %v", dir, want, blobs, err)
+		}
+	}
+	// the data dir has three unexpected entries, the keys dir two
+	if n := f.UnexpectedEntries(); n != 5 {
+		t.Fatalf("want 5 unexpected entries, got %d", n)
+	}
+	var walked []string
+	err := f.Walk(ctx, repo, func(objectType string, blob Blob) error {
+		walked = append(walked, objectType+"/"+blob.Name)
+		return nil
+	})
+	if err != nil || len(walked) != 3 {
+		t.Fatalf("Walk: want 3 blobs, got %v, %v", walked, err)
+	}
+
+	f.StrictListing = true
+	for _, dir := range []string{"data", "keys"} {
+		if _, err := f.ListBlobs(ctx, filepath.Join(repo, dir)); !errors.Is(err, ErrUnexpectedEntry) {
+			t.Errorf("%v: want ErrUnexpectedEntry, got %v", dir, err)
+		}
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "locks")); err != nil || len(blobs) != 1 {
+		t.Errorf("locks: want the lock listed, got %v, %v", blobs, err)
+	}
+	err = f.Walk(ctx, repo, func(objectType string, blob Blob) error { return nil })
+	var werr *WalkError
+	if !errors.As(err, &werr) || len(werr.Errors) != 5 || !errors.Is(werr.Errors[0], ErrUnexpectedEntry) {
+		t.Fatalf("Walk: want a WalkError for the unexpected entries, got %v", err)
+	}
+
+	// temporary files are never reported
+	for _, file := range junk {
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{filepath.Join(repo, "data", "notes"), filepath.Join(repo, "keys", "backup")} {
+		if err := os.Remove(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Walk(ctx, repo, func(objectType string, blob Blob) error { return nil }); err != nil {
+		t.Fatalf("Walk: want temporary files skipped, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fsync flushes the data of f to permanent storage. On macOS fsync only
+// passes the data to the drive, which may keep it in its volatile cache
+// across a power loss, so F_FULLFSYNC is used to flush the drive cache as
+// well. Filesystems which do not support F_FULLFSYNC, like some network
+// mounts, fall back to a plain fsync.
+func fsync(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var syncErr error
+	err = rc.Control(func(fd uintptr) {
+		syncErr = retryEINTR(func() error {
+			_, err := unix.FcntlInt(fd, unix.F_FULLFSYNC, 0)
+			return err
+		})
+		if errors.Is(syncErr, unix.ENOTSUP) || errors.Is(syncErr, unix.ENOTTY) || errors.Is(syncErr, unix.EINVAL) {
+			syncErr = retryEINTR(func() error {
+				return unix.Fsync(int(fd))
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if syncErr != nil {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: syncErr}
+	}
+	return nil
+}
+
+func retryEINTR(fn func() error) error {
+	for {
+		if err := fn(); err != unix.EINTR {
+			return err
+		}
+	}
+}
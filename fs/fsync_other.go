@@ -0,0 +1,11 @@
+//go:build !darwin
+// +build !darwin
+
+package fs
+
+import "os"
+
+// fsync flushes the data of f to permanent storage.
+func fsync(f *os.File) error {
+	return f.Sync()
+}
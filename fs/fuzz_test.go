@@ -0,0 +1,71 @@
+//go:build go1.18
+// +build go1.18
+
+package fs
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// escapes reports whether path is outside of root.
+func escapes(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel)
+}
+
+// fuzzNames are the seeds for the fuzz tests, names a client may try to
+// escape from the repository with.
+var fuzzNames = []string{
+	testID, "00", "", ".", "..", "...", "../..", "../" + testID, "..\\" + testID,
+	"./" + testID, "/" + testID, "ab/../" + testID, testID + "/..", testID + "\x00",
+	"\x00..", "%2e%2e", "%2e%2e%2f" + testID, "\xc0\xae\xc0\xae", "\xc0\xaf", "\xe0\x80\xae",
+	"\uff0e\uff0e", "\u2025", "\u2024\u2024", "..\u2215", "\u00e9", "\ufffd", "C:" + testID,
+	"\\\\?\\C:\\", "con", "aux.txt", strings.Repeat("a", 4096),
+}
+
+// FuzzValidateName checks that no name passing ValidateName leads to a blob
+// path outside of the repository, constructed like the handlers do.
+func FuzzValidateName(f *testing.F) {
+	for _, name := range fuzzNames {
+		f.Add(name)
+	}
+	repo := filepath.Join(filepath.FromSlash("/srv/restic"), "repo")
+	f.Fuzz(func(t *testing.T, name string) {
+		if ValidateName(name) != nil {
+			return
+		}
+		for _, objectType := range ObjectTypes {
+			path := blobPath(filepath.Join(repo, objectType), name)
+			if escapes(repo, path) {
+				t.Fatalf("%q: blob path %v outside of the repository", name, path)
+			}
+			if filepath.Base(path) != name {
+				t.Fatalf("%q: blob path %v has a different name", name, path)
+			}
+			if err := validateBlobPath(path); err != nil {
+				t.Fatalf("%q: constructed path %v rejected: %v", name, path, err)
+			}
+		}
+	})
+}
+
+// FuzzValidateBlobPath checks that no path passing validateBlobPath leaves
+// the repository once it is cleaned, even if the name was appended to the
+// directory without validating it first.
+func FuzzValidateBlobPath(f *testing.F) {
+	for _, name := range fuzzNames {
+		f.Add(name)
+	}
+	repo := filepath.Join(filepath.FromSlash("/srv/restic"), "repo")
+	f.Fuzz(func(t *testing.T, name string) {
+		path := filepath.Join(repo, "data") + string(filepath.Separator) + name
+		if validateBlobPath(path) != nil {
+			return
+		}
+		if escapes(repo, filepath.Clean(path)) {
+			t.Fatalf("%q: accepted path %v outside of the repository", name, path)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrReadTimeout is returned by the readers of DiskFilesystem.GetBlob once
+// the blob has not been read for longer than the ReadIdleTimeout.
+var ErrReadTimeout = newError("read_timeout", "blob not read within the idle timeout")
+
+// idleReader reads a file and closes it once it has been idle, neither read
+// nor seeked, for longer than timeout. Afterwards Read and Seek return
+// ErrReadTimeout.
+type idleReader struct {
+	f       *os.File
+	timeout time.Duration
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	last     time.Time // end of the last operation
+	active   bool      // an operation is in progress
+	closed   bool
+	timedOut bool
+}
+
+var _ io.ReadSeekCloser = &idleReader{}
+
+// newIdleReader returns an idleReader for f.
+func newIdleReader(f *os.File, timeout time.Duration) *idleReader {
+	r := &idleReader{f: f, timeout: timeout, last: time.Now()}
+	r.timer = time.AfterFunc(timeout, r.expire)
+	return r
+}
+
+// expire closes the file if it has been idle for the timeout, otherwise the
+// timer is restarted for the remaining time.
+func (r *idleReader) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.timedOut {
+		return
+	}
+	if idle := time.Since(r.last); r.active || idle < r.timeout {
+		remaining := r.timeout - idle
+		if r.active {
+			remaining = r.timeout
+		}
+		r.timer.Reset(remaining)
+		return
+	}
+	r.timedOut = true
+	_ = r.f.Close()
+}
+
+// begin marks the start of an operation, it fails once the reader has timed
+// out.
+func (r *idleReader) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timedOut {
+		return ErrReadTimeout
+	}
+	r.active = true
+	return nil
+}
+
+// end marks the end of an operation.
+func (r *idleReader) end() {
+	r.mu.Lock()
+	r.active = false
+	r.last = time.Now()
+	r.mu.Unlock()
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if err := r.begin(); err != nil {
+		return 0, err
+	}
+	defer r.end()
+	return r.f.Read(p)
+}
+
+func (r *idleReader) Seek(offset int64, whence int) (int64, error) {
+	if err := r.begin(); err != nil {
+		return 0, err
+	}
+	defer r.end()
+	return r.f.Seek(offset, whence)
+}
+
+// Close closes the file unless it has already been closed after the timeout.
+func (r *idleReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.timer.Stop()
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	if r.timedOut {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskFilesystemReadIdleTimeout(t *testing.T) {
+	ctx := context.Background()
+	const timeout = 50 * time.Millisecond
+	f := &DiskFilesystem{ReadIdleTimeout: timeout}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	data := strings.Repeat("x", 100)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a slow but steady reader is not interrupted
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		if _, err := rd.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(timeout / 5)
+	}
+	if _, err := rd.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stalled reader is closed
+	time.Sleep(3 * timeout)
+	if _, err := rd.Read(buf); !errors.Is(err, ErrReadTimeout) {
+		t.Fatalf("want ErrReadTimeout, got %v", err)
+	}
+	if _, err := rd.(*idleReader).f.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("file not closed: %v", err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a stall the file is closed by Close
+	rd, err = f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != data {
+		t.Fatalf("GetBlob: want %d bytes, got %d", len(data), len(buf))
+	}
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// ErrLastKey is returned by ReplaceKey instead of removing the only key of a
+// repository, without a key nobody can open the repository any more.
+var ErrLastKey = newError("last_key", "refusing to remove the last key")
+
+// ReplaceKey saves the key read from body as newName in the repository at
+// path and then removes the key oldName, e.g. when the password of a
+// repository is changed. The order guarantees that the repository has a
+// valid key at any time: if the server crashes in between, both keys are
+// left and the old one can be removed again later on.
+//
+// The old key is only removed after the new key has been saved and is listed
+// with a non-zero size. Otherwise the old key is kept and ReplaceKey fails,
+// with ErrLastKey if the old key is the only one. An exclusive lock of the
+// repository, see LockRepo, keeps concurrent replacements from removing each
+// other's keys.
+func ReplaceKey(ctx context.Context, f Filesystem, path, oldName, newName string, body io.Reader) error {
+	if err := ValidateName(oldName); err != nil {
+		return err
+	}
+	if err := ValidateName(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return fmt.Errorf("%v: the new key must have another name: %w", newName, ErrInvalidName)
+	}
+
+	unlock, err := LockRepo(ctx, f, path, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dir := filepath.Join(path, "keys")
+	oldPath, newPath := filepath.Join(dir, oldName), filepath.Join(dir, newName)
+	if _, err := f.CheckBlob(ctx, oldPath); err != nil {
+		return err
+	}
+	if _, err := f.SaveBlob(ctx, newPath, body, -1); err != nil {
+		return err
+	}
+
+	keys, err := f.ListBlobs(ctx, dir)
+	if err != nil {
+		return err
+	}
+	saved, others := false, 0
+	for _, key := range keys {
+		if key.Name == newName && key.Size > 0 {
+			saved = true
+		}
+		if key.Name != oldName && key.Size > 0 {
+			others++
+		}
+	}
+	switch {
+	case others == 0:
+		return fmt.Errorf("%v: new key %v is missing or empty: %w", oldPath, newName, ErrLastKey)
+	case !saved:
+		return fmt.Errorf("%v: new key is missing or empty after saving it: %w", newPath, ErrNotFound)
+	}
+
+	_, err = f.DeleteBlob(ctx, oldPath, false)
+	return err
+}
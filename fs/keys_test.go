@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceKey(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	oldKey, newKey := strings.Repeat("1", 64), strings.Repeat("2", 64)
+	keys := filepath.Join(repo, "keys")
+	if _, err := f.SaveBlob(ctx, filepath.Join(keys, oldKey), strings.NewReader("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty new key is not accepted as a replacement of the only key
+	err := ReplaceKey(ctx, f, repo, oldKey, newKey, strings.NewReader(""))
+	if !errors.Is(err, ErrLastKey) {
+		t.Fatalf("want ErrLastKey, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, filepath.Join(keys, oldKey)); err != nil {
+		t.Fatalf("old key removed: %v", err)
+	}
+
+	if err := ReplaceKey(ctx, f, repo, oldKey, newKey, strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := f.ListBlobs(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 || blobs[0].Name != newKey || blobs[0].Size != 3 {
+		t.Fatalf("want only the new key, got %v", blobs)
+	}
+
+	// the old key must exist, and the names must differ
+	if err := ReplaceKey(ctx, f, repo, oldKey, newKey, strings.NewReader("new")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound for the missing old key, got %v", err)
+	}
+	if err := ReplaceKey(ctx, f, repo, newKey, newKey, strings.NewReader("new")); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("want ErrInvalidName, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RepoLockFile is the file in the root directory of a repository which is
+// locked by DiskFilesystem.LockRepo.
+const RepoLockFile = ".rest-server-lock"
+
+// RepoLocker is implemented by Filesystems which can lock a repository for
+// the duration of a request.
+type RepoLocker interface {
+	// LockRepo acquires a shared or an exclusive lock for the repository at
+	// path, waiting until it is available or ctx is canceled. The returned
+	// function releases the lock.
+	LockRepo(ctx context.Context, path string, exclusive bool) (unlock func(), err error)
+}
+
+var _ RepoLocker = &DiskFilesystem{}
+
+// LockRepo locks the repository at path using f if it is a RepoLocker, and
+// does nothing otherwise. Wrappers use it to pass locking on to their base.
+func LockRepo(ctx context.Context, f Filesystem, path string, exclusive bool) (unlock func(), err error) {
+	if locker, ok := f.(RepoLocker); ok {
+		return locker.LockRepo(ctx, path, exclusive)
+	}
+	return func() {}, nil
+}
+
+// maxLockWait is the longest interval between two attempts to acquire a lock.
+const maxLockWait = 100 * time.Millisecond
+
+// LockRepo locks the RepoLockFile of the repository at path using an
+// advisory lock, flock on Unix and LockFileEx on Windows. Shared locks can be
+// held by any number of callers at the same time, an exclusive lock waits
+// until all other locks have been released and blocks new ones. This is used
+// to serialize deletions, e.g. by prune, with the uploads of other clients.
+//
+// Each lock uses its own file descriptor, so locks also exclude each other
+// within this process, except on AIX, which only has fcntl locks. Other
+// processes are only excluded if the filesystem honors advisory locks, which
+// some network filesystems do not. Locks are not fair, a steady stream of
+// shared locks can delay an exclusive lock.
+//
+// To avoid deadlocks, a caller must hold at most one lock at a time. If the
+// repository does not exist, nothing is locked.
+func (d *DiskFilesystem) LockRepo(ctx context.Context, path string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(path, RepoLockFile), os.O_RDWR|os.O_CREATE, d.fileMode())
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	wait := time.Millisecond
+	for {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			_ = f.Close()
+			return nil, &os.PathError{Op: "lock", Path: f.Name(), Err: err}
+		}
+		if ok {
+			// closing the file releases the lock
+			return func() { _ = f.Close() }, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxLockWait {
+			wait = maxLockWait
+		}
+	}
+}
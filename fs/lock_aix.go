@@ -0,0 +1,26 @@
+package fs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock tries to acquire an advisory lock on f without waiting, it returns
+// false if f is locked by someone else. AIX has no flock, so this uses a
+// fcntl lock of the whole file instead. Unlike flock, fcntl locks belong to
+// the process: they only exclude other processes, and closing any file
+// descriptor of the file releases all locks of the process on it. An
+// exclusive lock needs a file opened for writing.
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	lk := unix.Flock_t{Type: unix.F_RDLCK}
+	if exclusive {
+		lk.Type = unix.F_WRLCK
+	}
+	err := unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) || errors.Is(err, unix.EINTR) {
+		return false, nil
+	}
+	return err == nil, err
+}
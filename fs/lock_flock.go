@@ -0,0 +1,26 @@
+//go:build !windows && !aix
+// +build !windows,!aix
+
+package fs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock tries to acquire an advisory lock on f without waiting, it returns
+// false if f is locked by someone else.
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	// syscall has no flock on Solaris
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) || errors.Is(err, unix.EINTR) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMaintenance is returned by MaintenanceFilesystem for all operations
+// which would modify a repository while the maintenance mode is enabled.
+var ErrMaintenance = newError("maintenance", "server is in maintenance mode")
+
+// MaintenanceFilesystem wraps a Filesystem and rejects all modifications
+// while the maintenance mode is enabled, e.g. during a backup of the server
+// itself, like a ReadOnlyFilesystem. Reads are always served. The mode can be
+// switched at any time and applies to the operations started afterwards,
+// operations in progress are not aborted.
+type MaintenanceFilesystem struct {
+	Filesystem
+	enabled uint32 // must be accessed using sync/atomic
+}
+
+// NewMaintenanceFilesystem returns a MaintenanceFilesystem for base with the
+// maintenance mode disabled.
+func NewMaintenanceFilesystem(base Filesystem) *MaintenanceFilesystem {
+	return &MaintenanceFilesystem{Filesystem: base}
+}
+
+// SetMaintenance enables or disables the maintenance mode.
+func (m *MaintenanceFilesystem) SetMaintenance(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&m.enabled, v)
+}
+
+// Maintenance reports whether the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) Maintenance() bool {
+	return atomic.LoadUint32(&m.enabled) != 0
+}
+
+// CreateRepo creates the repository unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) CreateRepo(ctx context.Context, path string) error {
+	if m.Maintenance() {
+		return ErrMaintenance
+	}
+	return m.Filesystem.CreateRepo(ctx, path)
+}
+
+// SaveConfig saves the config unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	if m.Maintenance() {
+		return ErrMaintenance
+	}
+	return m.Filesystem.SaveConfig(ctx, path, rd)
+}
+
+// DeleteConfig removes the config unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	if m.Maintenance() {
+		return ErrMaintenance
+	}
+	return m.Filesystem.DeleteConfig(ctx, path)
+}
+
+// SaveBlob saves the blob unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	if m.Maintenance() {
+		return 0, ErrMaintenance
+	}
+	return m.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	if m.Maintenance() {
+		return 0, ErrMaintenance
+	}
+	return m.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs unless the maintenance mode is enabled.
+func (m *MaintenanceFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	if m.Maintenance() {
+		return nil, ErrMaintenance
+	}
+	return m.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
+
+var _ RepoLocker = &MaintenanceFilesystem{}
+
+// LockRepo locks the repository using the base, see LockRepo, so that the
+// wrapper can always be installed.
+func (m *MaintenanceFilesystem) LockRepo(ctx context.Context, path string, exclusive bool) (func(), error) {
+	return LockRepo(ctx, m.Filesystem, path, exclusive)
+}
+
+var _ BlobOpener = &MaintenanceFilesystem{}
+
+// OpenBlob opens the blob using the base, see OpenBlob. Reads are served in
+// maintenance mode as well.
+func (m *MaintenanceFilesystem) OpenBlob(ctx context.Context, path string) (BlobReaderAt, error) {
+	return OpenBlob(ctx, m.Filesystem, path)
+}
+
+var _ BlobPrefixLister = &MaintenanceFilesystem{}
+
+// ListBlobsPrefix lists the blobs using the base, see ListBlobsPrefix.
+func (m *MaintenanceFilesystem) ListBlobsPrefix(ctx context.Context, path, prefix string) ([]Blob, error) {
+	return ListBlobsPrefix(ctx, m.Filesystem, path, prefix)
+}
+
+var _ Presigner = &MaintenanceFilesystem{}
+
+// PresignGet returns a URL for the blob using the base, see PresignGet.
+// Downloads are allowed in maintenance mode as well.
+func (m *MaintenanceFilesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	return PresignGet(ctx, m.Filesystem, path, ttl)
+}
@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceFilesystem(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.FromSlash("/repo")
+	blob := filepath.Join(repo, "locks", testID)
+	f := NewMaintenanceFilesystem(NewMemoryFilesystem())
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	f.SetMaintenance(true)
+	if !f.Maintenance() {
+		t.Fatal("want the maintenance mode enabled")
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 4 {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+	for name, err := range map[string]error{
+		"CreateRepo":   f.CreateRepo(ctx, repo),
+		"SaveConfig":   f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")),
+		"DeleteConfig": f.DeleteConfig(ctx, filepath.Join(repo, "config")),
+	} {
+		if !errors.Is(err, ErrMaintenance) {
+			t.Errorf("%v: want ErrMaintenance, got %v", name, err)
+		}
+	}
+	other := filepath.Join(repo, "locks", strings.Repeat("0", 64))
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("lock"), 4); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("SaveBlob: want ErrMaintenance, got %v", err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("DeleteBlob: want ErrMaintenance, got %v", err)
+	}
+	if _, err := f.DeleteBlobs(ctx, []string{blob}, false); !errors.Is(err, ErrMaintenance) {
+		t.Errorf("DeleteBlobs: want ErrMaintenance, got %v", err)
+	}
+
+	f.SetMaintenance(false)
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatalf("DeleteBlob after the maintenance: %v", err)
+	}
+}
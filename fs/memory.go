@@ -0,0 +1,321 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryFilesystem keeps all repositories in memory. It is meant for tests
+// and ephemeral repositories, everything is lost when the process exits.
+type MemoryFilesystem struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+	dirs  map[string]struct{}
+}
+
+var _ Filesystem = &MemoryFilesystem{}
+
+// NewMemoryFilesystem returns a new, empty MemoryFilesystem.
+func NewMemoryFilesystem() *MemoryFilesystem {
+	return &MemoryFilesystem{
+		files: make(map[string][]byte),
+		dirs:  make(map[string]struct{}),
+	}
+}
+
+func notExist(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+// mkdirAll records path and all of its parents as existing directories. The
+// caller must hold the write lock.
+func (m *MemoryFilesystem) mkdirAll(path string) {
+	for {
+		m.dirs[path] = struct{}{}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return
+		}
+		path = parent
+	}
+}
+
+// CreateRepo creates the repository directories.
+func (m *MemoryFilesystem) CreateRepo(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[filepath.Join(path, "config")]; ok {
+		return repoExists(path)
+	}
+	m.mkdirAll(path)
+	for _, t := range ObjectTypes {
+		m.dirs[filepath.Join(path, t)] = struct{}{}
+	}
+	for i := 0; i < 256; i++ {
+		m.dirs[filepath.Join(path, "data", fmt.Sprintf("%02x", i))] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemoryFilesystem) size(op, path string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	buf, ok := m.files[path]
+	if !ok {
+		return 0, notExist(op, path)
+	}
+	return int64(len(buf)), nil
+}
+
+// CheckConfig returns whether the config file exists and its size.
+func (m *MemoryFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	size, err := m.size("stat", path)
+	if err != nil {
+		return false, 0, nil
+	}
+	return true, size, nil
+}
+
+// read returns a copy of the file at path
+func (m *MemoryFilesystem) read(path string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	buf, ok := m.files[path]
+	if !ok {
+		return nil, notExist("open", path)
+	}
+	return append([]byte(nil), buf...), nil
+}
+
+// GetConfig returns a copy of the config file.
+func (m *MemoryFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	return m.read(path)
+}
+
+// GetConfigReader returns a reader for a copy of the config file and its size.
+func (m *MemoryFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	buf, err := m.read(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nopCloser{bytes.NewReader(buf)}, int64(len(buf)), nil
+}
+
+// SaveConfig saves the config file, it fails if the file already exists.
+func (m *MemoryFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	buf, err := ioutil.ReadAll(contextReader{ctx, rd})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[path]; ok {
+		return &os.PathError{Op: "create", Path: path, Err: ErrConfigExists}
+	}
+	if _, ok := m.dirs[filepath.Dir(path)]; !ok {
+		return notExist("open", path)
+	}
+	m.files[path] = buf
+	return nil
+}
+
+func (m *MemoryFilesystem) remove(path string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf, ok := m.files[path]
+	if !ok {
+		return 0, notExist("remove", path)
+	}
+	delete(m.files, path)
+	return int64(len(buf)), nil
+}
+
+// DeleteConfig removes the config file.
+func (m *MemoryFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	_, err := m.remove(path)
+	return err
+}
+
+// ListBlobs lists all blobs in the object type directory at path.
+func (m *MemoryFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs := []Blob{}
+	err := m.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// ListBlobsFunc calls fn for all blobs in the object type directory at path,
+// sorted lexically by name like the listing of DiskFilesystem. The blobs are
+// collected before fn is called, so fn may modify m.
+func (m *MemoryFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	m.mu.RLock()
+	if _, ok := m.dirs[path]; !ok {
+		m.mu.RUnlock()
+		return notExist("open", path)
+	}
+
+	// blobs of hashed object types are stored one level deeper
+	depth := 1
+	if IsHashed(filepath.Base(path)) {
+		depth = 2
+	}
+
+	prefix := path + string(filepath.Separator)
+	blobs := []Blob{}
+	for name, buf := range m.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(name, prefix)
+		if strings.Count(rel, string(filepath.Separator)) != depth-1 {
+			continue
+		}
+		blobs = append(blobs, Blob{Name: filepath.Base(rel), Size: int64(len(buf))})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	for _, blob := range blobs {
+		if err := fn(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckBlob returns the name and size of the blob, modification times are not
+// recorded.
+func (m *MemoryFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	info, err := m.Stat(ctx, path)
+	if err != nil {
+		return Blob{}, err
+	}
+	return info.Blob(), nil
+}
+
+// Stat returns the name and size of the blob, the modification time and mode
+// are zero.
+func (m *MemoryFilesystem) Stat(ctx context.Context, path string) (BlobInfo, error) {
+	size, err := m.size("stat", path)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Name: filepath.Base(path), Size: size}, nil
+}
+
+// BlobExists returns whether the blob exists.
+func (m *MemoryFilesystem) BlobExists(ctx context.Context, path string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.files[path]
+	return ok, nil
+}
+
+// GetBlob returns a reader over a copy of the blob.
+func (m *MemoryFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	buf, err := m.read(path)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(buf)}, nil
+}
+
+// nopCloser adds a Close method which does nothing to an io.ReadSeeker.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// SaveBlob saves the blob, replacing it if it exists. The blob only becomes
+// visible once rd has been read completely.
+func (m *MemoryFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	var buf bytes.Buffer
+	if expectedSize > 0 {
+		buf.Grow(int(expectedSize))
+	}
+	n, err := buf.ReadFrom(contextReader{ctx, rd})
+	if err == nil {
+		err = checkSize(path, n, expectedSize)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mkdirAll(filepath.Dir(path))
+	m.files[path] = buf.Bytes()
+	return n, nil
+}
+
+// DeleteBlob removes the blob.
+func (m *MemoryFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	return m.remove(path)
+}
+
+// DeleteBlobs removes the blobs.
+func (m *MemoryFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	return deleteEach(ctx, m, paths, needSize)
+}
+
+// RepoStats returns the statistics of the repository.
+func (m *MemoryFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	m.mu.RLock()
+	_, ok := m.dirs[path]
+	m.mu.RUnlock()
+	if !ok {
+		return RepoStats{}, notExist("stat", path)
+	}
+	return listRepoStats(ctx, m, path)
+}
+
+// Walk calls fn for the blobs of all object types.
+func (m *MemoryFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	m.mu.RLock()
+	_, ok := m.dirs[path]
+	m.mu.RUnlock()
+	if !ok {
+		return notExist("stat", path)
+	}
+	return WalkTypes(ctx, m, path, fn)
+}
+
+// HealthCheck only checks that ctx has not been canceled, memory is always
+// writable.
+func (m *MemoryFilesystem) HealthCheck(ctx context.Context, path string) error {
+	return ctx.Err()
+}
+
+// Sync does nothing, the data is never durable.
+func (m *MemoryFilesystem) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close does nothing, the data is kept until the MemoryFilesystem is garbage
+// collected.
+func (m *MemoryFilesystem) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MetaDir is the directory in a repository which stores the sidecar files
+// of MetadataFilesystem. It is not one of the ObjectTypes, so its contents
+// are never listed.
+const MetaDir = ".meta"
+
+// errXattrNotSupported is returned by the xattr functions if the filesystem
+// does not support extended attributes, or not values of the required size.
+var errXattrNotSupported = errors.New("extended attributes not supported")
+
+// MetadataFilesystem wraps a DiskFilesystem and stores metadata for blobs,
+// key value pairs which are independent of the contents of the blob. The
+// metadata is stored in an extended attribute of the blob on Linux. Where
+// extended attributes are not supported, it is stored in a sidecar file in
+// the MetaDir of the repository instead.
+//
+// The metadata of a blob is kept if the blob is uploaded again, and removed
+// together with the blob.
+type MetadataFilesystem struct {
+	Filesystem
+	disk *DiskFilesystem
+
+	mu sync.Mutex // serializes updates of the metadata
+}
+
+// NewMetadataFilesystem returns a MetadataFilesystem for base. The metadata
+// is stored next to the blobs of base, so base must be the DiskFilesystem
+// itself and not another wrapper.
+func NewMetadataFilesystem(base *DiskFilesystem) *MetadataFilesystem {
+	return &MetadataFilesystem{Filesystem: base, disk: base}
+}
+
+// metaPath returns the path of the sidecar file for the blob at path.
+func metaPath(path string) string {
+	repo, objectType, name := SplitBlobPath(path)
+	return filepath.Join(repo, MetaDir, objectType, name)
+}
+
+// GetBlobMeta returns the metadata of the blob at path, which is empty if none
+// has been set. ErrNotFound is returned if the blob does not exist.
+func (m *MetadataFilesystem) GetBlobMeta(ctx context.Context, path string) (map[string]string, error) {
+	var buf []byte
+	err := m.disk.withBlob(path, func(file string) error {
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+		var err error
+		buf, err = getMetaXattr(file)
+		return err
+	})
+	if err != nil && !errors.Is(err, errXattrNotSupported) {
+		return nil, err
+	}
+	if buf == nil {
+		buf, err = ioutil.ReadFile(metaPath(path))
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]string{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	meta := map[string]string{}
+	if err := json.Unmarshal(buf, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// SetBlobMeta sets the keys in kv in the metadata of the blob at path, other
+// keys are kept. Keys with an empty value are removed. ErrNotFound is
+// returned if the blob does not exist.
+func (m *MetadataFilesystem) SetBlobMeta(ctx context.Context, path string, kv map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, err := m.GetBlobMeta(ctx, path)
+	if err != nil {
+		return err
+	}
+	for k, v := range kv {
+		if v == "" {
+			delete(meta, k)
+		} else {
+			meta[k] = v
+		}
+	}
+	return m.writeMeta(ctx, path, meta)
+}
+
+// writeMeta stores meta for the blob at path, which must exist. The caller
+// must hold m.mu.
+func (m *MetadataFilesystem) writeMeta(ctx context.Context, path string, meta map[string]string) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = m.disk.withBlob(path, func(file string) error {
+		return setMetaXattr(file, buf)
+	})
+	if err == nil {
+		// a sidecar file written before must not shadow the attribute
+		return m.removeSidecar(path)
+	}
+	if !errors.Is(err, errXattrNotSupported) {
+		return err
+	}
+
+	sidecar := metaPath(path)
+	if err := m.disk.mkdirAll(filepath.Dir(sidecar)); err != nil {
+		return classify(err)
+	}
+	w := m.disk.writers.start(sidecar)
+	defer w.finish()
+	_, err = m.disk.writeFile(ctx, sidecar, bytes.NewReader(buf), int64(len(buf)), 0, false, true, w)
+	return err
+}
+
+// removeSidecar removes the sidecar file of the blob at path, if any.
+func (m *MetadataFilesystem) removeSidecar(path string) error {
+	err := os.Remove(metaPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SaveBlob saves the blob. If the blob is replaced, its metadata is kept.
+func (m *MetadataFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	meta, err := m.GetBlobMeta(ctx, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	n, err := m.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	if err != nil || len(meta) == 0 {
+		return n, err
+	}
+
+	// the extended attributes have been replaced together with the file
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return n, m.writeMeta(ctx, path, meta)
+}
+
+// DeleteBlob removes the blob and its sidecar file.
+func (m *MetadataFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	size, err := m.Filesystem.DeleteBlob(ctx, path, needSize)
+	if err != nil {
+		return 0, err
+	}
+	return size, m.removeSidecar(path)
+}
+
+// DeleteBlobs removes the blobs and the sidecar files of those which have been
+// removed.
+func (m *MetadataFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes, err := m.Filesystem.DeleteBlobs(ctx, paths, needSize)
+	errs := make([]error, len(paths))
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		copy(errs, batchErr.Errors)
+	} else if err != nil {
+		return sizes, err
+	}
+	for i, path := range paths {
+		if errs[i] == nil {
+			errs[i] = m.removeSidecar(path)
+		}
+	}
+	return sizes, NewBatchError(errs)
+}
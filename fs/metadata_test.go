@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataFilesystem(t *testing.T) {
+	ctx := context.Background()
+	f := NewMetadataFilesystem(&DiskFilesystem{})
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if err := f.SetBlobMeta(ctx, blob, map[string]string{"hold": "yes"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SetBlobMeta: want ErrNotFound for a missing blob, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := f.GetBlobMeta(ctx, blob); err != nil || len(meta) != 0 {
+		t.Fatalf("GetBlobMeta: want no metadata, got %v, %v", meta, err)
+	}
+
+	if err := f.SetBlobMeta(ctx, blob, map[string]string{"hold": "yes", "until": "2030-01-01"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetBlobMeta(ctx, blob, map[string]string{"hold": ""}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"until": "2030-01-01"}
+	if meta, err := f.GetBlobMeta(ctx, blob); err != nil || !reflect.DeepEqual(meta, want) {
+		t.Fatalf("GetBlobMeta: want %v, got %v, %v", want, meta, err)
+	}
+
+	// the metadata is kept if the blob is uploaded again
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := f.GetBlobMeta(ctx, blob); err != nil || !reflect.DeepEqual(meta, want) {
+		t.Fatalf("GetBlobMeta after upload: want %v, got %v, %v", want, meta, err)
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs: want only the blob, got %v, %v", blobs, err)
+	}
+
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(metaPath(blob)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("sidecar file not removed: %v", err)
+	}
+	if _, err := f.GetBlobMeta(ctx, blob); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetBlobMeta: want ErrNotFound for a removed blob, got %v", err)
+	}
+}
+
+func TestMetadataFilesystemSidecar(t *testing.T) {
+	ctx := context.Background()
+	f := NewMetadataFilesystem(&DiskFilesystem{})
+	repo := filepath.Join(t.TempDir(), "repo")
+	blobs := []string{
+		filepath.Join(repo, "data", testID[:2], testID),
+		filepath.Join(repo, "keys", testID),
+	}
+	for _, blob := range blobs {
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+		// as written on filesystems without extended attributes
+		sidecar := metaPath(blob)
+		if err := os.MkdirAll(filepath.Dir(sidecar), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(sidecar, []byte(`{"hold":"yes"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if meta, err := f.GetBlobMeta(ctx, blob); err != nil || meta["hold"] != "yes" {
+			t.Fatalf("GetBlobMeta: want metadata from the sidecar file, got %v, %v", meta, err)
+		}
+	}
+
+	if _, err := f.DeleteBlobs(ctx, blobs, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		if _, err := os.Stat(metaPath(blob)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("sidecar file not removed: %v", err)
+		}
+	}
+}
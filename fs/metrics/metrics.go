@@ -0,0 +1,350 @@
+// Package metrics implements a fs.Filesystem wrapper which records
+// Prometheus metrics for all operations. It is kept separate from package fs
+// so that using a Filesystem does not require importing Prometheus.
+package metrics
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/restic/rest-server/fs"
+)
+
+var labels = []string{"operation", "type"}
+
+// Filesystem wraps a fs.Filesystem and records the number, the duration and
+// the transferred bytes of all operations, labeled by operation and object
+// type. The transferred bytes are also summed up per repository, see
+// Transferred.
+type Filesystem struct {
+	fs.Filesystem
+
+	operations *prometheus.CounterVec
+	bytes      *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+
+	mu        sync.Mutex
+	transfers map[string]*transfer // repository path -> bytes transferred
+}
+
+// transfer are the bytes transferred for a repository, they must be accessed
+// using sync/atomic.
+type transfer struct {
+	in, out int64
+}
+
+// New returns a Filesystem for base which registers its metrics with reg.
+func New(base fs.Filesystem, reg prometheus.Registerer) (*Filesystem, error) {
+	f := &Filesystem{
+		Filesystem: base,
+		operations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rest_server_fs_operations_total",
+				Help: "Total number of filesystem operations",
+			},
+			labels,
+		),
+		bytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rest_server_fs_bytes_total",
+				Help: "Total number of bytes read from or written to blobs",
+			},
+			labels,
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rest_server_fs_operation_duration_seconds",
+				Help:    "Duration of filesystem operations, for blob reads until the reader is closed",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+			},
+			labels,
+		),
+		transfers: make(map[string]*transfer),
+	}
+
+	for _, c := range []prometheus.Collector{f.operations, f.bytes, f.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// RegisterActiveRepos registers a gauge with reg which reports the number of
+// repositories open in f.
+func RegisterActiveRepos(f *fs.PerRepoFilesystem, reg prometheus.Registerer) error {
+	return reg.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "rest_server_fs_active_repos",
+			Help: "Number of repositories whose state is kept in memory",
+		},
+		func() float64 { return float64(f.Active()) },
+	))
+}
+
+// RegisterSoftLimits registers a collector with reg which reports the
+// repositories of q which are over their soft limit, as a gauge of 1 labeled
+// by the path of the repository, see fs.QuotaFilesystem.SoftLimit.
+// Repositories below the soft limit are not reported.
+func RegisterSoftLimits(q *fs.QuotaFilesystem, reg prometheus.Registerer) error {
+	return reg.Register(softLimitCollector{
+		q: q,
+		desc: prometheus.NewDesc("rest_server_fs_repo_over_soft_limit",
+			"Repositories which use more space than their soft limit", []string{"repo"}, nil),
+	})
+}
+
+// softLimitCollector reports the repositories over their soft limit.
+type softLimitCollector struct {
+	q    *fs.QuotaFilesystem
+	desc *prometheus.Desc
+}
+
+func (c softLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c softLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, repo := range c.q.OverSoftLimitRepos() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, repo)
+	}
+}
+
+// observe records an operation which has been started at start.
+func (f *Filesystem) observe(operation, objectType string, start time.Time) {
+	f.operations.WithLabelValues(operation, objectType).Inc()
+	f.duration.WithLabelValues(operation, objectType).Observe(time.Since(start).Seconds())
+}
+
+func blobType(path string) string {
+	_, objectType, _ := fs.SplitBlobPath(path)
+	return objectType
+}
+
+func blobRepo(path string) string {
+	repo, _, _ := fs.SplitBlobPath(path)
+	return repo
+}
+
+// counter returns a function which adds bytes transferred by an operation on
+// the repository at repo to the metrics and to the total of the repository,
+// to the bytes received if in is set and to the bytes sent otherwise.
+func (f *Filesystem) counter(operation, objectType, repo string, in bool) func(n int) {
+	bytes := f.bytes.WithLabelValues(operation, objectType)
+	f.mu.Lock()
+	t, ok := f.transfers[repo]
+	if !ok {
+		t = &transfer{}
+		f.transfers[repo] = t
+	}
+	f.mu.Unlock()
+	total := &t.out
+	if in {
+		total = &t.in
+	}
+	return func(n int) {
+		bytes.Add(float64(n))
+		atomic.AddInt64(total, int64(n))
+	}
+}
+
+// Transferred returns the bytes received by uploads to, in, and sent by
+// downloads from, out, the repository at repo since the Filesystem has been
+// created or ResetTransferred has been called for the repository. The bytes
+// are counted as they are streamed, so aborted transfers count as far as
+// they went. Listings are not counted.
+func (f *Filesystem) Transferred(repo string) (in, out int64) {
+	f.mu.Lock()
+	t, ok := f.transfers[filepath.Clean(repo)]
+	f.mu.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&t.in), atomic.LoadInt64(&t.out)
+}
+
+// ResetTransferred returns the bytes transferred for the repository at repo
+// like Transferred and resets them to zero, e.g. at the end of a billing
+// period. Bytes transferred concurrently are counted for the next period.
+func (f *Filesystem) ResetTransferred(repo string) (in, out int64) {
+	f.mu.Lock()
+	t, ok := f.transfers[filepath.Clean(repo)]
+	f.mu.Unlock()
+	if !ok {
+		return 0, 0
+	}
+	return atomic.SwapInt64(&t.in, 0), atomic.SwapInt64(&t.out, 0)
+}
+
+// CreateRepo creates the repository.
+func (f *Filesystem) CreateRepo(ctx context.Context, path string) error {
+	defer f.observe("create_repo", "", time.Now())
+	return f.Filesystem.CreateRepo(ctx, path)
+}
+
+// CheckConfig returns whether the config exists and its size.
+func (f *Filesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	defer f.observe("check_config", "config", time.Now())
+	return f.Filesystem.CheckConfig(ctx, path)
+}
+
+// GetConfig returns the config.
+func (f *Filesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	defer f.observe("get_config", "config", time.Now())
+	buf, err := f.Filesystem.GetConfig(ctx, path)
+	f.counter("get_config", "config", filepath.Dir(path), false)(len(buf))
+	return buf, err
+}
+
+// GetConfigReader returns a reader for the config which counts the bytes read.
+func (f *Filesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	defer f.observe("get_config", "config", time.Now())
+	rd, size, err := f.Filesystem.GetConfigReader(ctx, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &configReader{ReadCloser: rd, count: f.counter("get_config", "config", filepath.Dir(path), false)}, size, nil
+}
+
+// SaveConfig saves the config.
+func (f *Filesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	defer f.observe("save_config", "config", time.Now())
+	cr := &countingReader{rd: rd, count: f.counter("save_config", "config", filepath.Dir(path), true)}
+	return f.Filesystem.SaveConfig(ctx, path, cr)
+}
+
+// DeleteConfig removes the config.
+func (f *Filesystem) DeleteConfig(ctx context.Context, path string) error {
+	defer f.observe("delete_config", "config", time.Now())
+	return f.Filesystem.DeleteConfig(ctx, path)
+}
+
+// ListBlobs lists the blobs in path.
+func (f *Filesystem) ListBlobs(ctx context.Context, path string) ([]fs.Blob, error) {
+	defer f.observe("list_blobs", filepath.Base(path), time.Now())
+	return f.Filesystem.ListBlobs(ctx, path)
+}
+
+// ListBlobsFunc calls fn for the blobs in path.
+func (f *Filesystem) ListBlobsFunc(ctx context.Context, path string, fn func(fs.Blob) error) error {
+	defer f.observe("list_blobs", filepath.Base(path), time.Now())
+	return f.Filesystem.ListBlobsFunc(ctx, path, fn)
+}
+
+// CheckBlob returns the blob.
+func (f *Filesystem) CheckBlob(ctx context.Context, path string) (fs.Blob, error) {
+	defer f.observe("check_blob", blobType(path), time.Now())
+	return f.Filesystem.CheckBlob(ctx, path)
+}
+
+// GetBlob returns a reader for the blob. The bytes are counted as they are
+// read, the operation is recorded when the reader is closed.
+func (f *Filesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	start := time.Now()
+	objectType := blobType(path)
+	rd, err := f.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		f.observe("get_blob", objectType, start)
+		return nil, err
+	}
+	return &blobReader{
+		ReadSeekCloser: rd,
+		count:          f.counter("get_blob", objectType, blobRepo(path), false),
+		done: func() {
+			f.observe("get_blob", objectType, start)
+		},
+	}, nil
+}
+
+// SaveBlob saves the blob, counting the bytes as they are read from rd.
+func (f *Filesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	objectType := blobType(path)
+	defer f.observe("save_blob", objectType, time.Now())
+	cr := &countingReader{rd: rd, count: f.counter("save_blob", objectType, blobRepo(path), true)}
+	return f.Filesystem.SaveBlob(ctx, path, cr, expectedSize)
+}
+
+// DeleteBlob removes the blob.
+func (f *Filesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	defer f.observe("delete_blob", blobType(path), time.Now())
+	return f.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs, recording a single operation.
+func (f *Filesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	objectType := ""
+	if len(paths) > 0 {
+		objectType = blobType(paths[0])
+	}
+	defer f.observe("delete_blobs", objectType, time.Now())
+	return f.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
+
+// RepoStats returns the statistics of the repository.
+func (f *Filesystem) RepoStats(ctx context.Context, path string) (fs.RepoStats, error) {
+	defer f.observe("repo_stats", "", time.Now())
+	return f.Filesystem.RepoStats(ctx, path)
+}
+
+// Walk calls fn for the blobs of all object types.
+func (f *Filesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob fs.Blob) error) error {
+	defer f.observe("walk", "", time.Now())
+	return f.Filesystem.Walk(ctx, path, fn)
+}
+
+// HealthCheck checks the storage.
+func (f *Filesystem) HealthCheck(ctx context.Context, path string) error {
+	defer f.observe("health_check", "", time.Now())
+	return f.Filesystem.HealthCheck(ctx, path)
+}
+
+// countingReader passes the number of bytes read from rd to count.
+type countingReader struct {
+	rd    io.Reader
+	count func(n int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.count(n)
+	return n, err
+}
+
+// configReader passes the number of bytes read to count.
+type configReader struct {
+	io.ReadCloser
+	count func(n int)
+}
+
+func (r *configReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count(n)
+	return n, err
+}
+
+// blobReader passes the number of bytes read to count and calls done once it
+// is closed.
+type blobReader struct {
+	io.ReadSeekCloser
+	count func(n int)
+	done  func()
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	r.count(n)
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+	return r.ReadSeekCloser.Close()
+}
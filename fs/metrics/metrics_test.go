@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/restic/rest-server/fs"
+)
+
+func TestFilesystem(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	f, err := New(fs.NewMemoryFilesystem(), reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(fs.NewMemoryFilesystem(), reg); err == nil {
+		t.Fatal("registering the metrics twice must fail")
+	}
+
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	// the bytes must be counted without an announced size
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(f.operations.WithLabelValues("get_blob", "data")); n != 0 {
+		t.Fatalf("read must only be recorded on close, got %v operations", n)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		op         string
+		operations float64
+		bytes      float64
+	}{
+		{"save_blob", 1, 6},
+		{"get_blob", 1, 3},
+	} {
+		if n := testutil.ToFloat64(f.operations.WithLabelValues(test.op, "data")); n != test.operations {
+			t.Errorf("%v: want %v operations, got %v", test.op, test.operations, n)
+		}
+		if n := testutil.ToFloat64(f.bytes.WithLabelValues(test.op, "data")); n != test.bytes {
+			t.Errorf("%v: want %v bytes, got %v", test.op, test.bytes, n)
+		}
+	}
+
+	// aborted uploads count as far as they went
+	errAborted := errors.New("aborted")
+	aborted := io.MultiReader(strings.NewReader("fo"), iotest.ErrReader(errAborted))
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", id), aborted, 6); !errors.Is(err, errAborted) {
+		t.Fatalf("SaveBlob: want errAborted, got %v", err)
+	}
+	if in, out := f.Transferred(repo); in != 8 || out != 3 {
+		t.Fatalf("Transferred: want 8 bytes in and 3 out, got %v, %v", in, out)
+	}
+	if in, out := f.ResetTransferred(repo); in != 8 || out != 3 {
+		t.Fatalf("ResetTransferred: want 8 bytes in and 3 out, got %v, %v", in, out)
+	}
+	if in, out := f.Transferred(repo); in != 0 || out != 0 {
+		t.Fatalf("Transferred: want zero after the reset, got %v, %v", in, out)
+	}
+	if in, out := f.Transferred(filepath.FromSlash("/other")); in != 0 || out != 0 {
+		t.Fatalf("Transferred: want zero for another repository, got %v, %v", in, out)
+	}
+}
+
+func TestRegisterActiveRepos(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	p := fs.NewPerRepoFilesystem(fs.NewMemoryFilesystem(), func(base fs.Filesystem) fs.Filesystem { return base }, 0)
+	if err := RegisterActiveRepos(p, reg); err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"/a", "/b"} {
+		if err := p.CreateRepo(ctx, filepath.FromSlash(repo)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "# HELP rest_server_fs_active_repos Number of repositories whose state is kept in memory\n" +
+		"# TYPE rest_server_fs_active_repos gauge\nrest_server_fs_active_repos 2\n"
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "rest_server_fs_active_repos"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterSoftLimits(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	q := fs.NewQuotaFilesystem(fs.NewMemoryFilesystem(), 0)
+	q.SoftLimit = 2
+	if err := RegisterSoftLimits(q, reg); err != nil {
+		t.Fatal(err)
+	}
+	for repo, data := range map[string]string{"/a": "123", "/b": "1"} {
+		path := filepath.Join(filepath.FromSlash(repo), "keys", "key")
+		if _, err := q.SaveBlob(ctx, path, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "# HELP rest_server_fs_repo_over_soft_limit Repositories which use more space than their soft limit\n" +
+		"# TYPE rest_server_fs_repo_over_soft_limit gauge\n" +
+		"rest_server_fs_repo_over_soft_limit{repo=\"" + filepath.FromSlash("/a") + "\"} 1\n"
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "rest_server_fs_repo_over_soft_limit"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,399 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MirrorError is returned by MirrorFilesystem if an operation succeeded on
+// some members but failed on others, which then need to be reconciled.
+// Errors contains one entry for each member, nil for the members on which the
+// operation succeeded.
+type MirrorError struct {
+	Op     string
+	Path   string
+	Errors []error
+}
+
+func (e *MirrorError) Error() string {
+	var failed []string
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("member %d: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("%v %v failed on %d of %d mirrors: %v", e.Op, e.Path, len(failed), len(e.Errors), strings.Join(failed, "; "))
+}
+
+// Unwrap returns the errors of the members which failed.
+func (e *MirrorError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Is reports whether the error of one of the members matches target.
+func (e *MirrorError) Is(target error) bool { return anyIs(e.Errors, target) }
+
+// As finds the first error of the members which matches target.
+func (e *MirrorError) As(target interface{}) bool { return anyAs(e.Errors, target) }
+
+// mirrorResult combines the errors of all members. If the operation failed on
+// all members, the first error is returned unchanged.
+func mirrorResult(op, path string, errs []error) error {
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	switch failed {
+	case 0:
+		return nil
+	case len(errs):
+		return errs[0]
+	}
+	return &MirrorError{Op: op, Path: path, Errors: errs}
+}
+
+// ignoreNotExist clears not exist errors unless all members returned one, as
+// a file missing on some members is removed from all of them anyway.
+func ignoreNotExist(errs []error) {
+	for _, err := range errs {
+		if !errors.Is(err, os.ErrNotExist) {
+			for i := range errs {
+				if errors.Is(errs[i], os.ErrNotExist) {
+					errs[i] = nil
+				}
+			}
+			return
+		}
+	}
+}
+
+// MirrorFilesystem stores the repositories on several members synchronously.
+// Operations which modify data are done on all members and only succeed if
+// they succeed on every member; if they fail on some members only, a
+// *MirrorError is returned. Reads are served by the first member which does not
+// return an error.
+type MirrorFilesystem struct {
+	members []Filesystem
+}
+
+var _ Filesystem = &MirrorFilesystem{}
+
+// NewMirrorFilesystem returns a MirrorFilesystem for the members, at least
+// one member is required.
+func NewMirrorFilesystem(members ...Filesystem) *MirrorFilesystem {
+	if len(members) == 0 {
+		panic("MirrorFilesystem needs at least one member")
+	}
+	return &MirrorFilesystem{members: members}
+}
+
+// each calls fn for all members and returns their errors.
+func (m *MirrorFilesystem) each(fn func(f Filesystem) error) []error {
+	errs := make([]error, len(m.members))
+	for i, f := range m.members {
+		errs[i] = fn(f)
+	}
+	return errs
+}
+
+// first calls fn for the members in order until it succeeds. If it fails for
+// all members, the error of the first member is returned.
+func (m *MirrorFilesystem) first(fn func(f Filesystem) error) error {
+	var firstErr error
+	for i, f := range m.members {
+		err := fn(f)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if i < len(m.members)-1 && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("mirror member %d failed: %v, trying the next member", i, err)
+		}
+	}
+	return firstErr
+}
+
+// fanOut copies the data from rd to all members concurrently, save is called
+// for each member with a reader for its copy of the data. Members which fail
+// no longer receive data while the others continue. If reading from rd fails,
+// the error is passed to all members and returned as readErr.
+func (m *MirrorFilesystem) fanOut(rd io.Reader, save func(f Filesystem, rd io.Reader) error) (written int64, errs []error, readErr error) {
+	errs = make([]error, len(m.members))
+	pipes := make([]*io.PipeWriter, len(m.members))
+
+	var wg sync.WaitGroup
+	for i, f := range m.members {
+		pr, pw := io.Pipe()
+		pipes[i] = pw
+		wg.Add(1)
+		go func(i int, f Filesystem, pr *io.PipeReader) {
+			defer wg.Done()
+			errs[i] = save(f, pr)
+			// unblock the writer in case the member has stopped reading
+			_ = pr.CloseWithError(errors.New("mirror member stopped reading"))
+		}(i, f, pr)
+	}
+
+	buf := make([]byte, 32*1024)
+	active := len(pipes)
+	for active > 0 {
+		n, err := rd.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			for i, pw := range pipes {
+				if pw == nil {
+					continue
+				}
+				if _, err := pw.Write(buf[:n]); err != nil {
+					pipes[i] = nil
+					active--
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+
+	for _, pw := range pipes {
+		if pw == nil {
+			continue
+		}
+		if readErr != nil {
+			_ = pw.CloseWithError(readErr)
+		} else {
+			_ = pw.Close()
+		}
+	}
+	wg.Wait()
+	return written, errs, readErr
+}
+
+// CreateRepo creates the repository on all members.
+func (m *MirrorFilesystem) CreateRepo(ctx context.Context, path string) error {
+	return mirrorResult("create", path, m.each(func(f Filesystem) error {
+		return f.CreateRepo(ctx, path)
+	}))
+}
+
+// CheckConfig checks the config on the first healthy member.
+func (m *MirrorFilesystem) CheckConfig(ctx context.Context, path string) (exists bool, size int64, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		exists, size, err = f.CheckConfig(ctx, path)
+		return err
+	})
+	return exists, size, err
+}
+
+// GetConfig returns the config from the first healthy member.
+func (m *MirrorFilesystem) GetConfig(ctx context.Context, path string) (buf []byte, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		buf, err = f.GetConfig(ctx, path)
+		return err
+	})
+	return buf, err
+}
+
+// GetConfigReader returns a reader for the config from the first healthy
+// member.
+func (m *MirrorFilesystem) GetConfigReader(ctx context.Context, path string) (rd io.ReadCloser, size int64, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		rd, size, err = f.GetConfigReader(ctx, path)
+		return err
+	})
+	return rd, size, err
+}
+
+// SaveConfig saves the config on all members.
+func (m *MirrorFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	_, errs, err := m.fanOut(rd, func(f Filesystem, rd io.Reader) error {
+		return f.SaveConfig(ctx, path, rd)
+	})
+	if err != nil {
+		return err
+	}
+	return mirrorResult("save", path, errs)
+}
+
+// DeleteConfig removes the config from all members.
+func (m *MirrorFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	errs := m.each(func(f Filesystem) error {
+		return f.DeleteConfig(ctx, path)
+	})
+	ignoreNotExist(errs)
+	return mirrorResult("delete", path, errs)
+}
+
+// ListBlobs lists the blobs of the first healthy member.
+func (m *MirrorFilesystem) ListBlobs(ctx context.Context, path string) (blobs []Blob, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		blobs, err = f.ListBlobs(ctx, path)
+		return err
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc lists the blobs of the first healthy member. Once fn has been
+// called, errors are returned instead of falling back to the next member.
+func (m *MirrorFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	var listed bool
+	var listErr error
+	err := m.first(func(f Filesystem) error {
+		err := f.ListBlobsFunc(ctx, path, func(blob Blob) error {
+			listed = true
+			return fn(blob)
+		})
+		if err != nil && listed {
+			// listing another member would repeat the blobs passed to fn
+			listErr = err
+			return nil
+		}
+		return err
+	})
+	if listErr != nil {
+		return listErr
+	}
+	return err
+}
+
+// CheckBlob checks the blob on the first healthy member.
+func (m *MirrorFilesystem) CheckBlob(ctx context.Context, path string) (blob Blob, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		blob, err = f.CheckBlob(ctx, path)
+		return err
+	})
+	return blob, err
+}
+
+// GetBlob returns a reader for the blob from the first healthy member.
+func (m *MirrorFilesystem) GetBlob(ctx context.Context, path string) (rd io.ReadSeekCloser, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		rd, err = f.GetBlob(ctx, path)
+		return err
+	})
+	return rd, err
+}
+
+// SaveBlob saves the blob on all members concurrently, reading rd only once.
+func (m *MirrorFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	written, errs, err := m.fanOut(rd, func(f Filesystem, rd io.Reader) error {
+		_, err := f.SaveBlob(ctx, path, rd, expectedSize)
+		return err
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, mirrorResult("save", path, errs)
+}
+
+// DeleteBlob removes the blob from all members.
+func (m *MirrorFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	errs := m.each(func(f Filesystem) error {
+		n, err := f.DeleteBlob(ctx, path, needSize)
+		if err == nil && size == 0 {
+			size = n
+		}
+		return err
+	})
+	ignoreNotExist(errs)
+	return size, mirrorResult("delete", path, errs)
+}
+
+// DeleteBlobs removes the blobs from all members. If some blobs cannot be
+// removed from all members, a *BatchError is returned with a *MirrorError for
+// each of them.
+func (m *MirrorFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	perPath := make([][]error, len(paths))
+	for i := range perPath {
+		perPath[i] = make([]error, len(m.members))
+	}
+
+	for j, f := range m.members {
+		n, err := f.DeleteBlobs(ctx, paths, needSize)
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			// the whole batch failed for this member
+			for i := range paths {
+				perPath[i][j] = err
+			}
+			continue
+		}
+		for i := range paths {
+			if batchErr != nil && batchErr.Errors[i] != nil {
+				perPath[i][j] = batchErr.Errors[i]
+			} else if sizes[i] == 0 && i < len(n) {
+				sizes[i] = n[i]
+			}
+		}
+	}
+
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		errs[i] = mirrorResult("delete", path, perPath[i])
+	}
+	return sizes, NewBatchError(errs)
+}
+
+// HealthCheck checks all members.
+func (m *MirrorFilesystem) HealthCheck(ctx context.Context, path string) error {
+	return mirrorResult("health check", path, m.each(func(f Filesystem) error {
+		return f.HealthCheck(ctx, path)
+	}))
+}
+
+// Sync syncs all members.
+func (m *MirrorFilesystem) Sync(ctx context.Context) error {
+	return mirrorResult("sync", "", m.each(func(f Filesystem) error {
+		return f.Sync(ctx)
+	}))
+}
+
+// Close closes all members.
+func (m *MirrorFilesystem) Close() error {
+	return mirrorResult("close", "", m.each(func(f Filesystem) error {
+		return f.Close()
+	}))
+}
+
+// Walk lists the blobs of each object type on the first healthy member.
+func (m *MirrorFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, m, path, fn)
+}
+
+// RepoStats returns the statistics of the first healthy member.
+func (m *MirrorFilesystem) RepoStats(ctx context.Context, path string) (stats RepoStats, err error) {
+	err = m.first(func(f Filesystem) error {
+		var err error
+		stats, err = f.RepoStats(ctx, path)
+		return err
+	})
+	return stats, err
+}
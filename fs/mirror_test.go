@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMirrorFilesystem(t *testing.T) {
+	testFilesystem(t, NewMirrorFilesystem(NewMemoryFilesystem(), &DiskFilesystem{}), t.TempDir())
+}
+
+func TestMirrorFilesystemFailures(t *testing.T) {
+	ctx := context.Background()
+	a, b := NewMemoryFilesystem(), NewMemoryFilesystem()
+	f := NewMirrorFilesystem(a, b)
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []Filesystem{a, b} {
+		if b, err := member.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+			t.Fatalf("blob must be saved on all members, got %v, %v", b.Size, err)
+		}
+	}
+
+	// reads fall back to the next member
+	if _, err := a.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "foobar" {
+		t.Fatalf("GetBlob: got %q, %v", buf, err)
+	}
+	_ = rd.Close()
+
+	// deleting a blob missing on some members succeeds
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 6 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("DeleteBlob: want not exist error, got %v", err)
+	}
+
+	// partial failures are reported
+	f = NewMirrorFilesystem(a, NewReadOnlyFilesystem(b))
+	_, err = f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6)
+	var mirrorErr *MirrorError
+	if !errors.As(err, &mirrorErr) || mirrorErr.Errors[0] != nil || !errors.Is(mirrorErr.Errors[1], ErrReadOnly) {
+		t.Fatalf("want MirrorError for the second member, got %v", err)
+	}
+	if b, err := a.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("blob must be saved on the healthy member, got %v, %v", b.Size, err)
+	}
+
+	// read errors are passed on and nothing is saved
+	other := filepath.Join(repo, "keys", "key")
+	_, err = NewMirrorFilesystem(a, b).SaveBlob(ctx, other, io.MultiReader(strings.NewReader("foo"), readerFunc(func([]byte) (int, error) {
+		return 0, io.ErrUnexpectedEOF
+	})), -1)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("want ErrUnexpectedEOF, got %v", err)
+	}
+	for _, member := range []Filesystem{a, b} {
+		if _, err := member.CheckBlob(ctx, other); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("failed upload must not be saved, got %v", err)
+		}
+	}
+}
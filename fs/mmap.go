@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+)
+
+// errMmapNotSupported is returned by mmapFile on platforms without mmap.
+var errMmapNotSupported = errors.New("mmap not supported")
+
+// MmapFilesystem wraps a Filesystem and serves blobs of up to a maximum size
+// from a read-only memory mapping of the file returned by the underlying
+// Filesystem, e.g. a DiskFilesystem. Reading from the mapping avoids a
+// syscall per read, which helps workloads reading the same blobs repeatedly
+// while they stay in the page cache, like verifying a repository. Larger
+// blobs, blobs which are not returned as a file and blobs on platforms
+// without mmap are read from the file as usual.
+//
+// Removing a mapped blob is safe, the mapping keeps the data accessible until
+// it is unmapped. If a mapped blob is truncated, reading the missing part
+// fails with an error instead of crashing the server.
+type MmapFilesystem struct {
+	Filesystem
+	maxSize int64
+}
+
+// NewMmapFilesystem returns a MmapFilesystem for base which maps blobs of up
+// to maxSize bytes.
+func NewMmapFilesystem(base Filesystem, maxSize int64) *MmapFilesystem {
+	return &MmapFilesystem{Filesystem: base, maxSize: maxSize}
+}
+
+// GetBlob returns a reader for the blob, which reads from a memory mapping
+// if the blob is small enough. The mapping is removed when the reader is
+// closed.
+func (m *MmapFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := m.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := rd.(*os.File)
+	if !ok {
+		return rd, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 || fi.Size() > m.maxSize {
+		return f, nil
+	}
+
+	data, err := mmapFile(f, fi.Size())
+	if err != nil {
+		// read the file instead, e.g. if the filesystem does not support mmap
+		return f, nil
+	}
+	// the mapping stays valid once the file is closed
+	_ = f.Close()
+	return &mmapReader{path: path, data: data}, nil
+}
+
+// mmapReader reads from a memory mapping of a blob.
+type mmapReader struct {
+	path string
+	data []byte
+	pos  int64
+}
+
+func (r *mmapReader) Read(p []byte) (n int, err error) {
+	if r.data == nil {
+		return 0, os.ErrClosed
+	}
+	if r.pos >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+
+	// accessing pages beyond the end of a truncated file raises SIGBUS
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if recover() != nil {
+			n, err = 0, fmt.Errorf("%v: file truncated while being read", r.path)
+		}
+	}()
+	n = copy(p, r.data[r.pos:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *mmapReader) Seek(offset int64, whence int) (int64, error) {
+	if r.data == nil {
+		return 0, os.ErrClosed
+	}
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += int64(len(r.data))
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("seek: negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *mmapReader) Close() error {
+	if r.data == nil {
+		return os.ErrClosed
+	}
+	err := munmap(r.data)
+	r.data = nil
+	return err
+}
@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMmapFilesystem(t *testing.T) {
+	ctx := context.Background()
+	disk := &DiskFilesystem{}
+	f := NewMmapFilesystem(disk, 1<<20)
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	testFilesystem(t, f, t.TempDir())
+
+	data := bytes.Repeat([]byte("foobar"), 10000)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rd.(*mmapReader); !ok && runtime.GOOS != "windows" {
+		t.Fatalf("blob not mapped, got %T", rd)
+	}
+	if _, err := rd.Seek(-6, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("wrong data after seeking: %q", buf)
+	}
+
+	// larger blobs are read from the file
+	large := NewMmapFilesystem(disk, int64(len(data)-1))
+	rd, err = large.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rd.(*os.File); !ok {
+		t.Fatalf("large blob must not be mapped, got %T", rd)
+	}
+	if buf := readAll(t, rd); !bytes.Equal(buf, data) {
+		t.Fatal("wrong data read from the file")
+	}
+}
+
+func TestMmapFilesystemModified(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("mmap is not supported")
+	}
+	ctx := context.Background()
+	f := NewMmapFilesystem(&DiskFilesystem{}, 1<<20)
+	dir := t.TempDir()
+	blob := filepath.Join(dir, "repo", "data", testID[:2], testID)
+	data := strings.Repeat("x", 1<<16)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a removed blob can still be read
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != data {
+		t.Fatal("wrong data read from a removed blob")
+	}
+
+	// reading a truncated blob fails
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err = f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+	if err := os.Truncate(blob, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(rd); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Fatalf("want an error for a truncated blob, got %v", err)
+	}
+}
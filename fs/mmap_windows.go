@@ -0,0 +1,12 @@
+package fs
+
+import "os"
+
+// mmapFile is not supported on Windows, blobs are always read from the file.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapNotSupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
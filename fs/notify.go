@@ -0,0 +1,188 @@
+package fs
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Event describes a modification of a repository reported by a
+// NotifyFilesystem.
+type Event struct {
+	Repo       string // path of the repository
+	ObjectType string // one of the ObjectTypes, or "config"
+	Op         string // save_config, delete_config, save_blob or delete_blob
+	Name       string // name of the blob, empty for the config
+	Size       int64  // number of bytes written or removed
+	Hash       string // hex encoded hash of a saved blob, see HashAlgo
+}
+
+// NotifyFilesystem wraps a Filesystem and reports successful modifications
+// by calling a function, e.g. to trigger the replication of a repository.
+//
+// The function is called by a single worker goroutine, so that a slow
+// consumer does not delay uploads. If the consumer cannot keep up and the
+// buffer of pending events is full, further events are dropped and counted.
+//
+// A save_blob event is only reported once SaveBlob of the base returned
+// successfully, for a DiskFilesystem that is after the blob has been renamed
+// to its final name and synced according to its SyncMode. With SyncDeferred
+// or SyncNone the blob may not be durable yet when the event is reported.
+// Failed writes are never reported.
+type NotifyFilesystem struct {
+	Filesystem
+
+	// HashAlgo, if set, is used to compute the hash of each saved blob while
+	// it is passed to the base, which is reported as the Hash of its
+	// save_blob event. Consumers like an index of the stored blobs then need
+	// not read the blob again. It is usually the HashAlgo of the
+	// VerifyHashFilesystem the base verifies uploads with, so that the hash
+	// matches the name of the blob.
+	HashAlgo HashAlgo
+
+	fn      func(Event)
+	events  chan Event
+	dropped uint64 // must be accessed using sync/atomic
+
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+// NewNotifyFilesystem returns a NotifyFilesystem for base which calls fn for
+// each event, buffering up to buffer events. Close must be called to stop
+// the worker.
+func NewNotifyFilesystem(base Filesystem, fn func(Event), buffer int) *NotifyFilesystem {
+	n := &NotifyFilesystem{
+		Filesystem: base,
+		fn:         fn,
+		events:     make(chan Event, buffer),
+		done:       make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+func (n *NotifyFilesystem) run() {
+	defer close(n.done)
+	for ev := range n.events {
+		n.fn(ev)
+	}
+}
+
+// Close stops the worker after all buffered events have been passed to the
+// function, and then closes the base. Events of later modifications are
+// dropped.
+func (n *NotifyFilesystem) Close() error {
+	n.mu.Lock()
+	closed := n.closed
+	if !closed {
+		n.closed = true
+		close(n.events)
+	}
+	n.mu.Unlock()
+	<-n.done
+	if closed {
+		return nil
+	}
+	return n.Filesystem.Close()
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (n *NotifyFilesystem) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// notify queues the event without blocking.
+func (n *NotifyFilesystem) notify(ev Event) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		atomic.AddUint64(&n.dropped, 1)
+		return
+	}
+	select {
+	case n.events <- ev:
+	default:
+		atomic.AddUint64(&n.dropped, 1)
+	}
+}
+
+func (n *NotifyFilesystem) notifyBlob(op, path string, size int64, hash string) {
+	repo, objectType, name := SplitBlobPath(path)
+	n.notify(Event{Repo: repo, ObjectType: objectType, Op: op, Name: name, Size: size, Hash: hash})
+}
+
+// SaveConfig saves the config.
+func (n *NotifyFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	cr := &countingReader{rd: rd}
+	err := n.Filesystem.SaveConfig(ctx, path, cr)
+	if err == nil {
+		n.notify(Event{Repo: filepath.Dir(path), ObjectType: "config", Op: "save_config", Size: cr.n})
+	}
+	return err
+}
+
+// DeleteConfig removes the config.
+func (n *NotifyFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	err := n.Filesystem.DeleteConfig(ctx, path)
+	if err == nil {
+		n.notify(Event{Repo: filepath.Dir(path), ObjectType: "config", Op: "delete_config"})
+	}
+	return err
+}
+
+// SaveBlob saves the blob.
+func (n *NotifyFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	var hasher hash.Hash
+	if n.HashAlgo.New != nil {
+		hasher = n.HashAlgo.New()
+		rd = io.TeeReader(rd, hasher)
+	}
+	size, err := n.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	if err == nil {
+		var sum string
+		if hasher != nil {
+			sum = hex.EncodeToString(hasher.Sum(nil))
+		}
+		n.notifyBlob("save_blob", path, size, sum)
+	}
+	return size, err
+}
+
+// DeleteBlob removes the blob.
+func (n *NotifyFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	size, err := n.Filesystem.DeleteBlob(ctx, path, needSize)
+	if err == nil {
+		n.notifyBlob("delete_blob", path, size, "")
+	}
+	return size, err
+}
+
+// DeleteBlobs removes the blobs, an event is reported for each blob which
+// has been removed.
+func (n *NotifyFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes, err := n.Filesystem.DeleteBlobs(ctx, paths, needSize)
+
+	var batchErr *BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		// it is unknown which blobs have been removed
+		return sizes, err
+	}
+	for i, path := range paths {
+		if batchErr != nil && batchErr.Errors[i] != nil {
+			continue
+		}
+		var size int64
+		if i < len(sizes) {
+			size = sizes[i]
+		}
+		n.notifyBlob("delete_blob", path, size, "")
+	}
+	return sizes, err
+}
@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNotifyFilesystem(t *testing.T) {
+	ctx := context.Background()
+	var events []Event
+	f := NewNotifyFilesystem(NewMemoryFilesystem(), func(ev Event) {
+		events = append(events, ev)
+	}, 10)
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	cfg := filepath.Join(repo, "config")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, true); err != nil {
+		t.Fatal(err)
+	}
+	// failed modifications are not reported
+	if _, err := f.DeleteBlob(ctx, blob, true); err == nil {
+		t.Fatal("deleting a missing blob must fail")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Repo: repo, ObjectType: "config", Op: "save_config", Size: 6},
+		{Repo: repo, ObjectType: "data", Op: "save_blob", Name: testID, Size: 6},
+		{Repo: repo, ObjectType: "data", Op: "delete_blob", Name: testID, Size: 6},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("want %d events, got %v", len(want), events)
+	}
+	for i, ev := range events {
+		if ev != want[i] {
+			t.Errorf("event %d: want %+v, got %+v", i, want[i], ev)
+		}
+	}
+	if f.Dropped() != 0 {
+		t.Fatalf("want no dropped events, got %d", f.Dropped())
+	}
+}
+
+func TestNotifyFilesystemDrops(t *testing.T) {
+	ctx := context.Background()
+	block := make(chan struct{})
+	f := NewNotifyFilesystem(NewMemoryFilesystem(), func(ev Event) {
+		<-block
+	}, 2)
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// the worker blocks on the first event, two more fit into the buffer
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("%064x", i)
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", id), strings.NewReader("key"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped := f.Dropped(); dropped < 7 || dropped > 8 {
+		t.Fatalf("want 7 or 8 dropped events, got %d", dropped)
+	}
+	close(block)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifyFilesystemHash(t *testing.T) {
+	ctx := context.Background()
+	var events []Event
+	f := NewNotifyFilesystem(NewVerifyHashFilesystem(&DiskFilesystem{}), func(ev Event) {
+		events = append(events, ev)
+	}, 10)
+	f.HashAlgo = SHA256
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	// sha256("foo")
+	id := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// the failed upload is not reported
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err == nil {
+		t.Fatal("want an error for the hash mismatch")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Event{Repo: repo, ObjectType: "data", Op: "save_blob", Name: id, Size: 3, Hash: id}
+	if len(events) != 1 || events[0] != want {
+		t.Fatalf("want the event %+v, got %+v", want, events)
+	}
+}
@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/minio/sha256-simd"
+)
+
+// obfuscateRounds is the number of Feistel rounds, four rounds with a
+// pseudorandom round function give a pseudorandom permutation.
+const obfuscateRounds = 4
+
+// ObfuscatingFilesystem wraps a Filesystem and stores blobs under names
+// derived from the names used by the clients with a key held by the server,
+// so that the storage does not reveal the restic IDs of the blobs, e.g. to
+// other users of a shared storage who could otherwise check whether a
+// repository contains known data. The subdirs of hashed object types are
+// chosen by the stored names.
+//
+// The stored name is a keyed permutation of the client name: a Feistel
+// network over the decoded ID with HMAC-SHA-256 as round function. It is
+// deterministic and can be reversed with the key, so listings are mapped
+// back to the client names without a lookup table. Stored names are hex
+// strings of the same length as the client names, which must have an even
+// number of hex characters like the IDs of restic.
+//
+// The mapping must be used for the whole life of a repository. Blobs stored
+// without it, or with another key, are listed under wrong names. Restic and
+// other tools reading the repository directly from the storage, e.g. restic
+// check with the local backend, no longer find the blobs, the repository can
+// only be used through the server.
+type ObfuscatingFilesystem struct {
+	Filesystem
+	key []byte
+}
+
+// NewObfuscatingFilesystem returns an ObfuscatingFilesystem for base using
+// the 32 byte key.
+func NewObfuscatingFilesystem(base Filesystem, key []byte) (*ObfuscatingFilesystem, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length %d, want 32 bytes", len(key))
+	}
+	return &ObfuscatingFilesystem{Filesystem: base, key: append([]byte(nil), key...)}, nil
+}
+
+// round returns the output of the round function of round i for half,
+// n bytes long.
+func (o *ObfuscatingFilesystem) round(i int, half []byte, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	var prefix [5]byte
+	prefix[0] = byte(i)
+	for block := uint32(0); len(out) < n; block++ {
+		binary.BigEndian.PutUint32(prefix[1:], block)
+		mac := hmac.New(sha256.New, o.key)
+		_, _ = mac.Write(prefix[:])
+		_, _ = mac.Write(half)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// permute maps a name to its stored name, or back if reverse is set.
+func (o *ObfuscatingFilesystem) permute(name string, reverse bool) (string, error) {
+	id, err := hex.DecodeString(name)
+	if err != nil || ValidateName(name) != nil || len(id) < 2 || len(id)%2 != 0 {
+		return "", fmt.Errorf("%q: %w", name, ErrInvalidName)
+	}
+	l, r := id[:len(id)/2], id[len(id)/2:]
+	for i := 0; i < obfuscateRounds; i++ {
+		if reverse {
+			// undo the rounds starting with the last one
+			f := o.round(obfuscateRounds-1-i, l, len(r))
+			for j := range r {
+				r[j] ^= f[j]
+			}
+		} else {
+			f := o.round(i, r, len(l))
+			for j := range l {
+				l[j] ^= f[j]
+			}
+		}
+		l, r = r, l
+	}
+	return hex.EncodeToString(append(append([]byte(nil), l...), r...)), nil
+}
+
+// storedPath returns the path the blob at path is stored at.
+func (o *ObfuscatingFilesystem) storedPath(path string) (string, error) {
+	repo, objectType, name := SplitBlobPath(path)
+	stored, err := o.permute(name, false)
+	if err != nil {
+		return "", err
+	}
+	return blobPath(filepath.Join(repo, objectType), stored), nil
+}
+
+// reveal returns blob with the client name. Entries which are not valid
+// stored names cannot have been saved by the clients and are skipped.
+func (o *ObfuscatingFilesystem) reveal(blob Blob) (Blob, bool) {
+	name, err := o.permute(blob.Name, true)
+	if err != nil {
+		return Blob{}, false
+	}
+	blob.Name = name
+	return blob, true
+}
+
+// ListBlobs lists the blobs with their client names.
+func (o *ObfuscatingFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs, err := o.Filesystem.ListBlobs(ctx, path)
+	revealed := blobs[:0]
+	for _, blob := range blobs {
+		if blob, ok := o.reveal(blob); ok {
+			revealed = append(revealed, blob)
+		}
+	}
+	return revealed, err
+}
+
+// ListBlobsFunc calls fn for the blobs with their client names.
+func (o *ObfuscatingFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	return o.Filesystem.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		if blob, ok := o.reveal(blob); ok {
+			return fn(blob)
+		}
+		return nil
+	})
+}
+
+// Walk calls fn for the blobs with their client names.
+func (o *ObfuscatingFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, o, path, fn)
+}
+
+// CheckBlob returns the blob with its client name.
+func (o *ObfuscatingFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	stored, err := o.storedPath(path)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob, err := o.Filesystem.CheckBlob(ctx, stored)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob.Name = filepath.Base(path)
+	return blob, nil
+}
+
+// GetBlob returns a reader for the blob.
+func (o *ObfuscatingFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	stored, err := o.storedPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return o.Filesystem.GetBlob(ctx, stored)
+}
+
+// SaveBlob saves the blob under its stored name.
+func (o *ObfuscatingFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	stored, err := o.storedPath(path)
+	if err != nil {
+		return 0, err
+	}
+	return o.Filesystem.SaveBlob(ctx, stored, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob.
+func (o *ObfuscatingFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	stored, err := o.storedPath(path)
+	if err != nil {
+		return 0, err
+	}
+	return o.Filesystem.DeleteBlob(ctx, stored, needSize)
+}
+
+// DeleteBlobs removes the blobs.
+func (o *ObfuscatingFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	stored := make([]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if stored[i], err = o.storedPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return o.Filesystem.DeleteBlobs(ctx, stored, needSize)
+}
@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObfuscatingPermutation(t *testing.T) {
+	o, err := NewObfuscatingFilesystem(NewMemoryFilesystem(), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewObfuscatingFilesystem(NewMemoryFilesystem(), bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewObfuscatingFilesystem(NewMemoryFilesystem(), make([]byte, 16)); err == nil {
+		t.Fatal("short keys must be rejected")
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []int{2, 6, 32, 100} {
+		id := make([]byte, size)
+		rnd.Read(id)
+		name := hex.EncodeToString(id)
+		stored, err := o.permute(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored == name || len(stored) != len(name) || ValidateName(stored) != nil {
+			t.Fatalf("%v: got stored name %v", name, stored)
+		}
+		if again, _ := o.permute(name, false); again != stored {
+			t.Fatalf("%v: want a deterministic stored name, got %v and %v", name, stored, again)
+		}
+		if otherStored, _ := other.permute(name, false); otherStored == stored {
+			t.Fatalf("%v: want another stored name for another key", name)
+		}
+		if revealed, err := o.permute(stored, true); err != nil || revealed != name {
+			t.Fatalf("%v: got %v, %v back", name, revealed, err)
+		}
+	}
+	for _, name := range []string{"", "abc", "ABCD", "../x"} {
+		if _, err := o.permute(name, false); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: want ErrInvalidName, got %v", name, err)
+		}
+	}
+}
+
+func TestObfuscatingFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	f, err := NewObfuscatingFilesystem(base, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := f.storedPath(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(stored)
+	if stored != filepath.Join(repo, "data", name[:2], name) {
+		t.Fatalf("want the subdir of the stored name, got %v", stored)
+	}
+	if _, err := base.CheckBlob(ctx, blob); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want the client name hidden from the storage, got %v", err)
+	}
+	if b, err := base.CheckBlob(ctx, stored); err != nil || b.Size != 6 {
+		t.Fatalf("want the blob stored under %v, got %v, %v", stored, b, err)
+	}
+
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Name != testID || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: got %q", buf)
+	}
+	blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+	if err != nil || len(blobs) != 1 || blobs[0].Name != testID {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+	var walked []string
+	err = f.Walk(ctx, repo, func(objectType string, blob Blob) error {
+		walked = append(walked, objectType+"/"+blob.Name)
+		return nil
+	})
+	if err != nil || len(walked) != 1 || walked[0] != "data/"+testID {
+		t.Fatalf("Walk: got %v, %v", walked, err)
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 6 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+	if _, err := base.CheckBlob(ctx, stored); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want the stored blob removed, got %v", err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", "abc"), strings.NewReader("key"), 3); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("want ErrInvalidName for an odd name, got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package fs
+
+import "os"
+
+// osFS are the functions of the os package DiskFilesystem uses for single
+// files and directories, so that tests can simulate errors like a full disk
+// or missing permissions which are hard to provoke on a real filesystem.
+type osFS interface {
+	Open(name string) (*os.File, error)
+	Mkdir(name string, perm os.FileMode) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+}
+
+// realFS implements osFS using the os package.
+type realFS struct{}
+
+func (realFS) Open(name string) (*os.File, error)        { return os.Open(name) }
+func (realFS) Mkdir(name string, perm os.FileMode) error { return os.Mkdir(name, perm) }
+func (realFS) Remove(name string) error                  { return os.Remove(name) }
+func (realFS) Stat(name string) (os.FileInfo, error)     { return os.Stat(name) }
+func (realFS) Rename(oldpath, newpath string) error      { return os.Rename(oldpath, newpath) }
+func (realFS) Link(oldname, newname string) error        { return os.Link(oldname, newname) }
@@ -0,0 +1,331 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// faultyFS fails the operations for which an error is set.
+type faultyFS struct {
+	realFS
+	mkdirErr  error
+	removeErr error
+	renameErr error // only for renames between different directories
+	linkErr   error
+}
+
+func (f *faultyFS) Mkdir(name string, perm os.FileMode) error {
+	if f.mkdirErr != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: f.mkdirErr}
+	}
+	return f.realFS.Mkdir(name, perm)
+}
+
+func (f *faultyFS) Remove(name string) error {
+	if f.removeErr != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: f.removeErr}
+	}
+	return f.realFS.Remove(name)
+}
+
+func (f *faultyFS) Rename(oldpath, newpath string) error {
+	if f.renameErr != nil && filepath.Dir(oldpath) != filepath.Dir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: f.renameErr}
+	}
+	return f.realFS.Rename(oldpath, newpath)
+}
+
+func (f *faultyFS) Link(oldname, newname string) error {
+	if f.linkErr != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: f.linkErr}
+	}
+	return f.realFS.Link(oldname, newname)
+}
+
+// barrierFS records the state of the deferred syncs whenever a barrier blob
+// is renamed into place, which is the moment a crash could leave it on disk.
+type barrierFS struct {
+	realFS
+	f       *DiskFilesystem
+	mu      sync.Mutex
+	pending []uint64 // syncs still pending for each renamed barrier
+}
+
+func (b *barrierFS) Rename(oldpath, newpath string) error {
+	if _, objectType, _ := SplitBlobPath(newpath); isBarrier(objectType) {
+		b.f.syncs.mu.Lock()
+		pending := b.f.syncs.added - b.f.syncs.synced
+		b.f.syncs.mu.Unlock()
+		b.mu.Lock()
+		b.pending = append(b.pending, pending)
+		b.mu.Unlock()
+	}
+	return b.realFS.Rename(oldpath, newpath)
+}
+
+func TestDiskFilesystemSyncDeferredBarrier(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{SyncMode: SyncDeferred}
+	sys := &barrierFS{f: f}
+	f.sys = sys
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// like restic, upload packs concurrently, then the index referencing
+	// them, and repeat
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				id := fmt.Sprintf("%062x%02x", round, i)
+				_, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader(id), 64)
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		id := fmt.Sprintf("%064x", round)
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "index", id), strings.NewReader("index"), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sys.pending) != 5 {
+		t.Fatalf("want 5 index renames, got %d", len(sys.pending))
+	}
+	for i, pending := range sys.pending {
+		if pending != 0 {
+			t.Errorf("index %d became visible with %d pack syncs pending, a crash could lose them", i, pending)
+		}
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// truncatedFS fails all mkdirs of data subdirs once left of them have been
+// created, like a CreateRepo which is killed.
+type truncatedFS struct {
+	realFS
+	left int64 // must be accessed using sync/atomic
+}
+
+func (f *truncatedFS) Mkdir(name string, perm os.FileMode) error {
+	if filepath.Base(filepath.Dir(name)) == "data" && atomic.AddInt64(&f.left, -1) < 0 {
+		return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("killed")}
+	}
+	return f.realFS.Mkdir(name, perm)
+}
+
+func TestDiskFilesystemCreateRepoInterrupted(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.Join(t.TempDir(), "repo")
+	// mkdirAll only uses sys with IgnoreUmask
+	f := &DiskFilesystem{IgnoreUmask: true, sys: &truncatedFS{left: 128}}
+	if err := f.CreateRepo(ctx, repo); err == nil {
+		t.Fatal("CreateRepo: want error for the interrupted init")
+	}
+	entries, err := os.ReadDir(filepath.Join(repo, "data"))
+	if err != nil || len(entries) != 128 {
+		t.Fatalf("want 128 data subdirs, got %d, %v", len(entries), err)
+	}
+	subdirs := make(map[string]bool)
+	for _, e := range entries {
+		subdirs[e.Name()] = true
+	}
+	var missing string
+	for i := 0; i < 256 && missing == ""; i++ {
+		if name := fmt.Sprintf("%02x", i); !subdirs[name] {
+			missing = name
+		}
+	}
+
+	// uploads into a missing subdir succeed without running CreateRepo again
+	id := missing + testID[2:]
+	blob := filepath.Join(repo, "data", missing, id)
+	if _, err := (&DiskFilesystem{}).SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatalf("SaveBlob into missing subdir %v: %v", missing, err)
+	}
+
+	// running CreateRepo again completes the repository
+	if err := (&DiskFilesystem{}).CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 256; i++ {
+		dir := filepath.Join(repo, "data", fmt.Sprintf("%02x", i))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			t.Fatalf("%v not created: %v", dir, err)
+		}
+	}
+	for _, objectType := range ObjectTypes {
+		if fi, err := os.Stat(filepath.Join(repo, objectType)); err != nil || !fi.IsDir() {
+			t.Fatalf("%v not created: %v", objectType, err)
+		}
+	}
+	if b, err := (&DiskFilesystem{}).CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+}
+
+func TestDiskFilesystemOSErrors(t *testing.T) {
+	ctx := context.Background()
+	sys := &faultyFS{mkdirErr: os.ErrPermission}
+	f := &DiskFilesystem{sys: sys}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("CreateRepo: want permission error, got %v", err)
+	}
+
+	sys.mkdirErr = nil
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	// without hard links, the config is renamed into place
+	sys.linkErr = os.ErrPermission
+	config := filepath.Join(repo, "config")
+	if err := f.SaveConfig(ctx, config, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, config, strings.NewReader("config")); !errors.Is(err, ErrConfigExists) {
+		t.Fatalf("SaveConfig: want ErrConfigExists, got %v", err)
+	}
+	sys.linkErr = nil
+
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	sys.removeErr = os.ErrPermission
+	if _, err := f.DeleteBlob(ctx, blob, true); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("DeleteBlob: want permission error, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); err != nil {
+		t.Fatalf("blob removed despite the error: %v", err)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(blob)); err != nil || len(entries) != 1 {
+		t.Fatalf("want only the blob in its directory, got %v, %v", entries, err)
+	}
+
+	sys.removeErr = nil
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 6 {
+		t.Fatalf("DeleteBlob: want size 6, got %v, %v", size, err)
+	}
+	if entries, err := os.ReadDir(filepath.Dir(blob)); err != nil || len(entries) != 0 {
+		t.Fatalf("want no files left behind, got %v, %v", entries, err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, true); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteBlob: want ErrNotFound for the removed blob, got %v", err)
+	}
+}
+
+func TestDiskFilesystemNow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	f := &DiskFilesystem{Now: func() time.Time { return now }}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	lock := filepath.Join(repo, "locks", testID)
+	if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := f.PruneStaleLocks(ctx, repo, time.Hour); err != nil || n != 0 {
+		t.Fatalf("want the fresh lock kept, got %v, %v", n, err)
+	}
+	now = now.Add(2 * time.Hour)
+	if n, err := f.PruneStaleLocks(ctx, repo, time.Hour); err != nil || n != 1 {
+		t.Fatalf("want the lock removed two hours later, got %v, %v", n, err)
+	}
+}
+
+func TestTrashFilesystemNow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	f := NewTrashFilesystem(NewMemoryFilesystem(), time.Hour)
+	f.Now = func() time.Time { return now }
+	repo := filepath.FromSlash("/repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if err := f.Purge(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := f.trashEntries(ctx, filepath.Join(repo, TrashDir, "data")); err != nil || len(entries) != 1 {
+		t.Fatalf("want the entry kept within the retention, got %v, %v", entries, err)
+	}
+	now = now.Add(time.Hour)
+	if err := f.Purge(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RestoreBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want the entry purged after the retention, got %v", err)
+	}
+}
+
+// statFS counts the stats of paths.
+type statFS struct {
+	realFS
+	stats int
+}
+
+func (f *statFS) Stat(name string) (os.FileInfo, error) {
+	f.stats++
+	return f.realFS.Stat(name)
+}
+
+func TestSharedFilesOpenStats(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blob")
+	if err := ioutil.WriteFile(file, []byte("foobar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sys := &statFS{}
+	var files sharedFiles
+
+	r1, err := files.open(sys, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys.stats != 0 || r1.Size() != 6 {
+		t.Fatalf("want the size of the descriptor without a stat, got size %d after %d stats", r1.Size(), sys.stats)
+	}
+	// a shared file is checked for having been replaced
+	r2, err := files.open(sys, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sys.stats != 1 || r1.(*sharedReader).sf != r2.(*sharedReader).sf {
+		t.Fatalf("want the file shared after one stat, got %d stats", sys.stats)
+	}
+	for _, rd := range []BlobReaderAt{r1, r2} {
+		if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
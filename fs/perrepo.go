@@ -0,0 +1,407 @@
+package fs
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PerRepoFilesystem keeps a separate Filesystem for each repository in use,
+// created by open, e.g. a BloomFilesystem whose state grows with the number
+// of repositories. Once more than maxRepos repositories are open, the least
+// recently used ones are closed, which drops their state, as are those idle
+// for longer than the timeout passed to EvictIdle. A closed repository is
+// opened again on its next access. This bounds the memory of servers with
+// thousands of repositories.
+//
+// Repositories are only closed while there are no operations in progress in
+// them, including reads from the readers returned by GetBlob and
+// GetConfigReader. If all repositories are in use, more than maxRepos may be
+// open.
+type PerRepoFilesystem struct {
+	Filesystem
+	open     func(base Filesystem) Filesystem
+	maxRepos int
+
+	mu    sync.Mutex
+	lru   *list.List               // of *repoHandle, most recently used first
+	repos map[string]*list.Element // repository path -> lru element
+}
+
+// repoHandle is an open repository.
+type repoHandle struct {
+	path     string
+	fs       Filesystem
+	refs     int // operations in progress
+	lastUsed time.Time
+}
+
+// NewPerRepoFilesystem returns a PerRepoFilesystem which opens repositories
+// by calling open with base, keeping at most maxRepos of them open, or an
+// unlimited number if it is zero. The Filesystems returned by open share
+// base, closing them does not close base. open is called with a lock held,
+// so it must only create the Filesystem and leave expensive initialization,
+// like BloomFilesystem.Rebuild, to the first access.
+func NewPerRepoFilesystem(base Filesystem, open func(base Filesystem) Filesystem, maxRepos int) *PerRepoFilesystem {
+	return &PerRepoFilesystem{
+		Filesystem: base,
+		open:       open,
+		maxRepos:   maxRepos,
+		lru:        list.New(),
+		repos:      make(map[string]*list.Element),
+	}
+}
+
+// noCloseFilesystem is the base passed to open, so that closing a
+// repository does not close the shared base.
+type noCloseFilesystem struct {
+	Filesystem
+}
+
+func (noCloseFilesystem) Close() error { return nil }
+
+// Active returns the number of open repositories.
+func (p *PerRepoFilesystem) Active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.repos)
+}
+
+// acquire returns the open repository at repo, opening it if necessary. It
+// must be released once the operation has completed.
+func (p *PerRepoFilesystem) acquire(repo string) *repoHandle {
+	repo = filepath.Clean(repo)
+	p.mu.Lock()
+	if e, ok := p.repos[repo]; ok {
+		h := e.Value.(*repoHandle)
+		h.refs++
+		p.lru.MoveToFront(e)
+		p.mu.Unlock()
+		return h
+	}
+	h := &repoHandle{path: repo, fs: p.open(noCloseFilesystem{p.Filesystem}), refs: 1}
+	p.repos[repo] = p.lru.PushFront(h)
+	var evicted []*repoHandle
+	if p.maxRepos > 0 {
+		evicted = p.evict(func(*repoHandle) bool { return len(p.repos) > p.maxRepos })
+	}
+	p.mu.Unlock()
+	closeRepos(evicted)
+	return h
+}
+
+// release marks the operation in repository h as completed.
+func (p *PerRepoFilesystem) release(h *repoHandle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.refs--
+	h.lastUsed = time.Now()
+}
+
+// evict removes the repositories without operations in progress for which
+// cond returns true, starting with the least recently used one, and returns
+// them. p.mu must be held, the repositories must be closed afterwards.
+func (p *PerRepoFilesystem) evict(cond func(h *repoHandle) bool) []*repoHandle {
+	var evicted []*repoHandle
+	for e := p.lru.Back(); e != nil; {
+		prev := e.Prev()
+		h := e.Value.(*repoHandle)
+		if h.refs == 0 && cond(h) {
+			p.lru.Remove(e)
+			delete(p.repos, h.path)
+			evicted = append(evicted, h)
+		}
+		e = prev
+	}
+	return evicted
+}
+
+// closeRepos closes the repositories, errors are only logged as the
+// operations on them have succeeded.
+func closeRepos(repos []*repoHandle) {
+	for _, h := range repos {
+		if err := h.fs.Close(); err != nil {
+			log.Printf("closing repository %v: %v", h.path, err)
+		}
+	}
+}
+
+// EvictIdle closes the repositories which have not been used for longer
+// than idle and returns their number.
+func (p *PerRepoFilesystem) EvictIdle(idle time.Duration) int {
+	cutoff := time.Now().Add(-idle)
+	p.mu.Lock()
+	evicted := p.evict(func(h *repoHandle) bool { return h.lastUsed.Before(cutoff) })
+	p.mu.Unlock()
+	closeRepos(evicted)
+	return len(evicted)
+}
+
+// RunEvictor closes the repositories idle for longer than idle every
+// interval, until ctx is canceled.
+func (p *PerRepoFilesystem) RunEvictor(ctx context.Context, interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p.EvictIdle(idle)
+	}
+}
+
+// with calls fn with the open repository at repo.
+func (p *PerRepoFilesystem) with(repo string, fn func(f Filesystem) error) error {
+	h := p.acquire(repo)
+	defer p.release(h)
+	return fn(h.fs)
+}
+
+// repoReadCloser releases the repository once the reader has been closed.
+type repoReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *repoReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// repoReadSeekCloser releases the repository once the blob has been closed.
+type repoReadSeekCloser struct {
+	io.ReadSeekCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *repoReadSeekCloser) Close() error {
+	err := r.ReadSeekCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// CreateRepo creates the repository.
+func (p *PerRepoFilesystem) CreateRepo(ctx context.Context, path string) error {
+	return p.with(path, func(f Filesystem) error {
+		return f.CreateRepo(ctx, path)
+	})
+}
+
+// CheckConfig checks the config.
+func (p *PerRepoFilesystem) CheckConfig(ctx context.Context, path string) (exists bool, size int64, err error) {
+	err = p.with(filepath.Dir(path), func(f Filesystem) error {
+		var err error
+		exists, size, err = f.CheckConfig(ctx, path)
+		return err
+	})
+	return exists, size, err
+}
+
+// GetConfig returns the config.
+func (p *PerRepoFilesystem) GetConfig(ctx context.Context, path string) (buf []byte, err error) {
+	err = p.with(filepath.Dir(path), func(f Filesystem) error {
+		var err error
+		buf, err = f.GetConfig(ctx, path)
+		return err
+	})
+	return buf, err
+}
+
+// GetConfigReader returns a reader for the config, the repository stays
+// open until it has been closed.
+func (p *PerRepoFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	h := p.acquire(filepath.Dir(path))
+	rd, size, err := h.fs.GetConfigReader(ctx, path)
+	if err != nil {
+		p.release(h)
+		return nil, 0, err
+	}
+	return &repoReadCloser{ReadCloser: rd, release: func() { p.release(h) }}, size, nil
+}
+
+// SaveConfig saves the config.
+func (p *PerRepoFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	return p.with(filepath.Dir(path), func(f Filesystem) error {
+		return f.SaveConfig(ctx, path, rd)
+	})
+}
+
+// DeleteConfig removes the config.
+func (p *PerRepoFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return p.with(filepath.Dir(path), func(f Filesystem) error {
+		return f.DeleteConfig(ctx, path)
+	})
+}
+
+// ListBlobs lists the blobs.
+func (p *PerRepoFilesystem) ListBlobs(ctx context.Context, path string) (blobs []Blob, err error) {
+	err = p.with(filepath.Dir(path), func(f Filesystem) error {
+		var err error
+		blobs, err = f.ListBlobs(ctx, path)
+		return err
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc lists the blobs.
+func (p *PerRepoFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	return p.with(filepath.Dir(path), func(f Filesystem) error {
+		return f.ListBlobsFunc(ctx, path, fn)
+	})
+}
+
+// CheckBlob returns the blob.
+func (p *PerRepoFilesystem) CheckBlob(ctx context.Context, path string) (blob Blob, err error) {
+	repo, _, _ := SplitBlobPath(path)
+	err = p.with(repo, func(f Filesystem) error {
+		var err error
+		blob, err = f.CheckBlob(ctx, path)
+		return err
+	})
+	return blob, err
+}
+
+// GetBlob returns a reader for the blob, the repository stays open until it
+// has been closed.
+func (p *PerRepoFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	repo, _, _ := SplitBlobPath(path)
+	h := p.acquire(repo)
+	rd, err := h.fs.GetBlob(ctx, path)
+	if err != nil {
+		p.release(h)
+		return nil, err
+	}
+	return &repoReadSeekCloser{ReadSeekCloser: rd, release: func() { p.release(h) }}, nil
+}
+
+// SaveBlob saves the blob.
+func (p *PerRepoFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (n int64, err error) {
+	repo, _, _ := SplitBlobPath(path)
+	err = p.with(repo, func(f Filesystem) error {
+		var err error
+		n, err = f.SaveBlob(ctx, path, rd, expectedSize)
+		return err
+	})
+	return n, err
+}
+
+// DeleteBlob removes the blob.
+func (p *PerRepoFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (size int64, err error) {
+	repo, _, _ := SplitBlobPath(path)
+	err = p.with(repo, func(f Filesystem) error {
+		var err error
+		size, err = f.DeleteBlob(ctx, path, needSize)
+		return err
+	})
+	return size, err
+}
+
+// DeleteBlobs removes the blobs, the blobs of each repository in a single
+// batch.
+func (p *PerRepoFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	var repos []string
+	byRepo := make(map[string][]int)
+	for j, path := range paths {
+		repo, _, _ := SplitBlobPath(path)
+		if _, ok := byRepo[repo]; !ok {
+			repos = append(repos, repo)
+		}
+		byRepo[repo] = append(byRepo[repo], j)
+	}
+
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for _, repo := range repos {
+		indexes := byRepo[repo]
+		repoPaths := make([]string, len(indexes))
+		for k, j := range indexes {
+			repoPaths[k] = paths[j]
+		}
+		var n []int64
+		err := p.with(repo, func(f Filesystem) error {
+			var err error
+			n, err = f.DeleteBlobs(ctx, repoPaths, needSize)
+			return err
+		})
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			return sizes, err
+		}
+		for k, j := range indexes {
+			if batchErr != nil && batchErr.Errors[k] != nil {
+				errs[j] = batchErr.Errors[k]
+			} else if k < len(n) {
+				sizes[j] = n[k]
+			}
+		}
+	}
+	return sizes, NewBatchError(errs)
+}
+
+// RepoStats returns the statistics of the repository.
+func (p *PerRepoFilesystem) RepoStats(ctx context.Context, path string) (stats RepoStats, err error) {
+	err = p.with(path, func(f Filesystem) error {
+		var err error
+		stats, err = f.RepoStats(ctx, path)
+		return err
+	})
+	return stats, err
+}
+
+// Walk lists the blobs of each object type.
+func (p *PerRepoFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return p.with(path, func(f Filesystem) error {
+		return f.Walk(ctx, path, fn)
+	})
+}
+
+// Sync syncs all open repositories and then base.
+func (p *PerRepoFilesystem) Sync(ctx context.Context) error {
+	p.mu.Lock()
+	var open []*repoHandle
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		h := e.Value.(*repoHandle)
+		// not evicted while it is synced
+		h.refs++
+		open = append(open, h)
+	}
+	p.mu.Unlock()
+	var err error
+	for _, h := range open {
+		if err == nil {
+			if serr := h.fs.Sync(ctx); serr != nil {
+				err = fmt.Errorf("%v: %w", h.path, serr)
+			}
+		}
+		p.release(h)
+	}
+	if err != nil {
+		return err
+	}
+	return p.Filesystem.Sync(ctx)
+}
+
+// Close closes all open repositories and then base.
+func (p *PerRepoFilesystem) Close() error {
+	p.mu.Lock()
+	var open []*repoHandle
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		open = append(open, e.Value.(*repoHandle))
+	}
+	p.lru.Init()
+	p.repos = make(map[string]*list.Element)
+	p.mu.Unlock()
+	closeRepos(open)
+	return p.Filesystem.Close()
+}
@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPerRepoFilesystem(t *testing.T) {
+	testFilesystem(t, NewPerRepoFilesystem(NewMemoryFilesystem(), func(base Filesystem) Filesystem {
+		return NewBloomFilesystem(base)
+	}, 1), filepath.FromSlash("/srv/restic"))
+}
+
+func TestPerRepoFilesystemEviction(t *testing.T) {
+	ctx := context.Background()
+	base := &closeCounter{Filesystem: NewMemoryFilesystem()}
+	opened := make(map[string][]*closeCounter)
+	var current string
+	p := NewPerRepoFilesystem(base, func(base Filesystem) Filesystem {
+		c := &closeCounter{Filesystem: base}
+		opened[current] = append(opened[current], c)
+		return c
+	}, 2)
+
+	blob := func(repo string) string {
+		return filepath.Join(filepath.FromSlash("/"+repo), "keys", testID)
+	}
+	use := func(repo string) {
+		t.Helper()
+		current = repo
+		if _, err := p.SaveBlob(ctx, blob(repo), strings.NewReader("foo"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	use("a")
+	use("b")
+	use("a")
+	// b is the least recently used repository
+	use("c")
+	if n := p.Active(); n != 2 {
+		t.Fatalf("want 2 active repositories, got %d", n)
+	}
+	if len(opened["b"]) != 1 || opened["b"][0].closed != 1 || opened["a"][0].closed != 0 {
+		t.Fatalf("want b closed, got a %v, b %v", opened["a"], opened["b"])
+	}
+	if base.closed != 0 {
+		t.Fatal("base closed by the eviction of a repository")
+	}
+
+	// repositories with a reader still open are not evicted
+	current = "a"
+	rd, err := p.GetBlob(ctx, blob("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is opened again, then evicted instead of the least recently used a
+	use("b")
+	use("d")
+	if opened["a"][0].closed != 0 {
+		t.Fatal("repository closed while a blob is being read")
+	}
+	if len(opened["b"]) != 2 || opened["b"][1].closed != 1 {
+		t.Fatalf("want b reopened and closed again, got %v", opened["b"])
+	}
+	// while all repositories are in use, more than maxRepos are open
+	current = "d"
+	rd2, err := p.GetBlob(ctx, blob("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	use("e")
+	if n := p.Active(); n != 3 {
+		t.Fatalf("want 3 active repositories, got %d", n)
+	}
+	for _, rd := range []io.Closer{rd, rd2} {
+		if err := rd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := p.EvictIdle(0); n != 3 || p.Active() != 0 {
+		t.Fatalf("EvictIdle: want 3 repositories closed, got %d, %d active", n, p.Active())
+	}
+
+	use("a")
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if base.closed != 1 || opened["a"][1].closed != 1 {
+		t.Fatalf("Close: want base and a closed, got %d, %d", base.closed, opened["a"][1].closed)
+	}
+}
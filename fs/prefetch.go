@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// PrefetchTypes are the object types read by Prefetch if none are given.
+// restic reads all of them when a restore starts. The data blobs are left
+// out, they usually exceed the page cache by far.
+var PrefetchTypes = []string{"index", "keys", "snapshots"}
+
+// Prefetch loads the blobs of objectTypes in the repository at path into the
+// page cache, e.g. before a scheduled restore from a server whose cache is
+// cold, or those of PrefetchTypes if objectTypes is empty. Up to StatsWorkers
+// blobs are loaded in parallel. On Linux the kernel is asked to read the
+// blobs in the background, elsewhere they are read by Prefetch. Blobs
+// removed in the meantime are skipped.
+func (d *DiskFilesystem) Prefetch(ctx context.Context, path string, objectTypes []string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if len(objectTypes) == 0 {
+		objectTypes = PrefetchTypes
+	}
+
+	var paths []string
+	for _, t := range objectTypes {
+		if err := d.checkObjectType(t); err != nil {
+			return err
+		}
+		dir := filepath.Join(path, t)
+		err := d.ListBlobsFunc(ctx, dir, func(blob Blob) error {
+			paths = append(paths, blobPath(dir, blob.Name))
+			return nil
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return runParallel(ctx, len(paths), d.statsWorkers(), func(i int) error {
+		err := d.withBlob(paths[i], prefetchFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+// prefetchFile loads the file at path into the page cache.
+func prefetchFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = prefetch(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskFilesystemPrefetch(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(repo, "index", testID),
+		filepath.Join(repo, "keys", testID),
+		filepath.Join(repo, "data", testID[:2], testID),
+	} {
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Prefetch(ctx, repo, nil); err != nil {
+		t.Fatalf("Prefetch: %v", err)
+	}
+	if err := f.Prefetch(ctx, repo, []string{"data", "locks"}); err != nil {
+		t.Fatalf("Prefetch of data: %v", err)
+	}
+	// a missing object type directory is skipped
+	if err := os.Remove(filepath.Join(repo, "snapshots")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Prefetch(ctx, repo, nil); err != nil {
+		t.Fatalf("Prefetch without snapshots: %v", err)
+	}
+
+	if err := f.Prefetch(ctx, repo, []string{"config"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Prefetch of config: want ErrInvalidName, got %v", err)
+	}
+	if err := f.Prefetch(ctx, filepath.Join(repo, "missing"), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Prefetch of missing repo: want not exist error, got %v", err)
+	}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := f.Prefetch(cancelCtx, repo, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Prefetch with canceled context: want context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrQuotaExceeded is returned by QuotaFilesystem if saving a blob would
+// exceed the size limit of the repository.
+var ErrQuotaExceeded = newError("quota_exceeded", "repository quota exceeded")
+
+// QuotaFilesystem wraps a Filesystem and limits the total size of the blobs
+// stored in each repository. The current usage of a repository is computed
+// by listing all its blobs when it is accessed for the first time. The usage
+// is tracked for each object type as well, see UsageByType.
+//
+// Besides the hard limit, which rejects uploads, a soft limit can warn the
+// users of a repository in advance, see SoftLimit.
+type QuotaFilesystem struct {
+	Filesystem
+
+	// SoftLimit is the size of a repository in bytes above which it is
+	// reported as over its soft limit, zero means no soft limit. Uploads
+	// are still accepted up to the hard limit. When the usage of a
+	// repository rises above SoftLimit, a warning is logged and
+	// OnSoftLimit is called, once per crossing: only after the usage has
+	// dropped to SoftLimit or below again, e.g. after a prune, is the next
+	// crossing reported. A repository which is already over the soft limit
+	// is reported when it is first accessed. SoftLimit must not be changed
+	// once the QuotaFilesystem is used.
+	SoftLimit int64
+	// OnSoftLimit, if set, is called with the path and the usage of a
+	// repository whose usage has risen above SoftLimit, e.g. to notify its
+	// users. It is called synchronously by the operation which crossed the
+	// limit, so it should not block.
+	OnSoftLimit func(repo string, used int64)
+
+	// TypeLimits optionally limits the size of the blobs of single object
+	// types in each repository, e.g. of the index, in addition to the limit
+	// of the whole repository. It must not be changed once the
+	// QuotaFilesystem is used.
+	TypeLimits map[string]int64
+
+	maxBytes int64
+
+	mu    sync.Mutex
+	repos map[string]*repoUsage
+	paths pathLocks // serializes saving and deleting each blob
+}
+
+// repoUsage tracks the space used by a single repository.
+type repoUsage struct {
+	used int64 // must be accessed using sync/atomic, keep first for alignment
+	soft int32 // 1 while over the soft limit, must be accessed using sync/atomic
+
+	once sync.Once
+	err  error
+
+	mu    sync.Mutex
+	types map[string]*int64 // must be accessed using sync/atomic
+}
+
+// typeUsed returns the counter of the space used by objectType.
+func (u *repoUsage) typeUsed(objectType string) *int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.types == nil {
+		u.types = make(map[string]*int64)
+	}
+	used, ok := u.types[objectType]
+	if !ok {
+		used = new(int64)
+		u.types[objectType] = used
+	}
+	return used
+}
+
+// add changes the space used by objectType by n bytes.
+func (u *repoUsage) add(objectType string, n int64) {
+	atomic.AddInt64(&u.used, n)
+	atomic.AddInt64(u.typeUsed(objectType), n)
+}
+
+// NewQuotaFilesystem returns a QuotaFilesystem which limits the size of each
+// repository to maxBytes, zero means no hard limit, e.g. if only SoftLimit
+// is used.
+func NewQuotaFilesystem(base Filesystem, maxBytes int64) *QuotaFilesystem {
+	return &QuotaFilesystem{
+		Filesystem: base,
+		maxBytes:   maxBytes,
+		repos:      make(map[string]*repoUsage),
+	}
+}
+
+// usage returns the usage tracker for the repository at repo, computing the
+// initial usage if necessary.
+func (q *QuotaFilesystem) usage(ctx context.Context, repo string) (*repoUsage, error) {
+	q.mu.Lock()
+	u, ok := q.repos[repo]
+	if !ok {
+		u = &repoUsage{}
+		q.repos[repo] = u
+	}
+	q.mu.Unlock()
+
+	u.once.Do(func() {
+		var stats RepoStats
+		stats, u.err = q.tally(ctx, repo)
+		for objectType, o := range stats.Types {
+			u.add(objectType, o.Size)
+		}
+		if u.err == nil {
+			q.checkSoftLimit(repo, u)
+		}
+	})
+	if u.err != nil {
+		// forget the failed attempt, so that the next call tries again
+		q.mu.Lock()
+		if q.repos[repo] == u {
+			delete(q.repos, repo)
+		}
+		q.mu.Unlock()
+		return nil, u.err
+	}
+	return u, nil
+}
+
+// checkSoftLimit records whether the repository is over the soft limit and
+// reports it if it has just crossed the limit.
+func (q *QuotaFilesystem) checkSoftLimit(repo string, u *repoUsage) {
+	if q.SoftLimit <= 0 {
+		return
+	}
+	used := atomic.LoadInt64(&u.used)
+	if used <= q.SoftLimit {
+		atomic.StoreInt32(&u.soft, 0)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&u.soft, 0, 1) {
+		return
+	}
+	log.Printf("WARNING: repository %v uses %d bytes, more than its soft limit of %d bytes", repo, used, q.SoftLimit)
+	if q.OnSoftLimit != nil {
+		q.OnSoftLimit(repo, used)
+	}
+}
+
+// OverSoftLimit reports whether the repository at path uses more than
+// SoftLimit bytes.
+func (q *QuotaFilesystem) OverSoftLimit(ctx context.Context, path string) (bool, error) {
+	u, err := q.usage(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	return atomic.LoadInt32(&u.soft) != 0, nil
+}
+
+// OverSoftLimitRepos returns the paths of the repositories accessed so far
+// which are over the soft limit, in sorted order.
+func (q *QuotaFilesystem) OverSoftLimitRepos() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var repos []string
+	for repo, u := range q.repos {
+		if atomic.LoadInt32(&u.soft) != 0 {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+// tally sums up the sizes of all blobs in the repository.
+func (q *QuotaFilesystem) tally(ctx context.Context, repo string) (RepoStats, error) {
+	stats, err := q.Filesystem.RepoStats(ctx, repo)
+	if errors.Is(err, os.ErrNotExist) {
+		// the repository has not been created yet
+		return RepoStats{}, nil
+	}
+	return stats, err
+}
+
+// Usage returns the number of bytes used by the repository at path.
+func (q *QuotaFilesystem) Usage(ctx context.Context, path string) (int64, error) {
+	u, err := q.usage(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	return atomic.LoadInt64(&u.used), nil
+}
+
+// UsageByType returns the number of bytes used by the blobs of each object
+// type in the repository at path, e.g. to find out whether the index has
+// grown unexpectedly. Object types without blobs may be missing.
+func (q *QuotaFilesystem) UsageByType(ctx context.Context, path string) (map[string]int64, error) {
+	u, err := q.usage(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usage := make(map[string]int64, len(u.types))
+	for objectType, used := range u.types {
+		usage[objectType] = atomic.LoadInt64(used)
+	}
+	return usage, nil
+}
+
+// SaveBlob saves the blob unless this would exceed the quota, in which case
+// ErrQuotaExceeded is returned. A blob which replaces an existing one, or
+// which the base skips because it exists already, only counts with the
+// difference to the size of the existing blob. Saves and deletions of the
+// same blob wait for each other, so that the existing blob is only
+// accounted for once.
+func (q *QuotaFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	repo, objectType, _ := SplitBlobPath(path)
+	u, err := q.usage(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+	unlock, err := q.paths.lock(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	old, err := q.existingSize(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	// the space of the existing blob is released up front, so that the
+	// upload is checked against the usage without it
+	u.add(objectType, -old)
+	qr := &quotaReader{
+		rd:       rd,
+		used:     &u.used,
+		maxBytes: q.maxBytes,
+		typeUsed: u.typeUsed(objectType),
+		typeMax:  q.TypeLimits[objectType],
+	}
+
+	// reject the upload early if the announced size is already too large
+	if expectedSize > 0 {
+		if err := qr.check(expectedSize); err != nil {
+			u.add(objectType, old)
+			return 0, fmt.Errorf("blob of %d bytes: %w", expectedSize, err)
+		}
+	}
+
+	n, err := q.Filesystem.SaveBlob(ctx, path, qr, expectedSize)
+	if err != nil {
+		// the data has not been stored and the existing blob is kept,
+		// release the reserved space
+		u.add(objectType, old-qr.n)
+		return n, err
+	}
+	// account for the difference between the data read and the blob size
+	u.add(objectType, n-qr.n)
+	q.checkSoftLimit(repo, u)
+	return n, nil
+}
+
+// existingSize returns the size of the blob at path, or zero if it does not
+// exist.
+func (q *QuotaFilesystem) existingSize(ctx context.Context, path string) (int64, error) {
+	blob, err := q.Filesystem.CheckBlob(ctx, path)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return blob.Size, nil
+}
+
+// DeleteBlob removes the blob and releases the space it used.
+func (q *QuotaFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	repo, objectType, _ := SplitBlobPath(path)
+	u, err := q.usage(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock, err := q.paths.lock(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	// the size is always needed to update the usage
+	size, err := q.Filesystem.DeleteBlob(ctx, path, true)
+	if err != nil {
+		return size, err
+	}
+	u.add(objectType, -size)
+	q.checkSoftLimit(repo, u)
+	return size, nil
+}
+
+// DeleteBlobs removes the blobs and releases the space they used.
+func (q *QuotaFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	usages := make([]*repoUsage, len(paths))
+	for i, path := range paths {
+		repo, _, _ := SplitBlobPath(path)
+		u, err := q.usage(ctx, repo)
+		if err != nil {
+			return nil, err
+		}
+		usages[i] = u
+	}
+
+	// lock the blobs in order, so that concurrent calls cannot deadlock
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	for i, path := range sorted {
+		if i > 0 && path == sorted[i-1] {
+			continue
+		}
+		unlock, err := q.paths.lock(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	// the sizes are always needed to update the usage
+	sizes, err := q.Filesystem.DeleteBlobs(ctx, paths, true)
+	for i, size := range sizes {
+		_, objectType, _ := SplitBlobPath(paths[i])
+		usages[i].add(objectType, -size)
+	}
+	for i, path := range paths {
+		repo, _, _ := SplitBlobPath(path)
+		q.checkSoftLimit(repo, usages[i])
+	}
+	return sizes, err
+}
+
+// quotaReader reserves space for all data read from rd, both in the usage of
+// the repository and of the object type, and fails with ErrQuotaExceeded
+// once one of the limits would be exceeded.
+type quotaReader struct {
+	rd       io.Reader
+	used     *int64 // must be accessed using sync/atomic
+	maxBytes int64  // no limit if zero
+	typeUsed *int64 // must be accessed using sync/atomic
+	typeMax  int64  // no limit if zero
+	n        int64  // bytes reserved so far
+}
+
+// check returns ErrQuotaExceeded if n more bytes would exceed a limit.
+func (r *quotaReader) check(n int64) error {
+	if r.maxBytes > 0 && atomic.LoadInt64(r.used)+n > r.maxBytes {
+		return ErrQuotaExceeded
+	}
+	if r.typeMax > 0 && atomic.LoadInt64(r.typeUsed)+n > r.typeMax {
+		return fmt.Errorf("object type limit: %w", ErrQuotaExceeded)
+	}
+	return nil
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if n > 0 {
+		if used := atomic.AddInt64(r.used, int64(n)); r.maxBytes > 0 && used > r.maxBytes {
+			atomic.AddInt64(r.used, -int64(n))
+			return 0, ErrQuotaExceeded
+		}
+		if used := atomic.AddInt64(r.typeUsed, int64(n)); r.typeMax > 0 && used > r.typeMax {
+			atomic.AddInt64(r.typeUsed, -int64(n))
+			atomic.AddInt64(r.used, -int64(n))
+			return 0, fmt.Errorf("object type limit: %w", ErrQuotaExceeded)
+		}
+		r.n += int64(n)
+	}
+	return n, err
+}
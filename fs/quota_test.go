@@ -0,0 +1,324 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuotaFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	// existing data must be accounted for
+	if _, err := base.SaveBlob(ctx, filepath.Join(repo, "keys", "key"), strings.NewReader("1234"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQuotaFilesystem(base, 10)
+	if used, err := q.Usage(ctx, repo); err != nil || used != 4 {
+		t.Fatalf("want usage 4, got %v, %v", used, err)
+	}
+
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := q.SaveBlob(ctx, blob, strings.NewReader("123456"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size is checked both up front and while reading the data
+	for _, size := range []int64{1, -1} {
+		_, err := q.SaveBlob(ctx, filepath.Join(repo, "locks", "lock"), strings.NewReader("1"), size)
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("want ErrQuotaExceeded, got %v", err)
+		}
+	}
+	if used, _ := q.Usage(ctx, repo); used != 10 {
+		t.Fatalf("failed uploads must not change the usage, got %v", used)
+	}
+
+	if _, err := q.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := q.Usage(ctx, repo); used != 4 {
+		t.Fatalf("want usage 4 after delete, got %v", used)
+	}
+	if _, err := q.SaveBlob(ctx, blob, strings.NewReader("123456"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.DeleteBlobs(ctx, []string{blob}, false); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := q.Usage(ctx, repo); used != 4 {
+		t.Fatalf("want usage 4 after DeleteBlobs, got %v", used)
+	}
+
+	// replacing a blob only counts the difference in size, also when it
+	// would not fit next to the existing blob
+	if _, err := q.SaveBlob(ctx, blob, strings.NewReader("123456"), 6); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"123456", "654321", "123"} {
+		if _, err := q.SaveBlob(ctx, blob, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if used, _ := q.Usage(ctx, repo); used != 4+int64(len(data)) {
+			t.Fatalf("want usage %d after overwriting with %q, got %v", 4+len(data), data, used)
+		}
+	}
+	if usage, _ := q.UsageByType(ctx, repo); usage["data"] != 3 {
+		t.Fatalf("want 3 bytes of data after overwriting, got %v", usage)
+	}
+	if _, err := q.SaveBlob(ctx, blob, strings.NewReader("1234567"), 7); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded, got %v", err)
+	}
+	if used, _ := q.Usage(ctx, repo); used != 7 {
+		t.Fatalf("a rejected overwrite must keep the usage of the existing blob, got %v", used)
+	}
+	if _, err := q.DeleteBlob(ctx, blob, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent uploads must not exceed the limit together
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := filepath.Join(repo, "snapshots", string(rune('a'+i)))
+			_, _ = q.SaveBlob(ctx, name, strings.NewReader("12"), -1)
+		}(i)
+	}
+	wg.Wait()
+	if used, _ := q.Usage(ctx, repo); used != 10 {
+		t.Fatalf("want usage 10 after concurrent uploads, got %v", used)
+	}
+}
+
+// slowSaveFilesystem delays saving blobs, so that concurrent saves overlap.
+type slowSaveFilesystem struct {
+	Filesystem
+}
+
+func (s slowSaveFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+func TestQuotaFilesystemConcurrentOverwrite(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuotaFilesystem(slowSaveFilesystem{base}, 0)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+
+	// the existing blob must only be released once, whichever save wins
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if _, err := q.SaveBlob(ctx, blob, strings.NewReader(strings.Repeat("x", n)), int64(n)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stored, err := base.CheckBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := q.Usage(ctx, repo); used != stored.Size {
+		t.Fatalf("want usage %d after concurrent overwrites, got %v", stored.Size, used)
+	}
+
+	// a deletion racing with saves must not release the blob twice either
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := q.SaveBlob(ctx, blob, strings.NewReader("123"), 3); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := q.DeleteBlobs(ctx, []string{blob, blob}, false); err != nil && !errors.Is(err, ErrNotFound) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	var want int64
+	if stored, err := base.CheckBlob(ctx, blob); err == nil {
+		want = stored.Size
+	}
+	if used, _ := q.Usage(ctx, repo); used != want {
+		t.Fatalf("want usage %d after concurrent saves and deletions, got %v", want, used)
+	}
+}
+
+func TestQuotaFilesystemSkipExisting(t *testing.T) {
+	ctx := context.Background()
+	base := &DiskFilesystem{SkipExistingBlobs: true}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuotaFilesystem(base, 10)
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	for i := 0; i < 3; i++ {
+		// the upload is read and discarded by the base
+		if _, err := q.SaveBlob(ctx, blob, strings.NewReader("123456"), 6); err != nil {
+			t.Fatal(err)
+		}
+		if used, _ := q.Usage(ctx, repo); used != 6 {
+			t.Fatalf("upload %d: want usage 6, got %v", i, used)
+		}
+	}
+}
+
+func TestQuotaFilesystemTypeLimits(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(repo, "index", testID)
+	if _, err := base.SaveBlob(ctx, index, strings.NewReader("1234"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQuotaFilesystem(base, 100)
+	q.TypeLimits = map[string]int64{"index": 6}
+
+	// only the index is limited, the announced size and the data read are
+	// checked
+	for _, size := range []int64{3, -1} {
+		_, err := q.SaveBlob(ctx, filepath.Join(repo, "index", "new"), strings.NewReader("123"), size)
+		if !errors.Is(err, ErrQuotaExceeded) {
+			t.Fatalf("want ErrQuotaExceeded, got %v", err)
+		}
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := q.SaveBlob(ctx, blob, strings.NewReader("1234567890"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := q.UsageByType(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["index"] != 4 || usage["data"] != 10 {
+		t.Fatalf("want 4 bytes of index and 10 of data, got %v", usage)
+	}
+	if used, _ := q.Usage(ctx, repo); used != 14 {
+		t.Fatalf("want usage 14, got %v", used)
+	}
+
+	// deleting an index blob makes room for a new one
+	if _, err := q.DeleteBlobs(ctx, []string{index}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.SaveBlob(ctx, filepath.Join(repo, "index", "new"), strings.NewReader("123456"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ := q.UsageByType(ctx, repo); usage["index"] != 6 {
+		t.Fatalf("want 6 bytes of index, got %v", usage)
+	}
+}
+
+func TestQuotaFilesystemSoftLimit(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewQuotaFilesystem(base, 10)
+	q.SoftLimit = 8
+	var crossings []int64
+	q.OnSoftLimit = func(r string, used int64) {
+		if r != repo {
+			t.Errorf("want crossing of %v, got %v", repo, r)
+		}
+		crossings = append(crossings, used)
+	}
+	save := func(name string, size int) error {
+		_, err := q.SaveBlob(ctx, filepath.Join(repo, "keys", name), strings.NewReader(strings.Repeat("x", size)), int64(size))
+		return err
+	}
+	over := func(want bool) {
+		t.Helper()
+		if got, err := q.OverSoftLimit(ctx, repo); err != nil || got != want {
+			t.Fatalf("OverSoftLimit: want %v, got %v, %v", want, got, err)
+		}
+		if repos := q.OverSoftLimitRepos(); (len(repos) == 1) != want {
+			t.Fatalf("OverSoftLimitRepos: got %v", repos)
+		}
+	}
+
+	if err := save("a", 8); err != nil {
+		t.Fatal(err)
+	}
+	over(false)
+	// crossing the soft limit is reported once, writes are still accepted
+	if err := save("b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := save("c", 1); err != nil {
+		t.Fatal(err)
+	}
+	over(true)
+	if len(crossings) != 1 || crossings[0] != 9 {
+		t.Fatalf("want one crossing at 9 bytes, got %v", crossings)
+	}
+	// the hard limit still rejects uploads
+	if err := save("d", 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("want ErrQuotaExceeded, got %v", err)
+	}
+
+	// dropping below the limit rearms it
+	if _, err := q.DeleteBlobs(ctx, []string{filepath.Join(repo, "keys", "a")}, false); err != nil {
+		t.Fatal(err)
+	}
+	over(false)
+	if err := save("a", 8); err != nil {
+		t.Fatal(err)
+	}
+	over(true)
+	if len(crossings) != 2 {
+		t.Fatalf("want a second crossing, got %v", crossings)
+	}
+
+	// a repository already over the soft limit is reported on first access,
+	// without a hard limit all uploads are accepted
+	q = NewQuotaFilesystem(base, 0)
+	q.SoftLimit = 8
+	crossings = nil
+	q.OnSoftLimit = func(r string, used int64) {
+		crossings = append(crossings, used)
+	}
+	over(true)
+	if len(crossings) != 1 || crossings[0] != 10 {
+		t.Fatalf("want one crossing at 10 bytes, got %v", crossings)
+	}
+	if err := save("d", 100); err != nil {
+		t.Fatal(err)
+	}
+	if len(crossings) != 1 {
+		t.Fatalf("want no further crossing, got %v", crossings)
+	}
+}
@@ -0,0 +1,206 @@
+package fs
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ReadCacheFilesystem wraps a Filesystem and keeps small blobs which are read
+// in memory, e.g. the index files and keys which every restic client of a
+// repository reads again and again. Unlike TieredFilesystem, which caches on
+// fast storage, this saves the IOPS for tiny objects altogether.
+//
+// Blobs up to MaxBlobSize bytes are cached when they are read, and the least
+// recently read ones are dropped once the cached blobs exceed the size limit.
+// Saving or deleting a blob drops its cached copy, also if a read filling the
+// cache is in progress.
+type ReadCacheFilesystem struct {
+	Filesystem
+
+	// MaxBlobSize is the size up to which blobs are cached.
+	MaxBlobSize int64
+
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List               // of *cacheEntry, most recently read first
+	entries map[string]*list.Element // path -> lru element
+	fills   map[string]*cacheFill    // reads of uncached blobs in progress
+	used    int64
+
+	hits, misses uint64 // must be accessed using sync/atomic
+}
+
+// DefaultReadCacheBlobSize is the MaxBlobSize of a ReadCacheFilesystem
+// returned by NewReadCacheFilesystem.
+const DefaultReadCacheBlobSize = 1024 * 1024
+
+// cacheEntry is a cached blob.
+type cacheEntry struct {
+	path string
+	buf  []byte
+}
+
+// cacheFill are the reads of a blob which has not been cached yet. Once the
+// blob is saved or deleted, the data read must not be cached.
+type cacheFill struct {
+	readers int
+	stale   bool
+}
+
+// NewReadCacheFilesystem returns a ReadCacheFilesystem for base which caches
+// at most maxBytes of blobs.
+func NewReadCacheFilesystem(base Filesystem, maxBytes int64) *ReadCacheFilesystem {
+	return &ReadCacheFilesystem{
+		Filesystem:  base,
+		MaxBlobSize: DefaultReadCacheBlobSize,
+		maxBytes:    maxBytes,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		fills:       make(map[string]*cacheFill),
+	}
+}
+
+// Hits returns the number of blobs read from the cache.
+func (c *ReadCacheFilesystem) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+// Misses returns the number of blobs read from the base, including those too
+// large to be cached.
+func (c *ReadCacheFilesystem) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+// Used returns the size of the cached blobs.
+func (c *ReadCacheFilesystem) Used() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+// lookup returns the cached data of the blob at path, or registers a fill.
+func (c *ReadCacheFilesystem) lookup(path string) ([]byte, *cacheFill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*cacheEntry).buf, nil
+	}
+	fill := c.fills[path]
+	if fill == nil {
+		fill = &cacheFill{}
+		c.fills[path] = fill
+	}
+	fill.readers++
+	return nil, fill
+}
+
+// finish ends the fill of the blob at path and caches buf unless it is nil
+// or the blob has been modified in the meantime.
+func (c *ReadCacheFilesystem) finish(path string, fill *cacheFill, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fill.readers--
+	if fill.readers == 0 && c.fills[path] == fill {
+		delete(c.fills, path)
+	}
+	if buf == nil || fill.stale || int64(len(buf)) > c.maxBytes {
+		return
+	}
+	if el, ok := c.entries[path]; ok {
+		// filled concurrently
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[path] = c.lru.PushFront(&cacheEntry{path: path, buf: buf})
+	c.used += int64(len(buf))
+	for c.used > c.maxBytes {
+		e := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, e.path)
+		c.used -= int64(len(e.buf))
+	}
+}
+
+// invalidate drops the cached copy of the blob at path, and keeps fills in
+// progress from caching it.
+func (c *ReadCacheFilesystem) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, path)
+		c.used -= int64(len(el.Value.(*cacheEntry).buf))
+	}
+	if fill := c.fills[path]; fill != nil {
+		fill.stale = true
+		delete(c.fills, path)
+	}
+}
+
+// GetBlob returns a reader for the cached blob, or reads it from the base
+// and caches it if it is small enough.
+func (c *ReadCacheFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	buf, fill := c.lookup(path)
+	if fill == nil {
+		atomic.AddUint64(&c.hits, 1)
+		return nopCloser{bytes.NewReader(buf)}, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	rd, err := c.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		c.finish(path, fill, nil)
+		return nil, err
+	}
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err != nil || size > c.MaxBlobSize {
+		c.finish(path, fill, nil)
+		if err != nil {
+			_ = rd.Close()
+			return nil, err
+		}
+		return rd, nil
+	}
+
+	buf = make([]byte, size)
+	_, err = io.ReadFull(rd, buf)
+	_ = rd.Close()
+	if err != nil {
+		c.finish(path, fill, nil)
+		return nil, err
+	}
+	c.finish(path, fill, buf)
+	return nopCloser{bytes.NewReader(buf)}, nil
+}
+
+// SaveBlob saves the blob and drops its cached copy.
+func (c *ReadCacheFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	// also after saving, a read started meanwhile may have seen the old blob
+	c.invalidate(path)
+	defer c.invalidate(path)
+	return c.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob and its cached copy.
+func (c *ReadCacheFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	defer c.invalidate(path)
+	return c.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs and their cached copies.
+func (c *ReadCacheFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	defer func() {
+		for _, path := range paths {
+			c.invalidate(path)
+		}
+	}()
+	return c.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hookFilesystem calls hook before each GetBlob.
+type hookFilesystem struct {
+	Filesystem
+	hook func()
+}
+
+func (h *hookFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	if h.hook != nil {
+		h.hook()
+	}
+	return h.Filesystem.GetBlob(ctx, path)
+}
+
+func TestReadCacheFilesystem(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.FromSlash("/repo")
+	index := filepath.Join(repo, "index", testID)
+	pack := filepath.Join(repo, "data", testID[:2], testID)
+	mem := NewMemoryFilesystem()
+	for path, data := range map[string]string{index: "index", pack: strings.Repeat("x", 100)} {
+		if _, err := mem.SaveBlob(ctx, path, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := &hookFilesystem{Filesystem: mem}
+	c := NewReadCacheFilesystem(base, 64)
+	c.MaxBlobSize = 10
+
+	get := func(path, want string) {
+		t.Helper()
+		rd, err := c.GetBlob(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf := readAll(t, rd); string(buf) != want {
+			t.Fatalf("GetBlob(%v): want %q, got %q", path, want, buf)
+		}
+	}
+
+	get(index, "index")
+	get(index, "index")
+	if c.Hits() != 1 || c.Misses() != 1 || c.Used() != 5 {
+		t.Fatalf("want 1 hit and 1 miss with 5 bytes cached, got %d, %d, %d", c.Hits(), c.Misses(), c.Used())
+	}
+	// too large to be cached
+	get(pack, strings.Repeat("x", 100))
+	get(pack, strings.Repeat("x", 100))
+	if c.Hits() != 1 || c.Misses() != 3 || c.Used() != 5 {
+		t.Fatalf("want the pack not cached, got %d hits, %d misses, %d bytes", c.Hits(), c.Misses(), c.Used())
+	}
+
+	// saving drops the cached copy
+	if _, err := c.SaveBlob(ctx, index, strings.NewReader("index2"), 6); err != nil {
+		t.Fatal(err)
+	}
+	get(index, "index2")
+	if c.Misses() != 4 {
+		t.Fatalf("want a miss after saving, got %d misses", c.Misses())
+	}
+
+	// a blob saved while it is read for the cache is not cached
+	base.hook = func() {
+		base.hook = nil
+		if _, err := c.SaveBlob(ctx, index, strings.NewReader("index3"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.DeleteBlob(ctx, index, false); err != nil {
+		t.Fatal(err)
+	}
+	get(index, "index3")
+	get(index, "index3")
+	if c.Hits() != 1 || c.Misses() != 6 {
+		t.Fatalf("want no stale hit, got %d hits, %d misses", c.Hits(), c.Misses())
+	}
+	get(index, "index3")
+	if c.Hits() != 2 {
+		t.Fatalf("want a hit once the blob is cached again, got %d hits", c.Hits())
+	}
+
+	// the least recently read blobs are evicted
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := filepath.Join(repo, "keys", strings.Repeat(string("0123456789"[i]), 64))
+		if _, err := mem.SaveBlob(ctx, key, strings.NewReader("key-data"), 8); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		get(key, "key-data")
+	}
+	if c.Used() > 64 {
+		t.Fatalf("want at most 64 bytes cached, got %d", c.Used())
+	}
+	hits := c.Hits()
+	get(keys[9], "key-data")
+	get(keys[0], "key-data")
+	if c.Hits() != hits+1 {
+		t.Fatalf("want a hit for the newest key only, got %d hits", c.Hits()-hits)
+	}
+}
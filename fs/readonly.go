@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"context"
+	"io"
+)
+
+// ErrReadOnly is returned by ReadOnlyFilesystem for all operations which
+// would modify the repository, and by DiskFilesystem if the storage is
+// mounted read-only.
+var ErrReadOnly = newError("read_only", "repository is read-only")
+
+// ReadOnlyFilesystem wraps a Filesystem and rejects all modifications, unlike
+// AppendOnlyFilesystem not even new blobs or locks can be saved.
+type ReadOnlyFilesystem struct {
+	Filesystem
+}
+
+// NewReadOnlyFilesystem returns a ReadOnlyFilesystem for base.
+func NewReadOnlyFilesystem(base Filesystem) *ReadOnlyFilesystem {
+	return &ReadOnlyFilesystem{Filesystem: base}
+}
+
+// CreateRepo always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) CreateRepo(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
+
+// SaveConfig always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	return ErrReadOnly
+}
+
+// DeleteConfig always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
+
+// SaveBlob always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	return 0, ErrReadOnly
+}
+
+// DeleteBlob always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	return 0, ErrReadOnly
+}
+
+// DeleteBlobs always returns ErrReadOnly.
+func (r *ReadOnlyFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	return nil, ErrReadOnly
+}
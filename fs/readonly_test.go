@@ -0,0 +1,50 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyFilesystem(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	if err := base.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(repo, "config")
+	if err := base.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "locks", testID)
+	if _, err := base.SaveBlob(ctx, blob, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewReadOnlyFilesystem(base)
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 4 {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+
+	for name, err := range map[string]error{
+		"CreateRepo":   f.CreateRepo(ctx, repo),
+		"SaveConfig":   f.SaveConfig(ctx, filepath.Join(repo, "other"), strings.NewReader("config")),
+		"DeleteConfig": f.DeleteConfig(ctx, cfg),
+	} {
+		if !errors.Is(err, ErrReadOnly) {
+			t.Errorf("%v: want ErrReadOnly, got %v", name, err)
+		}
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "locks", "new"), strings.NewReader("lock"), 4); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SaveBlob: want ErrReadOnly, got %v", err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteBlob: want ErrReadOnly, got %v", err)
+	}
+}
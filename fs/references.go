@@ -0,0 +1,37 @@
+package fs
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// referenceWorkers is the number of existence checks done in parallel by
+// CheckReferences, which hides the latency of remote backends.
+const referenceWorkers = 16
+
+// CheckReferences returns the names of the data blobs in refs which do not
+// exist in the repository at path, in the order of refs. It lets a tool which
+// has parsed the index check that all packs are present without downloading
+// them. The blobs are checked in parallel using BlobExists, stopping at the
+// first error.
+func CheckReferences(ctx context.Context, f Filesystem, path string, refs []string) (missing []string, err error) {
+	dir := filepath.Join(path, "data")
+	exists := make([]bool, len(refs))
+	err = runParallel(ctx, len(refs), referenceWorkers, func(i int) error {
+		if err := ValidateName(refs[i]); err != nil {
+			return err
+		}
+		ok, err := BlobExists(ctx, f, blobPath(dir, refs[i]))
+		exists[i] = ok
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, ref := range refs {
+		if !exists[i] {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,40 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckReferences(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.FromSlash("/repo")
+	f := NewMemoryFilesystem()
+	var refs, want []string
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%02x%062x", i, i)
+		refs = append(refs, id)
+		if i%7 == 0 {
+			want = append(want, id)
+			continue
+		}
+		if _, err := f.SaveBlob(ctx, filepath.Join(repo, "data", id[:2], id), strings.NewReader("pack"), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	missing, err := CheckReferences(ctx, f, repo, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(missing, ",") != strings.Join(want, ",") {
+		t.Fatalf("want missing %v, got %v", want, missing)
+	}
+
+	if _, err := CheckReferences(ctx, f, repo, []string{testID, "../config"}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("want ErrInvalidName, got %v", err)
+	}
+}
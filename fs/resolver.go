@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// PathResolver maps the blobs of hashed object types to the subdirs of the
+// object type directory which store them.
+type PathResolver interface {
+	// Subdir returns the subdir storing the blob name, relative to the
+	// object type directory. It returns "" if the name is too short to be
+	// sharded, such blobs are stored in the object type directory itself.
+	Subdir(name string) string
+	// Subdirs returns all subdirs, they are created for new repositories.
+	Subdirs() []string
+}
+
+// ShardedResolver stores blobs in Depth levels of subdirs, each level named
+// after the next Width hex characters of the blob name. The layout used by
+// restic, data/xx/, has Width 2 and Depth 1, with Depth 2 the blobs are
+// stored in data/xx/yy/.
+type ShardedResolver struct {
+	Width int
+	Depth int
+}
+
+var _ PathResolver = ShardedResolver{}
+
+// Subdir returns the subdir for the blob name.
+func (r ShardedResolver) Subdir(name string) string {
+	if len(name) < r.Width*r.Depth {
+		return ""
+	}
+	parts := make([]string, r.Depth)
+	for i := range parts {
+		parts[i] = name[i*r.Width : (i+1)*r.Width]
+	}
+	return filepath.Join(parts...)
+}
+
+// Subdirs returns the innermost subdirs, creating them creates all levels.
+func (r ShardedResolver) Subdirs() []string {
+	subdirs := []string{""}
+	for i := 0; i < r.Depth; i++ {
+		next := make([]string, 0, len(subdirs)<<(4*r.Width))
+		for _, parent := range subdirs {
+			for j := 0; j < 1<<(4*r.Width); j++ {
+				next = append(next, filepath.Join(parent, fmt.Sprintf("%0*x", r.Width, j)))
+			}
+		}
+		subdirs = next
+	}
+	return subdirs
+}
@@ -0,0 +1,29 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedResolver(t *testing.T) {
+	tests := []struct {
+		r       ShardedResolver
+		subdir  string
+		subdirs int
+	}{
+		{ShardedResolver{Width: 2, Depth: 1}, "b5", 256},
+		{ShardedResolver{Width: 1, Depth: 1}, "b", 16},
+		{ShardedResolver{Width: 2, Depth: 2}, filepath.Join("b5", "bb"), 65536},
+	}
+	for _, test := range tests {
+		if subdir := test.r.Subdir(testID); subdir != test.subdir {
+			t.Errorf("%v: want subdir %q, got %q", test.r, test.subdir, subdir)
+		}
+		if subdirs := test.r.Subdirs(); len(subdirs) != test.subdirs {
+			t.Errorf("%v: want %d subdirs, got %d", test.r, test.subdirs, len(subdirs))
+		}
+	}
+	if subdir := (ShardedResolver{Width: 2, Depth: 2}).Subdir("abc"); subdir != "" {
+		t.Errorf("short names must not be sharded, got %q", subdir)
+	}
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrRetentionActive is returned by RetentionFilesystem for deleting a blob
+// before its retention has expired, or for shortening the retention.
+var ErrRetentionActive = newError("retention_active", "blob is under retention")
+
+// RetainUntilKey is the metadata key storing the time until which a blob
+// must be kept, formatted as RFC 3339.
+const RetainUntilKey = "retain-until"
+
+// RetentionFilesystem wraps a MetadataFilesystem and refuses to delete blobs
+// until the time stored in their RetainUntilKey metadata has passed. Saved
+// blobs are retained for a default duration. The retention can only be
+// extended, so not even an administrator with access to the API can remove
+// data early. Lock files are exempt, restic needs to be able to remove its
+// own locks.
+//
+// Blobs which are uploaded again are replaced, which is harmless as they are
+// named after the hash of their content. They keep their retention unless the
+// default retention ends later.
+type RetentionFilesystem struct {
+	Filesystem
+	meta      *MetadataFilesystem
+	retention time.Duration
+
+	// Now returns the current time, time.Now if unset.
+	Now func() time.Time
+}
+
+// NewRetentionFilesystem returns a RetentionFilesystem for base which
+// retains saved blobs for retention. With a retention of zero, blobs are only
+// retained once SetRetention has been called for them.
+func NewRetentionFilesystem(base *MetadataFilesystem, retention time.Duration) *RetentionFilesystem {
+	return &RetentionFilesystem{Filesystem: base, meta: base, retention: retention}
+}
+
+func (r *RetentionFilesystem) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// Retention returns the time until which the blob at path is retained, which
+// is the zero time if it is not retained.
+func (r *RetentionFilesystem) Retention(ctx context.Context, path string) (time.Time, error) {
+	meta, err := r.meta.GetBlobMeta(ctx, path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	v, ok := meta[RetainUntilKey]
+	if !ok {
+		return time.Time{}, nil
+	}
+	until, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%v: invalid retention: %w", path, err)
+	}
+	return until, nil
+}
+
+// SetRetention retains the blob at path until the given time. The retention
+// can only be extended, ErrRetentionActive is returned if the blob is already
+// retained for longer.
+func (r *RetentionFilesystem) SetRetention(ctx context.Context, path string, until time.Time) error {
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	current, err := r.Retention(ctx, path)
+	if err != nil {
+		return err
+	}
+	if until.Before(current) {
+		return fmt.Errorf("%v: retained until %v: %w", path, current.Format(time.RFC3339), ErrRetentionActive)
+	}
+	return r.setRetention(ctx, path, until)
+}
+
+// setRetention stores the retention of the blob at path. The caller must
+// hold r.meta.mu.
+func (r *RetentionFilesystem) setRetention(ctx context.Context, path string, until time.Time) error {
+	meta, err := r.meta.GetBlobMeta(ctx, path)
+	if err != nil {
+		return err
+	}
+	meta[RetainUntilKey] = until.UTC().Format(time.RFC3339)
+	return r.meta.writeMeta(ctx, path, meta)
+}
+
+// checkRetention returns ErrRetentionActive if the blob at path is retained.
+// Missing blobs are not retained.
+func (r *RetentionFilesystem) checkRetention(ctx context.Context, path string) error {
+	if isLock(path) {
+		return nil
+	}
+	until, err := r.Retention(ctx, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.now().Before(until) {
+		return fmt.Errorf("%v: retained until %v: %w", path, until.Format(time.RFC3339), ErrRetentionActive)
+	}
+	return nil
+}
+
+// SaveBlob saves the blob and retains it for the default retention.
+func (r *RetentionFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	n, err := r.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	if err != nil || r.retention <= 0 || isLock(path) {
+		return n, err
+	}
+
+	r.meta.mu.Lock()
+	defer r.meta.mu.Unlock()
+	until := r.now().Add(r.retention)
+	current, err := r.Retention(ctx, path)
+	if err != nil || !until.After(current) {
+		return n, err
+	}
+	return n, r.setRetention(ctx, path, until)
+}
+
+// DeleteBlob returns ErrRetentionActive if the blob is retained, otherwise it
+// is removed.
+func (r *RetentionFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	if err := r.checkRetention(ctx, path); err != nil {
+		return 0, err
+	}
+	return r.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs which are not retained. For the others, the
+// returned *BatchError contains ErrRetentionActive.
+func (r *RetentionFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	errs := make([]error, len(paths))
+	var allowed []string
+	var indexes []int
+	for i, path := range paths {
+		if err := r.checkRetention(ctx, path); err != nil {
+			errs[i] = err
+			continue
+		}
+		allowed = append(allowed, path)
+		indexes = append(indexes, i)
+	}
+
+	sizes := make([]int64, len(paths))
+	if len(allowed) > 0 {
+		allowedSizes, err := r.Filesystem.DeleteBlobs(ctx, allowed, needSize)
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			return nil, err
+		}
+		for j, i := range indexes {
+			if j < len(allowedSizes) {
+				sizes[i] = allowedSizes[j]
+			}
+			if batchErr != nil {
+				errs[i] = batchErr.Errors[j]
+			}
+		}
+	}
+	return sizes, NewBatchError(errs)
+}
@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionFilesystem(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewRetentionFilesystem(NewMetadataFilesystem(&DiskFilesystem{}), 24*time.Hour)
+	f.Now = func() time.Time { return now }
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	lock := filepath.Join(repo, "locks", testID)
+	for _, path := range []string{blob, lock} {
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if until, err := f.Retention(ctx, blob); err != nil || !until.Equal(now.Add(24*time.Hour)) {
+		t.Fatalf("Retention: want %v, got %v, %v", now.Add(24*time.Hour), until, err)
+	}
+
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, ErrRetentionActive) {
+		t.Fatalf("DeleteBlob: want ErrRetentionActive, got %v", err)
+	}
+	// restic must be able to remove its locks
+	if _, err := f.DeleteBlob(ctx, lock, false); err != nil {
+		t.Fatalf("DeleteBlob: lock not removed: %v", err)
+	}
+
+	// the retention can only be extended
+	if err := f.SetRetention(ctx, blob, now); !errors.Is(err, ErrRetentionActive) {
+		t.Fatalf("SetRetention: want ErrRetentionActive for shortening, got %v", err)
+	}
+	extended := now.Add(48 * time.Hour)
+	if err := f.SetRetention(ctx, blob, extended); err != nil {
+		t.Fatal(err)
+	}
+	// an upload of the same blob does not shorten it either
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if until, err := f.Retention(ctx, blob); err != nil || !until.Equal(extended) {
+		t.Fatalf("Retention: want %v, got %v, %v", extended, until, err)
+	}
+
+	now = now.Add(47 * time.Hour)
+	_, err := f.DeleteBlobs(ctx, []string{blob}, false)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !errors.Is(batchErr.Errors[0], ErrRetentionActive) {
+		t.Fatalf("DeleteBlobs: want ErrRetentionActive, got %v", err)
+	}
+
+	// expired retention allows the deletion
+	now = now.Add(time.Hour)
+	if sizes, err := f.DeleteBlobs(ctx, []string{blob}, true); err != nil || sizes[0] != 6 {
+		t.Fatalf("DeleteBlobs: want size 6, got %v, %v", sizes, err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("blob not removed: %v", err)
+	}
+}
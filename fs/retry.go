@@ -0,0 +1,228 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// permanentErrors are the errors which IsTransient never considers transient,
+// retrying would fail the same way again.
+var permanentErrors = []error{
+	context.Canceled,
+	context.DeadlineExceeded,
+	os.ErrPermission,
+	ErrNotFound,
+	ErrExists,
+	ErrNoSpace,
+	ErrInvalidName,
+	ErrRepoExists,
+	ErrNotRepo,
+	ErrShortWrite,
+	ErrLongWrite,
+	ErrBlobTooLarge,
+	ErrAppendOnly,
+	ErrReadOnly,
+	ErrMaintenance,
+	ErrBusy,
+	ErrQuotaExceeded,
+	ErrRetentionActive,
+	ErrHashMismatch,
+	ErrCorrupt,
+	ErrConfigCorrupt,
+	ErrConfigEncrypted,
+	ErrDecryption,
+	ErrPartialListing,
+	ErrTooManyEntries,
+	ErrUnexpectedEntry,
+	ErrLastKey,
+	ErrIncompleteUpload,
+	ErrSealed,
+}
+
+// IsTransient is the default predicate of RetryFilesystem. It reports all
+// errors as transient except for the sentinel errors of this package, missing
+// permissions and canceled contexts.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, permanent := range permanentErrors {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// RetryFilesystem wraps a Filesystem and retries operations which failed with
+// a transient error, e.g. an internal error of an S3 server or a broken SFTP
+// connection. The delay between two attempts starts with Backoff and is
+// doubled after each attempt up to MaxBackoff. If all attempts fail, the
+// error of the last one is returned.
+//
+// Only idempotent operations are retried: CheckBlob, GetBlob, DeleteBlob,
+// ListBlobs, and ListBlobsFunc as long as fn has not been called yet. SaveBlob
+// is retried if rd is an io.Seeker, which is rewound to where the first
+// attempt started, or if nothing has been read from rd yet. A DeleteBlob
+// retried after a failed attempt which nevertheless removed the blob returns
+// ErrNotFound.
+type RetryFilesystem struct {
+	Filesystem
+	attempts int
+
+	// Retryable reports whether an operation which failed with err is
+	// retried, IsTransient if unset.
+	Retryable func(err error) bool
+	// Backoff is the delay before the first retry, 100ms if unset.
+	Backoff time.Duration
+	// MaxBackoff is the longest delay between two attempts, 10s if unset.
+	MaxBackoff time.Duration
+}
+
+// NewRetryFilesystem returns a RetryFilesystem for base which tries each
+// operation up to attempts times.
+func NewRetryFilesystem(base Filesystem, attempts int) *RetryFilesystem {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &RetryFilesystem{Filesystem: base, attempts: attempts}
+}
+
+// retry calls fn until it succeeds, it returns an error which is not
+// retryable, the attempts are used up or ctx is canceled. If canRetry is not
+// nil, fn is only called again if it returns true.
+func (r *RetryFilesystem) retry(ctx context.Context, fn func() error, canRetry func() bool) error {
+	retryable := r.Retryable
+	if retryable == nil {
+		retryable = IsTransient
+	}
+	backoff := r.Backoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxBackoff := r.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.attempts || !retryable(err) {
+			return err
+		}
+		if canRetry != nil && !canRetry() {
+			return err
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// CheckBlob returns the blob, retrying transient errors.
+func (r *RetryFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	var blob Blob
+	err := r.retry(ctx, func() error {
+		var err error
+		blob, err = r.Filesystem.CheckBlob(ctx, path)
+		return err
+	}, nil)
+	return blob, err
+}
+
+// GetBlob opens the blob, retrying transient errors. Errors while reading
+// from the returned reader are not retried.
+func (r *RetryFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	var rd io.ReadSeekCloser
+	err := r.retry(ctx, func() error {
+		var err error
+		rd, err = r.Filesystem.GetBlob(ctx, path)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// DeleteBlob removes the blob, retrying transient errors.
+func (r *RetryFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	err := r.retry(ctx, func() error {
+		var err error
+		size, err = r.Filesystem.DeleteBlob(ctx, path, needSize)
+		return err
+	}, nil)
+	return size, err
+}
+
+// ListBlobs lists the blobs, retrying transient errors.
+func (r *RetryFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	var blobs []Blob
+	err := r.retry(ctx, func() error {
+		var err error
+		blobs, err = r.Filesystem.ListBlobs(ctx, path)
+		return err
+	}, nil)
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for the blobs. The listing is only retried as long
+// as fn has not been called, so that no blob is passed to fn twice.
+func (r *RetryFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	called := false
+	return r.retry(ctx, func() error {
+		return r.Filesystem.ListBlobsFunc(ctx, path, func(b Blob) error {
+			called = true
+			return fn(b)
+		})
+	}, func() bool { return !called })
+}
+
+// SaveBlob saves the blob, retrying transient errors as long as the data can
+// be read again.
+func (r *RetryFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	seeker, _ := rd.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			// e.g. a pipe, which cannot be rewound
+			seeker = nil
+		}
+	}
+
+	// count the data read from readers which cannot be rewound, other
+	// readers are passed on unchanged to keep the fast paths for files
+	var cr *countingReader
+	if seeker == nil {
+		cr = &countingReader{rd: rd}
+		rd = cr
+	}
+	var n int64
+	err := r.retry(ctx, func() error {
+		var err error
+		n, err = r.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+		return err
+	}, func() bool {
+		if seeker == nil {
+			return cr.n == 0
+		}
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err == nil
+	})
+	return n, err
+}
@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var errTransient = errors.New("transient error")
+
+// flakyFilesystem fails the next failures operations with errTransient. If
+// readFirst is set, SaveBlob reads the data before failing.
+type flakyFilesystem struct {
+	Filesystem
+	failures  int
+	readFirst bool
+	calls     int
+}
+
+func (f *flakyFilesystem) fail() error {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return errTransient
+	}
+	return nil
+}
+
+func (f *flakyFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	if err := f.fail(); err != nil {
+		return Blob{}, err
+	}
+	return f.Filesystem.CheckBlob(ctx, path)
+}
+
+func (f *flakyFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	err := f.Filesystem.ListBlobsFunc(ctx, path, fn)
+	if err != nil {
+		return err
+	}
+	return f.fail()
+}
+
+func (f *flakyFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	if f.failures > 0 && f.readFirst {
+		n, _ := io.Copy(io.Discard, rd)
+		return n, f.fail()
+	}
+	if err := f.fail(); err != nil {
+		return 0, err
+	}
+	return f.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+func TestRetryFilesystem(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := mem.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky := &flakyFilesystem{Filesystem: mem}
+	f := NewRetryFilesystem(flaky, 3)
+	f.Backoff = time.Millisecond
+
+	flaky.failures = 2
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: want success after two failures, got %v, %v", b, err)
+	}
+	flaky.failures, flaky.calls = 3, 0
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, errTransient) || flaky.calls != 3 {
+		t.Fatalf("CheckBlob: want the last error after 3 attempts, got %v after %d", err, flaky.calls)
+	}
+	flaky.failures, flaky.calls = 0, 0
+	if _, err := f.CheckBlob(ctx, filepath.Join(repo, "keys", "missing")); !errors.Is(err, ErrNotFound) || flaky.calls != 1 {
+		t.Fatalf("CheckBlob: missing blobs must not be retried, got %v after %d attempts", err, flaky.calls)
+	}
+
+	// the predicate is injectable
+	f.Retryable = func(err error) bool { return false }
+	flaky.failures, flaky.calls = 1, 0
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, errTransient) || flaky.calls != 1 {
+		t.Fatalf("CheckBlob: want no retry, got %v after %d attempts", err, flaky.calls)
+	}
+	f.Retryable = nil
+
+	// the listing is not retried once blobs have been passed to fn
+	flaky.failures, flaky.calls = 1, 0
+	err := f.ListBlobsFunc(ctx, filepath.Join(repo, "data"), func(Blob) error { return nil })
+	if !errors.Is(err, errTransient) || flaky.calls != 1 {
+		t.Fatalf("ListBlobsFunc: want no retry, got %v after %d attempts", err, flaky.calls)
+	}
+}
+
+func TestRetryFilesystemSaveBlob(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryFilesystem()
+	blob := filepath.Join(filepath.FromSlash("/repo"), "data", testID[:2], testID)
+	flaky := &flakyFilesystem{Filesystem: mem, readFirst: true}
+	f := NewRetryFilesystem(flaky, 3)
+	f.Backoff = time.Millisecond
+
+	// seekable readers are rewound
+	flaky.failures = 2
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil || n != 6 {
+		t.Fatalf("SaveBlob: want 6 bytes written, got %v, %v", n, err)
+	}
+	if buf, err := mem.read(blob); err != nil || string(buf) != "foobar" {
+		t.Fatalf("want %q saved, got %q, %v", "foobar", buf, err)
+	}
+
+	// other readers are only retried if nothing has been read
+	flaky.failures, flaky.calls = 1, 0
+	rd := iotest.OneByteReader(strings.NewReader("foobar"))
+	if _, err := f.SaveBlob(ctx, blob, rd, 6); !errors.Is(err, errTransient) || flaky.calls != 1 {
+		t.Fatalf("SaveBlob: want no retry, got %v after %d attempts", err, flaky.calls)
+	}
+	flaky.readFirst = false
+	flaky.failures, flaky.calls = 1, 0
+	rd = iotest.OneByteReader(strings.NewReader("foobar"))
+	if n, err := f.SaveBlob(ctx, blob, rd, 6); err != nil || n != 6 || flaky.calls != 2 {
+		t.Fatalf("SaveBlob: want success after a retry, got %v, %v after %d attempts", n, err, flaky.calls)
+	}
+}
+
+func TestRetryFilesystemCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	flaky := &flakyFilesystem{Filesystem: NewMemoryFilesystem(), failures: 10}
+	f := NewRetryFilesystem(flaky, 10)
+	f.Backoff = time.Hour
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := f.CheckBlob(ctx, "blob"); !errors.Is(err, errTransient) || flaky.calls != 1 {
+		t.Fatalf("want the error of the first attempt, got %v after %d attempts", err, flaky.calls)
+	}
+}
@@ -0,0 +1,228 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// RoutingFilesystem stores each object type of the repositories on its own
+// backend, e.g. the small and frequently read index, snapshots, keys and
+// locks on a local SSD and the large data blobs on S3. All backends use the
+// same paths. The config and the object types without a route are stored on
+// the default backend it embeds.
+//
+// Unlike ShardedFilesystem, the blobs of an object type are never spread
+// across several backends, so listings and lookups only ever access a single
+// backend.
+type RoutingFilesystem struct {
+	Filesystem
+	routes map[string]Filesystem
+}
+
+var _ Filesystem = &RoutingFilesystem{}
+
+// NewRoutingFilesystem returns a RoutingFilesystem which stores the object
+// types in routes on their backends and everything else on def.
+func NewRoutingFilesystem(def Filesystem, routes map[string]Filesystem) *RoutingFilesystem {
+	r := &RoutingFilesystem{Filesystem: def, routes: make(map[string]Filesystem, len(routes))}
+	for t, f := range routes {
+		r.routes[t] = f
+	}
+	return r
+}
+
+// route returns the backend storing the blobs of objectType.
+func (r *RoutingFilesystem) route(objectType string) Filesystem {
+	if f, ok := r.routes[objectType]; ok {
+		return f
+	}
+	return r.Filesystem
+}
+
+// blobRoute returns the backend storing the blob at path.
+func (r *RoutingFilesystem) blobRoute(path string) Filesystem {
+	_, objectType, _ := SplitBlobPath(path)
+	return r.route(objectType)
+}
+
+// backends returns the default backend followed by the other backends in
+// the order of their object types, each backend only once.
+func (r *RoutingFilesystem) backends() []Filesystem {
+	types := make([]string, 0, len(r.routes))
+	for t := range r.routes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	backends := []Filesystem{r.Filesystem}
+	for _, t := range types {
+		f := r.routes[t]
+		dup := false
+		for _, b := range backends {
+			if b == f {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			backends = append(backends, f)
+		}
+	}
+	return backends
+}
+
+// CreateRepo creates the repository on the default backend, which stores
+// the config, and then on the other backends.
+func (r *RoutingFilesystem) CreateRepo(ctx context.Context, path string) error {
+	backends := r.backends()
+	if err := backends[0].CreateRepo(ctx, path); err != nil {
+		return err
+	}
+	for _, f := range backends[1:] {
+		if err := f.CreateRepo(ctx, path); err != nil && !errors.Is(err, ErrRepoExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBlobs lists the blobs on the backend of the object type.
+func (r *RoutingFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	return r.route(filepath.Base(path)).ListBlobs(ctx, path)
+}
+
+// ListBlobsFunc lists the blobs on the backend of the object type.
+func (r *RoutingFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	return r.route(filepath.Base(path)).ListBlobsFunc(ctx, path, fn)
+}
+
+// CheckBlob returns the blob from the backend of its object type.
+func (r *RoutingFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	return r.blobRoute(path).CheckBlob(ctx, path)
+}
+
+// GetBlob returns a reader for the blob from the backend of its object type.
+func (r *RoutingFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	return r.blobRoute(path).GetBlob(ctx, path)
+}
+
+// SaveBlob saves the blob on the backend of its object type.
+func (r *RoutingFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	return r.blobRoute(path).SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob from the backend of its object type.
+func (r *RoutingFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	return r.blobRoute(path).DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs, each backend removes the blobs it stores in
+// a single batch.
+func (r *RoutingFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for _, f := range r.backends() {
+		var fpaths []string
+		var indexes []int
+		for j, path := range paths {
+			if r.blobRoute(path) == f {
+				fpaths = append(fpaths, path)
+				indexes = append(indexes, j)
+			}
+		}
+		if len(fpaths) == 0 {
+			continue
+		}
+		n, err := f.DeleteBlobs(ctx, fpaths, needSize)
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			return sizes, err
+		}
+		for k, j := range indexes {
+			if batchErr != nil && batchErr.Errors[k] != nil {
+				errs[j] = batchErr.Errors[k]
+			} else if k < len(n) {
+				sizes[j] = n[k]
+			}
+		}
+	}
+	return sizes, NewBatchError(errs)
+}
+
+// RepoStats adds up the statistics of each object type as reported by its
+// backend.
+func (r *RoutingFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	var stats RepoStats
+	for _, f := range r.backends() {
+		st, err := f.RepoStats(ctx, path)
+		if err != nil {
+			return RepoStats{}, err
+		}
+		for t, o := range st.Types {
+			if r.route(t) == f {
+				stats.add(t, o)
+			}
+		}
+	}
+	return stats, nil
+}
+
+// Walk calls fn for the blobs of each object type stored on its backend.
+// Blobs found on the backend of another object type are skipped.
+func (r *RoutingFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	var errs []error
+	for _, f := range r.backends() {
+		f := f
+		err := f.Walk(ctx, path, func(objectType string, blob Blob) error {
+			if r.route(objectType) != f {
+				return nil
+			}
+			return fn(objectType, blob)
+		})
+		var walkErr *WalkError
+		switch {
+		case errors.As(err, &walkErr):
+			errs = append(errs, walkErr.Errors...)
+		case err != nil:
+			return err
+		}
+	}
+	return newWalkError(errs)
+}
+
+// HealthCheck checks all backends.
+func (r *RoutingFilesystem) HealthCheck(ctx context.Context, path string) error {
+	for i, f := range r.backends() {
+		if err := f.HealthCheck(ctx, path); err != nil {
+			return fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Sync syncs all backends, also if syncing one of them fails. The error of
+// the first backend which failed is returned.
+func (r *RoutingFilesystem) Sync(ctx context.Context) error {
+	var firstErr error
+	for i, f := range r.backends() {
+		if err := f.Sync(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
+
+// Close closes all backends, also if closing one of them fails. The error of
+// the first backend which failed is returned.
+func (r *RoutingFilesystem) Close() error {
+	var firstErr error
+	for i, f := range r.backends() {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("backend %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoutingFilesystem(t *testing.T) {
+	fast := NewMemoryFilesystem()
+	testFilesystem(t, NewRoutingFilesystem(NewMemoryFilesystem(), map[string]Filesystem{
+		"index": fast, "snapshots": fast, "keys": fast, "locks": fast,
+	}), filepath.FromSlash("/srv/restic"))
+}
+
+func TestRoutingFilesystemPlacement(t *testing.T) {
+	ctx := context.Background()
+	def, fast := NewMemoryFilesystem(), NewMemoryFilesystem()
+	f := NewRoutingFilesystem(def, map[string]Filesystem{"index": fast, "keys": fast})
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(repo, "data", testID[:2], testID)
+	index := filepath.Join(repo, "index", testID)
+	for _, path := range []string{data, index} {
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := fast.CheckBlob(ctx, index); err != nil {
+		t.Fatalf("index blob not on its backend: %v", err)
+	}
+	if _, err := def.CheckBlob(ctx, index); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("index blob on the default backend: %v", err)
+	}
+	if _, err := def.CheckBlob(ctx, data); err != nil {
+		t.Fatalf("data blob not on the default backend: %v", err)
+	}
+	if _, err := fast.GetConfig(ctx, filepath.Join(repo, "config")); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("config on the routed backend: %v", err)
+	}
+	// CreateRepo fails once the config exists, like for a single backend
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("CreateRepo: want ErrRepoExists, got %v", err)
+	}
+
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil || stats.Count != 2 || stats.Types["index"].Count != 1 || stats.Types["data"].Count != 1 {
+		t.Fatalf("RepoStats: got %+v, %v", stats, err)
+	}
+	walked := make(map[string]int)
+	if err := f.Walk(ctx, repo, func(objectType string, blob Blob) error {
+		walked[objectType]++
+		return nil
+	}); err != nil || len(walked) != 2 || walked["index"] != 1 || walked["data"] != 1 {
+		t.Fatalf("Walk: got %v, %v", walked, err)
+	}
+
+	sizes, err := f.DeleteBlobs(ctx, []string{index, data}, true)
+	if err != nil || len(sizes) != 2 || sizes[0] != 6 || sizes[1] != 6 {
+		t.Fatalf("DeleteBlobs: got %v, %v", sizes, err)
+	}
+	for _, path := range []string{data, index} {
+		if _, err := f.CheckBlob(ctx, path); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("%v: want ErrNotFound after DeleteBlobs, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+// Package s3 implements a fs.Filesystem which stores the repositories in an
+// S3 bucket, for example on AWS or on a MinIO server.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// Options configure the Filesystem.
+type Options struct {
+	// Bucket is the name of the bucket the objects are stored in.
+	Bucket string
+	// Prefix is prepended to all object keys, it may be empty.
+	Prefix string
+	// Root is the local path the repositories are served from, usually the
+	// path of the server. The paths passed to the Filesystem must be below
+	// Root, they are mapped to object keys relative to Root.
+	Root string
+
+	// Endpoint is the URL of the S3 server, leave empty to use AWS.
+	Endpoint string
+	// Region is the region of the bucket, defaults to $AWS_REGION.
+	Region string
+	// AccessKeyID and SecretAccessKey are the credentials used to access the
+	// bucket, they default to $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY.
+	AccessKeyID     string
+	SecretAccessKey string
+	// UsePathStyle selects path style addressing of the bucket, which is
+	// needed for most MinIO setups.
+	UsePathStyle bool
+
+	// PartSize is the size of the parts for multipart uploads, blobs smaller
+	// than PartSize are uploaded in a single request. Defaults to 5 MiB.
+	PartSize int64
+}
+
+// Filesystem stores repositories in an S3 bucket. S3 has no directories, so
+// creating a repository is a no-op and listing an empty or missing directory
+// returns no blobs instead of an error.
+//
+// The context of an operation is passed to each request of the SDK, its
+// deadline bounds the request including the retries of the SDK, and the
+// reader returned by GetBlob. Without a deadline the SDK applies no timeout
+// to a request, only to connecting and the TLS handshake, so a request to a
+// hanging server runs until the context is canceled.
+type Filesystem struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	presign  *s3.PresignClient // nil without credentials
+	bucket   string
+	prefix   string
+	root     string
+}
+
+var (
+	_ fs.Filesystem = &Filesystem{}
+	_ fs.Presigner  = &Filesystem{}
+)
+
+// New returns a Filesystem for the bucket configured in opt.
+func New(opt Options) (*Filesystem, error) {
+	if opt.Bucket == "" {
+		return nil, errors.New("no bucket specified")
+	}
+	if opt.Root == "" {
+		return nil, errors.New("no root path specified")
+	}
+
+	region := opt.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	keyID, secret, token := opt.AccessKeyID, opt.SecretAccessKey, ""
+	if keyID == "" && secret == "" {
+		keyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	s3opt := s3.Options{
+		Region:       region,
+		UsePathStyle: opt.UsePathStyle,
+	}
+	if keyID != "" || secret != "" {
+		s3opt.Credentials = credentials.NewStaticCredentialsProvider(keyID, secret, token)
+	}
+	if opt.Endpoint != "" {
+		s3opt.EndpointResolver = s3.EndpointResolverFromURL(opt.Endpoint)
+	}
+	client := s3.New(s3opt)
+
+	prefix := strings.Trim(opt.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	f := &Filesystem{
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if opt.PartSize > 0 {
+				u.PartSize = opt.PartSize
+			}
+		}),
+		bucket: opt.Bucket,
+		prefix: prefix,
+		root:   filepath.Clean(opt.Root),
+	}
+	if s3opt.Credentials != nil {
+		f.presign = s3.NewPresignClient(client)
+	}
+	return f, nil
+}
+
+// key returns the object key for path.
+func (f *Filesystem) key(path string) (string, error) {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is not below %v", path, f.root)
+	}
+	if rel == "." {
+		return strings.TrimSuffix(f.prefix, "/"), nil
+	}
+	return f.prefix + filepath.ToSlash(rel), nil
+}
+
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// pathError wraps err, errors for missing objects are translated to
+// os.ErrNotExist.
+func pathError(op, path string, err error) error {
+	if isNotFound(err) {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// CreateRepo only checks that the repository has no config yet, S3 has no
+// directories.
+func (f *Filesystem) CreateRepo(ctx context.Context, path string) error {
+	exists, _, err := f.CheckConfig(ctx, filepath.Join(path, "config"))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &os.PathError{Op: "create", Path: path, Err: fs.ErrRepoExists}
+	}
+	return nil
+}
+
+func (f *Filesystem) head(ctx context.Context, op, path string) (int64, error) {
+	blob, err := f.stat(ctx, op, path)
+	return blob.Size, err
+}
+
+// stat returns the blob stored in the object for path.
+func (f *Filesystem) stat(ctx context.Context, op, path string) (fs.Blob, error) {
+	key, err := f.key(path)
+	if err != nil {
+		return fs.Blob{}, err
+	}
+	out, err := f.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fs.Blob{}, pathError(op, path, err)
+	}
+	return fs.Blob{
+		Name:    filepath.Base(path),
+		Size:    out.ContentLength,
+		ModTime: aws.ToTime(out.LastModified),
+	}, nil
+}
+
+func (f *Filesystem) remove(ctx context.Context, path string) error {
+	key, err := f.key(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return pathError("delete", path, err)
+	}
+	return nil
+}
+
+// CheckConfig returns whether the config object exists and its size.
+func (f *Filesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	size, err := f.head(ctx, "stat", path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, size, nil
+}
+
+// GetConfig returns the contents of the config object.
+func (f *Filesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	rd, _, err := f.GetConfigReader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// GetConfigReader returns the body of the config object and its size.
+func (f *Filesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	key, err := f.key(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	out, err := f.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, pathError("open", path, err)
+	}
+	return out.Body, out.ContentLength, nil
+}
+
+// SaveConfig stores the config object, it fails if the object already
+// exists.
+func (f *Filesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	_, err := f.head(ctx, "open", path)
+	if err == nil {
+		return &os.PathError{Op: "create", Path: path, Err: fs.ErrConfigExists}
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	key, err := f.key(path)
+	if err != nil {
+		return err
+	}
+	// the config is small, read it completely so that the request can be
+	// signed
+	buf, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return err
+	}
+	_, err = f.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(buf),
+	})
+	if err != nil {
+		return pathError("write", path, err)
+	}
+	return nil
+}
+
+// DeleteConfig removes the config object. S3 does not report an error if
+// the object does not exist.
+func (f *Filesystem) DeleteConfig(ctx context.Context, path string) error {
+	return f.remove(ctx, path)
+}
+
+// ListBlobs lists all blobs below path.
+func (f *Filesystem) ListBlobs(ctx context.Context, path string) ([]fs.Blob, error) {
+	var blobs []fs.Blob
+	err := f.ListBlobsFunc(ctx, path, func(blob fs.Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for all blobs below path. For hashed object types
+// all intermediate subdirs are listed at once, objects which are not in one
+// of these are ignored.
+func (f *Filesystem) ListBlobsFunc(ctx context.Context, path string, fn func(fs.Blob) error) error {
+	key, err := f.key(path)
+	if err != nil {
+		return err
+	}
+	prefix := key + "/"
+	hashed := fs.IsHashed(filepath.Base(path))
+
+	in := &s3.ListObjectsV2Input{
+		Bucket: aws.String(f.bucket),
+		Prefix: aws.String(prefix),
+	}
+	if !hashed {
+		in.Delimiter = aws.String("/")
+	}
+
+	pages := s3.NewListObjectsV2Paginator(f.client, in)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return pathError("readdir", path, err)
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if hashed {
+				i := strings.IndexByte(name, '/')
+				if i < 0 {
+					continue
+				}
+				name = name[i+1:]
+			}
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			if err := fn(fs.Blob{Name: name, Size: obj.Size, ModTime: aws.ToTime(obj.LastModified)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckBlob returns the blob stored in the object.
+func (f *Filesystem) CheckBlob(ctx context.Context, path string) (fs.Blob, error) {
+	return f.stat(ctx, "stat", path)
+}
+
+// GetBlob returns a reader for the blob object. Seeking the reader is cheap,
+// the data is only requested on the next call to Read.
+func (f *Filesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	size, err := f.head(ctx, "open", path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := f.key(path)
+	if err != nil {
+		return nil, err
+	}
+	return &objectReader{ctx: ctx, f: f, path: path, key: key, size: size}, nil
+}
+
+// PresignGet returns a presigned URL for the blob object, which is valid for
+// ttl. No URL is returned if the bucket is accessed without credentials.
+func (f *Filesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	if f.presign == nil {
+		return "", false, nil
+	}
+	key, err := f.key(path)
+	if err != nil {
+		return "", false, err
+	}
+	req, err := f.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		return "", false, pathError("presign", path, err)
+	}
+	return req.URL, true, nil
+}
+
+// SaveBlob uploads the blob, using a multipart upload for large blobs.
+func (f *Filesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	key, err := f.key(path)
+	if err != nil {
+		return 0, err
+	}
+	// a failed read aborts the upload, so that a truncated blob is not stored
+	cr := &countingReader{rd: fs.NewSizeCheckReader(path, rd, expectedSize)}
+	_, err = f.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+		Body:   cr,
+	})
+	if err != nil {
+		return cr.n, pathError("write", path, err)
+	}
+	return cr.n, nil
+}
+
+// DeleteBlob removes the blob object. If needSize is not set, S3 does not
+// report an error if the object does not exist.
+func (f *Filesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	if needSize {
+		var err error
+		size, err = f.head(ctx, "remove", path)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, f.remove(ctx, path)
+}
+
+// maxDeleteObjects is the maximum number of objects which can be removed
+// with a single DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// DeleteBlobs removes the blobs using DeleteObjects requests. If needSize is
+// set, the size of each blob is requested first.
+func (f *Filesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+
+	indexes := make(map[string]int, len(paths))
+	var objects []types.ObjectIdentifier
+	for i, path := range paths {
+		key, err := f.key(path)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if needSize {
+			size, err := f.head(ctx, "remove", path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			sizes[i] = size
+		}
+		indexes[key] = i
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+	}
+
+	for len(objects) > 0 {
+		batch := objects
+		if len(batch) > maxDeleteObjects {
+			batch = batch[:maxDeleteObjects]
+		}
+		objects = objects[len(batch):]
+
+		out, err := f.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(f.bucket),
+			Delete: &types.Delete{Objects: batch, Quiet: true},
+		})
+		if err != nil {
+			for _, obj := range batch {
+				i := indexes[aws.ToString(obj.Key)]
+				errs[i] = pathError("remove", paths[i], err)
+				sizes[i] = 0
+			}
+			continue
+		}
+		for _, e := range out.Errors {
+			i, ok := indexes[aws.ToString(e.Key)]
+			if !ok {
+				continue
+			}
+			errs[i] = &os.PathError{
+				Op:   "remove",
+				Path: paths[i],
+				Err:  fmt.Errorf("%v: %v", aws.ToString(e.Code), aws.ToString(e.Message)),
+			}
+			sizes[i] = 0
+		}
+	}
+	return sizes, fs.NewBatchError(errs)
+}
+
+// RepoStats returns the statistics of the repository by listing the blobs of
+// all object types.
+func (f *Filesystem) RepoStats(ctx context.Context, path string) (fs.RepoStats, error) {
+	var stats fs.RepoStats
+	stats.Types = make(map[string]fs.ObjectStats, len(fs.ObjectTypes))
+	for _, t := range fs.ObjectTypes {
+		var o fs.ObjectStats
+		err := f.ListBlobsFunc(ctx, filepath.Join(path, t), func(blob fs.Blob) error {
+			o.Size += blob.Size
+			o.Count++
+			return nil
+		})
+		if err != nil {
+			return fs.RepoStats{}, err
+		}
+		stats.Types[t] = o
+		stats.Size += o.Size
+		stats.Count += o.Count
+	}
+	return stats, nil
+}
+
+// Walk calls fn for the blobs of all object types by listing them.
+func (f *Filesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob fs.Blob) error) error {
+	return fs.WalkTypes(ctx, f, path, fn)
+}
+
+// HealthCheck writes and removes a small object below path.
+func (f *Filesystem) HealthCheck(ctx context.Context, path string) error {
+	path = filepath.Join(path, fs.HealthDir, "check")
+	key, err := f.key(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("ok\n"),
+	})
+	if err != nil {
+		return pathError("write", path, err)
+	}
+	return f.remove(ctx, path)
+}
+
+// Sync does nothing, an object is stored durably once its upload has
+// returned.
+func (f *Filesystem) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close does nothing, the client has no resources which need to be released.
+func (f *Filesystem) Close() error {
+	return nil
+}
+
+// objectReader reads an object, starting a new ranged request after each
+// seek.
+type objectReader struct {
+	ctx  context.Context
+	f    *Filesystem
+	path string
+	key  string
+
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		in := &s3.GetObjectInput{
+			Bucket: aws.String(r.f.bucket),
+			Key:    aws.String(r.key),
+		}
+		if r.offset > 0 {
+			in.Range = aws.String(fmt.Sprintf("bytes=%d-", r.offset))
+		}
+		out, err := r.f.client.GetObject(r.ctx, in)
+		if err != nil {
+			return 0, pathError("read", r.path, err)
+		}
+		r.body = out.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != r.offset {
+		if err := r.Close(); err != nil {
+			return 0, err
+		}
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// countingReader counts the bytes read from rd.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,274 @@
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// fakeS3 implements the small subset of the S3 API used by Filesystem, with
+// path style addressing and without authentication.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type listResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the first path component is the bucket
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		delim := r.URL.Query().Get("delimiter")
+		var res listResult
+		var keys []string
+		for k := range s.objects {
+			if strings.HasPrefix(k, prefix) && (delim == "" || !strings.Contains(k[len(prefix):], delim)) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			res.Contents = append(res.Contents, struct {
+				Key  string
+				Size int64
+			}{k, int64(len(s.objects[k]))})
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(res)
+
+	case r.Method == http.MethodPost && r.URL.Query().Has("delete"):
+		var req struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, obj := range req.Object {
+			delete(s.objects, obj.Key)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+
+	case r.Method == http.MethodPut:
+		buf, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = buf
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		buf, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				_, _ = fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(buf)-1, len(buf)))
+			buf = buf[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(buf)
+		}
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestFilesystem(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	root := filepath.FromSlash("/srv/restic")
+	f, err := New(Options{
+		Bucket:          "bucket",
+		Prefix:          "/backups/",
+		Root:            root,
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		UsePathStyle:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := f.HealthCheck(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("HealthCheck must remove its object, got %v", fake.objects)
+	}
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.CreateRepo(ctx, filepath.FromSlash("/elsewhere")); err == nil {
+		t.Fatal("paths outside of the root must be rejected")
+	}
+
+	cfg := filepath.Join(repo, "config")
+	if exists, _, err := f.CheckConfig(ctx, cfg); err != nil || exists {
+		t.Fatalf("CheckConfig: want missing config, got %v, %v", exists, err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("SaveConfig: want ErrExist, got %v", err)
+	}
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, fs.ErrRepoExists) {
+		t.Fatalf("CreateRepo: want ErrRepoExists, got %v", err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if rd, size, err := f.GetConfigReader(ctx, cfg); err != nil || size != 6 {
+		t.Fatalf("GetConfigReader: got size %v, %v", size, err)
+	} else if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfigReader: got %q, %v", buf, err)
+	} else {
+		_ = rd.Close()
+	}
+	if _, ok := fake.objects["backups/repo/config"]; !ok {
+		t.Fatalf("config stored under the wrong key, objects: %v", fake.objects)
+	}
+
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("blob data"), -1); err != nil || n != 9 {
+		t.Fatalf("SaveBlob: got %v, %v", n, err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", "key"), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated upload must not be stored
+	short := filepath.Join(repo, "snapshots", id)
+	if _, err := f.SaveBlob(ctx, short, strings.NewReader("short"), 10); !errors.Is(err, fs.ErrShortWrite) {
+		t.Fatalf("SaveBlob: want ErrShortWrite, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, short); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want ErrNotExist for a truncated upload, got %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 9 {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+
+	for _, tpe := range []string{"data", "keys"} {
+		blobs, err := f.ListBlobs(ctx, filepath.Join(repo, tpe))
+		if err != nil || len(blobs) != 1 {
+			t.Fatalf("ListBlobs %v: got %v, %v", tpe, blobs, err)
+		}
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "data" {
+		t.Fatalf("reading after seek: got %q, %v", buf, err)
+	}
+	if size, err := rd.Seek(0, io.SeekEnd); err != nil || size != 9 {
+		t.Fatalf("Seek: got %v, %v", size, err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, ok, err := f.PresignGet(ctx, blob, time.Minute)
+	if err != nil || !ok {
+		t.Fatalf("PresignGet: got %v, %v", ok, err)
+	}
+	if !strings.Contains(u, "X-Amz-Signature=") || !strings.Contains(u, "X-Amz-Expires=60") {
+		t.Fatalf("PresignGet: want a signed URL valid for a minute, got %v", u)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || string(buf) != "blob data" {
+		t.Fatalf("GET of the presigned URL: got %q, %v", buf, err)
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 9 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want ErrNotExist after delete, got %v", err)
+	}
+	if _, err := f.GetBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetBlob: want ErrNotExist after delete, got %v", err)
+	}
+
+	var paths []string
+	for _, name := range []string{"a", "b"} {
+		path := filepath.Join(repo, "locks", name)
+		if _, err := f.SaveBlob(ctx, path, strings.NewReader(name), 1); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, filepath.Join(repo, "locks", "missing"))
+	sizes, err := f.DeleteBlobs(ctx, paths, true)
+	if err != nil || len(sizes) != 3 || sizes[0] != 1 || sizes[1] != 1 || sizes[2] != 0 {
+		t.Fatalf("DeleteBlobs: got %v, %v", sizes, err)
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "locks")); err != nil || len(blobs) != 0 {
+		t.Fatalf("locks must have been removed, got %v, %v", blobs, err)
+	}
+}
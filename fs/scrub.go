@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// QuarantineDir is the directory in a repository corrupt blobs are moved to
+// by Scrub. Like TrashDir it is not one of the ObjectTypes, so quarantined
+// blobs are no longer listed and restic treats them as missing, e.g. so that
+// they are uploaded again from another copy of the repository.
+const QuarantineDir = "quarantine"
+
+// ScrubOptions configure Scrub.
+type ScrubOptions struct {
+	// BytesPerSecond limits the rate the blobs are read at, so that
+	// scrubbing does not slow down backups and restores. Zero means no
+	// limit.
+	BytesPerSecond int64
+	// After resumes an interrupted scrub, only the data blobs whose names
+	// sort after it are verified. It is usually the Last blob of the
+	// previous ScrubReport.
+	After string
+}
+
+// ScrubReport is the result of Scrub.
+type ScrubReport struct {
+	// Verified is the number of blobs which match their hash.
+	Verified int
+	// Corrupt lists the names of the blobs which did not match their hash.
+	Corrupt []string
+	// Quarantined is the number of corrupt blobs which have been moved to
+	// the QuarantineDir.
+	Quarantined int
+	// ConfigCorrupt is set if the config failed ValidateConfig. It is only
+	// checked at the start of a scrub, not when it is resumed.
+	ConfigCorrupt bool
+	// Last is the name of the last blob which has been checked, it
+	// resumes the scrub when passed as ScrubOptions.After.
+	Last string
+}
+
+// quarantinePath returns the path in the QuarantineDir for the blob at path.
+func quarantinePath(path string) (string, error) {
+	repo, _, _ := SplitBlobPath(path)
+	rel, err := filepath.Rel(repo, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(repo, QuarantineDir, rel), nil
+}
+
+// Scrub reads all data blobs of the repository at path in the order of their
+// names and verifies them with VerifyBlob. Corrupt blobs are moved to the
+// QuarantineDir of the repository and logged, instead of being left in place
+// where restic only notices the damage when it needs the data. A corrupt
+// config is logged and reported, but left in place.
+//
+// Scrub stops at the first error other than a corrupt blob, e.g. when ctx is
+// canceled. The report is returned also in that case, so that the scrub can
+// be resumed later on by passing its Last blob as ScrubOptions.After. Blobs
+// deleted during the scrub are skipped.
+func Scrub(ctx context.Context, f Filesystem, path string, opts ScrubOptions) (ScrubReport, error) {
+	var report ScrubReport
+	if opts.After == "" {
+		err := ValidateConfig(ctx, f, filepath.Join(path, "config"))
+		switch {
+		case errors.Is(err, ErrConfigCorrupt):
+			report.ConfigCorrupt = true
+			log.Printf("ERROR: %v", err)
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return report, err
+		}
+	}
+	dir := filepath.Join(path, "data")
+	blobs, err := f.ListBlobs(ctx, dir)
+	if err != nil {
+		return report, err
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+
+	var rd Filesystem = f
+	if opts.BytesPerSecond > 0 {
+		rd = NewThrottledFilesystem(f, opts.BytesPerSecond)
+	}
+	for _, blob := range blobs {
+		if blob.Name <= opts.After {
+			continue
+		}
+		p := blobPath(dir, blob.Name)
+		err := VerifyBlob(ctx, rd, p)
+		switch {
+		case err == nil:
+			report.Verified++
+		case errors.Is(err, ErrNotFound):
+			// deleted by a client in the meantime
+		case errors.Is(err, ErrCorrupt):
+			report.Corrupt = append(report.Corrupt, blob.Name)
+			log.Printf("ERROR: %v, moving it to the quarantine", err)
+			if err := quarantine(ctx, f, p); err != nil {
+				return report, err
+			}
+			report.Quarantined++
+		case errors.Is(err, ErrUnverifiable):
+			// not a pack file, e.g. a file left behind by another tool
+		default:
+			return report, err
+		}
+		report.Last = blob.Name
+	}
+	return report, nil
+}
+
+// quarantine moves the blob at path to the QuarantineDir.
+func quarantine(ctx context.Context, f Filesystem, path string) error {
+	dst, err := quarantinePath(path)
+	if err != nil {
+		return err
+	}
+	_, err = moveBlob(ctx, f, path, dst)
+	return err
+}
+
+// RunScrubber scrubs the repositories every interval, until ctx is canceled.
+// An interrupted scrub of a repository is resumed in the next round, so that
+// a slow scrub of a large repository makes progress even if it takes longer
+// than interval.
+func RunScrubber(ctx context.Context, f Filesystem, repos []string, interval time.Duration, opts ScrubOptions) {
+	resume := make(map[string]string, len(repos))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, repo := range repos {
+			o := opts
+			o.After = resume[repo]
+			report, err := Scrub(ctx, f, repo, o)
+			if err != nil {
+				if report.Last != "" {
+					resume[repo] = report.Last
+				}
+				if ctx.Err() == nil {
+					log.Printf("scrubbing %v failed: %v", repo, err)
+				}
+				continue
+			}
+			delete(resume, repo)
+			if len(report.Corrupt) > 0 {
+				log.Printf("scrubbing %v: %d blobs verified, %d corrupt, %d quarantined", repo, report.Verified, len(report.Corrupt), report.Quarantined)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	for _, f := range []Filesystem{NewMemoryFilesystem(), &DiskFilesystem{}} {
+		repo := filepath.FromSlash("/repo")
+		if _, ok := f.(*DiskFilesystem); ok {
+			repo = filepath.Join(t.TempDir(), "repo")
+		}
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(repo, "data")
+		save := func(name, data string) {
+			if _, err := f.SaveBlob(ctx, blobPath(dir, name), strings.NewReader(data), int64(len(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var good []string
+		for _, data := range []string{"foo", "bar"} {
+			sum := sha256.Sum256([]byte(data))
+			good = append(good, hex.EncodeToString(sum[:]))
+			save(good[len(good)-1], data)
+		}
+		// testID is not the hash of its data
+		save(testID, "corrupt")
+
+		report, err := Scrub(ctx, f, repo, ScrubOptions{BytesPerSecond: 1 << 20})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Verified != 2 || len(report.Corrupt) != 1 || report.Corrupt[0] != testID || report.Quarantined != 1 {
+			t.Fatalf("want 2 verified and testID quarantined, got %+v", report)
+		}
+
+		// the corrupt blob is no longer listed
+		blobs, err := f.ListBlobs(ctx, dir)
+		if err != nil || len(blobs) != 2 {
+			t.Fatalf("want the 2 good blobs listed, got %v, %v", blobs, err)
+		}
+		if _, err := f.CheckBlob(ctx, blobPath(dir, testID)); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("want the corrupt blob removed, got %v", err)
+		}
+		quarantined := filepath.Join(repo, QuarantineDir, "data", testID[:2], testID)
+		if b, err := f.CheckBlob(ctx, quarantined); err != nil || b.Size != 7 {
+			t.Fatalf("want the corrupt blob in the quarantine, got %v, %v", b, err)
+		}
+
+		// a resumed scrub only checks the blobs after the last one
+		first := good[0]
+		if good[1] < first {
+			first = good[1]
+		}
+		report, err = Scrub(ctx, f, repo, ScrubOptions{After: first})
+		if err != nil || report.Verified != 1 || len(report.Corrupt) != 0 {
+			t.Fatalf("want 1 blob verified after %v, got %+v, %v", first, report, err)
+		}
+
+		// a corrupt config is reported
+		if report.ConfigCorrupt {
+			t.Fatal("want no corrupt config reported without a config")
+		}
+		if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader(`{"version":2,"id":`)); err != nil {
+			t.Fatal(err)
+		}
+		report, err = Scrub(ctx, f, repo, ScrubOptions{})
+		if err != nil || !report.ConfigCorrupt || report.Verified != 2 {
+			t.Fatalf("want the corrupt config reported, got %+v, %v", report, err)
+		}
+
+		ctxCanceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := Scrub(ctxCanceled, f, repo, ScrubOptions{}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	}
+}
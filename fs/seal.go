@@ -0,0 +1,224 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrSealed is returned by SealFilesystem for all operations which would
+// modify a sealed repository, and by DiskFilesystem.DeleteRepo for sealed
+// repositories.
+var ErrSealed = newError("sealed", "repository is sealed")
+
+// SealMarker is the file in a repository which marks it as sealed, see
+// SealFilesystem. It is neither the config nor one of the ObjectTypes, so it
+// is never listed or served to clients. It contains the time the repository
+// was sealed.
+const SealMarker = ".sealed"
+
+// sealed reports whether the repository at path contains the SealMarker.
+func (d *DiskFilesystem) sealed(path string) (bool, error) {
+	_, err := os.Lstat(filepath.Join(path, SealMarker))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SealFilesystem wraps a DiskFilesystem and turns the repositories which
+// have been sealed into immutable archives. Unlike with
+// AppendOnlyFilesystem, no modification of a sealed repository is accepted,
+// not even new blobs or locks, so restic can only access it with --no-lock.
+// Reads are served as usual, so that the backups can still be restored and
+// verified.
+//
+// A repository is sealed by the SealMarker stored in it, which survives
+// restarts. Whether a repository is sealed is read once, when it is first
+// accessed, later changes of the marker by other tools are only noticed
+// after a restart. Seal and Unseal, meant for the operator, are logged and
+// reported to Audit.
+type SealFilesystem struct {
+	Filesystem
+	disk *DiskFilesystem
+
+	// Audit, if set, records the events seal and unseal with the path of
+	// the repository.
+	Audit AuditLogger
+
+	mu     sync.Mutex // serializes Seal and Unseal
+	states sync.Map   // repository path -> bool, whether it is sealed
+}
+
+// NewSealFilesystem returns a SealFilesystem for base. The markers are
+// stored in the repositories of base, so base must be the DiskFilesystem
+// itself and not another wrapper.
+func NewSealFilesystem(base *DiskFilesystem) *SealFilesystem {
+	return &SealFilesystem{Filesystem: base, disk: base}
+}
+
+// Sealed reports whether the repository at path is sealed.
+func (s *SealFilesystem) Sealed(ctx context.Context, path string) (bool, error) {
+	path = filepath.Clean(path)
+	if v, ok := s.states.Load(path); ok {
+		return v.(bool), nil
+	}
+	sealed, err := s.disk.sealed(path)
+	if err != nil {
+		return false, err
+	}
+	v, _ := s.states.LoadOrStore(path, sealed)
+	return v.(bool), nil
+}
+
+// check returns ErrSealed if the repository at path is sealed.
+func (s *SealFilesystem) check(ctx context.Context, path string) error {
+	sealed, err := s.Sealed(ctx, path)
+	if err != nil {
+		return err
+	}
+	if sealed {
+		return fmt.Errorf("%v: %w", path, ErrSealed)
+	}
+	return nil
+}
+
+// checkBlob returns ErrSealed if the repository of the blob at path is
+// sealed.
+func (s *SealFilesystem) checkBlob(ctx context.Context, path string) error {
+	repo, _, _ := SplitBlobPath(path)
+	return s.check(ctx, repo)
+}
+
+func (s *SealFilesystem) audit(ctx context.Context, op, path string, start time.Time, err error) {
+	if s.Audit != nil {
+		s.Audit.Log(ctx, AuditEvent{Op: op, Path: path, Duration: time.Since(start), Err: err})
+	}
+}
+
+// Seal seals the repository at path, afterwards all modifications of the
+// repository fail with ErrSealed. The marker is always saved with SyncFull.
+// Sealing a sealed repository does nothing.
+func (s *SealFilesystem) Seal(ctx context.Context, path string) error {
+	path = filepath.Clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	err := s.seal(ctx, path, start)
+	s.audit(ctx, "seal", path, start, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("repository %v sealed", path)
+	return nil
+}
+
+func (s *SealFilesystem) seal(ctx context.Context, path string, now time.Time) error {
+	if err := s.disk.checkRepo(path); err != nil {
+		return err
+	}
+	// later modifications are rejected, with LockRepos the requests in
+	// progress hold a shared lock and are waited for
+	s.states.Store(path, true)
+	unlock, err := s.disk.LockRepo(ctx, path, true)
+	if err != nil {
+		s.states.Delete(path)
+		return err
+	}
+	defer unlock()
+	marker := filepath.Join(path, SealMarker)
+	buf := []byte(now.UTC().Format(time.RFC3339) + "\n")
+	w := s.disk.writers.start(marker)
+	defer w.finish()
+	if _, err := s.disk.writeFile(ctx, marker, bytes.NewReader(buf), int64(len(buf)), 0, false, true, w); err != nil {
+		s.states.Delete(path)
+		return err
+	}
+	return nil
+}
+
+// Unseal lifts the seal of the repository at path, so that it can be
+// modified again. It requires the reason for which the operator lifts the
+// seal, which is logged. Unsealing a repository which is not sealed does
+// nothing.
+func (s *SealFilesystem) Unseal(ctx context.Context, path, reason string) error {
+	path = filepath.Clean(path)
+	if reason == "" {
+		return errors.New("unsealing a repository requires a reason")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
+	err := s.disk.fsys().Remove(filepath.Join(path, SealMarker))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = s.disk.syncDirMode(path, SyncFull)
+	}
+	s.audit(ctx, "unseal", path, start, err)
+	if err != nil {
+		return classify(err)
+	}
+	s.states.Store(path, false)
+	log.Printf("WARNING: repository %v unsealed: %v", path, reason)
+	return nil
+}
+
+// CreateRepo creates the repository unless it is sealed.
+func (s *SealFilesystem) CreateRepo(ctx context.Context, path string) error {
+	if err := s.check(ctx, path); err != nil {
+		return err
+	}
+	return s.Filesystem.CreateRepo(ctx, path)
+}
+
+// SaveConfig saves the config unless the repository is sealed.
+func (s *SealFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	if err := s.check(ctx, filepath.Dir(path)); err != nil {
+		return err
+	}
+	return s.Filesystem.SaveConfig(ctx, path, rd)
+}
+
+// DeleteConfig removes the config unless the repository is sealed.
+func (s *SealFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	if err := s.check(ctx, filepath.Dir(path)); err != nil {
+		return err
+	}
+	return s.Filesystem.DeleteConfig(ctx, path)
+}
+
+// SaveBlob saves the blob unless the repository is sealed.
+func (s *SealFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	if err := s.checkBlob(ctx, path); err != nil {
+		return 0, err
+	}
+	return s.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob unless the repository is sealed.
+func (s *SealFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	if err := s.checkBlob(ctx, path); err != nil {
+		return 0, err
+	}
+	return s.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs, none of them are removed if one of their
+// repositories is sealed.
+func (s *SealFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	for _, path := range paths {
+		if err := s.checkBlob(ctx, path); err != nil {
+			return nil, err
+		}
+	}
+	return s.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
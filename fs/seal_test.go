@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealFilesystem(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	disk := &DiskFilesystem{}
+	var events []string
+	f := NewSealFilesystem(disk)
+	f.Audit = AuditLoggerFunc(func(ctx context.Context, ev AuditEvent) {
+		events = append(events, ev.Op)
+	})
+
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(repo, "config")
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Seal(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(repo, "keys", testID)
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("key"), 3); !errors.Is(err, ErrSealed) {
+		t.Fatalf("SaveBlob: want ErrSealed, got %v", err)
+	}
+	if _, err := f.DeleteBlob(ctx, blob, false); !errors.Is(err, ErrSealed) {
+		t.Fatalf("DeleteBlob: want ErrSealed, got %v", err)
+	}
+	if err := f.DeleteConfig(ctx, cfg); !errors.Is(err, ErrSealed) {
+		t.Fatalf("DeleteConfig: want ErrSealed, got %v", err)
+	}
+	if err := disk.DeleteRepo(ctx, root, repo); !errors.Is(err, ErrSealed) {
+		t.Fatalf("DeleteRepo: want ErrSealed, got %v", err)
+	}
+	// reads are still served
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "keys")); err != nil || len(blobs) != 0 {
+		t.Fatalf("ListBlobs: want no keys, got %v, %v", blobs, err)
+	}
+
+	// the seal survives a restart
+	f = NewSealFilesystem(disk)
+	if sealed, err := f.Sealed(ctx, repo); err != nil || !sealed {
+		t.Fatalf("want the repository sealed after a restart, got %v, %v", sealed, err)
+	}
+	if err := f.Unseal(ctx, repo, ""); err == nil {
+		t.Fatal("want an error for unsealing without a reason")
+	}
+	f.Audit = AuditLoggerFunc(func(ctx context.Context, ev AuditEvent) {
+		events = append(events, ev.Op)
+	})
+	if err := f.Unseal(ctx, repo, "legal hold lifted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.SaveBlob(ctx, other, strings.NewReader("key"), 3); err != nil {
+		t.Fatalf("SaveBlob after Unseal: %v", err)
+	}
+	if strings.Join(events, ",") != "seal,unseal" {
+		t.Fatalf("want the audit events seal,unseal, got %v", events)
+	}
+}
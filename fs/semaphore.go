@@ -0,0 +1,164 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrBusy is returned by SemaphoreFilesystem if the limit of concurrent
+// transfers has been reached. The client should retry later.
+var ErrBusy = newError("busy", "too many concurrent transfers")
+
+// SemaphoreFilesystem wraps a Filesystem and limits the number of concurrent
+// blob transfers, uploads by SaveBlob and downloads by GetBlob until the
+// reader is closed. Each transfer holds a buffer and a file descriptor, so
+// the limit bounds memory and file descriptors under load. A transfer beyond
+// the limit fails immediately with ErrBusy instead of queueing.
+type SemaphoreFilesystem struct {
+	Filesystem
+
+	// MaxBytes additionally limits the sum of the sizes announced for the
+	// uploads in progress, zero means no limit. Uploads of unknown size
+	// are not counted. A single upload larger than MaxBytes is only
+	// accepted while no other upload is counted.
+	MaxBytes int64
+
+	max int
+
+	mu     sync.Mutex
+	active int
+	bytes  int64
+}
+
+// NewSemaphoreFilesystem returns a SemaphoreFilesystem for base which allows
+// at most max concurrent transfers, zero means no limit so that only
+// MaxBytes applies.
+func NewSemaphoreFilesystem(base Filesystem, max int) *SemaphoreFilesystem {
+	return &SemaphoreFilesystem{Filesystem: base, max: max}
+}
+
+// acquire reserves a transfer of size bytes, counted against MaxBytes unless
+// it is negative. The returned function releases the reservation.
+func (s *SemaphoreFilesystem) acquire(size int64) (func(), error) {
+	if size < 0 {
+		size = 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && s.active >= s.max {
+		return nil, ErrBusy
+	}
+	if s.MaxBytes > 0 && s.bytes > 0 && s.bytes+size > s.MaxBytes {
+		return nil, ErrBusy
+	}
+	s.active++
+	s.bytes += size
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.active--
+			s.bytes -= size
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+// Active returns the number of transfers in progress.
+func (s *SemaphoreFilesystem) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// SaveBlob saves the blob if the limits allow another upload.
+func (s *SemaphoreFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	release, err := s.acquire(expectedSize)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return s.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// GetBlob returns a reader for the blob if the limit allows another
+// download. The download counts until the reader is closed.
+func (s *SemaphoreFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	release, err := s.acquire(0)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := s.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReader{ReadSeekCloser: rd, release: release}, nil
+}
+
+var _ RepoLocker = &SemaphoreFilesystem{}
+
+// LockRepo locks the repository using the base, see LockRepo.
+func (s *SemaphoreFilesystem) LockRepo(ctx context.Context, path string, exclusive bool) (func(), error) {
+	return LockRepo(ctx, s.Filesystem, path, exclusive)
+}
+
+var _ BlobPrefixLister = &SemaphoreFilesystem{}
+
+// ListBlobsPrefix lists the blobs using the base, see ListBlobsPrefix.
+// Listings do not count as transfers.
+func (s *SemaphoreFilesystem) ListBlobsPrefix(ctx context.Context, path, prefix string) ([]Blob, error) {
+	return ListBlobsPrefix(ctx, s.Filesystem, path, prefix)
+}
+
+var _ BlobOpener = &SemaphoreFilesystem{}
+
+// OpenBlob opens the blob using the base, see OpenBlob, if the limit allows
+// another download. The download counts until the reader is closed.
+func (s *SemaphoreFilesystem) OpenBlob(ctx context.Context, path string) (BlobReaderAt, error) {
+	release, err := s.acquire(0)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := OpenBlob(ctx, s.Filesystem, path)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReaderAt{BlobReaderAt: rd, release: release}, nil
+}
+
+// releasingReaderAt calls release once it is closed.
+type releasingReaderAt struct {
+	BlobReaderAt
+	release func()
+}
+
+func (r *releasingReaderAt) Close() error {
+	err := r.BlobReaderAt.Close()
+	r.release()
+	return err
+}
+
+// releasingReader calls release once it is closed.
+type releasingReader struct {
+	io.ReadSeekCloser
+	release func()
+}
+
+func (r *releasingReader) Close() error {
+	err := r.ReadSeekCloser.Close()
+	r.release()
+	return err
+}
+
+var _ Presigner = &SemaphoreFilesystem{}
+
+// PresignGet returns a URL for the blob using the base, see PresignGet. The
+// download does not pass through the server and is not limited.
+func (s *SemaphoreFilesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	return PresignGet(ctx, s.Filesystem, path, ttl)
+}
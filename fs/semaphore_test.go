@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSemaphoreFilesystem(t *testing.T) {
+	ctx := context.Background()
+	repo := filepath.FromSlash("/repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	s := NewSemaphoreFilesystem(NewMemoryFilesystem(), 1)
+	if _, err := s.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() != 0 {
+		t.Fatalf("want no transfers after the upload, got %d", s.Active())
+	}
+
+	// an open download holds the only slot
+	rd, err := s.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetBlob(ctx, blob); !errors.Is(err, ErrBusy) {
+		t.Fatalf("GetBlob: want ErrBusy, got %v", err)
+	}
+	other := filepath.Join(repo, "keys", testID)
+	if _, err := s.SaveBlob(ctx, other, strings.NewReader("key"), 3); !errors.Is(err, ErrBusy) {
+		t.Fatalf("SaveBlob: want ErrBusy, got %v", err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("want %q, got %q", "foobar", buf)
+	}
+	// closing twice must not release twice
+	_ = rd.Close()
+	if s.Active() != 0 {
+		t.Fatalf("want no transfers after closing the reader, got %d", s.Active())
+	}
+	if _, err := s.SaveBlob(ctx, other, strings.NewReader("key"), 3); err != nil {
+		t.Fatalf("SaveBlob after the download: %v", err)
+	}
+
+	// so do readers for reads at arbitrary offsets
+	ra, err := s.OpenBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OpenBlob(ctx, blob); !errors.Is(err, ErrBusy) {
+		t.Fatalf("OpenBlob: want ErrBusy, got %v", err)
+	}
+	_ = ra.Close()
+	if s.Active() != 0 {
+		t.Fatalf("want no transfers after closing the reader, got %d", s.Active())
+	}
+
+	// a missing blob does not keep its slot
+	missing := filepath.Join(repo, "keys", strings.Repeat("0", 64))
+	if _, err := s.GetBlob(ctx, missing); !errors.Is(err, ErrNotFound) || s.Active() != 0 {
+		t.Fatalf("GetBlob: want ErrNotFound and no transfers, got %v, %d", err, s.Active())
+	}
+}
+
+func TestSemaphoreFilesystemMaxBytes(t *testing.T) {
+	s := NewSemaphoreFilesystem(NewMemoryFilesystem(), 0)
+	s.MaxBytes = 100
+
+	release1, err := s.acquire(60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.acquire(50); !errors.Is(err, ErrBusy) {
+		t.Fatalf("want ErrBusy beyond MaxBytes, got %v", err)
+	}
+	// uploads of unknown size are not counted
+	release2, err := s.acquire(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	release1()
+
+	// a single large upload is accepted if nothing else is counted
+	release3, err := s.acquire(500)
+	if err != nil {
+		t.Fatalf("want the large upload accepted, got %v", err)
+	}
+	if _, err := s.acquire(1); !errors.Is(err, ErrBusy) {
+		t.Fatalf("want ErrBusy during the large upload, got %v", err)
+	}
+	release3()
+}
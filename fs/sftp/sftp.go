@@ -0,0 +1,768 @@
+// Package sftp implements a fs.Filesystem which stores the repositories on a
+// remote server accessed via SFTP.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/restic/rest-server/fs"
+)
+
+// Options configure the Filesystem.
+type Options struct {
+	// Addr is the address of the SSH server, as host:port.
+	Addr string
+	// Config is the configuration of the SSH client, including the user,
+	// the authentication methods and the host key check.
+	Config *ssh.ClientConfig
+	// Dial connects to the server, it is used instead of Addr and Config if
+	// set. The returned io.Closer, which may be nil, is closed together with
+	// the client, e.g. to close the SSH connection.
+	Dial func(ctx context.Context) (*sftp.Client, io.Closer, error)
+
+	// Root is the local path the repositories are served from, usually the
+	// path of the server. The paths passed to the Filesystem must be below
+	// Root, they are mapped to paths relative to RemoteRoot.
+	Root string
+	// RemoteRoot is the directory on the server the repositories are stored
+	// in. Relative paths are relative to the home directory of the user.
+	RemoteRoot string
+
+	// Conns is the number of SFTP sessions used in parallel, defaults to 4.
+	// The operations are distributed over the sessions, each session can
+	// handle many operations at once.
+	Conns int
+}
+
+// Filesystem stores repositories on an SFTP server. Sessions are opened when
+// they are first needed and reopened if the connection is lost, operations
+// which did not modify anything are retried once on a new session.
+//
+// Operations end at the deadline of their context or when it is canceled,
+// also if the server stops responding, by closing the session they run on.
+// Without a deadline an operation waits for the server for as long as the
+// request is not canceled, there is no default timeout. Reading a blob
+// returned by GetBlob is not bounded by the context.
+type Filesystem struct {
+	dial       func(ctx context.Context) (*conn, error)
+	root       string
+	remoteRoot string
+
+	conns []*slot
+	next  uint32
+}
+
+var _ fs.Filesystem = &Filesystem{}
+
+// New returns a Filesystem for the server configured in opt.
+func New(opt Options) (*Filesystem, error) {
+	if opt.Root == "" {
+		return nil, errors.New("no root path specified")
+	}
+	dial := opt.Dial
+	if dial == nil {
+		if opt.Addr == "" || opt.Config == nil {
+			return nil, errors.New("no server address or SSH configuration specified")
+		}
+		dial = func(ctx context.Context) (*sftp.Client, io.Closer, error) {
+			return dialSSH(ctx, opt.Addr, opt.Config)
+		}
+	}
+	if opt.Conns <= 0 {
+		opt.Conns = 4
+	}
+
+	f := &Filesystem{
+		dial: func(ctx context.Context) (*conn, error) {
+			client, closer, err := dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return newConn(client, closer), nil
+		},
+		root:       filepath.Clean(opt.Root),
+		remoteRoot: path.Clean(opt.RemoteRoot),
+		conns:      make([]*slot, opt.Conns),
+	}
+	for i := range f.conns {
+		f.conns[i] = &slot{}
+	}
+	return f, nil
+}
+
+// dialSSH connects to the SSH server at addr and starts an SFTP session.
+func dialSSH(ctx context.Context, addr string, config *ssh.ClientConfig) (*sftp.Client, io.Closer, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+	if err != nil {
+		_ = nc.Close()
+		return nil, nil, err
+	}
+	sshClient := ssh.NewClient(sc, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, nil, err
+	}
+	return client, sshClient, nil
+}
+
+// conn is an SFTP session.
+type conn struct {
+	client *sftp.Client
+	closer io.Closer
+	lost   int32 // set once the session has been closed
+}
+
+func newConn(client *sftp.Client, closer io.Closer) *conn {
+	c := &conn{client: client, closer: closer}
+	go func() {
+		_ = client.Wait()
+		atomic.StoreInt32(&c.lost, 1)
+	}()
+	return c
+}
+
+func (c *conn) isLost() bool {
+	return atomic.LoadInt32(&c.lost) != 0
+}
+
+func (c *conn) close() {
+	_ = c.client.Close()
+	if c.closer != nil {
+		_ = c.closer.Close()
+	}
+}
+
+// abort closes the connection of the session, so that calls blocked on a
+// hanging server fail. Closing the client waits for the calls blocked on
+// writing to the server, so it must only be closed afterwards.
+func (c *conn) abort() {
+	if c.closer != nil {
+		_ = c.closer.Close()
+	}
+}
+
+// slot holds one of the sessions of the Filesystem.
+type slot struct {
+	mu sync.Mutex
+	c  *conn
+}
+
+// get returns a session, opening a new one if the session of the next slot
+// has not been opened yet or has been lost.
+func (f *Filesystem) get(ctx context.Context) (*conn, error) {
+	s := f.conns[int(atomic.AddUint32(&f.next, 1))%len(f.conns)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.c != nil && !s.c.isLost() {
+		return s.c, nil
+	}
+	if s.c != nil {
+		s.c.close()
+		s.c = nil
+	}
+	c, err := f.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.c = c
+	return c, nil
+}
+
+// discard closes c after an error caused by the connection, so that the next
+// operation on its slot opens a new session.
+func (f *Filesystem) discard(c *conn) {
+	for _, s := range f.conns {
+		s.mu.Lock()
+		if s.c == c {
+			s.c.close()
+			s.c = nil
+		}
+		s.mu.Unlock()
+	}
+}
+
+func isConnError(c *conn, err error) bool {
+	return err != nil && (c.isLost() || errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection) || errors.Is(err, io.ErrClosedPipe))
+}
+
+// do calls fn with a session. If fn fails because the connection has been
+// lost and retry is set, fn is called again with a new session.
+func (f *Filesystem) do(ctx context.Context, retry bool, fn func(client *sftp.Client) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c, err := f.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = f.call(ctx, c, fn)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		if !isConnError(c, err) {
+			return err
+		}
+		f.discard(c)
+		if !retry {
+			return err
+		}
+		retry = false
+	}
+}
+
+// call calls fn with the session c. The calls of the SFTP client do not take
+// a context, so if ctx is canceled or its deadline passes before fn returns,
+// c is closed to make a call stuck on a hanging server return. This also
+// fails the other operations running on c, those which did not modify
+// anything are retried on a new session. The error of ctx is returned
+// instead of the error of the aborted call.
+func (f *Filesystem) call(ctx context.Context, c *conn, fn func(client *sftp.Client) error) error {
+	if ctx.Done() == nil {
+		return fn(c.client)
+	}
+	stop := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.abort()
+			f.discard(c)
+			aborted <- true
+		case <-stop:
+			aborted <- false
+		}
+	}()
+	err := fn(c.client)
+	close(stop)
+	if <-aborted && err != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Sync does nothing, files are written and closed before SaveBlob returns
+// and syncing them to disk is left to the SFTP server.
+func (f *Filesystem) Sync(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close closes all sessions.
+func (f *Filesystem) Close() error {
+	for _, s := range f.conns {
+		s.mu.Lock()
+		if s.c != nil {
+			s.c.close()
+			s.c = nil
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// remote returns the path on the server for path.
+func (f *Filesystem) remote(p string) (string, error) {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is not below %v", p, f.root)
+	}
+	return path.Join(f.remoteRoot, filepath.ToSlash(rel)), nil
+}
+
+// osError translates SFTP status codes for missing files and denied
+// permissions to the corresponding errors of the os package.
+func osError(err error) error {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		switch status.FxCode() {
+		case sftp.ErrSSHFxNoSuchFile:
+			return os.ErrNotExist
+		case sftp.ErrSSHFxPermissionDenied:
+			return os.ErrPermission
+		}
+	}
+	return err
+}
+
+// pathError wraps err, translated with osError.
+func pathError(op, path string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		// keep the operation and remote path reported by the client
+		return &os.PathError{Op: pathErr.Op, Path: pathErr.Path, Err: osError(pathErr.Err)}
+	}
+	return &os.PathError{Op: op, Path: path, Err: osError(err)}
+}
+
+// CreateRepo creates the directories of the repository, including the data
+// subdirs, unless the repository already has a config.
+func (f *Filesystem) CreateRepo(ctx context.Context, p string) error {
+	dir, err := f.remote(p)
+	if err != nil {
+		return err
+	}
+	exists, _, err := f.CheckConfig(ctx, filepath.Join(p, "config"))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &os.PathError{Op: "create", Path: p, Err: fs.ErrRepoExists}
+	}
+
+	subdirs := make([]string, 256)
+	for i := range subdirs {
+		subdirs[i] = path.Join(dir, "data", fmt.Sprintf("%02x", i))
+	}
+
+	return f.do(ctx, true, func(client *sftp.Client) error {
+		for _, t := range fs.ObjectTypes {
+			if err := client.MkdirAll(path.Join(dir, t)); err != nil {
+				return pathError("mkdir", p, err)
+			}
+		}
+		return mkdirParallel(ctx, client, p, subdirs)
+	})
+}
+
+// mkdirWorkers is the number of data subdirs created in parallel by
+// CreateRepo, the requests are pipelined on the connection.
+const mkdirWorkers = 16
+
+// mkdirParallel creates dirs using up to mkdirWorkers concurrent requests.
+// Each worker stops at its first error, one of the errors is returned.
+func mkdirParallel(ctx context.Context, client *sftp.Client, p string, dirs []string) error {
+	var wg sync.WaitGroup
+	var next int64 = -1
+	errs := make(chan error, mkdirWorkers)
+	for i := 0; i < mkdirWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(dirs)) {
+					return
+				}
+				if err := ctx.Err(); err != nil {
+					errs <- err
+					return
+				}
+				if err := client.MkdirAll(dirs[i]); err != nil {
+					errs <- pathError("mkdir", p, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func (f *Filesystem) stat(ctx context.Context, p string) (os.FileInfo, error) {
+	remote, err := f.remote(p)
+	if err != nil {
+		return nil, err
+	}
+	var fi os.FileInfo
+	err = f.do(ctx, true, func(client *sftp.Client) error {
+		var err error
+		fi, err = client.Stat(remote)
+		if err != nil {
+			return pathError("stat", p, err)
+		}
+		return nil
+	})
+	return fi, err
+}
+
+func (f *Filesystem) remove(ctx context.Context, p string) error {
+	remote, err := f.remote(p)
+	if err != nil {
+		return err
+	}
+	return f.do(ctx, true, func(client *sftp.Client) error {
+		if err := client.Remove(remote); err != nil {
+			return pathError("remove", p, err)
+		}
+		return nil
+	})
+}
+
+// CheckConfig returns whether the config file exists and its size.
+func (f *Filesystem) CheckConfig(ctx context.Context, p string) (bool, int64, error) {
+	fi, err := f.stat(ctx, p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, fi.Size(), nil
+}
+
+// GetConfig returns the contents of the config file.
+func (f *Filesystem) GetConfig(ctx context.Context, p string) ([]byte, error) {
+	rd, _, err := f.GetConfigReader(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+	return ioutil.ReadAll(rd)
+}
+
+// GetConfigReader returns a reader for the config file and its size.
+func (f *Filesystem) GetConfigReader(ctx context.Context, p string) (io.ReadCloser, int64, error) {
+	remote, err := f.remote(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	var file *sftp.File
+	var size int64
+	err = f.do(ctx, true, func(client *sftp.Client) error {
+		var err error
+		file, err = client.Open(remote)
+		if err != nil {
+			return pathError("open", p, err)
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return pathError("stat", p, err)
+		}
+		size = fi.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// SaveConfig saves the config file, it fails if the file already exists. The
+// file is written to a temporary file first, which is renamed using the
+// SFTP rename operation that does not replace existing files.
+func (f *Filesystem) SaveConfig(ctx context.Context, p string, rd io.Reader) error {
+	remote, err := f.remote(p)
+	if err != nil {
+		return err
+	}
+	return f.do(ctx, false, func(client *sftp.Client) error {
+		if _, err := client.Stat(remote); err == nil {
+			return &os.PathError{Op: "create", Path: p, Err: fs.ErrConfigExists}
+		}
+		tmp, _, err := f.writeTemp(ctx, client, remote, rd, false)
+		if err != nil {
+			return pathError("write", p, err)
+		}
+		if err := client.Rename(tmp, remote); err != nil {
+			_ = client.Remove(tmp)
+			if _, statErr := client.Stat(remote); statErr == nil {
+				return &os.PathError{Op: "rename", Path: p, Err: fs.ErrConfigExists}
+			}
+			return pathError("rename", p, err)
+		}
+		return nil
+	})
+}
+
+// DeleteConfig removes the config file.
+func (f *Filesystem) DeleteConfig(ctx context.Context, p string) error {
+	return f.remove(ctx, p)
+}
+
+// ListBlobs lists all blobs in the object type directory at path.
+func (f *Filesystem) ListBlobs(ctx context.Context, p string) ([]fs.Blob, error) {
+	blobs := []fs.Blob{}
+	err := f.ListBlobsFunc(ctx, p, func(blob fs.Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// ListBlobsFunc calls fn for the blobs in the object type directory at path.
+// For hashed object types, the subdirs are read. Temporary files of uploads
+// in progress are skipped.
+func (f *Filesystem) ListBlobsFunc(ctx context.Context, p string, fn func(fs.Blob) error) error {
+	remote, err := f.remote(p)
+	if err != nil {
+		return err
+	}
+	hashed := fs.IsHashed(filepath.Base(p))
+
+	var called bool
+	return f.do(ctx, true, func(client *sftp.Client) error {
+		if called {
+			// listing again would repeat the blobs passed to fn
+			return errors.New("connection lost while listing")
+		}
+		entries, err := client.ReadDir(remote)
+		if err != nil {
+			return pathError("readdir", p, err)
+		}
+		if !hashed {
+			return listEntries(ctx, entries, func(blob fs.Blob) error {
+				called = true
+				return fn(blob)
+			})
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			subentries, err := client.ReadDir(path.Join(remote, e.Name()))
+			if err != nil {
+				return pathError("readdir", p, err)
+			}
+			err = listEntries(ctx, subentries, func(blob fs.Blob) error {
+				called = true
+				return fn(blob)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// listEntries calls fn for the files in entries.
+func listEntries(ctx context.Context, entries []os.FileInfo, fn func(fs.Blob) error) error {
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !e.Mode().IsRegular() || isTemp(e.Name()) {
+			continue
+		}
+		if err := fn(fs.Blob{Name: e.Name(), Size: e.Size(), ModTime: e.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const tempSuffix = ".rest-server-temp"
+
+func isTemp(name string) bool {
+	return strings.Contains(name, tempSuffix)
+}
+
+// CheckBlob returns the blob.
+func (f *Filesystem) CheckBlob(ctx context.Context, p string) (fs.Blob, error) {
+	fi, err := f.stat(ctx, p)
+	if err != nil {
+		return fs.Blob{}, err
+	}
+	return fs.Blob{Name: path.Base(filepath.ToSlash(p)), Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// GetBlob opens the blob for reading. The remote file supports seeking.
+func (f *Filesystem) GetBlob(ctx context.Context, p string) (io.ReadSeekCloser, error) {
+	remote, err := f.remote(p)
+	if err != nil {
+		return nil, err
+	}
+	var file *sftp.File
+	err = f.do(ctx, true, func(client *sftp.Client) error {
+		var err error
+		file, err = client.Open(remote)
+		if err != nil {
+			return pathError("open", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeTemp writes the data read from rd to a new temporary file next to
+// remote and returns its name. If createDir is set, a missing directory is
+// created. The temporary file is removed on errors.
+func (f *Filesystem) writeTemp(ctx context.Context, client *sftp.Client, remote string, rd io.Reader, createDir bool) (string, int64, error) {
+	tmp := remote + tempSuffix + strconv.FormatInt(rand.Int63(), 10)
+	file, err := client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if errors.Is(osError(err), os.ErrNotExist) && createDir {
+		if err := client.MkdirAll(path.Dir(remote)); err != nil {
+			return "", 0, err
+		}
+		file, err = client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	written, err := io.Copy(file, contextReader{ctx: ctx, rd: rd})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = client.Remove(tmp)
+		return "", written, err
+	}
+	return tmp, written, nil
+}
+
+// SaveBlob writes the blob to a temporary file and renames it to its final
+// name, replacing an existing blob. If the server does not support the
+// posix-rename extension, an existing blob is removed before the rename.
+func (f *Filesystem) SaveBlob(ctx context.Context, p string, rd io.Reader, expectedSize int64) (int64, error) {
+	remote, err := f.remote(p)
+	if err != nil {
+		return 0, err
+	}
+	rd = fs.NewSizeCheckReader(p, rd, expectedSize)
+	var written int64
+	err = f.do(ctx, false, func(client *sftp.Client) error {
+		var tmp string
+		var err error
+		tmp, written, err = f.writeTemp(ctx, client, remote, rd, true)
+		if err != nil {
+			return pathError("write", p, err)
+		}
+
+		if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+			err = client.PosixRename(tmp, remote)
+		} else {
+			_ = client.Remove(remote)
+			err = client.Rename(tmp, remote)
+		}
+		if err != nil {
+			_ = client.Remove(tmp)
+			return pathError("rename", p, err)
+		}
+		return nil
+	})
+	return written, err
+}
+
+// DeleteBlob removes the blob.
+func (f *Filesystem) DeleteBlob(ctx context.Context, p string, needSize bool) (int64, error) {
+	var size int64
+	if needSize {
+		fi, err := f.stat(ctx, p)
+		if err != nil {
+			return 0, err
+		}
+		size = fi.Size()
+	}
+	if err := f.remove(ctx, p); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// DeleteBlobs removes the blobs one by one, skipping missing blobs.
+func (f *Filesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for i, p := range paths {
+		size, err := f.DeleteBlob(ctx, p, needSize)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs[i] = err
+			continue
+		}
+		sizes[i] = size
+	}
+	return sizes, fs.NewBatchError(errs)
+}
+
+// RepoStats returns the statistics of the repository by listing the blobs of
+// all object types.
+func (f *Filesystem) RepoStats(ctx context.Context, p string) (fs.RepoStats, error) {
+	if _, err := f.stat(ctx, p); err != nil {
+		return fs.RepoStats{}, err
+	}
+
+	var stats fs.RepoStats
+	stats.Types = make(map[string]fs.ObjectStats, len(fs.ObjectTypes))
+	for _, t := range fs.ObjectTypes {
+		var o fs.ObjectStats
+		err := f.ListBlobsFunc(ctx, filepath.Join(p, t), func(blob fs.Blob) error {
+			o.Size += blob.Size
+			o.Count++
+			return nil
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fs.RepoStats{}, err
+		}
+		stats.Types[t] = o
+		stats.Size += o.Size
+		stats.Count += o.Count
+	}
+	return stats, nil
+}
+
+// Walk calls fn for the blobs of all object types by listing them.
+func (f *Filesystem) Walk(ctx context.Context, p string, fn func(objectType string, blob fs.Blob) error) error {
+	if _, err := f.stat(ctx, p); err != nil {
+		return err
+	}
+	return fs.WalkTypes(ctx, f, p, fn)
+}
+
+// HealthCheck writes and removes a small file in the HealthDir below path.
+func (f *Filesystem) HealthCheck(ctx context.Context, p string) error {
+	remote, err := f.remote(filepath.Join(p, fs.HealthDir, "check"))
+	if err != nil {
+		return err
+	}
+	return f.do(ctx, true, func(client *sftp.Client) error {
+		tmp, _, err := f.writeTemp(ctx, client, remote, strings.NewReader("ok\n"), true)
+		if err != nil {
+			return pathError("write", p, err)
+		}
+		if err := client.Remove(tmp); err != nil {
+			return pathError("remove", p, err)
+		}
+		return nil
+	})
+}
+
+// contextReader returns the error of ctx instead of reading from rd once ctx
+// is canceled.
+type contextReader struct {
+	ctx context.Context
+	rd  io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.rd.Read(p)
+}
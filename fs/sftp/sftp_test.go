@@ -0,0 +1,272 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/restic/rest-server/fs"
+)
+
+// pipe is one end of a connection between the client and the server.
+type pipe struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (p pipe) Close() error {
+	return p.WriteCloser.Close()
+}
+
+// testServer serves dir to SFTP clients connected using dial.
+type testServer struct {
+	dir string
+
+	hang    int32         // set to stop reading requests, must be accessed using sync/atomic
+	release chan struct{} // closed to resume the reads stopped by hang
+
+	mu      sync.Mutex
+	dials   int
+	servers []*sftp.Server
+}
+
+func (s *testServer) dial(ctx context.Context) (*sftp.Client, io.Closer, error) {
+	clientRd, serverWr := io.Pipe()
+	serverRd, clientWr := io.Pipe()
+	server, err := sftp.NewServer(pipe{hangReader{serverRd, s}, serverWr}, sftp.WithServerWorkingDirectory(s.dir))
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		_ = server.Serve()
+		_ = serverWr.Close()
+	}()
+	client, err := sftp.NewClientPipe(clientRd, clientWr)
+	if err != nil {
+		_ = server.Close()
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	s.dials++
+	s.servers = append(s.servers, server)
+	s.mu.Unlock()
+	return client, closerFunc(func() error {
+		_ = serverRd.Close()
+		return server.Close()
+	}), nil
+}
+
+type closerFunc func() error
+
+func (fn closerFunc) Close() error {
+	return fn()
+}
+
+// disconnect closes all connections from the server side.
+func (s *testServer) disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, server := range s.servers {
+		_ = server.Close()
+	}
+	s.servers = nil
+}
+
+// hangReader reads the requests of the clients, blocking while the server
+// hangs.
+type hangReader struct {
+	rd io.Reader
+	s  *testServer
+}
+
+func (r hangReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.s.hang) != 0 {
+		<-r.s.release
+	}
+	return r.rd.Read(p)
+}
+
+func TestFilesystem(t *testing.T) {
+	remote := t.TempDir()
+	srv := &testServer{dir: remote}
+	root := filepath.FromSlash("/srv/restic")
+	f, err := New(Options{
+		Dial:       srv.dial,
+		Root:       root,
+		RemoteRoot: filepath.ToSlash(filepath.Join(remote, "backups")),
+		Conns:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	ctx := context.Background()
+	if err := f.HealthCheck(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "backups", "repo", "data", "ff")); err != nil {
+		t.Fatalf("data subdirs not created: %v", err)
+	}
+	if err := f.CreateRepo(ctx, filepath.FromSlash("/elsewhere")); err == nil {
+		t.Fatal("paths outside of the root must be rejected")
+	}
+
+	cfg := filepath.Join(repo, "config")
+	if exists, _, err := f.CheckConfig(ctx, cfg); err != nil || exists {
+		t.Fatalf("CheckConfig: want missing config, got %v, %v", exists, err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("SaveConfig: want ErrExist, got %v", err)
+	}
+	if err := f.CreateRepo(ctx, repo); !errors.Is(err, fs.ErrRepoExists) {
+		t.Fatalf("CreateRepo: want ErrRepoExists, got %v", err)
+	}
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if rd, size, err := f.GetConfigReader(ctx, cfg); err != nil || size != 6 {
+		t.Fatalf("GetConfigReader: got size %v, %v", size, err)
+	} else if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfigReader: got %q, %v", buf, err)
+	} else {
+		_ = rd.Close()
+	}
+
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("blob data"), -1); err != nil || n != 9 {
+		t.Fatalf("SaveBlob: got %v, %v", n, err)
+	}
+	if n, err := f.SaveBlob(ctx, blob, strings.NewReader("blob data"), -1); err != nil || n != 9 {
+		t.Fatalf("SaveBlob must replace the blob, got %v, %v", n, err)
+	}
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, "keys", "key"), strings.NewReader("key"), 3); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated upload must not be stored
+	short := filepath.Join(repo, "snapshots", id)
+	if _, err := f.SaveBlob(ctx, short, strings.NewReader("short"), 10); !errors.Is(err, fs.ErrShortWrite) {
+		t.Fatalf("SaveBlob: want ErrShortWrite, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, short); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want ErrNotExist for a truncated upload, got %v", err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 9 {
+		t.Fatalf("CheckBlob: got %v, %v", b.Size, err)
+	}
+	for _, tpe := range []string{"data", "keys"} {
+		blobs, err := f.ListBlobs(ctx, filepath.Join(repo, tpe))
+		if err != nil || len(blobs) != 1 {
+			t.Fatalf("ListBlobs %v: got %v, %v", tpe, blobs, err)
+		}
+	}
+	stats, err := f.RepoStats(ctx, repo)
+	if err != nil || stats.Count != 2 || stats.Size != 12 {
+		t.Fatalf("RepoStats: got %+v, %v", stats, err)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "data" {
+		t.Fatalf("reading after seek: got %q, %v", buf, err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// operations are retried once the connection is lost
+	dials := srv.dials
+	srv.disconnect()
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 9 {
+		t.Fatalf("CheckBlob after disconnect: got %v, %v", b.Size, err)
+	}
+	if srv.dials == dials {
+		t.Fatal("no new session opened after disconnect")
+	}
+
+	if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 9 {
+		t.Fatalf("DeleteBlob: got %v, %v", size, err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("CheckBlob: want ErrNotExist after delete, got %v", err)
+	}
+	if _, err := f.GetBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetBlob: want ErrNotExist after delete, got %v", err)
+	}
+	sizes, err := f.DeleteBlobs(ctx, []string{filepath.Join(repo, "keys", "key"), blob}, true)
+	if err != nil || len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 0 {
+		t.Fatalf("DeleteBlobs: got %v, %v", sizes, err)
+	}
+	if err := f.DeleteConfig(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.GetConfig(ctx, cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("GetConfig: want ErrNotExist after delete, got %v", err)
+	}
+}
+
+func TestFilesystemDeadline(t *testing.T) {
+	remote := t.TempDir()
+	srv := &testServer{dir: remote, release: make(chan struct{})}
+	defer close(srv.release)
+	root := filepath.FromSlash("/srv/restic")
+	f, err := New(Options{Dial: srv.dial, Root: root, RemoteRoot: filepath.ToSlash(remote), Conns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	ctx := context.Background()
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hanging server does not outlive the deadline of the context
+	atomic.StoreInt32(&srv.hang, 1)
+	start := time.Now()
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.CheckBlob(tctx, filepath.Join(repo, "keys", "key")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("CheckBlob returned after %v", d)
+	}
+
+	// the next operation uses a new session
+	atomic.StoreInt32(&srv.hang, 0)
+	dials := srv.dials
+	if _, err := f.CheckBlob(ctx, filepath.Join(repo, "keys", "key")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want ErrNotExist, got %v", err)
+	}
+	if srv.dials == dials {
+		t.Fatal("no new session opened after the deadline")
+	}
+}
@@ -0,0 +1,758 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/minio/sha256-simd"
+)
+
+// ringReplicas is the number of points each backend has on a HashRing. More
+// points spread the keys more evenly.
+const ringReplicas = 128
+
+// HashRing places keys on n backends using consistent hashing: each backend
+// owns the keys whose hash falls between one of its points on the ring and the
+// preceding point. Adding a backend only moves the keys which now fall to the
+// points of the new backend, about 1/n of all keys, the other keys stay where
+// they are.
+//
+// Backends are identified by their index, so new backends must be appended.
+// Removing or reordering backends moves most keys.
+type HashRing struct {
+	points []uint64
+	owners map[uint64]int
+}
+
+// NewHashRing returns a HashRing for n backends.
+func NewHashRing(n int) *HashRing {
+	r := &HashRing{owners: make(map[uint64]int, n*ringReplicas)}
+	for i := 0; i < n; i++ {
+		for j := 0; j < ringReplicas; j++ {
+			p := ringHash(strconv.Itoa(i) + "-" + strconv.Itoa(j))
+			if _, ok := r.owners[p]; ok {
+				// a collision, the first backend keeps the point
+				continue
+			}
+			r.owners[p] = i
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Locate returns the index of the backend owning key.
+func (r *HashRing) Locate(key string) int {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Shard is a backend of a ShardedFilesystem. Dir is the directory of the
+// backend corresponding to the root directory of the ShardedFilesystem, paths
+// below the root are moved below Dir before they are passed to the backend.
+type Shard struct {
+	Filesystem
+	Dir string
+}
+
+// ShardedFilesystem spreads the repositories below a root directory across
+// several backends, e.g. one DiskFilesystem per disk, without combining the
+// disks using LVM or RAID. A placement function, usually HashRing.Locate,
+// maps each repository to a backend, using the path relative to the root as
+// the key.
+//
+// If ShardBlobs is set, each blob is placed on its own using its name as the
+// key, which spreads large repositories as well. Then the directories of the
+// repository are created on all backends and listings combine the blobs of
+// all backends. The config is placed like the repository.
+//
+// When a backend is added, the placement function maps some of the keys to
+// it, the data must then be moved using Rebalance. Until then repositories
+// stay usable: a repository is accessed on the backend which stores its
+// config, and with ShardBlobs blobs which are not found on their backend are
+// looked up on the others.
+type ShardedFilesystem struct {
+	// ShardBlobs places each blob on its own instead of whole repositories.
+	// It must not be changed once data has been stored.
+	ShardBlobs bool
+
+	root   string
+	shards []Shard
+	place  func(key string) int
+
+	repos sync.Map // repository path -> index of the shard storing the config
+}
+
+var _ Filesystem = &ShardedFilesystem{}
+
+// NewShardedFilesystem returns a ShardedFilesystem storing the repositories
+// below root on shards, which are chosen by place.
+func NewShardedFilesystem(root string, shards []Shard, place func(key string) int) *ShardedFilesystem {
+	return &ShardedFilesystem{
+		root:   filepath.Clean(root),
+		shards: shards,
+		place:  place,
+	}
+}
+
+// rel returns path relative to the root.
+func (s *ShardedFilesystem) rel(path string) (string, error) {
+	rel, err := filepath.Rel(s.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %v is not below %v", path, s.root)
+	}
+	return rel, nil
+}
+
+// shardPath returns the path used by shard i for path.
+func (s *ShardedFilesystem) shardPath(i int, path string) (string, error) {
+	rel, err := s.rel(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.shards[i].Dir, rel), nil
+}
+
+// locate returns the index of the shard for key as chosen by place.
+func (s *ShardedFilesystem) locate(key string) (int, error) {
+	i := s.place(key)
+	if i < 0 || i >= len(s.shards) {
+		return 0, fmt.Errorf("placement of %v on invalid shard %d", key, i)
+	}
+	return i, nil
+}
+
+// repoShard returns the index of the shard storing the config of the
+// repository at repo. The shard chosen by place is checked first, then the
+// others, as the repository may not have been moved after adding a shard.
+// New repositories are placed as chosen by place.
+func (s *ShardedFilesystem) repoShard(ctx context.Context, repo string) (int, error) {
+	if i, ok := s.repos.Load(repo); ok {
+		return i.(int), nil
+	}
+	rel, err := s.rel(repo)
+	if err != nil {
+		return 0, err
+	}
+	want, err := s.locate(filepath.ToSlash(rel))
+	if err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(s.shards); n++ {
+		i := (want + n) % len(s.shards)
+		p := filepath.Join(s.shards[i].Dir, rel)
+		exists, _, err := s.shards[i].CheckConfig(ctx, filepath.Join(p, "config"))
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			s.repos.Store(repo, i)
+			return i, nil
+		}
+	}
+	return want, nil
+}
+
+// blobShard returns the index of the shard for the blob at path.
+func (s *ShardedFilesystem) blobShard(ctx context.Context, path string) (int, error) {
+	repo, _, name := SplitBlobPath(path)
+	if !s.ShardBlobs {
+		return s.repoShard(ctx, repo)
+	}
+	return s.locate(name)
+}
+
+// withShard calls fn for shard i with the path for the shard.
+func (s *ShardedFilesystem) withShard(i int, path string, fn func(f Filesystem, path string) error) error {
+	p, err := s.shardPath(i, path)
+	if err != nil {
+		return err
+	}
+	return fn(s.shards[i].Filesystem, p)
+}
+
+// find calls fn for the shard i, and if fn returns ErrNotFound and lookup is
+// set, for the other shards until fn succeeds.
+func (s *ShardedFilesystem) find(i int, lookup bool, path string, fn func(f Filesystem, path string) error) error {
+	err := s.withShard(i, path, fn)
+	if !lookup || !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	for j := range s.shards {
+		if j == i {
+			continue
+		}
+		if err := s.withShard(j, path, fn); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return err
+}
+
+// CreateRepo creates the repository on its shard, or on all shards if
+// ShardBlobs is set.
+func (s *ShardedFilesystem) CreateRepo(ctx context.Context, path string) error {
+	if s.ShardBlobs {
+		// the config is only checked on the shard storing it
+		i, err := s.repoShard(ctx, path)
+		if err != nil {
+			return err
+		}
+		if err := s.withShard(i, path, func(f Filesystem, path string) error {
+			return f.CreateRepo(ctx, path)
+		}); err != nil {
+			return err
+		}
+		for j := range s.shards {
+			if j == i {
+				continue
+			}
+			err := s.withShard(j, path, func(f Filesystem, path string) error {
+				return f.CreateRepo(ctx, path)
+			})
+			if err != nil && !errors.Is(err, ErrRepoExists) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	i, err := s.repoShard(ctx, path)
+	if err != nil {
+		return err
+	}
+	return s.withShard(i, path, func(f Filesystem, path string) error {
+		return f.CreateRepo(ctx, path)
+	})
+}
+
+// CheckConfig checks the config on the shard of the repository.
+func (s *ShardedFilesystem) CheckConfig(ctx context.Context, path string) (exists bool, size int64, err error) {
+	i, err := s.repoShard(ctx, filepath.Dir(path))
+	if err != nil {
+		return false, 0, err
+	}
+	err = s.withShard(i, path, func(f Filesystem, path string) error {
+		var err error
+		exists, size, err = f.CheckConfig(ctx, path)
+		return err
+	})
+	return exists, size, err
+}
+
+// GetConfig returns the config from the shard of the repository.
+func (s *ShardedFilesystem) GetConfig(ctx context.Context, path string) (buf []byte, err error) {
+	i, err := s.repoShard(ctx, filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	err = s.withShard(i, path, func(f Filesystem, path string) error {
+		var err error
+		buf, err = f.GetConfig(ctx, path)
+		return err
+	})
+	return buf, err
+}
+
+// GetConfigReader returns a reader for the config from the shard of the
+// repository.
+func (s *ShardedFilesystem) GetConfigReader(ctx context.Context, path string) (rd io.ReadCloser, size int64, err error) {
+	i, err := s.repoShard(ctx, filepath.Dir(path))
+	if err != nil {
+		return nil, 0, err
+	}
+	err = s.withShard(i, path, func(f Filesystem, path string) error {
+		var err error
+		rd, size, err = f.GetConfigReader(ctx, path)
+		return err
+	})
+	return rd, size, err
+}
+
+// SaveConfig saves the config on the shard of the repository.
+func (s *ShardedFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	i, err := s.repoShard(ctx, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	return s.withShard(i, path, func(f Filesystem, path string) error {
+		return f.SaveConfig(ctx, path, rd)
+	})
+}
+
+// DeleteConfig removes the config from the shard of the repository.
+func (s *ShardedFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	i, err := s.repoShard(ctx, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	s.repos.Delete(filepath.Dir(path))
+	return s.withShard(i, path, func(f Filesystem, path string) error {
+		return f.DeleteConfig(ctx, path)
+	})
+}
+
+// ListBlobs lists the blobs in path, see ListBlobsFunc.
+func (s *ShardedFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	var blobs []Blob
+	err := s.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		blobs = append(blobs, blob)
+		return nil
+	})
+	return blobs, err
+}
+
+// ListBlobsFunc calls fn for the blobs in path. If ShardBlobs is set, the
+// blobs of all shards are listed, a blob stored on several shards while the
+// shards are being rebalanced is only listed once. ErrNotFound is only
+// returned if the directory is missing on all shards.
+func (s *ShardedFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	if !s.ShardBlobs {
+		i, err := s.repoShard(ctx, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		return s.withShard(i, path, func(f Filesystem, path string) error {
+			return f.ListBlobsFunc(ctx, path, fn)
+		})
+	}
+
+	seen := make(map[string]struct{})
+	found := false
+	var notFound error
+	for i := range s.shards {
+		err := s.withShard(i, path, func(f Filesystem, path string) error {
+			return f.ListBlobsFunc(ctx, path, func(blob Blob) error {
+				if _, ok := seen[blob.Name]; ok {
+					return nil
+				}
+				seen[blob.Name] = struct{}{}
+				return fn(blob)
+			})
+		})
+		if errors.Is(err, ErrNotFound) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return notFound
+	}
+	return nil
+}
+
+// CheckBlob returns the blob from its shard.
+func (s *ShardedFilesystem) CheckBlob(ctx context.Context, path string) (blob Blob, err error) {
+	i, err := s.blobShard(ctx, path)
+	if err != nil {
+		return Blob{}, err
+	}
+	err = s.find(i, s.ShardBlobs, path, func(f Filesystem, path string) error {
+		var err error
+		blob, err = f.CheckBlob(ctx, path)
+		return err
+	})
+	return blob, err
+}
+
+// GetBlob returns a reader for the blob from its shard.
+func (s *ShardedFilesystem) GetBlob(ctx context.Context, path string) (rd io.ReadSeekCloser, err error) {
+	i, err := s.blobShard(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	err = s.find(i, s.ShardBlobs, path, func(f Filesystem, path string) error {
+		var err error
+		rd, err = f.GetBlob(ctx, path)
+		return err
+	})
+	return rd, err
+}
+
+// SaveBlob saves the blob on its shard.
+func (s *ShardedFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (n int64, err error) {
+	i, err := s.blobShard(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	err = s.withShard(i, path, func(f Filesystem, path string) error {
+		var err error
+		n, err = f.SaveBlob(ctx, path, rd, expectedSize)
+		return err
+	})
+	return n, err
+}
+
+// DeleteBlob removes the blob. If ShardBlobs is set, it is removed from all
+// shards, so that a copy which has not been cleaned up by Rebalance does not
+// reappear. It fails with ErrNotFound only if no shard stores the blob.
+func (s *ShardedFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (size int64, err error) {
+	if !s.ShardBlobs {
+		i, err := s.blobShard(ctx, path)
+		if err != nil {
+			return 0, err
+		}
+		err = s.withShard(i, path, func(f Filesystem, path string) error {
+			var err error
+			size, err = f.DeleteBlob(ctx, path, needSize)
+			return err
+		})
+		return size, err
+	}
+
+	found := false
+	var notFound error
+	for i := range s.shards {
+		err := s.withShard(i, path, func(f Filesystem, path string) error {
+			n, err := f.DeleteBlob(ctx, path, needSize)
+			if err == nil && !found {
+				size = n
+			}
+			return err
+		})
+		if errors.Is(err, ErrNotFound) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		found = true
+	}
+	if !found {
+		return 0, notFound
+	}
+	return size, nil
+}
+
+// DeleteBlobs removes the blobs, like DeleteBlob.
+func (s *ShardedFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	// with ShardBlobs all blobs are removed from all shards, otherwise each
+	// blob only from the shard of its repository
+	shardOf := make([]int, len(paths))
+	if !s.ShardBlobs {
+		for j, path := range paths {
+			i, err := s.blobShard(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			shardOf[j] = i
+		}
+	}
+
+	sizes := make([]int64, len(paths))
+	errs := make([]error, len(paths))
+	for i := range s.shards {
+		var shardPaths []string
+		var indexes []int
+		for j, path := range paths {
+			if !s.ShardBlobs && shardOf[j] != i {
+				continue
+			}
+			p, err := s.shardPath(i, path)
+			if err != nil {
+				return nil, err
+			}
+			shardPaths = append(shardPaths, p)
+			indexes = append(indexes, j)
+		}
+
+		if len(shardPaths) == 0 {
+			continue
+		}
+		n, err := s.shards[i].DeleteBlobs(ctx, shardPaths, needSize)
+		var batchErr *BatchError
+		if err != nil && !errors.As(err, &batchErr) {
+			return sizes, err
+		}
+		for k, j := range indexes {
+			if batchErr != nil && batchErr.Errors[k] != nil {
+				errs[j] = batchErr.Errors[k]
+			} else if k < len(n) && n[k] > sizes[j] {
+				sizes[j] = n[k]
+			}
+		}
+	}
+	return sizes, NewBatchError(errs)
+}
+
+// RepoStats returns the statistics for the repository. If ShardBlobs is set,
+// the statistics of all shards are added up, blobs stored on several shards
+// while the shards are being rebalanced are counted more than once.
+func (s *ShardedFilesystem) RepoStats(ctx context.Context, path string) (stats RepoStats, err error) {
+	if s.ShardBlobs {
+		found := false
+		var notFound error
+		for i := range s.shards {
+			err := s.withShard(i, path, func(f Filesystem, path string) error {
+				st, err := f.RepoStats(ctx, path)
+				for t, o := range st.Types {
+					stats.add(t, o)
+				}
+				return err
+			})
+			if errors.Is(err, ErrNotFound) {
+				notFound = err
+				continue
+			}
+			if err != nil {
+				return RepoStats{}, err
+			}
+			found = true
+		}
+		if !found {
+			return RepoStats{}, notFound
+		}
+		return stats, nil
+	}
+	i, err := s.repoShard(ctx, path)
+	if err != nil {
+		return RepoStats{}, err
+	}
+	err = s.withShard(i, path, func(f Filesystem, path string) error {
+		var err error
+		stats, err = f.RepoStats(ctx, path)
+		return err
+	})
+	return stats, err
+}
+
+// Walk calls fn for each blob in the repository. If ShardBlobs is set, the
+// blobs of all shards are listed, a blob stored on several shards is only
+// listed once.
+func (s *ShardedFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	if s.ShardBlobs {
+		seen := make(map[string]struct{})
+		found := false
+		var notFound error
+		var errs []error
+		for i := range s.shards {
+			err := s.withShard(i, path, func(f Filesystem, path string) error {
+				return f.Walk(ctx, path, func(objectType string, blob Blob) error {
+					key := objectType + "/" + blob.Name
+					if _, ok := seen[key]; ok {
+						return nil
+					}
+					seen[key] = struct{}{}
+					return fn(objectType, blob)
+				})
+			})
+			var walkErr *WalkError
+			switch {
+			case errors.Is(err, ErrNotFound) && !errors.As(err, &walkErr):
+				notFound = err
+				continue
+			case errors.As(err, &walkErr):
+				errs = append(errs, walkErr.Errors...)
+			case err != nil:
+				return err
+			}
+			found = true
+		}
+		if !found {
+			return notFound
+		}
+		return newWalkError(errs)
+	}
+	i, err := s.repoShard(ctx, path)
+	if err != nil {
+		return err
+	}
+	return s.withShard(i, path, func(f Filesystem, path string) error {
+		return f.Walk(ctx, path, fn)
+	})
+}
+
+// HealthCheck checks all shards.
+func (s *ShardedFilesystem) HealthCheck(ctx context.Context, path string) error {
+	for i := range s.shards {
+		err := s.withShard(i, path, func(f Filesystem, path string) error {
+			return f.HealthCheck(ctx, path)
+		})
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Sync syncs all shards, also if syncing one of them fails. The error of
+// the first shard which failed is returned.
+func (s *ShardedFilesystem) Sync(ctx context.Context) error {
+	var firstErr error
+	for i, shard := range s.shards {
+		if err := shard.Filesystem.Sync(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
+
+// Close closes all shards, also if closing one of them fails. The error of
+// the first shard which failed is returned.
+func (s *ShardedFilesystem) Close() error {
+	var firstErr error
+	for i, shard := range s.shards {
+		if err := shard.Filesystem.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return firstErr
+}
+
+// Rebalance moves the data of the repository at path to the shards chosen
+// by the placement function, which is needed after adding a shard. Each blob
+// is copied to its new shard before it is removed from the old one.
+//
+// If ShardBlobs is set, the repository can be used while it is rebalanced.
+// Otherwise the whole repository is moved and its config is moved last, the
+// repository must not be used until Rebalance has returned, as blobs which
+// have already been moved are missing on the old shard.
+func (s *ShardedFilesystem) Rebalance(ctx context.Context, path string) error {
+	rel, err := s.rel(path)
+	if err != nil {
+		return err
+	}
+	repoTarget, err := s.locate(filepath.ToSlash(rel))
+	if err != nil {
+		return err
+	}
+	if s.ShardBlobs {
+		for i := range s.shards {
+			err := s.withShard(i, path, func(f Filesystem, path string) error {
+				return f.CreateRepo(ctx, path)
+			})
+			if err != nil && !errors.Is(err, ErrRepoExists) {
+				return err
+			}
+		}
+	} else if err := s.withShard(repoTarget, path, func(f Filesystem, path string) error {
+		return f.CreateRepo(ctx, path)
+	}); err != nil && !errors.Is(err, ErrRepoExists) {
+		return err
+	}
+
+	type move struct {
+		path   string
+		target int
+	}
+	for i := range s.shards {
+		var misplaced []move
+		err := s.withShard(i, path, func(f Filesystem, p string) error {
+			return f.Walk(ctx, p, func(objectType string, blob Blob) error {
+				target := repoTarget
+				if s.ShardBlobs {
+					var err error
+					if target, err = s.locate(blob.Name); err != nil {
+						return err
+					}
+				}
+				if target != i {
+					misplaced = append(misplaced, move{blobPath(filepath.Join(path, objectType), blob.Name), target})
+				}
+				return nil
+			})
+		})
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, m := range misplaced {
+			if err := s.moveBlob(ctx, m.path, i, m.target); err != nil {
+				return err
+			}
+		}
+	}
+	return s.moveConfig(ctx, path, repoTarget)
+}
+
+// moveBlob moves the blob at path from shard i to shard j.
+func (s *ShardedFilesystem) moveBlob(ctx context.Context, path string, i, j int) error {
+	src, err := s.shardPath(i, path)
+	if err != nil {
+		return err
+	}
+	dst, err := s.shardPath(j, path)
+	if err != nil {
+		return err
+	}
+	rd, err := s.shards[i].GetBlob(ctx, src)
+	if err != nil {
+		return err
+	}
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		_, err = s.shards[j].SaveBlob(ctx, dst, rd, size)
+	}
+	_ = rd.Close()
+	if err != nil {
+		return err
+	}
+	_, err = s.shards[i].DeleteBlob(ctx, src, false)
+	if errors.Is(err, ErrNotFound) {
+		// deleted concurrently
+		return nil
+	}
+	return err
+}
+
+// moveConfig moves the config of the repository at path to shard j.
+func (s *ShardedFilesystem) moveConfig(ctx context.Context, path string, j int) error {
+	cfg := filepath.Join(path, "config")
+	for i := range s.shards {
+		if i == j {
+			continue
+		}
+		src, err := s.shardPath(i, cfg)
+		if err != nil {
+			return err
+		}
+		buf, err := s.shards[i].GetConfig(ctx, src)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dst, err := s.shardPath(j, cfg)
+		if err != nil {
+			return err
+		}
+		if err := s.shards[j].SaveConfig(ctx, dst, bytes.NewReader(buf)); err != nil && !errors.Is(err, ErrExists) {
+			return err
+		}
+		s.repos.Store(path, j)
+		if err := s.shards[i].DeleteConfig(ctx, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
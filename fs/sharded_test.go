@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	const keys = 10000
+	r := NewHashRing(4)
+	counts := make([]int, 4)
+	owners := make([]int, keys)
+	for i := range owners {
+		owners[i] = r.Locate(fmt.Sprintf("%064x", i))
+		counts[owners[i]]++
+	}
+	for i, n := range counts {
+		if n < keys/8 {
+			t.Errorf("backend %d owns only %d of %d keys", i, n, keys)
+		}
+	}
+
+	// only keys moving to the new backend change their owner
+	r = NewHashRing(5)
+	moved := 0
+	for i, owner := range owners {
+		if o := r.Locate(fmt.Sprintf("%064x", i)); o != owner {
+			if o != 4 {
+				t.Fatalf("key %d moved from %d to %d", i, owner, o)
+			}
+			moved++
+		}
+	}
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Fatalf("want about a fifth of the keys moved, got %d of %d", moved, keys)
+	}
+}
+
+func newTestShards(t *testing.T, n int) []Shard {
+	shards := make([]Shard, n)
+	for i := range shards {
+		shards[i] = Shard{Filesystem: &DiskFilesystem{}, Dir: t.TempDir()}
+	}
+	return shards
+}
+
+func TestShardedFilesystem(t *testing.T) {
+	root := filepath.FromSlash("/srv/restic")
+	for _, shardBlobs := range []bool{false, true} {
+		f := NewShardedFilesystem(root, newTestShards(t, 3), NewHashRing(3).Locate)
+		f.ShardBlobs = shardBlobs
+		testFilesystem(t, f, root)
+	}
+}
+
+func TestShardedFilesystemRebalance(t *testing.T) {
+	ctx := context.Background()
+	root := filepath.FromSlash("/srv/restic")
+	repo := filepath.Join(root, "repo")
+	shards := newTestShards(t, 3)
+
+	for _, shardBlobs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ShardBlobs=%v", shardBlobs), func(t *testing.T) {
+			for _, s := range shards {
+				if err := os.RemoveAll(filepath.Join(s.Dir, "repo")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the repository is placed on the first shard, blobs on the
+			// first two
+			f := NewShardedFilesystem(root, shards[:2], func(key string) int {
+				if shardBlobs && !strings.Contains(key, "repo") {
+					return NewHashRing(2).Locate(key)
+				}
+				return 0
+			})
+			f.ShardBlobs = shardBlobs
+			if err := f.CreateRepo(ctx, repo); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+				t.Fatal(err)
+			}
+			var blobs []string
+			for i := 0; i < 20; i++ {
+				id := fmt.Sprintf("%064x", i)
+				blob := filepath.Join(repo, "data", id[:2], id)
+				if _, err := f.SaveBlob(ctx, blob, strings.NewReader(id), int64(len(id))); err != nil {
+					t.Fatal(err)
+				}
+				blobs = append(blobs, blob)
+			}
+
+			// after adding a shard, the repository is placed on it
+			ring := NewHashRing(3)
+			place := func(key string) int {
+				if shardBlobs && !strings.Contains(key, "repo") {
+					return ring.Locate(key)
+				}
+				return 2
+			}
+			f = NewShardedFilesystem(root, shards, place)
+			f.ShardBlobs = shardBlobs
+			check := func() {
+				t.Helper()
+				for _, blob := range blobs {
+					if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 64 {
+						t.Fatalf("CheckBlob: got %v, %v", b, err)
+					}
+				}
+				list, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+				if err != nil || len(list) != len(blobs) {
+					t.Fatalf("ListBlobs: want %d blobs, got %d, %v", len(blobs), len(list), err)
+				}
+			}
+			// the repository is found before it has been moved
+			check()
+
+			if err := f.Rebalance(ctx, repo); err != nil {
+				t.Fatal(err)
+			}
+			check()
+			if buf, err := f.GetConfig(ctx, filepath.Join(repo, "config")); err != nil || string(buf) != "config" {
+				t.Fatalf("GetConfig: got %q, %v", buf, err)
+			}
+			for i, s := range shards {
+				err := s.Walk(ctx, filepath.Join(s.Dir, "repo"), func(objectType string, blob Blob) error {
+					if want := place(blob.Name); want != i {
+						t.Errorf("blob %v found on shard %d instead of %d", blob.Name, i, want)
+					}
+					return nil
+				})
+				if err != nil && !os.IsNotExist(err) {
+					t.Fatal(err)
+				}
+				exists, _, err := s.CheckConfig(ctx, filepath.Join(s.Dir, "repo", "config"))
+				if err != nil || exists != (i == 2) {
+					t.Fatalf("shard %d: config exists %v, %v", i, exists, err)
+				}
+			}
+		})
+	}
+}
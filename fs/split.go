@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// SplitReadWriteFilesystem serves reads from a read replica, e.g. a copy of
+// the repositories on an SSD kept up to date by rsync, and does all writes on
+// the authoritative write Filesystem it embeds. Blobs, configs and listings
+// which are missing on the replica are read from the write Filesystem
+// instead, so new data is available before the replica has caught up.
+// Otherwise reads may be stale, e.g. a blob deleted on the write Filesystem
+// is still listed until it has been removed from the replica as well.
+type SplitReadWriteFilesystem struct {
+	Filesystem
+	read Filesystem
+
+	// Fallback is called if a read of path by the operation op, e.g.
+	// "GetBlob", fell through to the write Filesystem because the replica
+	// lacks the file. It can be used to measure the lag of the replica.
+	Fallback func(op, path string)
+}
+
+// NewSplitReadWriteFilesystem returns a SplitReadWriteFilesystem which reads
+// from read and writes to write.
+func NewSplitReadWriteFilesystem(read, write Filesystem) *SplitReadWriteFilesystem {
+	return &SplitReadWriteFilesystem{Filesystem: write, read: read}
+}
+
+// fallback reports whether a read which failed with err is retried on the
+// write Filesystem, and calls Fallback if so.
+func (s *SplitReadWriteFilesystem) fallback(op, path string, err error) bool {
+	if !errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if s.Fallback != nil {
+		s.Fallback(op, path)
+	}
+	return true
+}
+
+// CheckConfig checks the config on the replica, or on the write Filesystem
+// if the replica has none.
+func (s *SplitReadWriteFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	exists, size, err := s.read.CheckConfig(ctx, path)
+	if err == nil && !exists {
+		err = ErrNotFound
+	}
+	if s.fallback("CheckConfig", path, err) {
+		return s.Filesystem.CheckConfig(ctx, path)
+	}
+	return exists, size, err
+}
+
+// GetConfig returns the config from the replica, or from the write
+// Filesystem if the replica has none.
+func (s *SplitReadWriteFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	buf, err := s.read.GetConfig(ctx, path)
+	if s.fallback("GetConfig", path, err) {
+		return s.Filesystem.GetConfig(ctx, path)
+	}
+	return buf, err
+}
+
+// GetConfigReader returns a reader for the config from the replica, or from
+// the write Filesystem if the replica has none.
+func (s *SplitReadWriteFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	rd, size, err := s.read.GetConfigReader(ctx, path)
+	if s.fallback("GetConfigReader", path, err) {
+		return s.Filesystem.GetConfigReader(ctx, path)
+	}
+	return rd, size, err
+}
+
+// ListBlobs lists the blobs on the replica, or on the write Filesystem if the
+// directory is missing on the replica.
+func (s *SplitReadWriteFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	blobs, err := s.read.ListBlobs(ctx, path)
+	if s.fallback("ListBlobs", path, err) {
+		return s.Filesystem.ListBlobs(ctx, path)
+	}
+	return blobs, err
+}
+
+// ListBlobsFunc lists the blobs on the replica, or on the write Filesystem if
+// the directory is missing on the replica.
+func (s *SplitReadWriteFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	listed := false
+	err := s.read.ListBlobsFunc(ctx, path, func(blob Blob) error {
+		listed = true
+		return fn(blob)
+	})
+	if !listed && s.fallback("ListBlobsFunc", path, err) {
+		return s.Filesystem.ListBlobsFunc(ctx, path, fn)
+	}
+	return err
+}
+
+// CheckBlob checks the blob on the replica, or on the write Filesystem if the
+// replica lacks it.
+func (s *SplitReadWriteFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	blob, err := s.read.CheckBlob(ctx, path)
+	if s.fallback("CheckBlob", path, err) {
+		return s.Filesystem.CheckBlob(ctx, path)
+	}
+	return blob, err
+}
+
+// GetBlob returns a reader for the blob from the replica, or from the write
+// Filesystem if the replica lacks it.
+func (s *SplitReadWriteFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := s.read.GetBlob(ctx, path)
+	if s.fallback("GetBlob", path, err) {
+		return s.Filesystem.GetBlob(ctx, path)
+	}
+	return rd, err
+}
+
+// Walk lists the blobs of each object type like ListBlobsFunc.
+func (s *SplitReadWriteFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	return WalkTypes(ctx, s, path, fn)
+}
+
+// RepoStats returns the statistics of the repository on the replica, or on
+// the write Filesystem if the replica lacks the repository.
+func (s *SplitReadWriteFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	stats, err := s.read.RepoStats(ctx, path)
+	if s.fallback("RepoStats", path, err) {
+		return s.Filesystem.RepoStats(ctx, path)
+	}
+	return stats, err
+}
+
+// Sync syncs the write Filesystem, the replica is never written.
+func (s *SplitReadWriteFilesystem) Sync(ctx context.Context) error {
+	return s.Filesystem.Sync(ctx)
+}
+
+// Close closes the replica and the write Filesystem.
+func (s *SplitReadWriteFilesystem) Close() error {
+	err := s.read.Close()
+	if werr := s.Filesystem.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitReadWriteFilesystem(t *testing.T) {
+	ctx := context.Background()
+	replica, primary := NewMemoryFilesystem(), NewMemoryFilesystem()
+	f := NewSplitReadWriteFilesystem(replica, primary)
+	var fallbacks []string
+	f.Fallback = func(op, path string) {
+		fallbacks = append(fallbacks, op)
+	}
+
+	repo := filepath.FromSlash("/repo")
+	old := filepath.Join(repo, "keys", testID)
+	for _, m := range []*MemoryFilesystem{replica, primary} {
+		if _, err := m.SaveBlob(ctx, old, strings.NewReader("old"), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// writes only go to the primary
+	cfg := filepath.Join(repo, "config")
+	if err := f.SaveConfig(ctx, cfg, strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replica.read(blob); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("blob must not be written to the replica, got %v", err)
+	}
+
+	// reads of files the replica lacks fall through
+	if buf, err := f.GetConfig(ctx, cfg); err != nil || string(buf) != "config" {
+		t.Fatalf("GetConfig: got %q, %v", buf, err)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf := readAll(t, rd); string(buf) != "foobar" {
+		t.Fatalf("GetBlob: got %q", buf)
+	}
+	if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil || len(blobs) != 1 {
+		t.Fatalf("ListBlobs: got %v, %v", blobs, err)
+	}
+	want := []string{"GetConfig", "CheckBlob", "GetBlob", "ListBlobs"}
+	if strings.Join(fallbacks, ",") != strings.Join(want, ",") {
+		t.Fatalf("want fallbacks %v, got %v", want, fallbacks)
+	}
+
+	// deletions only go to the primary, the replica is read while it is
+	// stale
+	if _, err := f.DeleteBlob(ctx, old, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.read(old); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("blob not removed from the primary: %v", err)
+	}
+	fallbacks = nil
+	if b, err := f.CheckBlob(ctx, old); err != nil || b.Size != 3 {
+		t.Fatalf("CheckBlob: want the stale blob of the replica, got %v, %v", b, err)
+	}
+	if len(fallbacks) != 0 {
+		t.Fatalf("want no fallbacks, got %v", fallbacks)
+	}
+
+	missing := filepath.Join(repo, "keys", strings.Repeat("0", 64))
+	if _, err := f.CheckBlob(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CheckBlob: want ErrNotFound, got %v", err)
+	}
+}
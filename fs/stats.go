@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// RepoStats contains the number and total size of the blobs in a repository.
+type RepoStats struct {
+	Size  int64 `json:"size"`
+	Count int64 `json:"count"`
+
+	// Types contains the statistics for each of the ObjectTypes.
+	Types map[string]ObjectStats `json:"types"`
+}
+
+// ObjectStats contains the number and total size of the blobs of a single
+// object type.
+type ObjectStats struct {
+	Size  int64 `json:"size"`
+	Count int64 `json:"count"`
+}
+
+// add adds the statistics for an object type.
+func (s *RepoStats) add(objectType string, o ObjectStats) {
+	if s.Types == nil {
+		s.Types = make(map[string]ObjectStats, len(ObjectTypes))
+	}
+	t := s.Types[objectType]
+	t.Size += o.Size
+	t.Count += o.Count
+	s.Types[objectType] = t
+	s.Size += o.Size
+	s.Count += o.Count
+}
+
+// listRepoStats computes the statistics for the repository at path by
+// listing the blobs of all object types. Missing object type directories are
+// skipped.
+func listRepoStats(ctx context.Context, f Filesystem, path string) (RepoStats, error) {
+	var stats RepoStats
+	for _, t := range ObjectTypes {
+		var o ObjectStats
+		err := f.ListBlobsFunc(ctx, filepath.Join(path, t), func(blob Blob) error {
+			o.Size += blob.Size
+			o.Count++
+			return nil
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return RepoStats{}, err
+		}
+		stats.add(t, o)
+	}
+	return stats, nil
+}
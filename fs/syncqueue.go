@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// maxDeferredSyncs is the number of saved blobs whose sync may be pending
+// with SyncDeferred. Once it is reached, SaveBlob waits for the queue, which
+// bounds the memory used and the amount of data at risk.
+const maxDeferredSyncs = 1024
+
+// syncQueue syncs files in the background, one at a time in the order they
+// have been added. The worker is started when files are added and exits once
+// the queue is empty. The zero value is ready to use.
+type syncQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled whenever a file has been synced
+	pending []string
+	running bool
+
+	added, synced uint64 // number of files
+
+	failed   int // since the last flush
+	firstErr error
+}
+
+func (q *syncQueue) init() {
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mu)
+	}
+}
+
+// add queues the file at path to be synced using fn, waiting while the queue
+// is full.
+func (q *syncQueue) add(path string, fn func(path string) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.init()
+	for len(q.pending) >= maxDeferredSyncs {
+		q.cond.Wait()
+	}
+	q.pending = append(q.pending, path)
+	q.added++
+	if !q.running {
+		q.running = true
+		go q.run(fn)
+	}
+}
+
+func (q *syncQueue) run(fn func(path string) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) > 0 {
+		path := q.pending[0]
+		q.pending = q.pending[1:]
+
+		q.mu.Unlock()
+		err := fn(path)
+		q.mu.Lock()
+
+		q.synced++
+		if err != nil {
+			if q.failed == 0 {
+				q.firstErr = err
+			}
+			q.failed++
+		}
+		q.cond.Broadcast()
+	}
+	q.running = false
+}
+
+// flush waits until all files added before have been synced. It returns an
+// error if syncing any file has failed since the last flush.
+func (q *syncQueue) flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.init()
+	for target := q.added; q.synced < target; {
+		q.cond.Wait()
+	}
+	if q.failed == 0 {
+		return nil
+	}
+	err := fmt.Errorf("syncing %d saved blobs failed, first error: %w", q.failed, q.firstErr)
+	q.failed, q.firstErr = 0, nil
+	return err
+}
@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSyncQueue(t *testing.T) {
+	var q syncQueue
+	if err := q.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var synced []string
+	errSync := errors.New("sync failed")
+	fn := func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		synced = append(synced, path)
+		if strings.HasPrefix(path, "bad") {
+			return errSync
+		}
+		return nil
+	}
+	var want []string
+	for i := 0; i < 2*maxDeferredSyncs; i++ {
+		path := fmt.Sprint(i)
+		if i%500 == 1 {
+			path = "bad" + path
+		}
+		q.add(path, fn)
+		want = append(want, path)
+	}
+
+	// deferred errors are reported once
+	err := q.flush()
+	if !errors.Is(err, errSync) || !strings.Contains(err.Error(), "syncing 5 saved blobs failed") {
+		t.Fatalf("want sync error for 5 blobs, got %v", err)
+	}
+	if err := q.flush(); err != nil {
+		t.Fatalf("errors must be reset, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(synced, ",") != strings.Join(want, ",") {
+		t.Fatalf("files must be synced in order, got %d of %d", len(synced), len(want))
+	}
+}
@@ -0,0 +1,247 @@
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ExportTar writes the repository at path to w as a tar archive, e.g. to
+// stream it to a client for a cold archive or a migration. The archive
+// contains the directories and regular files of the repository with their
+// paths relative to path and their permissions, nothing is staged on disk.
+// Temporary files, the RepoLockFile and nested repositories are left out, as
+// are symlinks and other special files. The repository can be recreated with
+// ImportTar.
+//
+// The export holds a shared lock on the repository, see LockRepo, so that it
+// is not deleted or moved while it is written. Blobs removed by clients in
+// the meantime are skipped, blobs added in the meantime may be missing.
+func (d *DiskFilesystem) ExportTar(ctx context.Context, path string, w io.Writer) error {
+	path = filepath.Clean(path)
+	if err := d.checkRepo(path); err != nil {
+		return err
+	}
+	unlock, err := d.LockRepo(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tw := tar.NewWriter(w)
+	err = filepath.WalkDir(path, func(file string, e os.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) && file != path {
+			// removed in the meantime
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if file == path {
+			return nil
+		}
+		if e.IsDir() && d.isNestedRepo(path, file) {
+			return filepath.SkipDir
+		}
+		if !e.IsDir() && (!e.Type().IsRegular() || isTempFile(e.Name())) {
+			return nil
+		}
+		if filepath.Dir(file) == path && e.Name() == RepoLockFile {
+			// belongs to the lock held by the export
+			return nil
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		return exportEntry(ctx, tw, file, filepath.ToSlash(rel), e)
+	})
+	if err != nil {
+		return classify(err)
+	}
+	return tw.Close()
+}
+
+// exportEntry writes the directory or regular file at file to tw as name.
+func exportEntry(ctx context.Context, tw *tar.Writer, file, name string, e os.DirEntry) error {
+	fi, err := e.Info()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(fi.Mode().Perm()),
+		ModTime: fi.ModTime(),
+	}
+	if fi.IsDir() {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		return tw.WriteHeader(hdr)
+	}
+
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	// the size written to the header must match the data
+	if fi, err = f.Stat(); err != nil {
+		return err
+	}
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = fi.Size()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, contextReader{ctx, f}, hdr.Size); err != nil {
+		return fmt.Errorf("%v: %w", file, err)
+	}
+	return nil
+}
+
+// ImportTar creates the repository at path from the tar archive read from r,
+// as written by ExportTar. The path must not exist yet, missing parents are
+// created. The archive is extracted into a temporary directory next to path,
+// which is renamed to path only once it has been read completely and looks
+// like a repository with a config and the directories of all object types,
+// so clients never see a partially imported repository. Otherwise
+// ErrNotRepo is returned and nothing is left behind.
+//
+// The archive may only contain directories and regular files with relative
+// paths inside the repository, other entries fail the import with
+// ErrInvalidName. The permissions of the entries are kept.
+func (d *DiskFilesystem) ImportTar(ctx context.Context, path string, r io.Reader) error {
+	path = filepath.Clean(path)
+	if _, err := os.Lstat(path); err == nil {
+		return repoExists(path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := d.mkdirAll(filepath.Dir(path)); err != nil {
+		return classify(err)
+	}
+	tmp := filepath.Join(filepath.Dir(path), tempName(filepath.Base(path), fmt.Sprintf("%08x", rand.Uint32())))
+	if err := d.mkdir(tmp); err != nil {
+		return classify(err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			_ = os.RemoveAll(tmp)
+		}
+	}()
+
+	dirs, err := d.extractTar(ctx, tmp, r)
+	if err != nil {
+		return classify(err)
+	}
+	if !d.isRepo(tmp) {
+		return fmt.Errorf("archive for %v is not a repository: %w", path, ErrNotRepo)
+	}
+	// the permissions of the directories are set last, so that read-only
+	// directories do not keep their contents from being extracted
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return classify(err)
+		}
+		if err := d.syncDir(dirs[i].path); err != nil {
+			return err
+		}
+	}
+	if err := d.syncDir(tmp); err != nil {
+		return err
+	}
+	if err := d.fsys().Rename(tmp, path); err != nil {
+		return classify(err)
+	}
+	done = true
+	d.renamed.Delete(path)
+	d.layouts.Delete(path)
+	return d.syncDir(filepath.Dir(path))
+}
+
+// tarDir is a directory extracted by extractTar.
+type tarDir struct {
+	path string
+	mode os.FileMode
+}
+
+// extractTar extracts the archive read from r into dir, and returns the
+// directories of the archive, whose permissions have not been set yet.
+func (d *DiskFilesystem) extractTar(ctx context.Context, dir string, r io.Reader) ([]tarDir, error) {
+	var dirs []tarDir
+	tr := tar.NewReader(contextReader{ctx, r})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return dirs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("%q is outside of the repository: %w", hdr.Name, ErrInvalidName)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%q is outside of the repository: %w", hdr.Name, ErrInvalidName)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := d.mkdirAll(target); err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, tarDir{target, mode})
+		case tar.TypeReg:
+			if err := d.mkdirAll(filepath.Dir(target)); err != nil {
+				return nil, err
+			}
+			if err := d.extractFile(target, mode, tr); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%q has unsupported type %q: %w", hdr.Name, hdr.Typeflag, ErrInvalidName)
+		}
+	}
+}
+
+// extractFile writes the data read from rd to the new file name with the
+// permissions mode, and syncs it.
+func (d *DiskFilesystem) extractFile(name string, mode os.FileMode, rd io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rd)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		_, err = d.syncFileMode(f, d.SyncMode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
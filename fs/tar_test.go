@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskFilesystemExportImportTar(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join("data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, filepath.Join(repo, blob), strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(repo, blob), 0400); err != nil {
+		t.Fatal(err)
+	}
+	// temporary files are not exported
+	if err := ioutil.WriteFile(filepath.Join(repo, "data", tempName(testID, "1")), []byte("tmp"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := f.ExportTar(ctx, repo, &buf); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[hdr.Name] = true
+	}
+	for name, want := range map[string]bool{
+		"config":                        true,
+		"keys/":                         true,
+		filepath.ToSlash(blob):          true,
+		"nested/":                       false,
+		"data/" + tempName(testID, "1"): false,
+	} {
+		if names[name] != want {
+			t.Errorf("%v: want exported %v, got %v", name, want, names[name])
+		}
+	}
+
+	dst := filepath.Join(root, "imported", "repo")
+	if err := f.ImportTar(ctx, dst, bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := f.CheckBlob(ctx, filepath.Join(dst, blob)); err != nil || b.Size != 6 {
+		t.Fatalf("want the blob imported, got %v, %v", b, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, blob)); err != nil || fi.Mode().Perm() != 0400 {
+		t.Fatalf("want the mode kept, got %v, %v", fi, err)
+	}
+	if err := f.ImportTar(ctx, dst, bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("want ErrRepoExists, got %v", err)
+	}
+}
+
+func TestDiskFilesystemImportTarInvalid(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	root := t.TempDir()
+	archive := func(hdrs ...tar.Header) *bytes.Buffer {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range hdrs {
+			hdr := hdr
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return &buf
+	}
+	for _, test := range []struct {
+		name string
+		rd   *bytes.Buffer
+		err  error
+	}{
+		{"outside", archive(tar.Header{Name: "../evil", Typeflag: tar.TypeDir, Mode: 0700}), ErrInvalidName},
+		{"absolute", archive(tar.Header{Name: "/evil", Typeflag: tar.TypeDir, Mode: 0700}), ErrInvalidName},
+		{"symlink", archive(tar.Header{Name: "config", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}), ErrInvalidName},
+		{"no repository", archive(tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0700}), ErrNotRepo},
+	} {
+		if err := f.ImportTar(ctx, filepath.Join(root, "repo"), test.rd); !errors.Is(err, test.err) {
+			t.Errorf("%v: want %v, got %v", test.name, test.err, err)
+		}
+	}
+	if entries, err := os.ReadDir(root); err != nil || len(entries) != 0 {
+		t.Fatalf("want nothing left behind, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// ThrottledFilesystem wraps a Filesystem and limits the bandwidth of blob
+// transfers. The limit is shared by all transfers, so that e.g. a restore
+// cannot saturate the uplink while backups are running.
+type ThrottledFilesystem struct {
+	Filesystem
+	limiter *rate.Limiter
+}
+
+// NewThrottledFilesystem returns a ThrottledFilesystem for base which
+// transfers at most bytesPerSecond bytes per second, zero disables the limit.
+func NewThrottledFilesystem(base Filesystem, bytesPerSecond int64) *ThrottledFilesystem {
+	t := &ThrottledFilesystem{
+		Filesystem: base,
+		limiter:    rate.NewLimiter(rate.Inf, 0),
+	}
+	t.SetLimit(bytesPerSecond)
+	return t
+}
+
+// SetLimit changes the limit to bytesPerSecond, zero disables the limit. It
+// can be called while transfers are running.
+func (t *ThrottledFilesystem) SetLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		t.limiter.SetLimit(rate.Inf)
+		return
+	}
+	t.limiter.SetBurst(int(bytesPerSecond))
+	t.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// Limit returns the current limit in bytes per second, zero means no limit.
+func (t *ThrottledFilesystem) Limit() int64 {
+	if t.limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(t.limiter.Limit())
+}
+
+// GetBlob returns a reader for the blob which is throttled.
+func (t *ThrottledFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := t.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledReadSeekCloser{
+		ReadSeekCloser: rd,
+		rd:             throttledReader{ctx: ctx, rd: rd, limiter: t.limiter},
+	}, nil
+}
+
+// SaveBlob saves the blob, throttling the reads from rd.
+func (t *ThrottledFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	return t.Filesystem.SaveBlob(ctx, path, throttledReader{ctx: ctx, rd: rd, limiter: t.limiter}, expectedSize)
+}
+
+// throttledReader waits for the limiter after each read from rd.
+type throttledReader struct {
+	ctx     context.Context
+	rd      io.Reader
+	limiter *rate.Limiter
+}
+
+func (r throttledReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	if werr := r.wait(n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// wait blocks until n bytes may be transferred. The limiter cannot wait for
+// more than its burst size at once, so larger reads are split.
+func (r throttledReader) wait(n int) error {
+	for n > 0 {
+		if r.limiter.Limit() == rate.Inf {
+			return nil
+		}
+		m := n
+		if burst := r.limiter.Burst(); burst > 0 && m > burst {
+			m = burst
+		}
+		if err := r.limiter.WaitN(r.ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
+type throttledReadSeekCloser struct {
+	io.ReadSeekCloser
+	rd throttledReader
+}
+
+func (r *throttledReadSeekCloser) Read(p []byte) (int, error) {
+	return r.rd.Read(p)
+}
@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThrottledFilesystem(t *testing.T) {
+	ctx := context.Background()
+	f := NewThrottledFilesystem(NewMemoryFilesystem(), 20000)
+	if f.Limit() != 20000 {
+		t.Fatalf("want limit 20000, got %v", f.Limit())
+	}
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	data := make([]byte, 30000)
+
+	// the first 20000 bytes are within the burst, the rest takes 0.5s
+	start := time.Now()
+	if _, err := f.SaveBlob(ctx, blob, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("upload was not throttled, took %v", d)
+	}
+
+	// the limit is shared, reading now has to wait for the tokens
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	slow, err := f.GetBlob(cctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(slow); err == nil {
+		t.Fatal("read must fail once the context expires")
+	}
+
+	f.SetLimit(0)
+	if f.Limit() != 0 {
+		t.Fatalf("want no limit, got %v", f.Limit())
+	}
+	start = time.Now()
+	if buf, err := ioutil.ReadAll(rd); err != nil || len(buf) != len(data) {
+		t.Fatalf("ReadAll: got %v bytes, %v", len(buf), err)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Fatalf("unlimited read took %v", d)
+	}
+	_ = rd.Close()
+}
@@ -0,0 +1,277 @@
+package fs
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TieredFilesystem wraps a Filesystem, the cold tier, and caches blobs which
+// are read in a directory on fast storage, the hot tier. This lets a small
+// SSD accelerate restores from a large repository stored on HDDs.
+//
+// Blobs are only copied to the hot tier when they are read, saving a blob
+// stores it in the cold tier and drops the outdated cached copy. Once the
+// cached blobs exceed the size limit, the least recently read ones are
+// removed. The cold tier always stores all blobs, so the hot tier can be
+// wiped at any time.
+//
+// The hot tier mirrors the paths below the root directory of the cold tier.
+// The cache index is kept in memory, NewTieredFilesystem rebuilds it from
+// the blobs found in the hot tier.
+type TieredFilesystem struct {
+	Filesystem
+	root     string
+	hotDir   string
+	maxBytes int64
+	hot      *DiskFilesystem
+
+	mu      sync.Mutex
+	lru     *list.List               // of *hotEntry, most recently read first
+	entries map[string]*list.Element // path in the cold tier -> lru element
+	used    int64
+}
+
+// hotEntry is a blob stored in the hot tier.
+type hotEntry struct {
+	path string // in the cold tier
+	size int64
+}
+
+// NewTieredFilesystem returns a TieredFilesystem which caches the blobs of
+// cold read below root in hotDir, using at most maxBytes.
+func NewTieredFilesystem(cold Filesystem, root, hotDir string, maxBytes int64) (*TieredFilesystem, error) {
+	t := &TieredFilesystem{
+		Filesystem: cold,
+		root:       filepath.Clean(root),
+		hotDir:     filepath.Clean(hotDir),
+		maxBytes:   maxBytes,
+		// cached blobs are synced before they are renamed, so that a crash
+		// never leaves a corrupt blob behind in the cache
+		hot:     &DiskFilesystem{SyncMode: SyncDataOnly},
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	if err := os.MkdirAll(t.hotDir, DefaultDirMode); err != nil {
+		return nil, err
+	}
+	if err := t.scan(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// scan fills the index with the blobs in the hot tier, in the order of their
+// modification time which is updated whenever a blob is read. Leftover
+// temporary files are removed.
+func (t *TieredFilesystem) scan() error {
+	var entries []*hotEntry
+	mtimes := make(map[*hotEntry]time.Time)
+	err := filepath.Walk(t.hotDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if isTempFile(fi.Name()) {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(t.hotDir, path)
+		if err != nil {
+			return err
+		}
+		e := &hotEntry{path: filepath.Join(t.root, rel), size: fi.Size()}
+		entries = append(entries, e)
+		mtimes[e] = fi.ModTime()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return mtimes[entries[i]].After(mtimes[entries[j]])
+	})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range entries {
+		t.entries[e.path] = t.lru.PushBack(e)
+		t.used += e.size
+	}
+	// the limit may have been lowered since the last start
+	t.evict()
+	return nil
+}
+
+// hotPath returns the path in the hot tier for the blob at path, or false if
+// path is not below the root.
+func (t *TieredFilesystem) hotPath(path string) (string, bool) {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.Join(t.hotDir, rel), true
+}
+
+// add records the blob at path as cached and evicts other blobs as needed.
+func (t *TieredFilesystem) add(path string, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[path]; ok {
+		// promoted concurrently, the last copy has replaced the others
+		e := el.Value.(*hotEntry)
+		t.used += size - e.size
+		e.size = size
+		t.lru.MoveToFront(el)
+	} else {
+		t.entries[path] = t.lru.PushFront(&hotEntry{path: path, size: size})
+		t.used += size
+	}
+	t.evict()
+}
+
+// evict removes the least recently read blobs from the hot tier until the
+// size limit is met. The caller must hold the lock.
+func (t *TieredFilesystem) evict() {
+	for t.used > t.maxBytes && t.lru.Len() > 0 {
+		e := t.lru.Remove(t.lru.Back()).(*hotEntry)
+		delete(t.entries, e.path)
+		t.used -= e.size
+		t.removeHot(e.path)
+	}
+}
+
+// removeHot removes the blob at path from the hot tier.
+func (t *TieredFilesystem) removeHot(path string) {
+	hp, ok := t.hotPath(path)
+	if !ok {
+		return
+	}
+	if _, err := t.hot.DeleteBlob(context.Background(), hp, false); err != nil && !os.IsNotExist(err) {
+		log.Printf("tiered: removing cached blob: %v", err)
+	}
+}
+
+// drop removes the cached copy of the blob at path, if any.
+func (t *TieredFilesystem) drop(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	el, ok := t.entries[path]
+	if !ok {
+		return
+	}
+	e := t.lru.Remove(el).(*hotEntry)
+	delete(t.entries, path)
+	t.used -= e.size
+	t.removeHot(path)
+}
+
+// getHot opens the cached copy of the blob at path and marks it as recently
+// read. It returns false if the blob is not cached.
+func (t *TieredFilesystem) getHot(ctx context.Context, path, hp string) (io.ReadSeekCloser, bool) {
+	t.mu.Lock()
+	el, ok := t.entries[path]
+	if ok {
+		t.lru.MoveToFront(el)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	rd, err := t.hot.GetBlob(ctx, hp)
+	if err != nil {
+		// removed behind our back, read the blob from the cold tier
+		t.drop(path)
+		return nil, false
+	}
+	// keep the order for rebuilding the index, errors only affect the order
+	now := time.Now()
+	_ = os.Chtimes(hp, now, now)
+	return rd, true
+}
+
+// GetBlob returns the cached copy of the blob if there is one. Otherwise the
+// blob is copied from the cold tier to the hot tier first, unless it is
+// larger than the size limit.
+func (t *TieredFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	hp, ok := t.hotPath(path)
+	if !ok {
+		return t.Filesystem.GetBlob(ctx, path)
+	}
+	if rd, ok := t.getHot(ctx, path, hp); ok {
+		return rd, nil
+	}
+
+	rd, err := t.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	if size > t.maxBytes {
+		return rd, nil
+	}
+
+	if _, err := t.hot.SaveBlob(ctx, hp, rd, size); err != nil {
+		// the cache is only an optimization, serve the blob from the cold
+		// tier instead
+		log.Printf("tiered: caching blob: %v", err)
+		if _, err := rd.Seek(0, io.SeekStart); err != nil {
+			_ = rd.Close()
+			return nil, err
+		}
+		return rd, nil
+	}
+	_ = rd.Close()
+	t.add(path, size)
+
+	hot, err := t.hot.GetBlob(ctx, hp)
+	if err != nil {
+		// evicted right away by concurrent reads
+		return t.Filesystem.GetBlob(ctx, path)
+	}
+	return hot, nil
+}
+
+// SaveBlob saves the blob in the cold tier and drops the cached copy.
+func (t *TieredFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	n, err := t.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+	t.drop(path)
+	return n, err
+}
+
+// DeleteBlob removes the blob from both tiers.
+func (t *TieredFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	t.drop(path)
+	return t.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs from both tiers.
+func (t *TieredFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	for _, path := range paths {
+		t.drop(path)
+	}
+	return t.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
+
+// HotUsage returns the number of bytes used by the blobs in the hot tier.
+func (t *TieredFilesystem) HotUsage() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.used
+}
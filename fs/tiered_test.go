@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTieredFilesystem(t *testing.T) {
+	ctx := context.Background()
+	cold := NewMemoryFilesystem()
+	root := filepath.FromSlash("/srv/restic")
+	hotDir := t.TempDir()
+	f, err := NewTieredFilesystem(cold, root, hotDir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(root, "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blobs := make([]string, 3)
+	for i := range blobs {
+		id := fmt.Sprintf("%064x", i)
+		blobs[i] = filepath.Join(repo, "data", id[:2], id)
+		if _, err := f.SaveBlob(ctx, blobs[i], strings.NewReader(fmt.Sprintf("blob %05d", i)), 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hotPath := func(path string) string {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(hotDir, rel)
+	}
+	cached := func(path string) bool {
+		_, err := os.Stat(hotPath(path))
+		return err == nil
+	}
+	read := func(path string) string {
+		rd, err := f.GetBlob(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = rd.Close()
+		}()
+		return string(readAll(t, rd))
+	}
+
+	if cached(blobs[0]) {
+		t.Fatal("saved blobs must not be cached")
+	}
+	if buf := read(blobs[0]); buf != "blob 00000" || !cached(blobs[0]) {
+		t.Fatalf("blob must be cached after reading, got %q", buf)
+	}
+	read(blobs[1])
+	read(blobs[0])
+	// only two blobs fit, the least recently read one is evicted
+	read(blobs[2])
+	if !cached(blobs[0]) || cached(blobs[1]) || !cached(blobs[2]) || f.HotUsage() != 20 {
+		t.Fatalf("wrong blob evicted, usage %d", f.HotUsage())
+	}
+
+	// the index is rebuilt from the hot tier
+	f, err = NewTieredFilesystem(cold, root, hotDir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.HotUsage() != 20 {
+		t.Fatalf("want usage 20 after restart, got %d", f.HotUsage())
+	}
+
+	// saving a blob drops the outdated copy
+	if _, err := f.SaveBlob(ctx, blobs[2], strings.NewReader("new blob 2"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if cached(blobs[2]) {
+		t.Fatal("outdated blob must be dropped")
+	}
+	if buf := read(blobs[2]); buf != "new blob 2" {
+		t.Fatalf("want new blob, got %q", buf)
+	}
+
+	if _, err := f.DeleteBlob(ctx, blobs[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.DeleteBlobs(ctx, []string{blobs[2]}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range []string{blobs[0], blobs[2]} {
+		if cached(blob) {
+			t.Fatalf("%v must be removed from the hot tier", blob)
+		}
+		if _, err := f.GetBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("GetBlob: want not exist error, got %v", err)
+		}
+	}
+	if f.HotUsage() != 0 {
+		t.Fatalf("want no usage, got %d", f.HotUsage())
+	}
+
+	// blobs larger than the hot tier are not cached
+	large := filepath.Join(repo, "keys", testID)
+	if _, err := f.SaveBlob(ctx, large, strings.NewReader(strings.Repeat("x", 30)), 30); err != nil {
+		t.Fatal(err)
+	}
+	if buf := read(large); len(buf) != 30 || cached(large) {
+		t.Fatalf("large blob must be read from the cold tier, got %d bytes", len(buf))
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(hotDir, "repo", "keys")); err == nil && len(entries) != 0 {
+		t.Fatalf("unexpected files in the hot tier: %v", entries)
+	}
+}
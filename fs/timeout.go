@@ -0,0 +1,442 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTimeout is returned by TimeoutFilesystem if the underlying Filesystem
+// did not complete an operation within the timeout.
+var ErrTimeout = newError("timeout", "storage operation timed out")
+
+// TimeoutFilesystem wraps a Filesystem and fails operations with ErrTimeout
+// which the underlying Filesystem does not complete within the timeout, e.g.
+// because an NFS mount is wedged and a stat never returns. Each operation
+// runs in its own goroutine, which the request stops waiting for once the
+// timeout has passed, so that a single bad mount does not tie up all
+// requests of the server.
+//
+// A blocking system call cannot be interrupted, the goroutine of an operation
+// which timed out keeps running until the call returns. Its context is
+// canceled and files it opens afterwards are closed, see Pending.
+//
+// The time spent waiting for the client, reading the data of SaveBlob and
+// SaveConfig or in the function passed to ListBlobsFunc and Walk, does not
+// count towards the timeout, which only applies to the time spent in the
+// underlying Filesystem since the client was last waited for. The readers
+// returned by GetBlob and GetConfigReader are not covered, as the buffer
+// passed to Read cannot be handed to a goroutine which may outlive the call.
+// ReadIdleTimeout of DiskFilesystem handles clients which stop reading.
+type TimeoutFilesystem struct {
+	Filesystem
+	timeout time.Duration
+	pending int64 // must be accessed using sync/atomic
+}
+
+// NewTimeoutFilesystem returns a TimeoutFilesystem for base which fails
+// operations taking longer than timeout.
+func NewTimeoutFilesystem(base Filesystem, timeout time.Duration) *TimeoutFilesystem {
+	return &TimeoutFilesystem{Filesystem: base, timeout: timeout}
+}
+
+// Pending returns the number of operations which have timed out but are
+// still running in the underlying Filesystem. A growing number means that
+// the storage hangs.
+func (t *TimeoutFilesystem) Pending() int64 {
+	return atomic.LoadInt64(&t.pending)
+}
+
+// clientWait tracks the time an operation spends waiting for the client.
+// Once the operation has been abandoned, the client is no longer waited for.
+type clientWait struct {
+	mu        sync.Mutex // held while waiting for the client
+	last      time.Time  // when the client was last waited for
+	abandoned bool
+}
+
+func newClientWait() *clientWait {
+	return &clientWait{last: time.Now()}
+}
+
+// begin starts to wait for the client, it returns ErrTimeout if the
+// operation has already been abandoned. Otherwise end must be called.
+func (c *clientWait) begin() error {
+	c.mu.Lock()
+	if c.abandoned {
+		c.mu.Unlock()
+		return ErrTimeout
+	}
+	return nil
+}
+
+// end stops waiting for the client.
+func (c *clientWait) end() {
+	c.last = time.Now()
+	c.mu.Unlock()
+}
+
+// abandon marks the operation as abandoned, waiting until the client is no
+// longer waited for. Unless force is set, the operation is only abandoned if
+// the client has not been waited for within timeout, otherwise abandon
+// returns how much longer the operation may take.
+func (c *clientWait) abandon(timeout time.Duration, force bool) time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rest := timeout - time.Since(c.last); rest > 0 && !force {
+		return rest
+	}
+	c.abandoned = true
+	return 0
+}
+
+// clientReader reads from rd, the time spent in Read counts as waiting for
+// the client.
+type clientReader struct {
+	rd   io.Reader
+	wait *clientWait
+}
+
+func (r clientReader) Read(p []byte) (int, error) {
+	if err := r.wait.begin(); err != nil {
+		return 0, err
+	}
+	defer r.wait.end()
+	return r.rd.Read(p)
+}
+
+// run calls fn like call, for operations which only return an error.
+func (t *TimeoutFilesystem) run(ctx context.Context, op, path string, wait *clientWait, fn func(ctx context.Context) error, cleanup func()) error {
+	_, err := t.call(ctx, op, path, wait, fn, cleanup)
+	return err
+}
+
+// call calls fn in a new goroutine and waits until it returns, ctx is
+// canceled or it has taken longer than the timeout, not counting the time
+// spent waiting for the client if wait is not nil. It reports whether fn has
+// returned. Only then may the caller read the results fn has stored,
+// otherwise fn is still running and may store them at any time, so the
+// caller must return zero values. If fn has been abandoned, cleanup is called
+// once it returns, e.g. to close a file it has opened.
+func (t *TimeoutFilesystem) call(ctx context.Context, op, path string, wait *clientWait, fn func(ctx context.Context) error, cleanup func()) (bool, error) {
+	opCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(opCtx)
+	}()
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+loop:
+	for {
+		select {
+		case err := <-done:
+			cancel()
+			return true, err
+		case <-ctx.Done():
+			wait.abandon(t.timeout, true)
+			break loop
+		case <-timer.C:
+			if rest := wait.abandon(t.timeout, false); rest > 0 {
+				timer.Reset(rest)
+				continue
+			}
+			break loop
+		}
+	}
+
+	cancel()
+	atomic.AddInt64(&t.pending, 1)
+	go func() {
+		err := <-done
+		atomic.AddInt64(&t.pending, -1)
+		if err == nil && cleanup != nil {
+			cleanup()
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	log.Printf("WARNING: %v of %v did not complete within %v", op, path, t.timeout)
+	return false, fmt.Errorf("%v %v: %w", op, path, ErrTimeout)
+}
+
+// CreateRepo creates the repository.
+func (t *TimeoutFilesystem) CreateRepo(ctx context.Context, path string) error {
+	return t.run(ctx, "CreateRepo", path, nil, func(ctx context.Context) error {
+		return t.Filesystem.CreateRepo(ctx, path)
+	}, nil)
+}
+
+// CheckConfig checks the config.
+func (t *TimeoutFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	var exists bool
+	var size int64
+	done, err := t.call(ctx, "CheckConfig", path, nil, func(ctx context.Context) error {
+		var err error
+		exists, size, err = t.Filesystem.CheckConfig(ctx, path)
+		return err
+	}, nil)
+	if !done {
+		return false, 0, err
+	}
+	return exists, size, err
+}
+
+// GetConfig returns the config.
+func (t *TimeoutFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	var buf []byte
+	done, err := t.call(ctx, "GetConfig", path, nil, func(ctx context.Context) error {
+		var err error
+		buf, err = t.Filesystem.GetConfig(ctx, path)
+		return err
+	}, nil)
+	if !done {
+		return nil, err
+	}
+	return buf, err
+}
+
+// GetConfigReader opens the config, reading it is not covered by the
+// timeout.
+func (t *TimeoutFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	var rd io.ReadCloser
+	var size int64
+	done, err := t.call(ctx, "GetConfigReader", path, nil, func(ctx context.Context) error {
+		var err error
+		rd, size, err = t.Filesystem.GetConfigReader(ctx, path)
+		return err
+	}, func() {
+		_ = rd.Close()
+	})
+	if !done {
+		return nil, 0, err
+	}
+	return rd, size, err
+}
+
+// SaveConfig saves the config.
+func (t *TimeoutFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	wait := newClientWait()
+	return t.run(ctx, "SaveConfig", path, wait, func(ctx context.Context) error {
+		return t.Filesystem.SaveConfig(ctx, path, clientReader{rd, wait})
+	}, nil)
+}
+
+// DeleteConfig removes the config.
+func (t *TimeoutFilesystem) DeleteConfig(ctx context.Context, path string) error {
+	return t.run(ctx, "DeleteConfig", path, nil, func(ctx context.Context) error {
+		return t.Filesystem.DeleteConfig(ctx, path)
+	}, nil)
+}
+
+// ListBlobs lists the blobs.
+func (t *TimeoutFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	var blobs []Blob
+	done, err := t.call(ctx, "ListBlobs", path, nil, func(ctx context.Context) error {
+		var err error
+		blobs, err = t.Filesystem.ListBlobs(ctx, path)
+		return err
+	}, nil)
+	if !done {
+		return nil, err
+	}
+	return blobs, err
+}
+
+// ListBlobsFunc lists the blobs, fn is never called once the listing has
+// timed out.
+func (t *TimeoutFilesystem) ListBlobsFunc(ctx context.Context, path string, fn func(Blob) error) error {
+	wait := newClientWait()
+	return t.run(ctx, "ListBlobsFunc", path, wait, func(ctx context.Context) error {
+		return t.Filesystem.ListBlobsFunc(ctx, path, func(blob Blob) error {
+			if err := wait.begin(); err != nil {
+				return err
+			}
+			defer wait.end()
+			return fn(blob)
+		})
+	}, nil)
+}
+
+// CheckBlob returns the blob.
+func (t *TimeoutFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	var blob Blob
+	done, err := t.call(ctx, "CheckBlob", path, nil, func(ctx context.Context) error {
+		var err error
+		blob, err = t.Filesystem.CheckBlob(ctx, path)
+		return err
+	}, nil)
+	if !done {
+		return Blob{}, err
+	}
+	return blob, err
+}
+
+// GetBlob opens the blob, reading it is not covered by the timeout.
+func (t *TimeoutFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	var rd io.ReadSeekCloser
+	done, err := t.call(ctx, "GetBlob", path, nil, func(ctx context.Context) error {
+		var err error
+		rd, err = t.Filesystem.GetBlob(ctx, path)
+		return err
+	}, func() {
+		_ = rd.Close()
+	})
+	if !done {
+		return nil, err
+	}
+	return rd, err
+}
+
+// SaveBlob saves the blob.
+func (t *TimeoutFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	wait := newClientWait()
+	var size int64
+	done, err := t.call(ctx, "SaveBlob", path, wait, func(ctx context.Context) error {
+		var err error
+		size, err = t.Filesystem.SaveBlob(ctx, path, clientReader{rd, wait}, expectedSize)
+		return err
+	}, nil)
+	if !done {
+		return 0, err
+	}
+	return size, err
+}
+
+// DeleteBlob removes the blob.
+func (t *TimeoutFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	var size int64
+	done, err := t.call(ctx, "DeleteBlob", path, nil, func(ctx context.Context) error {
+		var err error
+		size, err = t.Filesystem.DeleteBlob(ctx, path, needSize)
+		return err
+	}, nil)
+	if !done {
+		return 0, err
+	}
+	return size, err
+}
+
+// DeleteBlobs removes the blobs, the timeout applies to the whole batch.
+func (t *TimeoutFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	var path string
+	if len(paths) > 0 {
+		path = paths[0]
+	}
+	var sizes []int64
+	done, err := t.call(ctx, "DeleteBlobs", path, nil, func(ctx context.Context) error {
+		var err error
+		sizes, err = t.Filesystem.DeleteBlobs(ctx, paths, needSize)
+		return err
+	}, nil)
+	if !done {
+		return nil, err
+	}
+	return sizes, err
+}
+
+// RepoStats returns the statistics of the repository.
+func (t *TimeoutFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	var stats RepoStats
+	done, err := t.call(ctx, "RepoStats", path, nil, func(ctx context.Context) error {
+		var err error
+		stats, err = t.Filesystem.RepoStats(ctx, path)
+		return err
+	}, nil)
+	if !done {
+		return RepoStats{}, err
+	}
+	return stats, err
+}
+
+// Walk lists the blobs of each object type, fn is never called once the walk
+// has timed out.
+func (t *TimeoutFilesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob Blob) error) error {
+	wait := newClientWait()
+	return t.run(ctx, "Walk", path, wait, func(ctx context.Context) error {
+		return t.Filesystem.Walk(ctx, path, func(objectType string, blob Blob) error {
+			if err := wait.begin(); err != nil {
+				return err
+			}
+			defer wait.end()
+			return fn(objectType, blob)
+		})
+	}, nil)
+}
+
+// HealthCheck checks the storage, a hanging storage fails with ErrTimeout.
+func (t *TimeoutFilesystem) HealthCheck(ctx context.Context, path string) error {
+	return t.run(ctx, "HealthCheck", path, nil, func(ctx context.Context) error {
+		return t.Filesystem.HealthCheck(ctx, path)
+	}, nil)
+}
+
+var _ RepoLocker = &TimeoutFilesystem{}
+
+// LockRepo locks the repository using the base, see LockRepo. Waiting for
+// the lock is not covered by the timeout, it ends when ctx is canceled.
+func (t *TimeoutFilesystem) LockRepo(ctx context.Context, path string, exclusive bool) (func(), error) {
+	return LockRepo(ctx, t.Filesystem, path, exclusive)
+}
+
+var _ BlobPrefixLister = &TimeoutFilesystem{}
+
+// ListBlobsPrefix lists the blobs using the base, see ListBlobsPrefix.
+func (t *TimeoutFilesystem) ListBlobsPrefix(ctx context.Context, path, prefix string) ([]Blob, error) {
+	var blobs []Blob
+	done, err := t.call(ctx, "ListBlobsPrefix", path, nil, func(ctx context.Context) error {
+		var err error
+		blobs, err = ListBlobsPrefix(ctx, t.Filesystem, path, prefix)
+		return err
+	}, nil)
+	if !done {
+		return nil, err
+	}
+	return blobs, err
+}
+
+var _ BlobOpener = &TimeoutFilesystem{}
+
+// OpenBlob opens the blob using the base, see OpenBlob. Like GetBlob,
+// reading it is not covered by the timeout.
+func (t *TimeoutFilesystem) OpenBlob(ctx context.Context, path string) (BlobReaderAt, error) {
+	var rd BlobReaderAt
+	done, err := t.call(ctx, "OpenBlob", path, nil, func(ctx context.Context) error {
+		var err error
+		rd, err = OpenBlob(ctx, t.Filesystem, path)
+		return err
+	}, func() {
+		_ = rd.Close()
+	})
+	if !done {
+		return nil, err
+	}
+	return rd, err
+}
+
+var _ Presigner = &TimeoutFilesystem{}
+
+// PresignGet returns a URL for the blob using the base, see PresignGet.
+func (t *TimeoutFilesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	var (
+		url string
+		ok  bool
+	)
+	done, err := t.call(ctx, "PresignGet", path, nil, func(ctx context.Context) error {
+		var err error
+		url, ok, err = PresignGet(ctx, t.Filesystem, path, ttl)
+		return err
+	}, nil)
+	if !done {
+		return "", false, err
+	}
+	return url, ok, err
+}
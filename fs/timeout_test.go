@@ -0,0 +1,260 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// hangingFilesystem blocks CheckBlob and GetBlob until release is closed,
+// the readers returned by GetBlob are sent to opened.
+type hangingFilesystem struct {
+	Filesystem
+	release chan struct{}
+	opened  chan *closeRecorder
+}
+
+func (h *hangingFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	<-h.release
+	return h.Filesystem.CheckBlob(ctx, path)
+}
+
+func (h *hangingFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	<-h.release
+	rd, err := h.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &closeRecorder{ReadSeekCloser: rd, closed: make(chan struct{})}
+	h.opened <- rec
+	return rec, nil
+}
+
+// closeRecorder closes closed once it is closed.
+type closeRecorder struct {
+	io.ReadSeekCloser
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return c.ReadSeekCloser.Close()
+}
+
+// slowReader sleeps before each read.
+type slowReader struct {
+	rd    io.Reader
+	delay time.Duration
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.rd.Read(p)
+}
+
+func TestTimeoutFilesystem(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryFilesystem()
+	hang := &hangingFilesystem{Filesystem: mem, release: make(chan struct{}), opened: make(chan *closeRecorder, 1)}
+	const timeout = 20 * time.Millisecond
+	f := NewTimeoutFilesystem(hang, timeout)
+
+	blob := filepath.Join(filepath.FromSlash("/repo"), "data", testID[:2], testID)
+
+	// waiting for the client does not count towards the timeout
+	if _, err := f.SaveBlob(ctx, blob, slowReader{iotest.OneByteReader(strings.NewReader("foobar")), timeout / 2}, 6); err != nil {
+		t.Fatal(err)
+	}
+	err := f.ListBlobsFunc(ctx, filepath.Join(filepath.FromSlash("/repo"), "data"), func(Blob) error {
+		time.Sleep(2 * timeout)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("CheckBlob: want ErrTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > 50*timeout {
+		t.Fatalf("CheckBlob returned after %v", d)
+	}
+	if _, err := f.GetBlob(ctx, blob); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("GetBlob: want ErrTimeout, got %v", err)
+	}
+	if n := f.Pending(); n != 2 {
+		t.Fatalf("want 2 pending operations, got %d", n)
+	}
+
+	// canceled requests return at once as well
+	ctxCanceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := f.CheckBlob(ctxCanceled, blob); !errors.Is(err, context.Canceled) {
+		t.Fatalf("CheckBlob: want context.Canceled, got %v", err)
+	}
+
+	// the reader opened after the timeout is closed
+	close(hang.release)
+	select {
+	case <-(<-hang.opened).closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned reader not closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no pending operations, got %d", f.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+		t.Fatalf("CheckBlob: got %v, %v", b, err)
+	}
+}
+
+// lateFilesystem completes the operations only after delay, the readers it
+// returns count their Close calls in closed.
+type lateFilesystem struct {
+	Filesystem
+	delay  time.Duration
+	closed int64 // must be accessed using sync/atomic
+}
+
+func (l *lateFilesystem) CheckBlob(ctx context.Context, path string) (Blob, error) {
+	time.Sleep(l.delay)
+	return l.Filesystem.CheckBlob(ctx, path)
+}
+
+func (l *lateFilesystem) ListBlobs(ctx context.Context, path string) ([]Blob, error) {
+	time.Sleep(l.delay)
+	return l.Filesystem.ListBlobs(ctx, path)
+}
+
+func (l *lateFilesystem) RepoStats(ctx context.Context, path string) (RepoStats, error) {
+	time.Sleep(l.delay)
+	return l.Filesystem.RepoStats(ctx, path)
+}
+
+func (l *lateFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	time.Sleep(l.delay)
+	rd, size, err := l.Filesystem.GetConfigReader(ctx, path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &countingCloser{ReadCloser: rd, closed: &l.closed}, size, nil
+}
+
+func (l *lateFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	time.Sleep(l.delay)
+	rd, err := l.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.ReadSeeker
+		io.Closer
+	}{rd, &countingCloser{ReadCloser: rd, closed: &l.closed}}, nil
+}
+
+func (l *lateFilesystem) OpenBlob(ctx context.Context, path string) (BlobReaderAt, error) {
+	time.Sleep(l.delay)
+	rd, err := OpenBlob(ctx, l.Filesystem, path)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReaderAt{BlobReaderAt: rd, closed: &l.closed}, nil
+}
+
+// countingCloser increments closed when it is closed.
+type countingCloser struct {
+	io.ReadCloser
+	closed *int64
+}
+
+func (c *countingCloser) Close() error {
+	atomic.AddInt64(c.closed, 1)
+	return c.ReadCloser.Close()
+}
+
+// countingReaderAt increments closed when it is closed.
+type countingReaderAt struct {
+	BlobReaderAt
+	closed *int64
+}
+
+func (c *countingReaderAt) Close() error {
+	atomic.AddInt64(c.closed, 1)
+	return c.BlobReaderAt.Close()
+}
+
+// TestTimeoutFilesystemLateResults checks that the results of operations
+// which complete after the timeout are neither returned nor leaked, run it
+// with -race.
+func TestTimeoutFilesystemLateResults(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryFilesystem()
+	repo := filepath.FromSlash("/repo")
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if err := mem.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	late := &lateFilesystem{Filesystem: mem, delay: 50 * time.Millisecond}
+	f := NewTimeoutFilesystem(late, 10*time.Millisecond)
+
+	for name, op := range map[string]func() (bool, error){
+		"CheckBlob": func() (bool, error) {
+			b, err := f.CheckBlob(ctx, blob)
+			return b == Blob{}, err
+		},
+		"ListBlobs": func() (bool, error) {
+			blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data"))
+			return blobs == nil, err
+		},
+		"RepoStats": func() (bool, error) {
+			stats, err := f.RepoStats(ctx, repo)
+			return stats.Types == nil, err
+		},
+		"GetConfigReader": func() (bool, error) {
+			rd, size, err := f.GetConfigReader(ctx, filepath.Join(repo, "config"))
+			return rd == nil && size == 0, err
+		},
+		"GetBlob": func() (bool, error) {
+			rd, err := f.GetBlob(ctx, blob)
+			return rd == nil, err
+		},
+		"OpenBlob": func() (bool, error) {
+			rd, err := f.OpenBlob(ctx, blob)
+			return rd == nil, err
+		},
+	} {
+		zero, err := op()
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("%v: want ErrTimeout, got %v", name, err)
+		}
+		if !zero {
+			t.Fatalf("%v: want zero values after the timeout", name)
+		}
+	}
+
+	// the readers opened after the timeout are closed
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Pending() != 0 || atomic.LoadInt64(&late.closed) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no pending operations and 3 closed readers, got %d and %d", f.Pending(), atomic.LoadInt64(&late.closed))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package fs
+
+import "time"
+
+// SaveBlobTiming is the time DiskFilesystem.SaveBlob spent in each phase of
+// saving a blob, see DiskFilesystem.SaveTiming. Phases which have been
+// skipped, e.g. the syncs with SyncNone or SyncDeferred, are zero.
+type SaveBlobTiming struct {
+	Open    time.Duration // creating and preallocating the temporary file
+	Copy    time.Duration // receiving the data and writing it to the file
+	Sync    time.Duration // syncing and closing the file
+	Rename  time.Duration // renaming the file, including concurrent writers
+	SyncDir time.Duration // syncing the directory of the blob
+}
+
+// Total returns the sum of all phases.
+func (t SaveBlobTiming) Total() time.Duration {
+	return t.Open + t.Copy + t.Sync + t.Rename + t.SyncDir
+}
+
+type savePhase int
+
+const (
+	phaseOpen savePhase = iota
+	phaseCopy
+	phaseSync
+	phaseRename
+	phaseSyncDir
+)
+
+// saveTimer measures the phases of a save. A nil saveTimer measures nothing,
+// so that time.Now is only called if SaveTiming is set.
+type saveTimer struct {
+	timing SaveBlobTiming
+	last   time.Time
+}
+
+func newSaveTimer() *saveTimer {
+	return &saveTimer{last: time.Now()}
+}
+
+// lap adds the time since the previous lap to phase.
+func (s *saveTimer) lap(phase savePhase) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	d := now.Sub(s.last)
+	s.last = now
+	switch phase {
+	case phaseOpen:
+		s.timing.Open += d
+	case phaseCopy:
+		s.timing.Copy += d
+	case phaseSync:
+		s.timing.Sync += d
+	case phaseRename:
+		s.timing.Rename += d
+	case phaseSyncDir:
+		s.timing.SyncDir += d
+	}
+}
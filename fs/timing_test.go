@@ -0,0 +1,42 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskFilesystemSaveTiming(t *testing.T) {
+	ctx := context.Background()
+	var paths []string
+	var timings []SaveBlobTiming
+	f := &DiskFilesystem{SaveTiming: func(path string, timing SaveBlobTiming) {
+		paths = append(paths, path)
+		timings = append(timings, timing)
+	}}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	blob := filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	// failed saves and the config are not reported
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 6); !errors.Is(err, ErrShortWrite) {
+		t.Fatalf("want ErrShortWrite, got %v", err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(paths) != 1 || paths[0] != blob {
+		t.Fatalf("want the timing of %v, got %v", blob, paths)
+	}
+	tm := timings[0]
+	if tm.Total() <= 0 {
+		t.Fatalf("want the phases measured, got %+v", tm)
+	}
+}
@@ -0,0 +1,270 @@
+// Package tracing implements a fs.Filesystem wrapper which starts an
+// OpenTelemetry span for all operations. It is kept separate from package fs
+// so that using a Filesystem does not require importing OpenTelemetry.
+package tracing
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/restic/rest-server/fs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys set on the spans.
+const (
+	OperationKey  = attribute.Key("rest_server.fs.operation")
+	ObjectTypeKey = attribute.Key("rest_server.fs.object_type")
+	RepoKey       = attribute.Key("rest_server.fs.repo")
+	BytesKey      = attribute.Key("rest_server.fs.bytes")
+)
+
+// Filesystem wraps a fs.Filesystem and starts a span for each operation as a
+// child of the span in the context of the operation, if any. The spans carry
+// the operation, the object type, the repository and the transferred bytes,
+// errors are recorded on them.
+type Filesystem struct {
+	fs.Filesystem
+
+	tracer trace.Tracer
+}
+
+// New returns a Filesystem for base which starts its spans with tracer.
+func New(base fs.Filesystem, tracer trace.Tracer) *Filesystem {
+	return &Filesystem{Filesystem: base, tracer: tracer}
+}
+
+// start starts the span for an operation on an object of objectType, which is
+// empty for operations on the repository, in repo.
+func (f *Filesystem) start(ctx context.Context, operation, objectType, repo string) (context.Context, trace.Span) {
+	return f.tracer.Start(ctx, "fs."+operation, trace.WithAttributes(
+		OperationKey.String(operation),
+		ObjectTypeKey.String(objectType),
+		RepoKey.String(repo),
+	))
+}
+
+// end records err, if any, and ends span.
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func blobPath(path string) (repo, objectType string) {
+	repo, objectType, _ = fs.SplitBlobPath(path)
+	return repo, objectType
+}
+
+// CreateRepo creates the repository.
+func (f *Filesystem) CreateRepo(ctx context.Context, path string) (err error) {
+	ctx, span := f.start(ctx, "CreateRepo", "", path)
+	defer func() { end(span, err) }()
+	return f.Filesystem.CreateRepo(ctx, path)
+}
+
+// CheckConfig returns whether the config exists and its size.
+func (f *Filesystem) CheckConfig(ctx context.Context, path string) (exists bool, size int64, err error) {
+	ctx, span := f.start(ctx, "CheckConfig", "config", filepath.Dir(path))
+	defer func() { end(span, err) }()
+	return f.Filesystem.CheckConfig(ctx, path)
+}
+
+// GetConfig returns the config.
+func (f *Filesystem) GetConfig(ctx context.Context, path string) (buf []byte, err error) {
+	ctx, span := f.start(ctx, "GetConfig", "config", filepath.Dir(path))
+	defer func() {
+		span.SetAttributes(BytesKey.Int(len(buf)))
+		end(span, err)
+	}()
+	return f.Filesystem.GetConfig(ctx, path)
+}
+
+// GetConfigReader returns a reader for the config. The span ends when the
+// reader is closed.
+func (f *Filesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	ctx, span := f.start(ctx, "GetConfig", "config", filepath.Dir(path))
+	rd, size, err := f.Filesystem.GetConfigReader(ctx, path)
+	if err != nil {
+		end(span, err)
+		return nil, 0, err
+	}
+	return &configReader{ReadCloser: rd, span: span}, size, nil
+}
+
+// SaveConfig saves the config.
+func (f *Filesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) (err error) {
+	ctx, span := f.start(ctx, "SaveConfig", "config", filepath.Dir(path))
+	cr := &countingReader{rd: rd}
+	defer func() {
+		span.SetAttributes(BytesKey.Int64(cr.n))
+		end(span, err)
+	}()
+	return f.Filesystem.SaveConfig(ctx, path, cr)
+}
+
+// DeleteConfig removes the config.
+func (f *Filesystem) DeleteConfig(ctx context.Context, path string) (err error) {
+	ctx, span := f.start(ctx, "DeleteConfig", "config", filepath.Dir(path))
+	defer func() { end(span, err) }()
+	return f.Filesystem.DeleteConfig(ctx, path)
+}
+
+// ListBlobs lists the blobs in path.
+func (f *Filesystem) ListBlobs(ctx context.Context, path string) (blobs []fs.Blob, err error) {
+	ctx, span := f.start(ctx, "ListBlobs", filepath.Base(path), filepath.Dir(path))
+	defer func() { end(span, err) }()
+	return f.Filesystem.ListBlobs(ctx, path)
+}
+
+// ListBlobsFunc calls fn for the blobs in path.
+func (f *Filesystem) ListBlobsFunc(ctx context.Context, path string, fn func(fs.Blob) error) (err error) {
+	ctx, span := f.start(ctx, "ListBlobs", filepath.Base(path), filepath.Dir(path))
+	defer func() { end(span, err) }()
+	return f.Filesystem.ListBlobsFunc(ctx, path, fn)
+}
+
+// CheckBlob returns the blob.
+func (f *Filesystem) CheckBlob(ctx context.Context, path string) (blob fs.Blob, err error) {
+	repo, objectType := blobPath(path)
+	ctx, span := f.start(ctx, "CheckBlob", objectType, repo)
+	defer func() { end(span, err) }()
+	return f.Filesystem.CheckBlob(ctx, path)
+}
+
+// GetBlob returns a reader for the blob. The span ends when the reader is
+// closed, with the number of bytes read.
+func (f *Filesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	repo, objectType := blobPath(path)
+	ctx, span := f.start(ctx, "GetBlob", objectType, repo)
+	rd, err := f.Filesystem.GetBlob(ctx, path)
+	if err != nil {
+		end(span, err)
+		return nil, err
+	}
+	return &blobReader{ReadSeekCloser: rd, span: span}, nil
+}
+
+// SaveBlob saves the blob.
+func (f *Filesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (n int64, err error) {
+	repo, objectType := blobPath(path)
+	ctx, span := f.start(ctx, "SaveBlob", objectType, repo)
+	defer func() {
+		span.SetAttributes(BytesKey.Int64(n))
+		end(span, err)
+	}()
+	return f.Filesystem.SaveBlob(ctx, path, rd, expectedSize)
+}
+
+// DeleteBlob removes the blob.
+func (f *Filesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (size int64, err error) {
+	repo, objectType := blobPath(path)
+	ctx, span := f.start(ctx, "DeleteBlob", objectType, repo)
+	defer func() {
+		span.SetAttributes(BytesKey.Int64(size))
+		end(span, err)
+	}()
+	return f.Filesystem.DeleteBlob(ctx, path, needSize)
+}
+
+// DeleteBlobs removes the blobs in a single span.
+func (f *Filesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) (sizes []int64, err error) {
+	var repo, objectType string
+	if len(paths) > 0 {
+		repo, objectType = blobPath(paths[0])
+	}
+	ctx, span := f.start(ctx, "DeleteBlobs", objectType, repo)
+	defer func() {
+		var total int64
+		for _, size := range sizes {
+			total += size
+		}
+		span.SetAttributes(BytesKey.Int64(total))
+		end(span, err)
+	}()
+	return f.Filesystem.DeleteBlobs(ctx, paths, needSize)
+}
+
+// RepoStats returns the statistics of the repository.
+func (f *Filesystem) RepoStats(ctx context.Context, path string) (stats fs.RepoStats, err error) {
+	ctx, span := f.start(ctx, "RepoStats", "", path)
+	defer func() { end(span, err) }()
+	return f.Filesystem.RepoStats(ctx, path)
+}
+
+// Walk calls fn for the blobs of all object types.
+func (f *Filesystem) Walk(ctx context.Context, path string, fn func(objectType string, blob fs.Blob) error) (err error) {
+	ctx, span := f.start(ctx, "Walk", "", path)
+	defer func() { end(span, err) }()
+	return f.Filesystem.Walk(ctx, path, fn)
+}
+
+// HealthCheck checks the storage.
+func (f *Filesystem) HealthCheck(ctx context.Context, path string) (err error) {
+	ctx, span := f.start(ctx, "HealthCheck", "", path)
+	defer func() { end(span, err) }()
+	return f.Filesystem.HealthCheck(ctx, path)
+}
+
+// countingReader counts the bytes read from rd.
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// configReader counts the bytes read and ends the span once it is closed.
+type configReader struct {
+	io.ReadCloser
+	span trace.Span
+	n    int64
+}
+
+func (r *configReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *configReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.span != nil {
+		r.span.SetAttributes(BytesKey.Int64(r.n))
+		end(r.span, err)
+		r.span = nil
+	}
+	return err
+}
+
+// blobReader counts the bytes read and ends the span once it is closed.
+type blobReader struct {
+	io.ReadSeekCloser
+	span trace.Span
+	n    int64
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	err := r.ReadSeekCloser.Close()
+	if r.span != nil {
+		r.span.SetAttributes(BytesKey.Int64(r.n))
+		end(r.span, err)
+		r.span = nil
+	}
+	return err
+}
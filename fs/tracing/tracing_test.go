@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/restic/rest-server/fs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span records the attributes and the status set on it.
+type span struct {
+	trace.Span // no-op span for all other methods
+	name       string
+	attrs      map[attribute.Key]attribute.Value
+	code       codes.Code
+	err        error
+	ended      bool
+}
+
+func (s *span) SetAttributes(kv ...attribute.KeyValue) {
+	for _, a := range kv {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *span) RecordError(err error, options ...trace.EventOption) { s.err = err }
+
+func (s *span) SetStatus(code codes.Code, description string) { s.code = code }
+
+func (s *span) End(options ...trace.SpanEndOption) { s.ended = true }
+
+// tracer records all started spans.
+type tracer struct {
+	spans []*span
+}
+
+func (t *tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	s := &span{
+		Span:  trace.SpanFromContext(ctx),
+		name:  name,
+		attrs: make(map[attribute.Key]attribute.Value),
+	}
+	cfg := trace.NewSpanStartConfig(opts...)
+	s.SetAttributes(cfg.Attributes()...)
+	t.spans = append(t.spans, s)
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func (t *tracer) last() *span {
+	return t.spans[len(t.spans)-1]
+}
+
+func TestFilesystem(t *testing.T) {
+	ctx := context.Background()
+	tr := &tracer{}
+	f := New(fs.NewMemoryFilesystem(), tr)
+
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+		t.Fatal(err)
+	}
+	s := tr.last()
+	if !s.ended || s.name != "fs.SaveBlob" || s.attrs[ObjectTypeKey].AsString() != "data" ||
+		s.attrs[RepoKey].AsString() != repo || s.attrs[BytesKey].AsInt64() != 6 {
+		t.Fatalf("unexpected span %v %v", s.name, s.attrs)
+	}
+
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	if s := tr.last(); s.ended {
+		t.Fatal("the GetBlob span must only end when the reader is closed")
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := tr.last(); !s.ended || s.attrs[BytesKey].AsInt64() != 6 {
+		t.Fatalf("unexpected span %v %v", s.name, s.attrs)
+	}
+
+	// errors are recorded
+	if _, err := f.DeleteBlob(ctx, filepath.Join(repo, "locks", id), true); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("DeleteBlob: want not exist error, got %v", err)
+	}
+	if s := tr.last(); !s.ended || s.code != codes.Error || !errors.Is(s.err, os.ErrNotExist) || s.attrs[ObjectTypeKey].AsString() != "locks" {
+		t.Fatalf("unexpected span %v %v, error %v", s.name, s.attrs, s.err)
+	}
+
+	// the spans are children of the span in the context
+	parent := &span{attrs: make(map[attribute.Key]attribute.Value)}
+	if _, err := f.CheckBlob(trace.ContextWithSpan(ctx, parent), blob); err != nil {
+		t.Fatal(err)
+	}
+	if s := tr.last(); s.Span != parent {
+		t.Fatal("span not started in the context of the operation")
+	}
+}
@@ -0,0 +1,262 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrashDir is the directory in a repository deleted blobs are moved to by
+// TrashFilesystem. It is not one of the ObjectTypes, so its contents are
+// never listed.
+const TrashDir = ".trash"
+
+// renamer is implemented by Filesystems which can move a file cheaply, like
+// DiskFilesystem.
+type renamer interface {
+	Rename(ctx context.Context, oldpath, newpath string) error
+}
+
+// TrashFilesystem wraps a Filesystem and moves deleted blobs to the TrashDir
+// of the repository instead of removing them, so that they can be restored
+// with RestoreBlob. Within the trash the path of each blob is kept, the name
+// is suffixed with the time of the deletion.
+//
+// Trash entries older than the retention are removed by Purge, or
+// periodically by RunReaper for all repositories which have been accessed.
+type TrashFilesystem struct {
+	Filesystem
+	retention time.Duration
+
+	// Now returns the current time, time.Now if unset. It is used for the
+	// names of trash entries and to determine which entries are purged.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	repos map[string]struct{}
+}
+
+// NewTrashFilesystem returns a TrashFilesystem for base which keeps deleted
+// blobs for retention.
+func NewTrashFilesystem(base Filesystem, retention time.Duration) *TrashFilesystem {
+	return &TrashFilesystem{
+		Filesystem: base,
+		retention:  retention,
+		repos:      make(map[string]struct{}),
+	}
+}
+
+func (t *TrashFilesystem) now() time.Time {
+	if t.Now == nil {
+		return time.Now()
+	}
+	return t.Now()
+}
+
+// seen records that repo has been accessed, so that the reaper purges it.
+func (t *TrashFilesystem) seen(repo string) {
+	t.mu.Lock()
+	t.repos[repo] = struct{}{}
+	t.mu.Unlock()
+}
+
+// trashPath returns the path in the trash for the blob at path, without the
+// suffix.
+func trashPath(path string) (string, error) {
+	repo, _, _ := SplitBlobPath(path)
+	rel, err := filepath.Rel(repo, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(repo, TrashDir, rel), nil
+}
+
+// parseTrashName splits the name of a trash entry into the name of the blob
+// and the time it has been deleted.
+func parseTrashName(name string) (string, time.Time, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(name[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:i], time.Unix(0, ns), true
+}
+
+// move moves the blob at oldpath to newpath.
+func (t *TrashFilesystem) move(ctx context.Context, oldpath, newpath string) (int64, error) {
+	return moveBlob(ctx, t.Filesystem, oldpath, newpath)
+}
+
+// moveBlob moves the blob at oldpath in f to newpath, using Rename if f
+// supports it and copying and deleting the blob otherwise. It returns the
+// size of the blob.
+func moveBlob(ctx context.Context, f Filesystem, oldpath, newpath string) (int64, error) {
+	blob, err := f.CheckBlob(ctx, oldpath)
+	if err != nil {
+		return 0, err
+	}
+
+	if r, ok := f.(renamer); ok {
+		return blob.Size, r.Rename(ctx, oldpath, newpath)
+	}
+
+	rd, err := f.GetBlob(ctx, oldpath)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.SaveBlob(ctx, newpath, rd, blob.Size)
+	_ = rd.Close()
+	if err != nil {
+		return 0, err
+	}
+	return f.DeleteBlob(ctx, oldpath, false)
+}
+
+// CheckConfig checks the config and registers the repository with the
+// reaper.
+func (t *TrashFilesystem) CheckConfig(ctx context.Context, path string) (bool, int64, error) {
+	t.seen(filepath.Dir(path))
+	return t.Filesystem.CheckConfig(ctx, path)
+}
+
+// GetConfig returns the config and registers the repository with the reaper.
+func (t *TrashFilesystem) GetConfig(ctx context.Context, path string) ([]byte, error) {
+	t.seen(filepath.Dir(path))
+	return t.Filesystem.GetConfig(ctx, path)
+}
+
+// GetConfigReader returns a reader for the config and registers the
+// repository with the reaper.
+func (t *TrashFilesystem) GetConfigReader(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	t.seen(filepath.Dir(path))
+	return t.Filesystem.GetConfigReader(ctx, path)
+}
+
+// DeleteBlob moves the blob to the trash. The size of the blob is always
+// returned.
+func (t *TrashFilesystem) DeleteBlob(ctx context.Context, path string, needSize bool) (int64, error) {
+	repo, _, _ := SplitBlobPath(path)
+	t.seen(repo)
+
+	trash, err := trashPath(path)
+	if err != nil {
+		return 0, err
+	}
+	return t.move(ctx, path, trash+"."+strconv.FormatInt(t.now().UnixNano(), 10))
+}
+
+// DeleteBlobs moves the blobs to the trash.
+func (t *TrashFilesystem) DeleteBlobs(ctx context.Context, paths []string, needSize bool) ([]int64, error) {
+	return deleteEach(ctx, t, paths, needSize)
+}
+
+// RestoreBlob moves the most recently deleted version of the blob at path
+// back from the trash. An error satisfying errors.Is(err, os.ErrNotExist) is
+// returned if the trash does not contain the blob.
+func (t *TrashFilesystem) RestoreBlob(ctx context.Context, path string) error {
+	trash, err := trashPath(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(trash)
+	name := filepath.Base(path)
+
+	var newest time.Time
+	var found string
+	entries, err := t.trashEntries(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		blob, deleted, ok := parseTrashName(filepath.Base(e))
+		if ok && blob == name && deleted.After(newest) {
+			newest, found = deleted, e
+		}
+	}
+	if found == "" {
+		return &os.PathError{Op: "restore", Path: path, Err: os.ErrNotExist}
+	}
+
+	if _, err := t.Filesystem.CheckBlob(ctx, path); err == nil {
+		return &os.PathError{Op: "restore", Path: path, Err: os.ErrExist}
+	}
+	_, err = t.move(ctx, found, path)
+	return err
+}
+
+// trashEntries returns the paths of all entries in the trash directory dir.
+func (t *TrashFilesystem) trashEntries(ctx context.Context, dir string) ([]string, error) {
+	var entries []string
+	err := t.Filesystem.ListBlobsFunc(ctx, dir, func(blob Blob) error {
+		if IsHashed(filepath.Base(dir)) && len(blob.Name) < 2 {
+			return nil
+		}
+		entries = append(entries, blobPath(dir, blob.Name))
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// Purge removes all entries from the trash of the repository at repo which
+// are older than the retention.
+func (t *TrashFilesystem) Purge(ctx context.Context, repo string) error {
+	cutoff := t.now().Add(-t.retention)
+	for _, tpe := range ObjectTypes {
+		entries, err := t.trashEntries(ctx, filepath.Join(repo, TrashDir, tpe))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			_, deleted, ok := parseTrashName(filepath.Base(e))
+			if !ok || deleted.After(cutoff) {
+				continue
+			}
+			_, err := t.Filesystem.DeleteBlob(ctx, e, false)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("purge %v: %w", e, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RunReaper purges the trash of all repositories which have been accessed
+// every interval, until ctx is canceled.
+func (t *TrashFilesystem) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		repos := make([]string, 0, len(t.repos))
+		for repo := range t.repos {
+			repos = append(repos, repo)
+		}
+		t.mu.Unlock()
+
+		for _, repo := range repos {
+			if err := t.Purge(ctx, repo); err != nil && ctx.Err() == nil {
+				log.Printf("purging trash of %v failed: %v", repo, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrashFilesystem(t *testing.T) {
+	ctx := context.Background()
+	for _, base := range []Filesystem{&DiskFilesystem{}, NewMemoryFilesystem()} {
+		f := NewTrashFilesystem(base, time.Hour)
+		repo := filepath.Join(t.TempDir(), "repo")
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+
+		blob := filepath.Join(repo, "data", testID[:2], testID)
+		if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foobar"), 6); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := f.DeleteBlob(ctx, blob, true); err != nil || size != 6 {
+			t.Fatalf("%T: DeleteBlob: want size 6, got %v, %v", base, size, err)
+		}
+		if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%T: deleted blob must not exist, got %v", base, err)
+		}
+		if blobs, err := f.ListBlobs(ctx, filepath.Join(repo, "data")); err != nil || len(blobs) != 0 {
+			t.Fatalf("%T: trash must not be listed, got %v, %v", base, blobs, err)
+		}
+
+		if err := f.RestoreBlob(ctx, blob); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := f.CheckBlob(ctx, blob); err != nil || b.Size != 6 {
+			t.Fatalf("%T: restored blob: want size 6, got %v, %v", base, b.Size, err)
+		}
+		if err := f.RestoreBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%T: RestoreBlob: want not exist error, got %v", base, err)
+		}
+
+		// entries within the retention are kept
+		if _, err := f.DeleteBlob(ctx, blob, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Purge(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := f.trashEntries(ctx, filepath.Join(repo, TrashDir, "data"))
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%T: want one trash entry, got %v, %v", base, entries, err)
+		}
+
+		f.retention = 0
+		if err := f.Purge(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.RestoreBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%T: purged blob must not be restorable, got %v", base, err)
+		}
+	}
+}
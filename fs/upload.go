@@ -0,0 +1,335 @@
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrIncompleteUpload is returned by CommitBlob if parts of the upload are
+// missing, i.e. there are gaps between the ranges written by SaveBlobAt or
+// less data than announced by SetUploadTotal has been uploaded.
+var ErrIncompleteUpload = newError("incomplete_upload", "upload is incomplete")
+
+// upload is a blob which is uploaded in parts, see BeginBlob.
+type upload struct {
+	mu     sync.Mutex
+	path   string      // the blob path passed to BeginBlob
+	file   string      // the temporary file the parts are written to
+	size   int64       // the size of the temporary file
+	total  int64       // the size announced by SetUploadTotal, or -1
+	ranges []byteRange // the ranges written so far, sorted and merged
+	done   bool        // committed or aborted
+}
+
+// byteRange is the range of bytes from start up to, but excluding, end.
+type byteRange struct {
+	start, end int64
+}
+
+// addRange adds the range from start to end to the sorted and merged ranges.
+func addRange(ranges []byteRange, start, end int64) []byteRange {
+	if start >= end {
+		return ranges
+	}
+	merged := make([]byteRange, 0, len(ranges)+1)
+	r := byteRange{start, end}
+	added := false
+	for _, o := range ranges {
+		switch {
+		case o.end < r.start:
+			merged = append(merged, o)
+		case r.end < o.start:
+			if !added {
+				merged = append(merged, r)
+				added = true
+			}
+			merged = append(merged, o)
+		default:
+			// overlapping or adjacent
+			if o.start < r.start {
+				r.start = o.start
+			}
+			if o.end > r.end {
+				r.end = o.end
+			}
+		}
+	}
+	if !added {
+		// all other ranges start before it
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// complete returns the number of bytes uploaded without a gap from the start
+// of the blob.
+func (u *upload) complete() int64 {
+	if len(u.ranges) == 0 || u.ranges[0].start > 0 {
+		return 0
+	}
+	return u.ranges[0].end
+}
+
+// BeginBlob starts an upload of the blob at path which is sent in parts by
+// AppendBlob or SaveBlobAt, e.g. so that an upload interrupted by a network
+// error can be resumed instead of being restarted from the beginning. The
+// returned upload ID identifies the upload in the other calls.
+//
+// The parts are staged in a temporary file like the data of SaveBlob, which
+// is renamed by CommitBlob. Uploads are only known to the process which
+// started them. Their temporary files are left behind if the server stops
+// before the upload is committed or aborted, CleanTemp removes them, as well
+// as those of uploads which have been abandoned for longer.
+func (d *DiskFilesystem) BeginBlob(ctx context.Context, path string) (string, error) {
+	if err := d.validateBlobPath(path); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+
+	repo, _, _ := SplitBlobPath(path)
+	resolved := d.resolve(path)
+	if err := d.checkSymlinks(repo, resolved); err != nil {
+		return "", err
+	}
+	file := filepath.Join(d.stagingDir(filepath.Dir(resolved)), tempName(filepath.Base(resolved), id))
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.fileMode())
+	if os.IsNotExist(err) {
+		// the directory is missing, create it and retry
+		if err := d.mkdirAll(filepath.Dir(file)); err != nil {
+			return "", classify(err)
+		}
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, d.fileMode())
+	}
+	if err != nil {
+		return "", classify(err)
+	}
+	err = d.chmodFile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeTemp(file)
+		return "", classify(err)
+	}
+
+	d.uploads.Store(id, &upload{path: path, file: file, total: -1})
+	return id, nil
+}
+
+// lockUpload returns the upload with the ID id, locked. ErrNotFound is
+// returned if there is no such upload or it has already been finished.
+func (d *DiskFilesystem) lockUpload(id string) (*upload, error) {
+	v, ok := d.uploads.Load(id)
+	if !ok {
+		return nil, fmt.Errorf("upload %v: %w", id, ErrNotFound)
+	}
+	u := v.(*upload)
+	u.mu.Lock()
+	if u.done {
+		u.mu.Unlock()
+		return nil, fmt.Errorf("upload %v: %w", id, ErrNotFound)
+	}
+	return u, nil
+}
+
+// finishUpload marks the locked upload u with the ID id as done.
+func (d *DiskFilesystem) finishUpload(id string, u *upload) {
+	u.done = true
+	d.uploads.Delete(id)
+}
+
+// AppendBlob appends the data read from rd to the upload with the ID
+// uploadID. A part is either appended completely or not at all: if reading
+// rd or writing the data fails, the data of the part is removed again, so
+// that the client can send the same part once more. Parts of the same upload
+// are appended one after another. ErrBlobTooLarge is returned if the upload
+// would exceed MaxBlobSize, ErrNoSpace if less than MinFreeSpace would be
+// left.
+func (d *DiskFilesystem) AppendBlob(ctx context.Context, uploadID string, rd io.Reader) error {
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	return d.writePart(ctx, uploadID, u, u.size, rd)
+}
+
+// SaveBlobAt writes the data read from rd at offset into the upload with the
+// ID uploadID, e.g. for a request with a Content-Range header. Unlike with
+// AppendBlob the parts can be sent in any order, so a client can resume an
+// upload from any offset. CommitBlob fails with ErrIncompleteUpload if there
+// are gaps between the parts. A part which fails is not recorded as written
+// and the data it appended to the end of the upload is removed again, but
+// data it wrote over earlier parts stays overwritten, the client is expected
+// to send the same data for the same range again. ErrLongWrite is returned if
+// the part ends after the size announced by SetUploadTotal.
+func (d *DiskFilesystem) SaveBlobAt(ctx context.Context, uploadID string, offset int64, rd io.Reader) error {
+	if offset < 0 {
+		return fmt.Errorf("upload %v: negative offset %d: %w", uploadID, offset, os.ErrInvalid)
+	}
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	return d.writePart(ctx, uploadID, u, offset, rd)
+}
+
+// SetUploadTotal announces the size of the blob uploaded with the ID
+// uploadID, CommitBlob then fails with ErrIncompleteUpload until that much
+// data has been uploaded. ErrLongWrite is returned if more data has already
+// been uploaded.
+func (d *DiskFilesystem) SetUploadTotal(ctx context.Context, uploadID string, total int64) error {
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	if total < 0 {
+		return fmt.Errorf("upload %v: negative size %d: %w", uploadID, total, os.ErrInvalid)
+	}
+	if u.size > total {
+		return fmt.Errorf("upload %v: %d bytes uploaded, more than %d: %w", uploadID, u.size, total, ErrLongWrite)
+	}
+	u.total = total
+	return nil
+}
+
+// writePart writes the data read from rd at offset into the temporary file
+// of the locked upload u with the ID uploadID.
+func (d *DiskFilesystem) writePart(ctx context.Context, uploadID string, u *upload, offset int64, rd io.Reader) error {
+	if d.MinFreeSpace > 0 {
+		if err := d.checkFreeSpace(u.file, -1); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(u.file, os.O_WRONLY, 0)
+	if err != nil {
+		return classify(err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	var n int64
+	if d.MaxBlobSize > 0 && offset >= d.MaxBlobSize {
+		// the upload is already complete, any more data is too much
+		n, err = d.copyData(ctx, f, io.LimitReader(rd, 1), 0)
+		if err == nil && n > 0 {
+			err = ErrBlobTooLarge
+		}
+	} else {
+		var maxSize int64
+		if d.MaxBlobSize > 0 {
+			maxSize = d.MaxBlobSize - offset
+		}
+		n, err = d.copyData(ctx, f, rd, maxSize)
+	}
+	if err == nil && u.total >= 0 && offset+n > u.total {
+		err = fmt.Errorf("upload %v: more than %d bytes uploaded: %w", uploadID, u.total, ErrLongWrite)
+	}
+	if err != nil {
+		if truncErr := f.Truncate(u.size); truncErr != nil {
+			// the upload cannot be continued with the partial data
+			_ = f.Close()
+			removeTemp(u.file)
+			d.finishUpload(uploadID, u)
+			return fmt.Errorf("upload %v aborted, removing a failed part: %v: %w", uploadID, truncErr, classify(err))
+		}
+		_ = f.Close()
+		return classify(err)
+	}
+	if err := f.Close(); err != nil {
+		return classify(err)
+	}
+	if offset+n > u.size {
+		u.size = offset + n
+	}
+	u.ranges = addRange(u.ranges, offset, offset+n)
+	return nil
+}
+
+// UploadSize returns the number of bytes uploaded with the ID uploadID without
+// a gap from the start of the blob, which is where a client resumes an
+// interrupted upload.
+func (d *DiskFilesystem) UploadSize(ctx context.Context, uploadID string) (int64, error) {
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	defer u.mu.Unlock()
+	return u.complete(), nil
+}
+
+// CommitBlob finishes the upload with the ID uploadID and atomically replaces
+// the blob at path with the uploaded data, which is synced like the data of
+// SaveBlob. path must be the path passed to BeginBlob, otherwise
+// ErrInvalidName is returned and the upload is kept. If the parts written by
+// SaveBlobAt leave a gap, or less data than announced by SetUploadTotal has
+// been uploaded, ErrIncompleteUpload is returned and the upload is kept as
+// well, so that the missing parts can still be sent. The size of the blob is
+// returned.
+func (d *DiskFilesystem) CommitBlob(ctx context.Context, uploadID, path string) (int64, error) {
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	defer u.mu.Unlock()
+	if path != u.path {
+		return 0, fmt.Errorf("upload %v is for %v, not %v: %w", uploadID, u.path, path, ErrInvalidName)
+	}
+	if complete := u.complete(); complete != u.size || (u.total >= 0 && complete != u.total) {
+		want := u.total
+		if want < 0 {
+			want = u.size
+		}
+		return 0, fmt.Errorf("upload %v: %d of %d bytes uploaded without a gap: %w", uploadID, complete, want, ErrIncompleteUpload)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	repo, _, _ := SplitBlobPath(path)
+	resolved := d.resolve(path)
+	if err := d.checkSymlinks(repo, resolved); err != nil {
+		return 0, err
+	}
+
+	d.finishUpload(uploadID, u)
+	f, err := os.OpenFile(u.file, os.O_WRONLY, 0)
+	if err != nil {
+		removeTemp(u.file)
+		return 0, classify(err)
+	}
+	w := d.writers.start(resolved)
+	defer w.finish()
+	if err := d.commitFile(f, resolved, true, true, w); err != nil {
+		return 0, classify(err)
+	}
+	return u.size, nil
+}
+
+// AbortBlob cancels the upload with the ID uploadID and removes the data
+// uploaded so far.
+func (d *DiskFilesystem) AbortBlob(ctx context.Context, uploadID string) error {
+	u, err := d.lockUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	d.finishUpload(uploadID, u)
+	if err := os.Remove(u.file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDiskFilesystemResumableUpload(t *testing.T) {
+	ctx := context.Background()
+	for _, tempDir := range []bool{false, true} {
+		base := t.TempDir()
+		f := &DiskFilesystem{}
+		if tempDir {
+			f.TempDir = filepath.Join(base, "tmp")
+			if err := os.Mkdir(f.TempDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		repo := filepath.Join(base, "repo")
+		if err := f.CreateRepo(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+		blob := filepath.Join(repo, "data", testID[:2], testID)
+
+		id, err := f.BeginBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.AppendBlob(ctx, id, strings.NewReader("foo")); err != nil {
+			t.Fatal(err)
+		}
+		// a failed part is removed again
+		failing := io.MultiReader(strings.NewReader("xxx"), iotest.ErrReader(io.ErrUnexpectedEOF))
+		if err := f.AppendBlob(ctx, id, failing); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("want io.ErrUnexpectedEOF, got %v", err)
+		}
+		if size, err := f.UploadSize(ctx, id); err != nil || size != 3 {
+			t.Fatalf("UploadSize: want 3, got %v, %v", size, err)
+		}
+		if err := f.AppendBlob(ctx, id, strings.NewReader("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("blob saved before the upload has been committed: %v", err)
+		}
+
+		other := filepath.Join(repo, "data", "00", strings.Repeat("0", 64))
+		if _, err := f.CommitBlob(ctx, id, other); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("CommitBlob: want ErrInvalidName for another path, got %v", err)
+		}
+		if size, err := f.CommitBlob(ctx, id, blob); err != nil || size != 6 {
+			t.Fatalf("CommitBlob: want 6 bytes, got %v, %v", size, err)
+		}
+		rd, err := f.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf := readAll(t, rd); !bytes.Equal(buf, []byte("foobar")) {
+			t.Fatalf("wrong data saved: %q", buf)
+		}
+
+		// the upload is finished
+		if err := f.AppendBlob(ctx, id, strings.NewReader("baz")); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("AppendBlob: want ErrNotFound after commit, got %v", err)
+		}
+		if _, err := f.CommitBlob(ctx, id, blob); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("CommitBlob: want ErrNotFound after commit, got %v", err)
+		}
+
+		// an aborted upload leaves nothing behind
+		id, err = f.BeginBlob(ctx, other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.AppendBlob(ctx, id, strings.NewReader("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.AbortBlob(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.AbortBlob(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("AbortBlob: want ErrNotFound for an aborted upload, got %v", err)
+		}
+		if n, err := f.CleanTemp(ctx, repo, -1); err != nil || n != 0 {
+			t.Fatalf("temporary files left behind: %v, %v", n, err)
+		}
+	}
+}
+
+func TestDiskFilesystemResumableUploadMaxSize(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{MaxBlobSize: 6}
+	blob := filepath.Join(t.TempDir(), "repo", "data", testID[:2], testID)
+
+	id, err := f.BeginBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AppendBlob(ctx, id, strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AppendBlob(ctx, id, strings.NewReader("barbaz")); !errors.Is(err, ErrBlobTooLarge) {
+		t.Fatalf("want ErrBlobTooLarge, got %v", err)
+	}
+	if err := f.AppendBlob(ctx, id, strings.NewReader("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AppendBlob(ctx, id, strings.NewReader("x")); !errors.Is(err, ErrBlobTooLarge) {
+		t.Fatalf("want ErrBlobTooLarge for a complete upload, got %v", err)
+	}
+	// an empty part is fine
+	if err := f.AppendBlob(ctx, id, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := f.CommitBlob(ctx, id, blob); err != nil || size != 6 {
+		t.Fatalf("CommitBlob: want 6 bytes, got %v, %v", size, err)
+	}
+}
+
+func TestDiskFilesystemSaveBlobAt(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	blob := filepath.Join(t.TempDir(), "repo", "data", testID[:2], testID)
+
+	id, err := f.BeginBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetUploadTotal(ctx, id, 9); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveBlobAt(ctx, id, 6, strings.NewReader("baz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveBlobAt(ctx, id, 0, strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := f.UploadSize(ctx, id); err != nil || size != 3 {
+		t.Fatalf("UploadSize: want 3 bytes before the gap, got %v, %v", size, err)
+	}
+	if _, err := f.CommitBlob(ctx, id, blob); !errors.Is(err, ErrIncompleteUpload) {
+		t.Fatalf("CommitBlob: want ErrIncompleteUpload for the gap, got %v", err)
+	}
+
+	// a failed part is not recorded and parts must not exceed the total
+	if err := f.SaveBlobAt(ctx, id, 3, iotest.TimeoutReader(strings.NewReader("bar"))); err == nil {
+		t.Fatal("want an error for the failing reader")
+	}
+	if err := f.SaveBlobAt(ctx, id, 6, strings.NewReader("bazz")); !errors.Is(err, ErrLongWrite) {
+		t.Fatalf("want ErrLongWrite, got %v", err)
+	}
+	if _, err := f.CommitBlob(ctx, id, blob); !errors.Is(err, ErrIncompleteUpload) {
+		t.Fatalf("CommitBlob: want ErrIncompleteUpload after the failed part, got %v", err)
+	}
+
+	if err := f.SaveBlobAt(ctx, id, 3, strings.NewReader("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := f.CommitBlob(ctx, id, blob); err != nil || size != 9 {
+		t.Fatalf("CommitBlob: want 9 bytes, got %v, %v", size, err)
+	}
+	buf, err := os.ReadFile(blob)
+	if err != nil || string(buf) != "foobarbaz" {
+		t.Fatalf("want %q, got %q, %v", "foobarbaz", buf, err)
+	}
+
+	// the announced total must be reached
+	id, err = f.BeginBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.AppendBlob(ctx, id, strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetUploadTotal(ctx, id, 2); !errors.Is(err, ErrLongWrite) {
+		t.Fatalf("SetUploadTotal: want ErrLongWrite, got %v", err)
+	}
+	if err := f.SetUploadTotal(ctx, id, 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.CommitBlob(ctx, id, blob); !errors.Is(err, ErrIncompleteUpload) {
+		t.Fatalf("CommitBlob: want ErrIncompleteUpload for a short upload, got %v", err)
+	}
+}
+
+func TestAddRange(t *testing.T) {
+	var ranges []byteRange
+	for _, r := range []byteRange{{10, 20}, {0, 5}, {30, 40}, {5, 8}, {15, 32}, {50, 50}} {
+		ranges = addRange(ranges, r.start, r.end)
+	}
+	want := []byteRange{{0, 8}, {10, 40}}
+	if len(ranges) != len(want) {
+		t.Fatalf("want %v, got %v", want, ranges)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, ranges)
+		}
+	}
+}
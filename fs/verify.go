@@ -0,0 +1,223 @@
+package fs
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path/filepath"
+
+	"github.com/minio/sha256-simd"
+)
+
+// ErrHashMismatch is returned by VerifyHashFilesystem if the hash of
+// an uploaded blob does not match its name.
+var ErrHashMismatch = newError("hash_mismatch", "blob content does not match hash")
+
+// ErrCorrupt is returned by VerifyHashFilesystem and VerifyBlob if the
+// hash of a stored blob does not match its name.
+var ErrCorrupt = newError("corrupt", "stored blob is corrupt")
+
+// ErrUnverifiable is returned by VerifyBlob for files which are not named
+// after the hash of their content, so their integrity cannot be checked.
+var ErrUnverifiable = newError("unverifiable", "file is not named after its hash")
+
+// HashAlgo is the hash function blobs are named after, blob names are the hex
+// encoded hash of their content. Restic repositories currently use SHA256,
+// which is also used for the zero HashAlgo.
+type HashAlgo struct {
+	// Name identifies the hash function in error messages.
+	Name string
+	// New returns a new hash.Hash computing the hash.
+	New func() hash.Hash
+}
+
+// SHA256 is the hash function used by restic repositories.
+var SHA256 = HashAlgo{Name: "SHA-256", New: sha256.New}
+
+// orDefault returns a, or SHA256 for the zero HashAlgo.
+func (a HashAlgo) orDefault() HashAlgo {
+	if a.New == nil {
+		return SHA256
+	}
+	return a
+}
+
+// validName reports whether name is a hex encoded hash of a.
+func (a HashAlgo) validName(name string) bool {
+	return len(name) == 2*a.New().Size() && isHex(name)
+}
+
+// VerifyBlob reads the blob at path from f and checks that its SHA-256 hash
+// matches its name, see VerifyBlobHash. It returns ErrCorrupt on a mismatch,
+// ErrNotFound if the blob does not exist and ErrUnverifiable for the config,
+// lock files and other files which are not named after a hash. Lock files are
+// named after their hash by restic, but they are removed by clients at any
+// time and contain no data worth checking.
+//
+// Unlike CheckBlob, which only returns the size, this reads the whole blob,
+// so verifying a repository costs as much I/O as downloading it. A scrubber
+// calling VerifyBlob for the blobs returned by Walk should limit the number
+// of concurrent calls.
+func VerifyBlob(ctx context.Context, f Filesystem, path string) error {
+	return VerifyBlobHash(ctx, f, path, SHA256)
+}
+
+// VerifyBlobHash is like VerifyBlob for repositories whose blobs are named
+// after the hash algo instead of SHA-256. Names which do not have the length
+// of the hex encoded hash are reported as ErrUnverifiable.
+func VerifyBlobHash(ctx context.Context, f Filesystem, path string, algo HashAlgo) error {
+	algo = algo.orDefault()
+	_, objectType, name := SplitBlobPath(path)
+	if objectType == "locks" || !algo.validName(name) {
+		return fmt.Errorf("%v: %w", path, ErrUnverifiable)
+	}
+	rd, err := f.GetBlob(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rd.Close()
+	}()
+
+	h := algo.New()
+	if _, err := io.Copy(h, contextReader{ctx, rd}); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != name {
+		return fmt.Errorf("%v: %v hash is %v: %w", path, algo.Name, sum, ErrCorrupt)
+	}
+	return nil
+}
+
+// VerifyHashFilesystem wraps a Filesystem and verifies that the name of each
+// saved blob is the hash of its content, SHA-256 unless HashAlgo is set. The
+// hash is computed while the data is passed to the underlying Filesystem, so
+// that a mismatch makes SaveBlob fail before the blob is stored. The config
+// is not verified.
+type VerifyHashFilesystem struct {
+	Filesystem
+
+	// VerifyOnRead also verifies the hash of blobs which are read, to detect
+	// blobs which have been corrupted on the storage.
+	VerifyOnRead bool
+	// HashAlgo is the hash function the blobs are named after, SHA256 if
+	// unset. As each repository is served through its own
+	// VerifyHashFilesystem, repositories of different versions can use
+	// different hash functions.
+	HashAlgo HashAlgo
+}
+
+// NewVerifyHashFilesystem returns a VerifyHashFilesystem for base.
+func NewVerifyHashFilesystem(base Filesystem) *VerifyHashFilesystem {
+	return &VerifyHashFilesystem{Filesystem: base}
+}
+
+// SaveBlob saves the blob, it fails with ErrHashMismatch if the hash of the
+// data does not match the name of the blob, and with ErrInvalidName without
+// reading any data if the name is not a hex encoded hash of the HashAlgo.
+func (v *VerifyHashFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	algo := v.HashAlgo.orDefault()
+	id := filepath.Base(path)
+	if !algo.validName(id) {
+		return 0, fmt.Errorf("%v: not a %v hash: %w", path, algo.Name, ErrInvalidName)
+	}
+	hr := &hashingReader{rd: rd, hasher: algo.New(), id: id}
+	return v.Filesystem.SaveBlob(ctx, path, hr, expectedSize)
+}
+
+// GetBlob returns a reader for the blob. If VerifyOnRead is set, the reader
+// fails with ErrCorrupt instead of returning the last part of the blob if the
+// hash of the data does not match the name of the blob. This only works if
+// the blob is read from the start to the end, the hash is not verified after
+// seeking elsewhere, e.g. for range requests.
+//
+// As the corruption is only detected at the end, most of the data has already
+// been passed on by then. The caller must make sure the client notices the
+// error, e.g. by aborting the connection. The HTTP server does so if the
+// response is shorter than the announced Content-Length.
+func (v *VerifyHashFilesystem) GetBlob(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	rd, err := v.Filesystem.GetBlob(ctx, path)
+	if err != nil || !v.VerifyOnRead {
+		return rd, err
+	}
+	size, err := rd.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = rd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = rd.Close()
+		return nil, err
+	}
+	hasher := v.HashAlgo.orDefault().New()
+	return &verifyingReader{ReadSeekCloser: rd, path: path, hasher: hasher, size: size, verify: true}, nil
+}
+
+// verifyingReader computes the hash of the data read from the start
+// of the blob, and fails with ErrCorrupt instead of returning the last chunk
+// of data if the hash does not match the name of the blob.
+type verifyingReader struct {
+	io.ReadSeekCloser
+	path   string
+	hasher hash.Hash
+	size   int64
+	pos    int64
+	verify bool // whether all data up to pos has been hashed
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	r.pos += int64(n)
+	if !r.verify {
+		return n, err
+	}
+	_, _ = r.hasher.Write(p[:n])
+	if r.pos < r.size {
+		return n, err
+	}
+
+	r.verify = false
+	if sum := hex.EncodeToString(r.hasher.Sum(nil)); r.pos > r.size || sum != filepath.Base(r.path) {
+		log.Printf("ERROR: blob %v is corrupt, its hash is %v", r.path, sum)
+		return 0, fmt.Errorf("%v: %w", r.path, ErrCorrupt)
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos == 0 {
+		// reading from the start again
+		r.hasher.Reset()
+		r.verify = true
+	} else if pos != r.pos {
+		r.verify = false
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// hashingReader passes through the data read from rd and returns
+// ErrHashMismatch instead of io.EOF if the hash of the data does not
+// match the expected ID.
+type hashingReader struct {
+	rd     io.Reader
+	hasher hash.Hash
+	id     string
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	_, _ = r.hasher.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(r.hasher.Sum(nil)); sum != r.id {
+			err = fmt.Errorf("%w: got %v", ErrHashMismatch, sum)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,170 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyHashFilesystem(t *testing.T) {
+	ctx := context.Background()
+	f := NewVerifyHashFilesystem(NewMemoryFilesystem())
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// the config is not named after its hash
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("foo")
+	id := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	blob = filepath.Join(repo, "data", testID[:2], testID)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("want ErrHashMismatch, got %v", err)
+	}
+	if _, err := f.CheckBlob(ctx, blob); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("blob with mismatching hash must not be stored, got %v", err)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	f := NewVerifyHashFilesystem(base)
+	f.VerifyOnRead = true
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("foo")
+	id := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	read := func() (string, error) {
+		rd, err := f.GetBlob(ctx, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = rd.Close()
+		}()
+		buf, err := ioutil.ReadAll(rd)
+		return string(buf), err
+	}
+	if buf, err := read(); err != nil || buf != "foo" {
+		t.Fatalf("reading intact blob: got %q, %v", buf, err)
+	}
+
+	// simulate bit rot on the storage
+	base.files[blob] = []byte("fop")
+	if buf, err := read(); !errors.Is(err, ErrCorrupt) || buf == "fop" {
+		t.Fatalf("want ErrCorrupt without the corrupt data, got %q, %v", buf, err)
+	}
+
+	// reading a part of the blob cannot be verified
+	rd, err := f.GetBlob(ctx, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rd.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadAll(rd); err != nil || string(buf) != "op" {
+		t.Fatalf("reading after seek: got %q, %v", buf, err)
+	}
+	_ = rd.Close()
+}
+
+func TestVerifyBlob(t *testing.T) {
+	ctx := context.Background()
+	f := &DiskFilesystem{}
+	repo := filepath.Join(t.TempDir(), "repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SaveConfig(ctx, filepath.Join(repo, "config"), strings.NewReader("config")); err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256("foo")
+	id := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBlob(ctx, f, blob); err != nil {
+		t.Fatalf("intact blob: %v", err)
+	}
+
+	corrupt := filepath.Join(repo, "snapshots", testID)
+	if _, err := f.SaveBlob(ctx, corrupt, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBlob(ctx, f, corrupt); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("want ErrCorrupt, got %v", err)
+	}
+
+	missing := filepath.Join(repo, "data", testID[:2], testID)
+	if err := VerifyBlob(ctx, f, missing); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+
+	lock := filepath.Join(repo, "locks", testID)
+	if _, err := f.SaveBlob(ctx, lock, strings.NewReader("lock"), 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(repo, "config"), lock} {
+		if err := VerifyBlob(ctx, f, path); !errors.Is(err, ErrUnverifiable) || errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%v: want only ErrUnverifiable, got %v", path, err)
+		}
+	}
+}
+
+func TestVerifyHashAlgo(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryFilesystem()
+	f := NewVerifyHashFilesystem(base)
+	f.HashAlgo = HashAlgo{Name: "SHA-512", New: sha512.New}
+	repo := filepath.FromSlash("/repo")
+	if err := f.CreateRepo(ctx, repo); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha512.Sum512([]byte("foo"))
+	id := hex.EncodeToString(sum[:])
+	blob := filepath.Join(repo, "data", id[:2], id)
+	if _, err := f.SaveBlob(ctx, blob, strings.NewReader("foo"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBlobHash(ctx, base, blob, f.HashAlgo); err != nil {
+		t.Fatalf("intact blob: %v", err)
+	}
+	if err := VerifyBlob(ctx, base, blob); !errors.Is(err, ErrUnverifiable) {
+		t.Fatalf("SHA-512 names are no SHA-256 hashes, got %v", err)
+	}
+
+	// SHA-256 names have the wrong length
+	blob = filepath.Join(repo, "data", testID[:2], testID)
+	rd := &countingReader{rd: strings.NewReader("foo")}
+	if _, err := f.SaveBlob(ctx, blob, rd, 3); !errors.Is(err, ErrInvalidName) || rd.n != 0 {
+		t.Fatalf("want ErrInvalidName before reading, got %v after %d bytes", err, rd.n)
+	}
+}
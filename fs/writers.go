@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"context"
+	"sync"
+)
+
+// pathWriters coordinates concurrent writers of the same path within the
+// process. Writers only hold a lock while they rename their data to the final
+// name, so that a stalled upload never blocks later ones. Once a newer writer
+// has replaced the file, older writers discard their data instead of
+// overwriting it. The zero value is ready to use.
+type pathWriters struct {
+	mu    sync.Mutex
+	paths map[string]*pathState
+}
+
+type pathState struct {
+	commitMu  sync.Mutex // held while renaming
+	next      uint64     // generation of the next writer
+	committed uint64     // generation of the last writer which replaced the file, plus one
+	refs      int
+}
+
+// pathWriter is a single writer of a path.
+type pathWriter struct {
+	writers *pathWriters
+	path    string
+	state   *pathState
+	gen     uint64
+	timer   *saveTimer // measures the save if SaveTiming is set
+}
+
+// start registers a new writer for path, finish must be called once it is
+// done.
+func (w *pathWriters) start(path string) *pathWriter {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.paths == nil {
+		w.paths = make(map[string]*pathState)
+	}
+	st, ok := w.paths[path]
+	if !ok {
+		st = &pathState{}
+		w.paths[path] = st
+	}
+	st.refs++
+	gen := st.next
+	st.next++
+	return &pathWriter{writers: w, path: path, state: st, gen: gen}
+}
+
+// commit calls rename unless a newer writer has already replaced the file,
+// it reports whether rename has been called successfully. A nil writer always
+// calls rename.
+func (pw *pathWriter) commit(rename func() error) (bool, error) {
+	if pw == nil {
+		return true, rename()
+	}
+
+	pw.state.commitMu.Lock()
+	defer pw.state.commitMu.Unlock()
+
+	if pw.state.committed > pw.gen {
+		return false, nil
+	}
+	if err := rename(); err != nil {
+		return false, err
+	}
+	pw.state.committed = pw.gen + 1
+	return true, nil
+}
+
+// saveTimer returns the timer of the writer, nil for a nil writer.
+func (pw *pathWriter) saveTimer() *saveTimer {
+	if pw == nil {
+		return nil
+	}
+	return pw.timer
+}
+
+// finish unregisters the writer.
+func (pw *pathWriter) finish() {
+	w := pw.writers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pw.state.refs--
+	if pw.state.refs == 0 {
+		delete(w.paths, pw.path)
+	}
+}
+
+// pathLocks serializes operations on the same path within the process, for
+// wrappers which must see a consistent state of a path from before to after
+// the operation. The zero value is ready to use.
+type pathLocks struct {
+	mu    sync.Mutex
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	held chan struct{} // holds a value while the path is locked
+	refs int
+}
+
+// lock locks path, waiting until it has been unlocked or ctx is canceled.
+// The returned function unlocks it.
+func (l *pathLocks) lock(ctx context.Context, path string) (func(), error) {
+	l.mu.Lock()
+	if l.paths == nil {
+		l.paths = make(map[string]*pathLock)
+	}
+	pl, ok := l.paths[path]
+	if !ok {
+		pl = &pathLock{held: make(chan struct{}, 1)}
+		l.paths[path] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	select {
+	case pl.held <- struct{}{}:
+		return func() {
+			<-pl.held
+			l.release(path, pl)
+		}, nil
+	case <-ctx.Done():
+		l.release(path, pl)
+		return nil, ctx.Err()
+	}
+}
+
+// release drops a reference to the lock of path.
+func (l *pathLocks) release(path string, pl *pathLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pl.refs--
+	if pl.refs == 0 {
+		delete(l.paths, path)
+	}
+}
@@ -0,0 +1,57 @@
+package fs
+
+import "testing"
+
+func TestPathWriters(t *testing.T) {
+	var w pathWriters
+	var renamed []string
+	rename := func(name string) func() error {
+		return func() error {
+			renamed = append(renamed, name)
+			return nil
+		}
+	}
+
+	older := w.start("blob")
+	newer := w.start("blob")
+	other := w.start("other")
+
+	// the newer writer finishes first, the older one must not overwrite it
+	if ok, err := newer.commit(rename("newer")); err != nil || !ok {
+		t.Fatalf("newer writer: got %v, %v", ok, err)
+	}
+	if ok, err := older.commit(rename("older")); err != nil || ok {
+		t.Fatalf("older writer must be discarded, got %v, %v", ok, err)
+	}
+	if ok, err := other.commit(rename("other")); err != nil || !ok {
+		t.Fatalf("writer for another path: got %v, %v", ok, err)
+	}
+	if len(renamed) != 2 || renamed[0] != "newer" || renamed[1] != "other" {
+		t.Fatalf("unexpected renames %v", renamed)
+	}
+
+	// an older writer which finishes first is replaced by the newer one
+	renamed = nil
+	older2 := w.start("blob")
+	newer2 := w.start("blob")
+	for _, pw := range []*pathWriter{older2, newer2} {
+		if ok, err := pw.commit(rename("x")); err != nil || !ok {
+			t.Fatalf("got %v, %v", ok, err)
+		}
+	}
+	if len(renamed) != 2 {
+		t.Fatalf("want two renames, got %v", renamed)
+	}
+
+	for _, pw := range []*pathWriter{older, newer, other, older2, newer2} {
+		pw.finish()
+	}
+	if len(w.paths) != 0 {
+		t.Fatalf("finished writers must be removed, got %v", w.paths)
+	}
+
+	var nilWriter *pathWriter
+	if ok, err := nilWriter.commit(rename("nil")); err != nil || !ok {
+		t.Fatalf("nil writer: got %v, %v", ok, err)
+	}
+}
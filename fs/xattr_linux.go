@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// metaXattr is the extended attribute storing the metadata of a blob.
+const metaXattr = "user.rest-server.meta"
+
+// xattrNotSupported reports whether err means that the filesystem does not
+// support the extended attribute.
+func xattrNotSupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.E2BIG) || errors.Is(err, unix.ENOSPC)
+}
+
+// getMetaXattr returns the metadata stored in the extended attribute of the
+// file at path, or nil if it has none.
+func getMetaXattr(path string) ([]byte, error) {
+	for {
+		size, err := unix.Getxattr(path, metaXattr, nil)
+		if errors.Is(err, unix.ENODATA) {
+			return nil, nil
+		}
+		if xattrNotSupported(err) {
+			return nil, errXattrNotSupported
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		buf := make([]byte, size)
+		n, err := unix.Getxattr(path, metaXattr, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// the attribute has grown in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return buf[:n], nil
+	}
+}
+
+// setMetaXattr stores buf in the extended attribute of the file at path.
+func setMetaXattr(path string, buf []byte) error {
+	err := unix.Setxattr(path, metaXattr, buf, 0)
+	if xattrNotSupported(err) {
+		return errXattrNotSupported
+	}
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package fs
+
+// getMetaXattr returns errXattrNotSupported, extended attributes are only
+// used on Linux.
+func getMetaXattr(path string) ([]byte, error) {
+	return nil, errXattrNotSupported
+}
+
+// setMetaXattr returns errXattrNotSupported, extended attributes are only
+// used on Linux.
+func setMetaXattr(path string, buf []byte) error {
+	return errXattrNotSupported
+}
@@ -0,0 +1,37 @@
+//go:build go1.18
+// +build go1.18
+
+package restserver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzFolderPath checks that no URL path leads to a repository outside of
+// the base directory, using the same steps as the handler.
+func FuzzFolderPath(f *testing.F) {
+	for _, p := range []string{
+		"/", "/repo/config", "/../config", "/repo/../../config", "/a/b/c/d/e/f/data/",
+		"/..%2f/config", "/\x00/config", "/repo\x00/data/", "/\xc0\xae\xc0\xae/config",
+		"/\uff0e\uff0e/keys/", "/..\\../keys/", "/./config", "//config", "/repo//locks/",
+	} {
+		f.Add(p)
+	}
+	base := filepath.FromSlash("/srv/restic")
+	f.Fuzz(func(t *testing.T, urlPath string) {
+		folderPath, _ := splitURLPath(urlPath, MaxFolderDepth, nil)
+		if !folderPathValid(folderPath) {
+			return
+		}
+		path, err := join(base, folderPath...)
+		if err != nil {
+			return
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("%q: repository %v outside of the base directory", urlPath, path)
+		}
+	})
+}
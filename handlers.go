@@ -7,8 +7,9 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
+	"github.com/restic/rest-server/fs"
 	"github.com/restic/rest-server/quota"
 	"github.com/restic/rest-server/repo"
 )
@@ -30,12 +31,50 @@ type Server struct {
 	PrometheusNoAuth bool
 	Debug            bool
 	MaxRepoSize      int64
+	MaxBlobSize      int64
+	MinFreeSpace     uint64
+	CopyBufferSize   int
+	StatsWorkers     int
+	FollowSymlinks   bool
+	BestEffortList   bool
+	UseFileLocks     bool
+	ReadIdleTimeout  time.Duration
+	SkipExisting     bool
+	LockRepos        bool
+	ObjectTypes      []string // served object types, repo.ObjectTypes if unset
 	PanicOnError     bool
 	NoVerifyUpload   bool
+	VerifyOnRead     bool
+	HealthCheck      bool
+
+	// Filesystem stores the repositories, a fs.DiskFilesystem is used if
+	// it is not set.
+	Filesystem fs.Filesystem
+	// RedirectTTL redirects blob downloads to the storage if the Filesystem
+	// supports it, see repo.Options.
+	RedirectTTL time.Duration
+	// MaxTransfers and MaxTransferBytes limit concurrent blob transfers
+	// using a fs.SemaphoreFilesystem, zero means no limit.
+	MaxTransfers     int
+	MaxTransferBytes int64
+	// OperationTimeout fails storage operations which take longer using a
+	// fs.TimeoutFilesystem, zero means no timeout.
+	OperationTimeout time.Duration
+	// CompressConfig sends the config gzip compressed to clients which
+	// accept it, see repo.Options.
+	CompressConfig bool
+	// RootTemplate gives each user a root directory of their own below
+	// Path, "{user}" is replaced by the name of the user, e.g.
+	// "tenants/{user}". The repository paths of the URLs are relative to
+	// the root, so that no repository name reaches the data of another user.
+	RootTemplate string
+	// MaxListDepth and MaxListEntries bound the directories read by a
+	// listing of the default fs.DiskFilesystem, zero means no limit.
+	MaxListDepth   int
+	MaxListEntries int
 
 	htpasswdFile *HtpasswdFile
 	quotaManager *quota.Manager
-	fsyncWarning sync.Once
 }
 
 // MaxFolderDepth is the maxDepth param passed to splitURLPath.
@@ -59,10 +98,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		httpDefaultError(w, http.StatusUnauthorized)
 		return
 	}
+	if !s.NoAuth {
+		r = r.WithContext(withUsername(r.Context(), username))
+	}
 
 	// Perform the path parsing to determine the repo folder and remainder for the
 	// repo handler.
-	folderPath, remainder := splitURLPath(r.URL.Path, MaxFolderDepth)
+	folderPath, remainder := splitURLPath(r.URL.Path, MaxFolderDepth, s.ObjectTypes)
 	if !folderPathValid(folderPath) {
 		log.Printf("Invalid request path: %s", r.URL.Path)
 		httpDefaultError(w, http.StatusNotFound)
@@ -77,8 +119,19 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	root := s.Path
+	if s.RootTemplate != "" {
+		var err error
+		root, err = userRoot(s.Path, s.RootTemplate, username)
+		if err != nil {
+			log.Printf("Cannot determine the root of user %q: %v", username, err)
+			httpDefaultError(w, http.StatusUnauthorized)
+			return
+		}
+	}
+
 	// Determine filesystem path for this repo
-	fsPath, err := join(s.Path, folderPath...)
+	fsPath, err := join(root, folderPath...)
 	if err != nil {
 		// We did not expect an error at this stage, because we just checked the path
 		log.Printf("Unexpected join error for path %q", r.URL.Path)
@@ -93,7 +146,12 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		QuotaManager:   s.quotaManager, // may be nil
 		PanicOnError:   s.PanicOnError,
 		NoVerifyUpload: s.NoVerifyUpload,
-		FsyncWarning:   &s.fsyncWarning,
+		VerifyOnRead:   s.VerifyOnRead,
+		LockRepo:       s.LockRepos,
+		ObjectTypes:    s.ObjectTypes,
+		Filesystem:     s.Filesystem,
+		RedirectTTL:    s.RedirectTTL,
+		CompressConfig: s.CompressConfig,
 	}
 	if s.Prometheus {
 		opt.BlobMetricFunc = makeBlobMetricFunc(username, folderPath)
@@ -108,6 +166,17 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	repoHandler.ServeHTTP(w, r)
 }
 
+// healthCheck checks that the storage is writable, it is served at /healthz
+// without authentication.
+func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if err := s.Filesystem.HealthCheck(r.Context(), s.Path); err != nil {
+		log.Printf("health check failed: %v", err)
+		httpDefaultError(w, http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
 func valid(name string) bool {
 	// taken from net/http.Dir
 	if strings.Contains(name, "\x00") {
@@ -121,8 +190,11 @@ func valid(name string) bool {
 	return true
 }
 
-func isValidType(name string) bool {
-	for _, tpe := range repo.ObjectTypes {
+func isValidType(name string, objectTypes []string) bool {
+	if objectTypes == nil {
+		objectTypes = repo.ObjectTypes
+	}
+	for _, tpe := range objectTypes {
 		if name == tpe {
 			return true
 		}
@@ -155,11 +227,22 @@ func join(base string, names ...string) (string, error) {
 	return filepath.Join(clean...), nil
 }
 
+// userRoot returns the root directory of username below base, for which
+// template is expanded like Server.RootTemplate. User names which are not
+// usable as a single directory name are rejected.
+func userRoot(base, template, username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+		return "", errors.New("invalid user name")
+	}
+	names := strings.Split(strings.ReplaceAll(template, "{user}", username), "/")
+	return join(base, names...)
+}
+
 // splitURLPath splits the URL path into a folderPath of the subrepo, and
 // a remainder that can be passed to repo.Handler.
 // Example: /foo/bar/locks/0123... will be split into:
 //          ["foo", "bar"] and "/locks/0123..."
-func splitURLPath(urlPath string, maxDepth int) (folderPath []string, remainder string) {
+func splitURLPath(urlPath string, maxDepth int, objectTypes []string) (folderPath []string, remainder string) {
 	if !strings.HasPrefix(urlPath, "/") {
 		// Really should start with "/"
 		return nil, urlPath
@@ -167,7 +250,7 @@ func splitURLPath(urlPath string, maxDepth int) (folderPath []string, remainder
 	p := strings.SplitN(urlPath, "/", maxDepth+2)
 	// Skip the empty first one and the remainder in the last one
 	for _, name := range p[1 : len(p)-1] {
-		if isValidType(name) {
+		if isValidType(name, objectTypes) {
 			// We found a part that is a special repo file or dir
 			break
 		}
@@ -2,8 +2,11 @@ package restserver
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,11 +16,15 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/minio/sha256-simd"
+	"github.com/restic/rest-server/fs"
+	"github.com/restic/rest-server/repo"
 )
 
 func TestJoin(t *testing.T) {
@@ -119,7 +126,10 @@ func createOverwriteDeleteSeq(t testing.TB, path string, data string) []TestRequ
 		},
 	}
 
+	// overwriting the config is a conflict, e.g. with a repeated init
+	overwriteCode := http.StatusConflict
 	if !strings.HasSuffix(path, "/config") {
+		overwriteCode = http.StatusForbidden
 		req = append(req, TestRequest{
 			// broken upload must fail
 			req:  newRequest(t, "POST", path, strings.NewReader(data+"broken")),
@@ -141,7 +151,7 @@ func createOverwriteDeleteSeq(t testing.TB, path string, data string) []TestRequ
 		},
 		TestRequest{
 			req:  newRequest(t, "POST", path, strings.NewReader(data+"other stuff")),
-			want: []wantFunc{wantCode(http.StatusForbidden)},
+			want: []wantFunc{wantCode(overwriteCode)},
 		},
 		TestRequest{
 			req: newRequest(t, "GET", path, nil),
@@ -329,6 +339,92 @@ func TestResticHandler(t *testing.T) {
 	}
 }
 
+// TestResticMemoryHandler runs the append-only tests against a repository
+// which is stored in memory.
+func TestResticMemoryHandler(t *testing.T) {
+	mux, data, fileID, tempdir, cleanup := createTestHandler(t, Server{
+		AppendOnly:   true,
+		NoAuth:       true,
+		Debug:        true,
+		PanicOnError: true,
+		Filesystem:   fs.NewMemoryFilesystem(),
+	})
+	defer cleanup()
+
+	var tests = []struct {
+		seq []TestRequest
+	}{
+		{createOverwriteDeleteSeq(t, "/config", data)},
+		{createOverwriteDeleteSeq(t, "/data/"+fileID, data)},
+		{createOverwriteDeleteSeq(t, "/parent1/data/"+fileID, data)},
+	}
+
+	// create the repos
+	for _, path := range []string{"/", "/parent1/"} {
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "POST", path+"?create=true", nil),
+			[]wantFunc{wantCode(http.StatusOK)})
+	}
+
+	for _, test := range tests {
+		t.Run("", func(t *testing.T) {
+			for i, seq := range test.seq {
+				t.Logf("request %v: %v %v", i, seq.req.Method, seq.req.URL.Path)
+				checkRequest(t, mux.ServeHTTP, seq.req, seq.want)
+			}
+		})
+	}
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/data/", nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody(`["` + fileID + `"]`)})
+
+	// range requests must be supported
+	req := newRequest(t, "GET", "/data/"+fileID, nil)
+	req.Header.Set("Range", "bytes=7-10")
+	checkRequest(t, mux.ServeHTTP, req,
+		[]wantFunc{wantCode(http.StatusPartialContent), wantBody(data[7:11])})
+
+	// nothing must have been written to disk
+	if _, err := os.Stat(path.Join(tempdir, "data")); !os.IsNotExist(err) {
+		t.Fatalf("want data dir to not exist on disk, got %v", err)
+	}
+}
+
+// TestResticReadOnlyHandler runs tests against a read-only filesystem.
+func TestResticReadOnlyHandler(t *testing.T) {
+	base := fs.NewMemoryFilesystem()
+	mux, data, fileID, tempdir, cleanup := createTestHandler(t, Server{
+		NoAuth:       true,
+		Debug:        true,
+		PanicOnError: true,
+		Filesystem:   fs.NewReadOnlyFilesystem(base),
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := base.CreateRepo(ctx, tempdir); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.SaveConfig(ctx, filepath.Join(tempdir, "config"), strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/config", nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody(data)})
+
+	for _, req := range []*http.Request{
+		newRequest(t, "POST", "/?create=true", nil),
+		newRequest(t, "POST", "/config", strings.NewReader(data)),
+		newRequest(t, "DELETE", "/config", nil),
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		newRequest(t, "DELETE", "/locks/"+fileID, nil),
+	} {
+		checkRequest(t, mux.ServeHTTP, req, []wantFunc{wantCode(http.StatusForbidden)})
+	}
+}
+
 // TestResticErrorHandler runs tests on the restic handler error handling.
 func TestResticErrorHandler(t *testing.T) {
 	mux, _, _, tempdir, cleanup := createTestHandler(t, Server{
@@ -473,7 +569,7 @@ func TestSplitURLPath(t *testing.T) {
 
 	for i, test := range tests {
 		t.Run(fmt.Sprintf("test-%d", i), func(t *testing.T) {
-			folderPath, remainder := splitURLPath(test.urlPath, test.maxDepth)
+			folderPath, remainder := splitURLPath(test.urlPath, test.maxDepth, nil)
 
 			var fpEqual bool
 			if len(test.folderPath) == 0 && len(folderPath) == 0 {
@@ -591,3 +687,613 @@ func TestAbortedRequest(t *testing.T) {
 		},
 	)
 }
+
+// TestGetBlobClosesFiles downloads many blobs and checks that the number of
+// open file descriptors stays bounded.
+func TestGetBlobClosesFiles(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("counting open files requires /proc/self/fd")
+	}
+	openFiles := func() int {
+		entries, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	mux, data, fileID, _, cleanup := createTestHandler(t, Server{
+		NoAuth: true,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	before := openFiles()
+	for i := 0; i < 500; i++ {
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "GET", "/data/"+fileID, nil),
+			[]wantFunc{wantCode(http.StatusOK), wantBody(data)})
+	}
+	if after := openFiles(); after > before+10 {
+		t.Fatalf("open files grew from %d to %d", before, after)
+	}
+}
+
+// createHtpasswd creates a htpasswd file with the user "restic" and the
+// password "test".
+func createHtpasswd(t *testing.T) string {
+	htpasswd := filepath.Join(t.TempDir(), ".htpasswd")
+	err := ioutil.WriteFile(htpasswd, []byte("restic:$2y$05$z/OEmNQamd6m6LSegUErh.r/Owk9Xwmc5lxDheIuHY2Z7XiS6FtJm\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return htpasswd
+}
+
+// TestAuditUsername checks that the authenticated user is available to the
+// Filesystem.
+func TestAuditUsername(t *testing.T) {
+	htpasswd := createHtpasswd(t)
+
+	var users []string
+	logger := fs.AuditLoggerFunc(func(ctx context.Context, event fs.AuditEvent) {
+		username, _ := UsernameFromContext(ctx)
+		users = append(users, username)
+	})
+	mux, _, _, _, cleanup := createTestHandler(t, Server{
+		HtpasswdPath: htpasswd,
+		Filesystem:   fs.NewAuditFilesystem(&fs.DiskFilesystem{}, logger),
+	})
+	defer cleanup()
+
+	req := newRequest(t, "POST", "/?create=true", nil)
+	req.SetBasicAuth("restic", "test")
+	checkRequest(t, mux.ServeHTTP, req, []wantFunc{wantCode(http.StatusOK)})
+
+	if len(users) != 1 || users[0] != "restic" {
+		t.Fatalf("want user restic, got %v", users)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	mux, _, _, tempdir, cleanup := createTestHandler(t, Server{
+		HtpasswdPath: createHtpasswd(t),
+		HealthCheck:  true,
+	})
+	defer cleanup()
+
+	// no authentication is needed
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/healthz", nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody("ok\n")})
+
+	if err := os.RemoveAll(tempdir); err != nil {
+		t.Fatal(err)
+	}
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/healthz", nil),
+		[]wantFunc{wantCode(http.StatusServiceUnavailable)})
+}
+
+func TestDebugCapabilities(t *testing.T) {
+	mux, _, _, _, cleanup := createTestHandler(t, Server{
+		NoAuth: true,
+		Debug:  true,
+	})
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, newRequest(t, "GET", "/debug/capabilities", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("want JSON, got status %v, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var caps fs.Capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && !caps.Fsync {
+		t.Fatalf("want fsync supported, got %+v", caps)
+	}
+}
+
+// syncCountingFilesystem counts the calls of Sync.
+type syncCountingFilesystem struct {
+	fs.Filesystem
+	syncs int
+}
+
+func (f *syncCountingFilesystem) Sync(ctx context.Context) error {
+	f.syncs++
+	return f.Filesystem.Sync(ctx)
+}
+
+func TestSyncRepo(t *testing.T) {
+	counting := &syncCountingFilesystem{Filesystem: fs.NewMemoryFilesystem()}
+	mux, _, _, _, cleanup := createTestHandler(t, Server{
+		NoAuth:     true,
+		Filesystem: counting,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?sync=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	if counting.syncs != 1 {
+		t.Fatalf("want 1 sync, got %d", counting.syncs)
+	}
+	// neither create nor sync
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/", nil),
+		[]wantFunc{wantCode(http.StatusBadRequest)})
+}
+
+// noSpaceFilesystem fails all uploads because the storage is full.
+type noSpaceFilesystem struct {
+	fs.Filesystem
+}
+
+func (noSpaceFilesystem) SaveConfig(ctx context.Context, path string, rd io.Reader) error {
+	return fs.ErrNoSpace
+}
+
+func (noSpaceFilesystem) SaveBlob(ctx context.Context, path string, rd io.Reader, expectedSize int64) (int64, error) {
+	return 0, fs.ErrNoSpace
+}
+
+func TestNoSpace(t *testing.T) {
+	mux, data, fileID, _, cleanup := createTestHandler(t, Server{
+		NoAuth:     true,
+		Filesystem: noSpaceFilesystem{fs.NewMemoryFilesystem()},
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/config", strings.NewReader("config")),
+		[]wantFunc{wantCode(http.StatusInsufficientStorage)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusInsufficientStorage)})
+}
+
+func TestLockRepos(t *testing.T) {
+	// the TimeoutFilesystem wrapped around the disk must not hide its locks
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		t.Run(fmt.Sprintf("timeout %v", timeout), func(t *testing.T) {
+			testLockRepos(t, timeout)
+		})
+	}
+}
+
+func testLockRepos(t *testing.T, timeout time.Duration) {
+	disk := &fs.DiskFilesystem{}
+	mux, data, fileID, tempdir, cleanup := createTestHandler(t, Server{
+		NoAuth:           true,
+		LockRepos:        true,
+		OperationTimeout: timeout,
+		Filesystem:       disk,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	// another request holds a shared lock
+	unlock, err := disk.LockRepo(context.Background(), tempdir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "DELETE", "/locks/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "DELETE", "/data/"+fileID, nil).WithContext(ctx),
+		[]wantFunc{wantCode(http.StatusInternalServerError)})
+
+	unlock()
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "DELETE", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+}
+
+func TestObjectTypes(t *testing.T) {
+	mux, data, fileID, tempdir, cleanup := createTestHandler(t, Server{
+		NoAuth:      true,
+		ObjectTypes: []string{"data", "index", "keys", "locks", "snapshots", "unpacked"},
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/unpacked/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/unpacked/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody(data)})
+	if _, err := os.Stat(filepath.Join(tempdir, "unpacked", fileID)); err != nil {
+		t.Fatal(err)
+	}
+
+	// in a subrepo
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/sub/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/sub/unpacked/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+	if _, err := os.Stat(filepath.Join(tempdir, "sub", "unpacked", fileID)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/other/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusNotFound)})
+}
+
+// TestConfigSize checks that a HEAD request for the config reports the size
+// of the config streamed by a GET request, which restic uses to probe
+// repositories.
+func TestConfigSize(t *testing.T) {
+	for _, f := range []fs.Filesystem{nil, fs.NewMemoryFilesystem()} {
+		mux, _, _, _, cleanup := createTestHandler(t, Server{
+			NoAuth:     true,
+			Filesystem: f,
+		})
+
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "POST", "/?create=true", nil),
+			[]wantFunc{wantCode(http.StatusOK)})
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "HEAD", "/config", nil),
+			[]wantFunc{wantCode(http.StatusNotFound)})
+		config := strings.Repeat("encrypted config ", 100)
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "POST", "/config", strings.NewReader(config)),
+			[]wantFunc{wantCode(http.StatusOK)})
+
+		head := httptest.NewRecorder()
+		mux.ServeHTTP(head, newRequest(t, "HEAD", "/config", nil))
+		get := httptest.NewRecorder()
+		mux.ServeHTTP(get, newRequest(t, "GET", "/config", nil))
+		if head.Code != http.StatusOK || get.Code != http.StatusOK {
+			t.Fatalf("want status 200, got %v for HEAD and %v for GET", head.Code, get.Code)
+		}
+		if get.Body.String() != config {
+			t.Fatalf("GET returned the wrong config %q", get.Body.String())
+		}
+		if want := fmt.Sprint(len(config)); head.Header().Get("Content-Length") != want {
+			t.Fatalf("HEAD: want Content-Length %v, got %q", want, head.Header().Get("Content-Length"))
+		}
+		cleanup()
+	}
+}
+
+// presignFilesystem returns URLs of a fictional storage for the blobs.
+type presignFilesystem struct {
+	fs.Filesystem
+}
+
+func (p presignFilesystem) PresignGet(ctx context.Context, path string, ttl time.Duration) (string, bool, error) {
+	return "https://storage.example.com/" + filepath.Base(path) + "?ttl=" + ttl.String(), true, nil
+}
+
+func TestRedirectDownloads(t *testing.T) {
+	mux, data, fileID, _, cleanup := createTestHandler(t, Server{
+		NoAuth:      true,
+		Filesystem:  presignFilesystem{fs.NewMemoryFilesystem()},
+		RedirectTTL: time.Minute,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, newRequest(t, "GET", "/data/"+fileID, nil))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("want a redirect, got %v", rr.Code)
+	}
+	if want := "https://storage.example.com/" + fileID + "?ttl=1m0s"; rr.Header().Get("Location") != want {
+		t.Fatalf("want redirect to %v, got %v", want, rr.Header().Get("Location"))
+	}
+	// HEAD requests and the config are served directly
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "HEAD", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/config", strings.NewReader("config")),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/config", nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody("config")})
+}
+
+func TestRedirectDownloadsWrapped(t *testing.T) {
+	// the wrappers added by NewHandler and main must not hide the
+	// fs.Presigner of the storage
+	conf := Server{
+		Path:             t.TempDir(),
+		NoAuth:           true,
+		Filesystem:       presignFilesystem{fs.NewMemoryFilesystem()},
+		RedirectTTL:      time.Minute,
+		OperationTimeout: time.Minute,
+		MaxTransfers:     1,
+	}
+	mux, err := NewHandler(&conf)
+	if err != nil {
+		t.Fatalf("error from NewHandler: %v", err)
+	}
+	maintenance := fs.NewMaintenanceFilesystem(conf.Filesystem)
+	conf.Filesystem = maintenance
+
+	data := "redirected data"
+	hash := sha256.Sum256([]byte(data))
+	fileID := hex.EncodeToString(hash[:])
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	// downloads are still redirected in maintenance mode
+	for _, enabled := range []bool{false, true} {
+		maintenance.SetMaintenance(enabled)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, newRequest(t, "GET", "/data/"+fileID, nil))
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("maintenance %v: want a redirect, got %v", enabled, rr.Code)
+		}
+		if want := "https://storage.example.com/" + fileID + "?ttl=1m0s"; rr.Header().Get("Location") != want {
+			t.Fatalf("maintenance %v: want redirect to %v, got %v", enabled, want, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestDeleteConfigRetried(t *testing.T) {
+	mux, data, fileID, tempdir, cleanup := createTestHandler(t, Server{
+		NoAuth: true,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/config", strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	// a retried deletion succeeds as well
+	for i := 0; i < 2; i++ {
+		checkRequest(t, mux.ServeHTTP,
+			newRequest(t, "DELETE", "/config", nil),
+			[]wantFunc{wantCode(http.StatusOK)})
+	}
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/config", nil),
+		[]wantFunc{wantCode(http.StatusNotFound)})
+
+	// only the config is removed
+	for _, objectType := range repo.ObjectTypes {
+		if fi, err := os.Stat(filepath.Join(tempdir, objectType)); err != nil || !fi.IsDir() {
+			t.Fatalf("object type directory %v removed: %v", objectType, err)
+		}
+	}
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody(data)})
+}
+
+func TestCompressConfig(t *testing.T) {
+	mux, _, _, _, cleanup := createTestHandler(t, Server{
+		NoAuth:         true,
+		Filesystem:     fs.NewMemoryFilesystem(),
+		CompressConfig: true,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	config := strings.Repeat("encrypted config ", 100)
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/config", strings.NewReader(config)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	for accept, compressed := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip":     true,
+		"br;q=1.0, *;q=0.5": true,
+		"gzip;q=0":          false,
+		"*, gzip;q=0":       false,
+		"identity":          false,
+	} {
+		req := newRequest(t, "GET", "/config", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: want status 200, got %v", accept, rr.Code)
+		}
+		body := rr.Body.String()
+		if compressed {
+			if rr.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("%q: want the config compressed, got headers %v", accept, rr.Header())
+			}
+			gz, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = string(buf)
+		} else if rr.Header().Get("Content-Encoding") != "" || rr.Header().Get("Content-Length") != fmt.Sprint(len(config)) {
+			t.Fatalf("%q: want the config uncompressed, got headers %v", accept, rr.Header())
+		}
+		if body != config {
+			t.Fatalf("%q: got the wrong config %q", accept, body)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	maintenance := fs.NewMaintenanceFilesystem(fs.NewMemoryFilesystem())
+	mux, data, fileID, _, cleanup := createTestHandler(t, Server{
+		NoAuth:     true,
+		Filesystem: maintenance,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/data/"+fileID, strings.NewReader(data)),
+		[]wantFunc{wantCode(http.StatusOK)})
+
+	maintenance.SetMaintenance(true)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, newRequest(t, "DELETE", "/data/"+fileID, nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("want status %v, got %v", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "300" {
+		t.Fatalf("want Retry-After 300, got %q", rr.Header().Get("Retry-After"))
+	}
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK), wantBody(data)})
+
+	maintenance.SetMaintenance(false)
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "DELETE", "/data/"+fileID, nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{&os.PathError{Op: "open", Path: "blob", Err: os.ErrNotExist}, http.StatusNotFound},
+		{fmt.Errorf("saving config: %w", os.ErrExist), http.StatusForbidden},
+		{fmt.Errorf("saving config: %w", fs.ErrConfigExists), http.StatusConflict},
+		{fmt.Errorf("saving blob: %w", fs.ErrBlobExists), http.StatusConflict},
+		{fs.ErrRepoExists, http.StatusConflict},
+		{fs.ErrAppendOnly, http.StatusForbidden},
+		{fs.ErrReadOnly, http.StatusForbidden},
+		{fs.ErrRetentionActive, http.StatusForbidden},
+		{fs.ErrQuotaExceeded, http.StatusRequestEntityTooLarge},
+		{fs.ErrBlobTooLarge, http.StatusRequestEntityTooLarge},
+		{fs.ErrNoSpace, http.StatusInsufficientStorage},
+		{fs.ErrMaintenance, http.StatusServiceUnavailable},
+		{fs.ErrBusy, http.StatusServiceUnavailable},
+		{fs.ErrHashMismatch, http.StatusBadRequest},
+		{fmt.Errorf("blob: %w", fs.ErrShortWrite), http.StatusBadRequest},
+		{fmt.Errorf("blob: %w", fs.ErrLongWrite), http.StatusBadRequest},
+		{fs.ErrInvalidName, http.StatusBadRequest},
+		{io.ErrUnexpectedEOF, http.StatusBadRequest},
+		{os.ErrPermission, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if code := repo.ErrorStatus(test.err); code != test.code {
+			t.Errorf("%v: want status %d, got %d", test.err, test.code, code)
+		}
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	mux, _, _, _, cleanup := createTestHandler(t, Server{
+		AppendOnly: true,
+		NoAuth:     true,
+	})
+	defer cleanup()
+
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "POST", "/?create=true", nil),
+		[]wantFunc{wantCode(http.StatusOK)})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "GET", "/data/"+strings.Repeat("a", 64), nil),
+		[]wantFunc{
+			wantCode(http.StatusNotFound),
+			wantBody(`{"error":"file does not exist","code":"not_found"}` + "\n"),
+		})
+	checkRequest(t, mux.ServeHTTP,
+		newRequest(t, "DELETE", "/config", nil),
+		[]wantFunc{
+			wantCode(http.StatusForbidden),
+			wantBody(`{"error":"repository is append-only","code":"append_only"}` + "\n"),
+		})
+}
+
+func TestRootTemplate(t *testing.T) {
+	mux, _, _, tempdir, cleanup := createTestHandler(t, Server{
+		HtpasswdPath: createHtpasswd(t),
+		RootTemplate: "tenants/{user}",
+	})
+	defer cleanup()
+
+	req := newRequest(t, "POST", "/laptop/?create=true", nil)
+	req.SetBasicAuth("restic", "test")
+	checkRequest(t, mux.ServeHTTP, req, []wantFunc{wantCode(http.StatusOK)})
+	if _, err := os.Stat(filepath.Join(tempdir, "tenants", "restic", "laptop", "data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the root stays below the data directory
+	if root, err := userRoot(tempdir, "../{user}/..", "restic"); err != nil || root != filepath.Join(tempdir, "restic") {
+		t.Fatalf("want the root below %v, got %v, %v", tempdir, root, err)
+	}
+	for _, username := range []string{"", ".", "..", "a/b"} {
+		if _, err := userRoot(tempdir, "tenants/{user}", username); err == nil {
+			t.Errorf("user %q: want an error", username)
+		}
+	}
+
+	for _, conf := range []Server{
+		{NoAuth: true, RootTemplate: "{user}"},
+		{HtpasswdPath: createHtpasswd(t), RootTemplate: "tenants"},
+		{HtpasswdPath: createHtpasswd(t), RootTemplate: filepath.Join(tempdir, "{user}")},
+	} {
+		conf.Path = tempdir
+		if _, err := NewHandler(&conf); err == nil {
+			t.Errorf("root template %q: want an error", conf.RootTemplate)
+		}
+	}
+}
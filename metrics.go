@@ -2,8 +2,10 @@ package restserver
 
 import (
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/restic/rest-server/fs"
 	"github.com/restic/rest-server/repo"
 )
 
@@ -57,6 +59,45 @@ var metricBlobDeleteBytesTotal = prometheus.NewCounterVec(
 	metricLabelList,
 )
 
+var metricSyncDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "rest_server_fsync_duration_seconds",
+		Help:    "Duration of fsync calls of the data storage",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	},
+	[]string{"kind"},
+)
+
+var metricCapability = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "rest_server_fs_capability",
+		Help: "Whether the data storage supports a capability, probed on startup",
+	},
+	[]string{"capability"},
+)
+
+// setCapabilities exports caps as the capability metrics.
+func setCapabilities(caps fs.Capabilities) {
+	names, supported := caps.Names()
+	for i, name := range names {
+		v := 0.0
+		if supported[i] {
+			v = 1
+		}
+		metricCapability.WithLabelValues(name).Set(v)
+	}
+}
+
+// observeSync records the duration of an fsync of a file or, if dir is set,
+// a directory. It is the fs.DiskFilesystem.SyncObserver.
+func observeSync(dir bool, duration time.Duration) {
+	kind := "file"
+	if dir {
+		kind = "dir"
+	}
+	metricSyncDuration.WithLabelValues(kind).Observe(duration.Seconds())
+}
+
 // makeBlobMetricFunc creates a metrics callback function that increments the
 // Prometheus metrics.
 func makeBlobMetricFunc(username string, folderPath []string) repo.BlobMetricFunc {
@@ -89,4 +130,6 @@ func init() {
 	prometheus.MustRegister(metricBlobReadBytesTotal)
 	prometheus.MustRegister(metricBlobDeleteTotal)
 	prometheus.MustRegister(metricBlobDeleteBytesTotal)
+	prometheus.MustRegister(metricSyncDuration)
+	prometheus.MustRegister(metricCapability)
 }
@@ -1,15 +1,20 @@
 package restserver
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gorilla/handlers"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/restic/rest-server/fs"
 	"github.com/restic/rest-server/quota"
 )
 
@@ -21,6 +26,22 @@ func (s *Server) debugHandler(next http.Handler) http.Handler {
 		})
 }
 
+// logSaveTiming logs the phases of saving a blob, it is used with --debug.
+func logSaveTiming(path string, t fs.SaveBlobTiming) {
+	log.Printf("saved %v in %v: open %v, copy %v, sync %v, rename %v, sync dir %v",
+		path, t.Total(), t.Open, t.Copy, t.Sync, t.Rename, t.SyncDir)
+}
+
+// logCapabilities logs the capabilities of the storage on startup.
+func logCapabilities(caps fs.Capabilities) {
+	names, supported := caps.Names()
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%v %v", name, supported[i]))
+	}
+	log.Printf("Storage capabilities: %v", strings.Join(parts, ", "))
+}
+
 func (s *Server) logHandler(next http.Handler) http.Handler {
 	var accessLog io.Writer
 
@@ -49,6 +70,24 @@ func (s *Server) checkAuth(r *http.Request) (username string, ok bool) {
 	return username, true
 }
 
+type contextKey int
+
+const usernameKey contextKey = 0
+
+// withUsername returns a copy of ctx carrying the name of the authenticated
+// user, so that it is available to the Filesystem.
+func withUsername(ctx context.Context, username string) context.Context {
+	return context.WithValue(ctx, usernameKey, username)
+}
+
+// UsernameFromContext returns the name of the user authenticated for the
+// request ctx belongs to. It can be used in a Filesystem, e.g. by an
+// fs.AuditLogger. ok is false if authentication is disabled.
+func UsernameFromContext(ctx context.Context) (username string, ok bool) {
+	username, ok = ctx.Value(usernameKey).(string)
+	return username, ok
+}
+
 func (s *Server) wrapMetricsAuth(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		username, ok := s.checkAuth(r)
@@ -64,6 +103,20 @@ func (s *Server) wrapMetricsAuth(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// validObjectType returns true if name can be used as an object type, which
+// is the name of a directory in each repository and a part of the URL paths.
+func validObjectType(name string) bool {
+	if name == "" || name == "config" {
+		return false
+	}
+	for _, c := range name {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
 // NewHandler returns the master HTTP multiplexer/router.
 func NewHandler(server *Server) (http.Handler, error) {
 	if !server.NoAuth {
@@ -78,6 +131,76 @@ func NewHandler(server *Server) (http.Handler, error) {
 		log.Printf("Loaded htpasswd file %s", server.HtpasswdPath)
 	}
 
+	if server.RootTemplate != "" {
+		if server.NoAuth {
+			return nil, errors.New("a root template needs authentication")
+		}
+		if !strings.Contains(server.RootTemplate, "{user}") || filepath.IsAbs(server.RootTemplate) {
+			return nil, fmt.Errorf("invalid root template %q, it must contain {user} and be relative to the data directory", server.RootTemplate)
+		}
+	}
+
+	for _, t := range server.ObjectTypes {
+		if !validObjectType(t) {
+			return nil, fmt.Errorf("invalid object type %q", t)
+		}
+	}
+
+	if server.Filesystem == nil {
+		// shared by all requests so that the fsync warning is only printed once
+		server.Filesystem = &fs.DiskFilesystem{
+			MaxBlobSize:       server.MaxBlobSize,
+			MinFreeSpace:      server.MinFreeSpace,
+			SkipExistingBlobs: server.SkipExisting,
+			CopyBufferSize:    server.CopyBufferSize,
+			FollowSymlinks:    server.FollowSymlinks,
+			ReadIdleTimeout:   server.ReadIdleTimeout,
+			BestEffortListing: server.BestEffortList,
+			UseFileLocks:      server.UseFileLocks,
+			StatsWorkers:      server.StatsWorkers,
+			ObjectTypes:       server.ObjectTypes,
+			MaxListDepth:      server.MaxListDepth,
+			MaxListEntries:    server.MaxListEntries,
+		}
+	}
+	var caps *fs.Capabilities
+	if d, ok := server.Filesystem.(*fs.DiskFilesystem); ok {
+		if server.Prometheus && d.SyncObserver == nil {
+			d.SyncObserver = observeSync
+		}
+		if server.Debug && d.SaveTiming == nil {
+			d.SaveTiming = logSaveTiming
+		}
+		if c, err := d.Capabilities(server.Path); err == nil {
+			logCapabilities(c)
+			if server.Prometheus {
+				setCapabilities(c)
+			}
+			caps = &c
+		}
+		// remove the temporary files of uploads interrupted by a crash, in
+		// the background as it has to walk all repositories
+		go func() {
+			n, err := d.SweepTemps(context.Background(), server.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("removing orphaned temporary files: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Removed %d orphaned temporary files", n)
+			}
+		}()
+	}
+
+	if server.OperationTimeout > 0 {
+		server.Filesystem = fs.NewTimeoutFilesystem(server.Filesystem, server.OperationTimeout)
+	}
+
+	if server.MaxTransfers > 0 || server.MaxTransferBytes > 0 {
+		sem := fs.NewSemaphoreFilesystem(server.Filesystem, server.MaxTransfers)
+		sem.MaxBytes = server.MaxTransferBytes
+		server.Filesystem = sem
+	}
+
 	const GiB = 1024 * 1024 * 1024
 
 	if server.MaxRepoSize > 0 {
@@ -98,6 +221,15 @@ func NewHandler(server *Server) (http.Handler, error) {
 			mux.HandleFunc("/metrics", server.wrapMetricsAuth(promhttp.Handler().ServeHTTP))
 		}
 	}
+	if server.HealthCheck {
+		mux.HandleFunc("/healthz", server.healthCheck)
+	}
+	if server.Debug && caps != nil {
+		mux.HandleFunc("/debug/capabilities", server.wrapMetricsAuth(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(caps)
+		}))
+	}
 	mux.Handle("/", server)
 
 	var handler http.Handler = mux
@@ -1,27 +1,24 @@
 package repo
 
 import (
-	"encoding/hex"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/minio/sha256-simd"
 	"github.com/miolini/datacounter"
+	"github.com/restic/rest-server/fs"
 	"github.com/restic/rest-server/quota"
 )
 
@@ -32,6 +29,21 @@ type Options struct {
 	DirMode        os.FileMode
 	FileMode       os.FileMode
 	NoVerifyUpload bool
+	// VerifyOnRead verifies the hash of blobs as they are read, unless
+	// NoVerifyUpload is set.
+	VerifyOnRead bool
+	// HashAlgo is the hash function the blobs of the repository are named
+	// after, fs.SHA256 if unset.
+	HashAlgo fs.HashAlgo
+	// LockRepo locks the repository for each request if the Filesystem
+	// implements fs.RepoLocker. Deletions, except of lock files, take an
+	// exclusive lock and all other requests a shared one, so that a prune
+	// never removes data while another client is uploading to the repository.
+	LockRepo bool
+	// ObjectTypes are the object types served, ObjectTypes if unset. They
+	// are also used for the fs.DiskFilesystem created if Filesystem is
+	// unset.
+	ObjectTypes []string
 
 	// If set, we will panic when an internal server error happens. This
 	// makes it easier to debug such errors.
@@ -39,16 +51,33 @@ type Options struct {
 
 	BlobMetricFunc BlobMetricFunc
 	QuotaManager   *quota.Manager
-	FsyncWarning   *sync.Once
+	// FsyncWarning is no longer used, the Filesystem itself warns once if
+	// fsync is not supported.
+	//
+	// Deprecated: ignored.
+	FsyncWarning *sync.Once
+
+	// Filesystem is used to store the repository. If unset, a
+	// fs.DiskFilesystem using DirMode and FileMode is created.
+	Filesystem fs.Filesystem
+	// RedirectTTL enables redirects of blob downloads to the storage if the
+	// Filesystem implements fs.Presigner, with URLs valid for RedirectTTL.
+	// Downloads are not redirected if VerifyOnRead is active, as the data
+	// would bypass the verification. See fs.Presigner for the security
+	// implications.
+	RedirectTTL time.Duration
+	// CompressConfig sends the config gzip compressed to clients which
+	// accept it, as negotiated by the Accept-Encoding header.
+	CompressConfig bool
 }
 
 // DefaultDirMode is the file mode used for directory creation if not
 // overridden in the Options
-const DefaultDirMode os.FileMode = 0700
+const DefaultDirMode = fs.DefaultDirMode
 
 // DefaultFileMode is the file mode used for file creation if not
 // overridden in the Options
-const DefaultFileMode os.FileMode = 0600
+const DefaultFileMode = fs.DefaultFileMode
 
 // New creates a new Handler for a single Restic backup repo.
 // path is the full filesystem path to this repo directory.
@@ -63,9 +92,23 @@ func New(path string, opt Options) (*Handler, error) {
 	if opt.FileMode == 0 {
 		opt.FileMode = DefaultFileMode
 	}
+	if opt.Filesystem == nil {
+		opt.Filesystem = &fs.DiskFilesystem{DirMode: opt.DirMode, FileMode: opt.FileMode, ObjectTypes: opt.ObjectTypes}
+	}
 	h := Handler{
 		path: path,
 		opt:  opt,
+		fs:   opt.Filesystem,
+	}
+	if !opt.NoVerifyUpload {
+		// reject uploads if the file content doesn't match the file name
+		vf := fs.NewVerifyHashFilesystem(h.fs)
+		vf.VerifyOnRead = opt.VerifyOnRead
+		vf.HashAlgo = opt.HashAlgo
+		h.fs = vf
+	}
+	if opt.AppendOnly {
+		h.fs = fs.NewAppendOnlyFilesystem(h.fs)
 	}
 	return &h, nil
 }
@@ -75,6 +118,7 @@ func New(path string, opt Options) (*Handler, error) {
 type Handler struct {
 	path string // filesystem path of repo
 	opt  Options
+	fs   fs.Filesystem
 }
 
 // httpDefaultError write a HTTP error with the default description
@@ -82,6 +126,30 @@ func httpDefaultError(w http.ResponseWriter, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
 
+// errorBody is the JSON body of the errors reported by fileAccessError and
+// internalServerError.
+type errorBody struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// httpCodedError writes a HTTP error with a JSON body carrying the
+// description and code of err as returned by fs.ErrorCode. Errors which do
+// not originate from the Filesystem are described by the status code only.
+func httpCodedError(w http.ResponseWriter, status int, err error) {
+	body := errorBody{Error: http.StatusText(status), Code: fs.CodeInternal}
+	if code, text := fs.ErrorCode(err); code != fs.CodeInternal {
+		body = errorBody{Error: text, Code: code}
+	} else if status == http.StatusBadRequest {
+		body.Code = "bad_request"
+	}
+	buf, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(buf, '\n'))
+}
+
 // httpMethodNotAllowed writes a 405 Method Not Allowed HTTP error with
 // the required Allow header listing the methods that are allowed.
 func httpMethodNotAllowed(w http.ResponseWriter, allowed []string) {
@@ -89,24 +157,20 @@ func httpMethodNotAllowed(w http.ResponseWriter, allowed []string) {
 	httpDefaultError(w, http.StatusMethodNotAllowed)
 }
 
-// errFileContentDoesntMatchHash is the error raised when the file content hash
-// doesn't match the hash provided in the URL
-var errFileContentDoesntMatchHash = errors.New("file content does not match hash")
-
 // BlobPathRE matches valid blob URI paths with optional object IDs
 var BlobPathRE = regexp.MustCompile(`^/(data|index|keys|locks|snapshots)/([0-9a-f]{64})?$`)
 
+// objectPathRE matches blob URI paths of any object type, which is checked
+// against Options.ObjectTypes by getObject.
+var objectPathRE = regexp.MustCompile(`^/([a-z]+)/([0-9a-f]{64})?$`)
+
 // ObjectTypes are subdirs that are used for object storage
-var ObjectTypes = []string{"data", "index", "keys", "locks", "snapshots"}
+var ObjectTypes = fs.ObjectTypes
 
 // FileTypes are files stored directly under the repo direct that are accessible
 // through a request
 var FileTypes = []string{"config"}
 
-func isHashed(objectType string) bool {
-	return objectType == "data"
-}
-
 // BlobOperation describe the current blob operation in the BlobMetricFunc callback.
 type BlobOperation byte
 
@@ -128,12 +192,25 @@ type BlobMetricFunc func(objectType string, operation BlobOperation, nBytes uint
 // ServeHTTP performs strict matching on the repo part of the URL path and
 // dispatches the request to the appropriate handler.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.opt.LockRepo {
+		unlock, err := h.lockRepo(r)
+		if err != nil {
+			h.fileAccessError(w, err)
+			return
+		}
+		defer unlock()
+	}
+
 	urlPath := r.URL.Path
 	if urlPath == "/" {
 		// TODO: add HEAD and GET
 		switch r.Method {
 		case "POST":
-			h.createRepo(w, r)
+			if r.URL.Query().Get("sync") == "true" {
+				h.syncRepo(w, r)
+			} else {
+				h.createRepo(w, r)
+			}
 		default:
 			httpMethodNotAllowed(w, []string{"POST"})
 		}
@@ -183,11 +260,28 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	httpDefaultError(w, http.StatusNotFound)
 }
 
+// lockRepo locks the repository for the request r, see Options.LockRepo.
+func (h *Handler) lockRepo(r *http.Request) (func(), error) {
+	locker, ok := h.opt.Filesystem.(fs.RepoLocker)
+	if !ok {
+		return func() {}, nil
+	}
+	// restic removes its own locks all the time, this must not wait for
+	// other requests
+	objectType, _ := h.getObject(r.URL.Path)
+	exclusive := r.Method == "DELETE" && objectType != "locks"
+	return locker.LockRepo(r.Context(), h.path, exclusive)
+}
+
 // getObject parses the URL path and returns the objectType and objectID,
 // if any. The objectID is optional.
 func (h *Handler) getObject(urlPath string) (objectType, objectID string) {
-	m := BlobPathRE.FindStringSubmatch(urlPath)
-	if len(m) == 0 {
+	re := BlobPathRE
+	if h.opt.ObjectTypes != nil {
+		re = objectPathRE
+	}
+	m := re.FindStringSubmatch(urlPath)
+	if len(m) == 0 || (h.opt.ObjectTypes != nil && !isObjectType(m[1], h.opt.ObjectTypes)) {
 		return "", "" // no match
 	}
 	if len(m) == 2 || m[2] == "" {
@@ -196,6 +290,15 @@ func (h *Handler) getObject(urlPath string) (objectType, objectID string) {
 	return m[1], m[2]
 }
 
+func isObjectType(name string, objectTypes []string) bool {
+	for _, t := range objectTypes {
+		if name == t {
+			return true
+		}
+	}
+	return false
+}
+
 // getSubPath returns the path for a file or subdir in the root of the repo.
 func (h *Handler) getSubPath(name string) string {
 	return filepath.Join(h.path, name)
@@ -209,7 +312,7 @@ func (h *Handler) getObjectPath(objectType, objectID string) string {
 	if objectType == "" || objectID == "" {
 		panic("invalid objectType or objectID")
 	}
-	if isHashed(objectType) {
+	if fs.IsHashed(objectType) {
 		if len(objectID) < 2 {
 			// Should never happen, because BlobPathRE checked this
 			panic("getObjectPath: objectID shorter than 2 chars")
@@ -240,14 +343,19 @@ func (h *Handler) incrementRepoSpaceUsage(by int64) {
 	}
 }
 
-// wrapFileWriter wraps the file writer if repo quota are enabled, and returns it
-// as is if not.
+// wrapFileReader wraps the request body if repo quota are enabled, and
+// returns it as is if not. The quota is enforced by writing everything that
+// is read to a writer wrapped by the QuotaManager.
 // If an error occurs, it returns both an error and the appropriate HTTP error code.
-func (h *Handler) wrapFileWriter(r *http.Request, w io.Writer) (io.Writer, int, error) {
+func (h *Handler) wrapFileReader(r *http.Request, rd io.Reader) (io.Reader, int, error) {
 	if h.opt.QuotaManager == nil {
-		return w, 0, nil // unmodified
+		return rd, 0, nil // unmodified
 	}
-	return h.opt.QuotaManager.WrapWriter(r, w)
+	w, errCode, err := h.opt.QuotaManager.WrapWriter(r, io.Discard)
+	if err != nil {
+		return nil, errCode, err
+	}
+	return io.TeeReader(rd, w), 0, nil
 }
 
 // checkConfig checks whether a configuration exists.
@@ -257,13 +365,17 @@ func (h *Handler) checkConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	cfg := h.getSubPath("config")
 
-	st, err := os.Stat(cfg)
+	exists, size, err := h.fs.CheckConfig(r.Context(), cfg)
 	if err != nil {
 		h.fileAccessError(w, err)
 		return
 	}
+	if !exists {
+		httpDefaultError(w, http.StatusNotFound)
+		return
+	}
 
-	w.Header().Add("Content-Length", fmt.Sprint(st.Size()))
+	w.Header().Add("Content-Length", fmt.Sprint(size))
 }
 
 // getConfig allows for a config to be retrieved.
@@ -273,13 +385,54 @@ func (h *Handler) getConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	cfg := h.getSubPath("config")
 
-	bytes, err := ioutil.ReadFile(cfg)
+	rd, size, err := h.fs.GetConfigReader(r.Context(), cfg)
 	if err != nil {
 		h.fileAccessError(w, err)
 		return
 	}
+	defer func() {
+		_ = rd.Close()
+	}()
+
+	if h.opt.CompressConfig && acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+		// the compressed size is not known up front
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		if _, err := io.Copy(gz, rd); err == nil {
+			_ = gz.Close()
+		}
+		return
+	}
 
-	_, _ = w.Write(bytes)
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	_, _ = io.Copy(w, rd)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header accept allows
+// the content coding enc, either by name or by "*", ignoring the preference
+// between the codings.
+func acceptsEncoding(accept, enc string) bool {
+	sawStar, star := false, false
+	for _, part := range strings.Split(accept, ",") {
+		name, params := strings.TrimSpace(part), ""
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name, params = strings.TrimSpace(name[:i]), strings.TrimSpace(name[i+1:])
+		}
+		ok := true
+		if strings.HasPrefix(params, "q=") {
+			if q, err := strconv.ParseFloat(params[2:], 64); err == nil && q == 0 {
+				ok = false
+			}
+		}
+		switch {
+		case strings.EqualFold(name, enc):
+			return ok
+		case name == "*":
+			sawStar, star = true, ok
+		}
+	}
+	return sawStar && star
 }
 
 // saveConfig allows for a config to be saved.
@@ -289,24 +442,8 @@ func (h *Handler) saveConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	cfg := h.getSubPath("config")
 
-	f, err := os.OpenFile(cfg, os.O_CREATE|os.O_WRONLY|os.O_EXCL, h.opt.FileMode)
-	if err != nil && os.IsExist(err) {
-		if h.opt.Debug {
-			log.Print(err)
-		}
-		httpDefaultError(w, http.StatusForbidden)
-		return
-	}
-
-	_, err = io.Copy(f, r.Body)
-	if err != nil {
-		h.internalServerError(w, err)
-		return
-	}
-
-	err = f.Close()
-	if err != nil {
-		h.internalServerError(w, err)
+	if err := h.fs.SaveConfig(r.Context(), cfg, r.Body); err != nil {
+		h.fileAccessError(w, err)
 		return
 	}
 
@@ -319,17 +456,12 @@ func (h *Handler) deleteConfig(w http.ResponseWriter, r *http.Request) {
 		log.Println("deleteConfig()")
 	}
 
-	if h.opt.AppendOnly {
-		httpDefaultError(w, http.StatusForbidden)
-		return
-	}
-
 	cfg := h.getSubPath("config")
 
-	if err := os.Remove(cfg); err != nil {
+	if err := h.fs.DeleteConfig(r.Context(), cfg); err != nil {
 		// ignore not exist errors to make deleting idempotent, which is
 		// necessary to properly handle request retries
-		if !errors.Is(err, os.ErrNotExist) {
+		if !errors.Is(err, fs.ErrNotFound) {
 			h.fileAccessError(w, err)
 		}
 		return
@@ -341,26 +473,14 @@ const (
 	mimeTypeAPIV2 = "application/vnd.x.restic.rest.v2"
 )
 
-// listBlobs lists all blobs of a given type in an arbitrary order.
+// listBlobs lists all blobs of a given type in an arbitrary order. The list
+// is written while the blobs are listed, so that large directories need not
+// be kept in memory. For API version 2, the sizes of the blobs are included.
 func (h *Handler) listBlobs(w http.ResponseWriter, r *http.Request) {
 	if h.opt.Debug {
 		log.Println("listBlobs()")
 	}
 
-	switch r.Header.Get("Accept") {
-	case mimeTypeAPIV2:
-		h.listBlobsV2(w, r)
-	default:
-		h.listBlobsV1(w, r)
-	}
-}
-
-// listBlobsV1 lists all blobs of a given type in an arbitrary order.
-// TODO: unify listBlobsV1 and listBlobsV2
-func (h *Handler) listBlobsV1(w http.ResponseWriter, r *http.Request) {
-	if h.opt.Debug {
-		log.Println("listBlobsV1()")
-	}
 	objectType, _ := h.getObject(r.URL.Path)
 	if objectType == "" {
 		h.internalServerError(w, fmt.Errorf(
@@ -369,101 +489,69 @@ func (h *Handler) listBlobsV1(w http.ResponseWriter, r *http.Request) {
 	}
 	path := h.getSubPath(objectType)
 
-	items, err := ioutil.ReadDir(path)
-	if err != nil {
-		h.fileAccessError(w, err)
-		return
+	mimeType := mimeTypeAPIV1
+	if r.Header.Get("Accept") == mimeTypeAPIV2 {
+		mimeType = mimeTypeAPIV2
 	}
 
-	names := []string{}
-	for _, i := range items {
-		if isHashed(objectType) {
-			if !i.IsDir() {
-				// ignore files in intermediate directories
-				continue
-			}
-			subpath := filepath.Join(path, i.Name())
-			var subitems []os.FileInfo
-			subitems, err = ioutil.ReadDir(subpath)
-			if err != nil {
-				h.fileAccessError(w, err)
-				return
-			}
-			for _, f := range subitems {
-				names = append(names, f.Name())
-			}
-		} else {
-			names = append(names, i.Name())
-		}
-	}
-
-	data, err := json.Marshal(names)
-	if err != nil {
-		h.internalServerError(w, err)
-		return
-	}
-
-	w.Header().Set("Content-Type", mimeTypeAPIV1)
-	_, _ = w.Write(data)
-}
-
-// Blob represents a single blob, its name and its size.
-type Blob struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-}
-
-// listBlobsV2 lists all blobs of a given type, together with their sizes, in an arbitrary order.
-// TODO: unify listBlobsV1 and listBlobsV2
-func (h *Handler) listBlobsV2(w http.ResponseWriter, r *http.Request) {
-	if h.opt.Debug {
-		log.Println("listBlobsV2()")
-	}
-
-	objectType, _ := h.getObject(r.URL.Path)
-	if objectType == "" {
-		h.internalServerError(w, fmt.Errorf(
-			"cannot determine object type: %s", r.URL.Path))
-		return
+	// the response is only started with the first blob, so that errors
+	// reading the directory can still be reported properly
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", mimeType)
+		_, err := w.Write([]byte("["))
+		return err
 	}
-	path := h.getSubPath(objectType)
 
-	items, err := ioutil.ReadDir(path)
-	if err != nil {
-		h.fileAccessError(w, err)
-		return
-	}
+	err := h.fs.ListBlobsFunc(r.Context(), path, func(blob fs.Blob) error {
+		var item interface{} = blob.Name
+		if mimeType == mimeTypeAPIV2 {
+			// the modification time is not part of the protocol
+			item = struct {
+				Name string `json:"name"`
+				Size int64  `json:"size"`
+			}{blob.Name, blob.Size}
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
 
-	blobs := []Blob{}
-	for _, i := range items {
-		if isHashed(objectType) {
-			if !i.IsDir() {
-				// ignore files in intermediate directories
-				continue
-			}
-			subpath := filepath.Join(path, i.Name())
-			var subitems []os.FileInfo
-			subitems, err = ioutil.ReadDir(subpath)
-			if err != nil {
-				h.fileAccessError(w, err)
-				return
-			}
-			for _, f := range subitems {
-				blobs = append(blobs, Blob{Name: f.Name(), Size: f.Size()})
-			}
+		if !started {
+			err = start()
 		} else {
-			blobs = append(blobs, Blob{Name: i.Name(), Size: i.Size()})
+			_, err = w.Write([]byte(","))
+		}
+		if err != nil {
+			return err
 		}
+		_, err = w.Write(data)
+		return err
+	})
+	if errors.Is(err, fs.ErrPartialListing) {
+		// the readable blobs have been listed, which keeps damaged
+		// repositories usable for restores
+		log.Printf("WARNING: %v", err)
+		err = nil
 	}
-
-	data, err := json.Marshal(blobs)
 	if err != nil {
-		h.internalServerError(w, err)
+		if !started {
+			h.fileAccessError(w, err)
+			return
+		}
+		// the status has already been sent, the client will notice the
+		// incomplete list
+		log.Printf("ERROR: listing %v failed: %v", path, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", mimeTypeAPIV2)
-	_, _ = w.Write(data)
+	if !started {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	_, _ = w.Write([]byte("]"))
 }
 
 // checkBlob tests whether a blob exists.
@@ -480,13 +568,16 @@ func (h *Handler) checkBlob(w http.ResponseWriter, r *http.Request) {
 	}
 	path := h.getObjectPath(objectType, objectID)
 
-	st, err := os.Stat(path)
+	blob, err := h.fs.CheckBlob(r.Context(), path)
 	if err != nil {
 		h.fileAccessError(w, err)
 		return
 	}
 
-	w.Header().Add("Content-Length", fmt.Sprint(st.Size()))
+	w.Header().Add("Content-Length", fmt.Sprint(blob.Size))
+	if !blob.ModTime.IsZero() {
+		w.Header().Add("Last-Modified", blob.ModTime.UTC().Format(http.TimeFormat))
+	}
 }
 
 // getBlob retrieves a blob from the repository.
@@ -503,16 +594,37 @@ func (h *Handler) getBlob(w http.ResponseWriter, r *http.Request) {
 	}
 	path := h.getObjectPath(objectType, objectID)
 
-	file, err := os.Open(path)
+	if h.opt.RedirectTTL > 0 && (h.opt.NoVerifyUpload || !h.opt.VerifyOnRead) {
+		// the wrappers of h.fs are only concerned with writes and would hide
+		// the fs.Presigner of the storage
+		url, ok, err := fs.PresignGet(r.Context(), h.opt.Filesystem, path, h.opt.RedirectTTL)
+		if err != nil {
+			h.fileAccessError(w, err)
+			return
+		}
+		if ok {
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
+	src := h.fs
+	if h.opt.NoVerifyUpload || !h.opt.VerifyOnRead {
+		// like for redirects, the wrappers of h.fs do not change reads, and
+		// the Filesystem may serve concurrent range requests for the blob
+		// from one file, see fs.BlobOpener
+		src = h.opt.Filesystem
+	}
+	rd, err := fs.OpenBlob(r.Context(), src, path)
 	if err != nil {
 		h.fileAccessError(w, err)
 		return
 	}
 
 	wc := datacounter.NewResponseWriterCounter(w)
-	http.ServeContent(wc, r, "", time.Unix(0, 0), file)
+	http.ServeContent(wc, r, "", time.Unix(0, 0), io.NewSectionReader(rd, 0, rd.Size()))
 
-	if err = file.Close(); err != nil {
+	if err = rd.Close(); err != nil {
 		h.internalServerError(w, err)
 		return
 	}
@@ -534,35 +646,18 @@ func (h *Handler) saveBlob(w http.ResponseWriter, r *http.Request) {
 	}
 	path := h.getObjectPath(objectType, objectID)
 
-	_, err := os.Stat(path)
-	if err == nil {
-		httpDefaultError(w, http.StatusForbidden)
-		return
-	}
-	if !os.IsNotExist(err) {
+	exists, err := fs.BlobExists(r.Context(), h.fs, path)
+	if err != nil {
 		h.internalServerError(w, err)
 		return
 	}
-
-	tmpFn := filepath.Join(filepath.Dir(path), objectID+".rest-server-temp")
-	tf, err := tempFile(tmpFn, h.opt.FileMode)
-	if os.IsNotExist(err) {
-		// the error is caused by a missing directory, create it and retry
-		mkdirErr := os.MkdirAll(filepath.Dir(path), h.opt.DirMode)
-		if mkdirErr != nil {
-			log.Print(mkdirErr)
-		} else {
-			// try again
-			tf, err = tempFile(tmpFn, h.opt.FileMode)
-		}
-	}
-	if err != nil {
-		h.internalServerError(w, err)
+	if exists {
+		httpDefaultError(w, http.StatusForbidden)
 		return
 	}
 
 	// ensure this blob does not put us over the quota size limit (if there is one)
-	outFile, errCode, err := h.wrapFileWriter(r, tf)
+	body, errCode, err := h.wrapFileReader(r, r.Body)
 	if err != nil {
 		if h.opt.Debug {
 			log.Println(err)
@@ -571,132 +666,16 @@ func (h *Handler) saveBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var written int64
-
-	if h.opt.NoVerifyUpload {
-		// just write the file without checking the contents
-		written, err = io.Copy(outFile, r.Body)
-	} else {
-		// calculate hash for current request
-		hasher := sha256.New()
-		written, err = io.Copy(outFile, io.TeeReader(r.Body, hasher))
-
-		// reject if file content doesn't match file name
-		if err == nil && hex.EncodeToString(hasher.Sum(nil)) != objectID {
-			err = errFileContentDoesntMatchHash
-		}
-	}
-
+	written, err := h.fs.SaveBlob(r.Context(), path, body, r.ContentLength)
 	if err != nil {
-		_ = tf.Close()
-		_ = os.Remove(tf.Name())
 		h.incrementRepoSpaceUsage(-written)
-		if h.opt.Debug {
-			log.Print(err)
-		}
-		var pathError *os.PathError
-		if errors.As(err, &pathError) && (pathError.Err == syscall.ENOSPC ||
-			pathError.Err == syscall.EDQUOT) {
-			// The error is disk-related (no space left, no quota left),
-			// notify the client using the correct HTTP status
-			httpDefaultError(w, http.StatusInsufficientStorage)
-		} else if errors.Is(err, errFileContentDoesntMatchHash) ||
-			errors.Is(err, io.ErrUnexpectedEOF) ||
-			errors.Is(err, http.ErrMissingBoundary) ||
-			errors.Is(err, http.ErrNotMultipart) {
-			// The error is connection-related, send a client-side HTTP status
-			httpDefaultError(w, http.StatusBadRequest)
-		} else {
-			// Otherwise we have a different internal error, reply with
-			// server-side HTTP status
-			h.internalServerError(w, err)
-		}
-		return
-	}
-
-	syncNotSup, err := syncFile(tf)
-	if err != nil {
-		_ = tf.Close()
-		_ = os.Remove(tf.Name())
-		h.incrementRepoSpaceUsage(-written)
-		h.internalServerError(w, err)
-		return
-	}
-
-	if err := tf.Close(); err != nil {
-		_ = os.Remove(tf.Name())
-		h.incrementRepoSpaceUsage(-written)
-		h.internalServerError(w, err)
-		return
-	}
-
-	if err := os.Rename(tf.Name(), path); err != nil {
-		_ = os.Remove(tf.Name())
-		h.incrementRepoSpaceUsage(-written)
-		h.internalServerError(w, err)
+		h.fileAccessError(w, err)
 		return
 	}
 
-	if syncNotSup {
-		h.opt.FsyncWarning.Do(func() {
-			log.Print("WARNING: fsync is not supported by the data storage. This can lead to data loss, if the system crashes or the storage is unexpectedly disconnected.")
-		})
-	} else {
-		if err := syncDir(filepath.Dir(path)); err != nil {
-			// Don't call os.Remove(path) as this is prone to race conditions with parallel upload retries
-			h.internalServerError(w, err)
-			return
-		}
-	}
-
 	h.sendMetric(objectType, BlobWrite, uint64(written))
 }
 
-// tempFile implements a custom version of ioutil.TempFile which allows modifying the file permissions
-func tempFile(fn string, perm os.FileMode) (f *os.File, err error) {
-	for i := 0; i < 10; i++ {
-		name := fn + strconv.FormatInt(rand.Int63(), 10)
-		f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
-		if os.IsExist(err) {
-			continue
-		}
-		break
-	}
-	return
-}
-
-func syncFile(f *os.File) (bool, error) {
-	err := f.Sync()
-	// Ignore error if filesystem does not support fsync.
-	syncNotSup := err != nil && (errors.Is(err, syscall.ENOTSUP) || isMacENOTTY(err))
-	if syncNotSup {
-		err = nil
-	}
-	return syncNotSup, err
-}
-
-func syncDir(dirname string) error {
-	if runtime.GOOS == "windows" {
-		// syncing a directory is not possible on windows
-		return nil
-	}
-
-	dir, err := os.Open(dirname)
-	if err != nil {
-		return err
-	}
-	err = dir.Sync()
-	// Ignore error if filesystem does not support fsync.
-	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EINVAL) {
-		err = nil
-	}
-	if err != nil {
-		_ = dir.Close()
-		return err
-	}
-	return dir.Close()
-}
-
 // deleteBlob deletes a blob from the repository.
 func (h *Handler) deleteBlob(w http.ResponseWriter, r *http.Request) {
 	if h.opt.Debug {
@@ -709,25 +688,13 @@ func (h *Handler) deleteBlob(w http.ResponseWriter, r *http.Request) {
 			"cannot determine object type or id: %s", r.URL.Path))
 		return
 	}
-	if h.opt.AppendOnly && objectType != "locks" {
-		httpDefaultError(w, http.StatusForbidden)
-		return
-	}
-
 	path := h.getObjectPath(objectType, objectID)
 
-	var size int64
-	if h.needSize() {
-		stat, err := os.Stat(path)
-		if err == nil {
-			size = stat.Size()
-		}
-	}
-
-	if err := os.Remove(path); err != nil {
+	size, err := h.fs.DeleteBlob(r.Context(), path, h.needSize())
+	if err != nil {
 		// ignore not exist errors to make deleting idempotent, which is
 		// necessary to properly handle request retries
-		if !errors.Is(err, os.ErrNotExist) {
+		if !errors.Is(err, fs.ErrNotFound) {
 			h.fileAccessError(w, err)
 		}
 		return
@@ -750,24 +717,24 @@ func (h *Handler) createRepo(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Creating repository directories in %s\n", h.path)
 
-	if err := os.MkdirAll(h.path, h.opt.DirMode); err != nil {
-		h.internalServerError(w, err)
+	if err := h.fs.CreateRepo(r.Context(), h.path); err != nil {
+		h.fileAccessError(w, err)
 		return
 	}
+}
 
-	for _, d := range ObjectTypes {
-		if err := os.Mkdir(filepath.Join(h.path, d), h.opt.DirMode); err != nil && !os.IsExist(err) {
-			h.internalServerError(w, err)
-			return
-		}
+// syncRepo makes all writes completed so far durable, see fs.Filesystem.Sync,
+// so that a client can wait for its backup to be stored before reporting it
+// as done. It succeeds once the Filesystem has synced all pending writes,
+// also those of other repositories.
+func (h *Handler) syncRepo(w http.ResponseWriter, r *http.Request) {
+	if h.opt.Debug {
+		log.Println("syncRepo()")
 	}
 
-	for i := 0; i < 256; i++ {
-		dirPath := filepath.Join(h.path, "data", fmt.Sprintf("%02x", i))
-		if err := os.Mkdir(dirPath, h.opt.DirMode); err != nil && !os.IsExist(err) {
-			h.internalServerError(w, err)
-			return
-		}
+	if err := h.fs.Sync(r.Context()); err != nil {
+		h.fileAccessError(w, err)
+		return
 	}
 }
 
@@ -779,20 +746,88 @@ func (h *Handler) internalServerError(w http.ResponseWriter, err error) {
 	if h.opt.PanicOnError {
 		panic(fmt.Sprintf("internal server error: %v", err))
 	}
-	httpDefaultError(w, http.StatusInternalServerError)
+	// the error may contain paths, it is only logged
+	httpCodedError(w, http.StatusInternalServerError, nil)
 }
 
-// internalServerError is called to report an error that occurred while
-// accessing a file. If the does not exist, the corresponding http status code
-// will be returned to the client. All other errors are passed on to
+// fileAccessError is called to report an error returned by the Filesystem.
+// Errors caused by the client or the state of the repository are reported
+// with the status code returned by ErrorStatus and a JSON body with the code
+// of the error, see httpCodedError. All other errors are passed on to
 // internalServerError
 func (h *Handler) fileAccessError(w http.ResponseWriter, err error) {
 	if h.opt.Debug {
 		log.Print(err)
 	}
-	if errors.Is(err, os.ErrNotExist) {
-		httpDefaultError(w, http.StatusNotFound)
-	} else {
+	code := ErrorStatus(err)
+	if code == http.StatusInternalServerError {
 		h.internalServerError(w, err)
+		return
+	}
+	if retry := retryAfter(err); retry > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)))
+	}
+	httpCodedError(w, code, err)
+}
+
+// MaintenanceRetryAfter is sent in the Retry-After header of requests
+// rejected with fs.ErrMaintenance.
+const MaintenanceRetryAfter = 5 * time.Minute
+
+// BusyRetryAfter is sent in the Retry-After header of requests rejected with
+// fs.ErrBusy.
+const BusyRetryAfter = 10 * time.Second
+
+// retryAfter returns when a request which failed with err may be retried, or
+// zero if retrying does not help.
+func retryAfter(err error) time.Duration {
+	switch {
+	case errors.Is(err, fs.ErrMaintenance):
+		return MaintenanceRetryAfter
+	case errors.Is(err, fs.ErrBusy):
+		return BusyRetryAfter
+	default:
+		return 0
+	}
+}
+
+// ErrorStatus returns the HTTP status code for an error returned by a
+// fs.Filesystem.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrRepoExists),
+		errors.Is(err, fs.ErrConfigExists),
+		errors.Is(err, fs.ErrBlobExists):
+		return http.StatusConflict
+	case errors.Is(err, fs.ErrExists),
+		errors.Is(err, fs.ErrAppendOnly),
+		errors.Is(err, fs.ErrReadOnly),
+		errors.Is(err, fs.ErrSealed),
+		errors.Is(err, fs.ErrRetentionActive):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrQuotaExceeded),
+		errors.Is(err, fs.ErrBlobTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fs.ErrNoSpace):
+		// no space left on the disk or no disk quota left
+		return http.StatusInsufficientStorage
+	case errors.Is(err, fs.ErrMaintenance),
+		errors.Is(err, fs.ErrBusy):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, fs.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, fs.ErrHashMismatch),
+		errors.Is(err, fs.ErrInvalidName),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, fs.ErrLongWrite),
+		errors.Is(err, http.ErrMissingBoundary),
+		errors.Is(err, http.ErrNotMultipart):
+		// the upload failed because of the client or the connection
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
 	}
 }
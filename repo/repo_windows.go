@@ -1,4 +0,0 @@
-package repo
-
-// Windows is not macOS.
-func isMacENOTTY(err error) bool { return false }